@@ -37,9 +37,10 @@ const xaxisLayout = {
 };
 
 class Chart {
-  constructor(container, metric, rangeFactory, refreshInterval, aggregator, step) {
+  constructor(container, metric, instance, rangeFactory, refreshInterval, aggregator, step) {
     this.container = container;
     this.metric = metric;
+    this.instance = instance;
     this.rangeFactory = rangeFactory;
     this.refreshInterval = refreshInterval;
     this.aggregator = aggregator;
@@ -82,6 +83,20 @@ class Chart {
 
       // The range for the X axis currently displayed in the graph, if zoomed.
       zoomRange: null,
+
+      // The bursts (i.e., windows of high-resolution scraping) overlapping the
+      // range of the data currently contained in the graph, highlighted as
+      // shaded areas.
+      bursts: [],
+
+      // The buckets of scrape attempts in the range of the data currently
+      // contained in the graph, used to highlight failed or missing scrapes.
+      scrapes: [],
+
+      // The slow transactions captured from 'varnishlog' in the range of the
+      // data currently contained in the graph, displayed as markers on top
+      // of 'MAIN.*' graphs.
+      transactions: [],
     };
 
     intersectionObserver.observe(this.container);
@@ -431,14 +446,30 @@ class Chart {
     // Fetch metric samples from the storage, adjusting the step if necessary,
     // and ignoring the selected aggregator if the metric is a bitmap. This
     // will be improved in the future adding more flexibility to control the
-    // down-sampling of bitmap metrics.
+    // down-sampling of bitmap metrics. Rates and increases are only available
+    // for counters, so other metrics fall back to averages.
     const loadingIcon = this.container.querySelector('.card .loading-icon');
     loadingIcon.classList.remove('d-none');
     try {
       const [from, to] = this.rangeFactory();
       const optimalStep = this.estimateOptimalStep(from, to);
-      const aggregator = this.metric.flag === 'b' ? 'bit_and' : this.aggregator;
-      return await storage.getMetric(this.metric.id, from, to, optimalStep, aggregator);
+      let aggregator = this.metric.flag === 'b' ? 'bit_and' : this.aggregator;
+      if ((aggregator === 'rate' || aggregator === 'increase') &&
+          (this.metric.flag !== 'c' || this.metric.format === 'd')) {
+        aggregator = 'avg';
+      }
+      const [metric, bursts, scrapes, transactions] = await Promise.all([
+        storage.getMetric(this.metric.id, from, to, optimalStep, aggregator, this.instance),
+        storage.getBursts(from, to),
+        storage.getScrapes(from, to, optimalStep, this.instance),
+        varnishmon.config.transactions.enabled && this.metric.name.startsWith('MAIN.') ?
+          storage.getTransactions(from, to, this.instance) :
+          Promise.resolve([]),
+      ]);
+      metric.bursts = bursts;
+      metric.scrapes = scrapes.scrapes;
+      metric.transactions = transactions;
+      return metric;
     } finally {
       loadingIcon.classList.add('d-none');
     }
@@ -495,6 +526,11 @@ class Chart {
     // as returned by the storage.
     this.graph.step = metric.step;
 
+    // Store the bursts & scrape attempts.
+    this.graph.bursts = metric.bursts;
+    this.graph.scrapes = metric.scrapes;
+    this.graph.transactions = metric.transactions;
+
     // Calculate & store the range for the X axis. This may change during
     // zoom events, and we need to know the original range to reset it.
     this.graph.range = [
@@ -529,7 +565,16 @@ class Chart {
         hovertemplate: '<b>X:</b> %{x|%Y-%m-%d %H:%M:%S}<br><b>Y:</b> %{y:,.1f}<extra></extra>',
         connectgaps: false,
         line: { shape: 'linear', width: 2 },
-      }
+      },
+      {
+        ...this.transactionsData(),
+        type: 'scatter',
+        mode: 'markers',
+        yaxis: 'y2',
+        marker: { size: 8, symbol: 'triangle-down', color: '#dc3545' },
+        hovertemplate: '%{text}<extra></extra>',
+        showlegend: false,
+      },
     ];
 
     // Prepare layout for Plotly.
@@ -546,6 +591,15 @@ class Chart {
         ...xaxisLayout,
         range: Array.from(range), // Beware the array needs to be cloned.
       },
+      shapes: this.shapes(),
+      // Secondary Y axis used to display slow transactions as markers at the
+      // top of the graph, regardless of the values of the metric.
+      yaxis2: {
+        overlaying: 'y',
+        range: [0, 1],
+        fixedrange: true,
+        visible: false,
+      },
       yaxis: {
         fixedrange: true,
         griddash: 'dash',
@@ -578,7 +632,9 @@ class Chart {
       icon: Plotly.Icons.disk,
       click: (gd) => {
         Plotly.downloadImage(gd, {
-          filename: `${varnishmon.storage.hostname} - ${this.metric.name}`,
+          filename: this.instance !== '' ?
+            `${varnishmon.storage.hostname} - ${this.instance} - ${this.metric.name}` :
+            `${varnishmon.storage.hostname} - ${this.metric.name}`,
           format: 'png',
           width: null,
           height: null,
@@ -642,11 +698,13 @@ class Chart {
 
     // Prepare data for Plotly.
     const data = {
-      mode: this.estimatePlotlyDataMode(...range, this.graph.step),
+      mode: [this.estimatePlotlyDataMode(...range, this.graph.step), 'markers'],
     };
     if (!sameData) {
-      data.x = [this.graph.x];
-      data.y = [this.graph.y];
+      const transactions = this.transactionsData();
+      data.x = [this.graph.x, transactions.x];
+      data.y = [this.graph.y, transactions.y];
+      data.text = [null, transactions.text];
     }
 
     // Prepare layout for Plotly.
@@ -656,11 +714,90 @@ class Chart {
         range: Array.from(range), // Beware the array needs to be cloned.
       },
     };
+    if (!sameData) {
+      layout.shapes = this.shapes();
+    }
 
     // Update the graph!
     Plotly.update(this.graph.element, data, layout);
   }
 
+  shapes() {
+    // Highlight bursts, failed scrapes and missing scrapes as shaded areas
+    // covering the whole Y axis.
+    const shape = (from, to, color) => ({
+      type: 'rect',
+      xref: 'x',
+      yref: 'paper',
+      x0: from,
+      x1: to,
+      y0: 0,
+      y1: 1,
+      fillcolor: color,
+      opacity: 0.15,
+      line: { width: 0 },
+      layer: 'below',
+    });
+    const shapes = this.graph.bursts.map(burst => shape(burst.from, burst.to, '#ffc107'));
+
+    // Buckets including failed attempts are shaded in red, and gaps between
+    // buckets (i.e., no attempts at all, usually because varnishmon was not
+    // running) in grey. Adjacent buckets are merged to keep the number of
+    // shapes low.
+    const step = this.graph.step * 1000;
+    let failed = null;
+    let previous = null;
+    this.graph.scrapes.forEach(bucket => {
+      const start = bucket.timestamp.getTime();
+      const end = start + step;
+
+      if (previous !== null && start - previous > step) {
+        shapes.push(shape(new Date(previous + step), new Date(start), '#6c757d'));
+      }
+      previous = start;
+
+      if (Object.keys(bucket.outcomes).some(outcome => outcome !== 'ok')) {
+        if (failed !== null && failed[1] === start) {
+          failed[1] = end;
+        } else {
+          if (failed !== null) {
+            shapes.push(shape(new Date(failed[0]), new Date(failed[1]), '#dc3545'));
+          }
+          failed = [start, end];
+        }
+      }
+    });
+    if (failed !== null) {
+      shapes.push(shape(new Date(failed[0]), new Date(failed[1]), '#dc3545'));
+    }
+
+    return shapes;
+  }
+
+  transactionsData() {
+    // Slow transactions are displayed as markers at the top of the graph,
+    // including a summary of the transaction in the hover text. Beware values
+    // like the URL are provided by clients, so they must be escaped.
+    const escape = (value) => String(value).
+      replace(/&/g, '&amp;').replace(/</g, '&lt;').replace(/>/g, '&gt;');
+    const data = { x: [], y: [], text: [] };
+    this.graph.transactions.forEach(transaction => {
+      data.x.push(transaction.timestamp);
+      data.y.push(0.95);
+      data.text.push(
+        `<b>${escape(transaction.method)} ${escape(transaction.host)}${escape(transaction.url)}</b><br>` +
+        `<b>Status:</b> ${transaction.status}` +
+        (transaction.backend !== '' ? ` (${escape(transaction.backend)})` : '') + '<br>' +
+        `<b>Duration:</b> ${transaction.duration.toFixed(3)}s<br>` +
+        `<b>VXID:</b> ${transaction.vxid}<br>` +
+        Object.entries(transaction.timings).
+          sort((a, b) => a[1] - b[1]).
+          map(([name, value]) => `${escape(name)}: ${value.toFixed(3)}s`).
+          join('<br>'));
+    });
+    return data;
+  }
+
   estimatePlotlyDataMode(from, to, step) {
     const samples = (helpers.dateToUnix(to) - helpers.dateToUnix(from)) / step;
     const containerWidth = this.container.clientWidth;
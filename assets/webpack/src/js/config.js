@@ -11,6 +11,11 @@ const TIME_RANGE_TO = `${PREFIX}time-range-to`;
 const DEFAULT_RELATIVE_TIME_RANGE = ['now-1h', 'now'];
 
 export function getTimeRange(skipLocalStorage = false) {
+  // Archived databases are always browsed from their full time range.
+  if (varnishmon.storage.archive) {
+    skipLocalStorage = true;
+  }
+
   if (!skipLocalStorage) {
     const from = getTimeRangeValue(TIME_RANGE_FROM);
     const to = getTimeRangeValue(TIME_RANGE_TO);
@@ -23,7 +28,7 @@ export function getTimeRange(skipLocalStorage = false) {
     }
   }
 
-  if (varnishmon.config.scraper.enabled) {
+  if (varnishmon.config.scraper.enabled && !varnishmon.storage.archive) {
     return DEFAULT_RELATIVE_TIME_RANGE;
   }
 
@@ -34,6 +39,11 @@ export function getTimeRange(skipLocalStorage = false) {
 }
 
 export function setTimeRange(from, to) {
+  // Don't mess with the time range of the current database.
+  if (varnishmon.storage.archive) {
+    return;
+  }
+
   setTimeRangeValue(TIME_RANGE_FROM, from);
   setTimeRangeValue(TIME_RANGE_TO, to);
 }
@@ -63,6 +73,47 @@ function setTimeRangeValue(key, value) {
   }
 }
 
+/******************************************************************************
+* INSTANCE.
+******************************************************************************/
+
+const INSTANCE = `${PREFIX}instance`;
+
+export function getInstance() {
+  try {
+    let value = localStorage.getItem(INSTANCE);
+    if (value != null && isValidInstanceValue(value)) {
+      return value;
+    }
+  } catch (error) {
+    console.error(`Failed to read '${INSTANCE}' from local storage!`, error);
+  }
+
+  const values = getInstanceValues();
+  return values.length > 0 ? values[0] : '';
+}
+
+export function setInstance(value) {
+  if (!isValidInstanceValue(value)) {
+    console.error('Invalid instance value!', value);
+    return;
+  }
+
+  try {
+    localStorage.setItem(INSTANCE, value);
+  } catch (error) {
+    console.error(`Failed to write '${INSTANCE}' to local storage!`, error);
+  }
+}
+
+export function getInstanceValues() {
+  return varnishmon.storage.instances;
+}
+
+function isValidInstanceValue(value) {
+  return getInstanceValues().includes(value);
+}
+
 /******************************************************************************
 * REFRESH INTERVAL.
 ******************************************************************************/
@@ -258,7 +309,7 @@ function isValidColumnsValue(value) {
 ******************************************************************************/
 
 const AGGREGATOR = `${PREFIX}aggregator`;
-const AGGREGATOR_VALUES = ['avg', 'min', 'max', 'first', 'last', 'count'];
+const AGGREGATOR_VALUES = ['avg', 'min', 'max', 'first', 'last', 'count', 'rate', 'increase'];
 
 export function getAggregator() {
   try {
@@ -35,6 +35,16 @@ function syncConfigWithUI() {
     range.setDates(...config.getTimeRange(true));
   }
 
+  // Instance. The selector is only displayed when there is more than one
+  // instance to choose from.
+  const instanceSelector = document.getElementById('instance');
+  populateSelect(instanceSelector, config.getInstanceValues(), config.getInstance());
+  instanceSelector.addEventListener('change', (event) => {
+    config.setInstance(event.target.value);
+  });
+  document.getElementById('instance-container').classList.toggle(
+    'd-none', config.getInstanceValues().length <= 1);
+
   // Refresh interval.
   const refreshInterval = document.getElementById('refresh-interval');
   populateSelect(refreshInterval, config.getRefreshIntervalValues(), config.getRefreshInterval());
@@ -70,6 +80,11 @@ function syncConfigWithUI() {
     config.setAggregator(event.target.value);
   });
 
+  // Top requests. The toggle is only displayed when the aggregation of
+  // 'varnishncsa' logs is enabled.
+  document.getElementById('top-toggle-container').classList.toggle(
+    'd-none', !varnishmon.config.top.enabled);
+
   // Step.
   const stepSelector = document.getElementById('step');
   stepSelector.min = config.getMinimumStep();
@@ -87,6 +102,44 @@ function syncConfigWithUI() {
   });
 }
 
+async function setUpArchiveSelector() {
+  // The selector is only displayed when there are archived databases (i.e.,
+  // database files rotated by varnishmon) to choose from. Archives are opened
+  // in a new page load, so everything is initialized from scratch.
+  let archives;
+  try {
+    archives = await storage.getArchives();
+  } catch (error) {
+    console.error('Failed to fetch archives!', error);
+    return;
+  }
+  if (archives.length === 0) {
+    return;
+  }
+
+  const archiveSelector = document.getElementById('archive');
+  const current = document.createElement('option');
+  current.value = '';
+  current.text = 'current';
+  archiveSelector.appendChild(current);
+  archives.reverse().forEach(archive => {
+    const option = document.createElement('option');
+    option.value = archive.file;
+    option.text = `${archive.earliest.toISOString().slice(0, 16)} → ${archive.latest.toISOString().slice(0, 16)}`;
+    option.title = `${archive.file} (${archive.hostname}, ${archive.metrics} metrics)`;
+    archiveSelector.appendChild(option);
+  });
+  archiveSelector.value = varnishmon.storage.archive;
+  archiveSelector.addEventListener('change', (event) => {
+    const params = new URLSearchParams();
+    if (event.target.value) {
+      params.set('archive', event.target.value);
+    }
+    window.location.search = params.toString();
+  });
+  document.getElementById('archive-container').classList.remove('d-none');
+}
+
 function getRefreshInterval() {
   let value = parseInt(document.getElementById('refresh-interval').value, 10);
   if (value < 0) {
@@ -138,6 +191,14 @@ function setUpEventListeners() {
 
     // Reload the metrics using the new time range.
     reloadMetrics();
+    reloadTop();
+  });
+
+  // On change in the instance, the search results must be rebuilt from scratch
+  // because a different instance might lead to a different set of metrics.
+  document.getElementById('instance').addEventListener('change', () => {
+    reloadMetrics();
+    reloadTop();
   });
 
   // On change in the refresh interval, report the new value to all the charts.
@@ -153,7 +214,17 @@ function setUpEventListeners() {
     document.getElementById('clusters').querySelectorAll('.chart').forEach((chartDiv) => {
       chartDiv.chart.refresh();
     });
+    reloadTop();
+  });
+
+  // On click in the top requests button, show / hide the top requests panel.
+  // On change in its widgets, reload it.
+  document.getElementById('top-toggle').addEventListener('click', () => {
+    document.getElementById('top').classList.toggle('d-none');
+    reloadTop();
   });
+  document.getElementById('top-dimension').addEventListener('change', reloadTop);
+  document.getElementById('top-order').addEventListener('change', reloadTop);
 
   // On change in the filter, verbosity or columns widgets, update the search
   // results accordingly. This is a lightweight operation, as it only adjusts
@@ -198,6 +269,25 @@ function setUpEventListeners() {
     });
   });
 
+  // On click in any of the export formats, download the samples of the metrics
+  // matching the filter, using the current time range, instance, aggregator
+  // and step. Rates and increases are calculated per metric, so stored rates
+  // of counters are averaged instead.
+  document.getElementById('export-formats').querySelectorAll('[data-format]').forEach((item) => {
+    item.addEventListener('click', (event) => {
+      let aggregator = document.getElementById('aggregator').value;
+      if (aggregator === 'rate' || aggregator === 'increase') {
+        aggregator = 'avg';
+      }
+      const [from, to] = document.getElementById('range').timeRangePicker.getDatesFactory()();
+      window.location.href = storage.getExportUrl(
+        from, to, getStep(), aggregator,
+        document.getElementById('filter').value,
+        document.getElementById('instance').value,
+        event.currentTarget.dataset.format);
+    });
+  });
+
   // On click in the reset button, reset the config in the local storage and
   // reload the page.
   document.getElementById('reset').addEventListener('click', () => {
@@ -235,6 +325,7 @@ async function reloadMetrics() {
 
   // Fetch values from some widgets.
   const rangeFactory = document.getElementById('range').timeRangePicker.getDatesFactory();
+  const instance = document.getElementById('instance').value;
   const refreshInterval = getRefreshInterval();
   const aggregator = document.getElementById('aggregator').value;
   const step = getStep();
@@ -243,7 +334,7 @@ async function reloadMetrics() {
   let metrics;
   try {
     const [from, to] = rangeFactory();
-    metrics = await storage.getMetrics(from, to, step);
+    metrics = await storage.getMetrics(from, to, step, instance);
   } catch (error) {
     clustersSelector.innerHTML = '';
     clustersSelector.appendChild(document.getElementById('metrics-meditation-template').
@@ -276,7 +367,7 @@ async function reloadMetrics() {
     const chartsDiv = clusterDiv.querySelector('.charts');
     cluster.metrics.forEach(metric => {
       const chartDiv = chartTemplateSelector.content.cloneNode(true).firstElementChild;
-      const chart = new Chart(chartDiv, metric, rangeFactory, refreshInterval, aggregator, step);
+      const chart = new Chart(chartDiv, metric, instance, rangeFactory, refreshInterval, aggregator, step);
       chart.addEventListener('zoom', (event) => {
         // Apply the zoom range to all the charts except the one that triggered
         // the event.
@@ -310,6 +401,46 @@ async function reloadMetrics() {
   updateSearchResults();
 }
 
+async function reloadTop() {
+  // Nothing to do if the panel is hidden.
+  const topSelector = document.getElementById('top');
+  if (topSelector.classList.contains('d-none')) {
+    return;
+  }
+
+  // Fetch top requests from the storage.
+  const itemsSelector = document.getElementById('top-items');
+  let items;
+  try {
+    const [from, to] = document.getElementById('range').timeRangePicker.getDatesFactory()();
+    items = await storage.getTop(
+      from, to,
+      document.getElementById('top-dimension').value,
+      document.getElementById('top-order').value,
+      10,
+      document.getElementById('instance').value);
+  } catch (error) {
+    itemsSelector.innerHTML = '';
+    helpers.notify('error', `Failed to fetch top requests: ${error}`);
+    return;
+  }
+
+  // Rebuild the table.
+  itemsSelector.innerHTML = '';
+  items.forEach((item) => {
+    const row = document.createElement('tr');
+    [item.key, item.requests.toLocaleString(), item.bytes.toLocaleString()].forEach((value, i) => {
+      const cell = document.createElement('td');
+      cell.textContent = value;
+      if (i > 0) {
+        cell.classList.add('text-end');
+      }
+      row.appendChild(cell);
+    });
+    itemsSelector.appendChild(row);
+  });
+}
+
 function updateSearchResults() {
   // Adjust charts according to the filtering criteria, the verbosity and the
   // number of columns available.
@@ -386,6 +517,12 @@ document.addEventListener('DOMContentLoaded', async () => {
   new Dropdown(document.getElementById('filterHistoryList'));
   rebuildFilterHistoryList();
 
+  // Prepare export formats dropdown.
+  new Dropdown(document.getElementById('export'));
+
+  // Populate the archive selector.
+  setUpArchiveSelector();
+
   // Load metrics.
   reloadMetrics();
 });
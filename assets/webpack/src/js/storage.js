@@ -16,14 +16,17 @@ import * as varnish from './varnish';
  * @param {Date} to - The end of the time range, optionally aligned to a step
  * boundary.
  * @param {number} step - The time step in seconds.
+ * @param {string} instance - The Varnish instance, or an empty string to
+ * consider all instances.
  * @returns {Object} The clustered metrics plus the time range and step
  * parameters adjusted by the storage API (e.g., aligned to step boundaries).
  */
-export async function getMetrics(from, to, step) {
-  const params = new URLSearchParams({
+export async function getMetrics(from, to, step, instance) {
+  const params = buildParams({
     from: helpers.dateToUnix(from),
     to: helpers.dateToUnix(to),
     step: step,
+    instance: instance,
   });
   const response = await fetch(`/storage/metrics?${params.toString()}`);
   if (!response.ok) {
@@ -35,6 +38,7 @@ export async function getMetrics(from, to, step) {
     from: helpers.unixToDate(data.from),
     to: helpers.unixToDate(data.to),
     step: data.step,
+    instances: data.instances,
     clusters: preprocessMetrics(data.metrics),
   };
 }
@@ -139,15 +143,21 @@ function preprocessMetrics(metrics) {
  * boundary.
  * @param {number} step - The time step in seconds.
  * @param {string} aggregator - The aggregation function to use.
+ * @param {string} instance - The Varnish instance. It can only be an empty
+ * string if there is a single instance.
  * @returns {Object} The metric samples plus the time range and step parameters
  * adjusted by the storage API (e.g., aligned to step boundaries).
  */
-export async function getMetric(id, from, to, step, aggregator) {
-  const params = new URLSearchParams({
+export async function getMetric(id, from, to, step, aggregator, instance) {
+  // Gaps (i.e., missed scrapes) are filled with nulls, so charts are broken
+  // instead of drawing a straight line across them.
+  const params = buildParams({
     from: helpers.dateToUnix(from),
     to: helpers.dateToUnix(to),
     step: step,
     aggregator: aggregator,
+    fill: 'null',
+    instance: instance,
   });
   const response = await fetch(`/storage/metrics/${id}?${params.toString()}`);
   if (!response.ok) {
@@ -159,42 +169,262 @@ export async function getMetric(id, from, to, step, aggregator) {
     from: helpers.unixToDate(data.from),
     to: helpers.unixToDate(data.to),
     step: data.step,
-    samples: preprocessSamples(data.samples, data.step),
+    samples: preprocessSamples(data.samples),
   };
 }
 
 /**
- * Sorts the samples by timestamp, converts the timestamps to Date objects and
- * injects null values in all detected gaps.
+ * Sorts the samples by timestamp and converts the timestamps to Date objects.
+ * Gaps are already filled with null values by the storage API.
  *
  * @param {Array} samples - The samples to process, as returned by the storage
  * API.
- * @param {number} step - The time step in seconds.
  * @returns {Array} The processed samples.
  */
-function preprocessSamples(samples, step) {
-  // Sort samples by timestamp.
-  const sortedSamples = samples.sort((a, b) => a[0] - b[0]);
-
-  // Fill gaps with nulls and convert timestamps to Date objects.
-  const preprocessedSamples = [];
-  for (let i = 0; i < sortedSamples.length; i++) {
-    // Add the current sample to the processed samples.
-    const currentSample = sortedSamples[i];
-    const currentTime = currentSample[0];
-    const currentValue = currentSample[1];
-    preprocessedSamples.push([helpers.unixToDate(currentTime), currentValue]);
-
-    // Check if there is a gap to the next sample and fill it with nulls in each
-    // missing step.
-    if (i < sortedSamples.length - 1) {
-      const nextSample = sortedSamples[i + 1];
-      const nextTime = nextSample[0];
-      for (let j = 1; j < (nextTime - currentTime) / step; j++) {
-        preprocessedSamples.push([helpers.unixToDate(currentTime + j * step), null]);
-      }
+function preprocessSamples(samples) {
+  return samples
+    .sort((a, b) => a[0] - b[0])
+    .map(([timestamp, value]) => [helpers.unixToDate(timestamp), value]);
+}
+
+/******************************************************************************
+ * BURSTS.
+ ******************************************************************************/
+
+/**
+ * Retrieves the bursts (i.e., windows of high-resolution scraping) overlapping
+ * a time range from the storage API.
+ *
+ * @param {Date} from - The start of the time range.
+ * @param {Date} to - The end of the time range.
+ * @returns {Array} The bursts, each one with 'from' and 'to' Date objects and
+ * the scraping 'period' in seconds.
+ */
+export async function getBursts(from, to) {
+  const params = buildParams({
+    from: helpers.dateToUnix(from),
+    to: helpers.dateToUnix(to),
+  });
+  return await fetchCached(`/storage/bursts?${params.toString()}`, data => {
+    return data.bursts.map(burst => ({
+      from: helpers.unixToDate(burst.from),
+      to: helpers.unixToDate(burst.to),
+      period: burst.period,
+    }));
+  });
+}
+
+/******************************************************************************
+ * SCRAPES.
+ ******************************************************************************/
+
+/**
+ * Retrieves the outcomes of scrape attempts in a time range from the storage
+ * API, aggregated by step.
+ *
+ * @param {Date} from - The start of the time range, optionally aligned to a
+ * step boundary.
+ * @param {Date} to - The end of the time range, optionally aligned to a step
+ * boundary.
+ * @param {number} step - The time step in seconds.
+ * @param {string} instance - The Varnish instance, or an empty string to
+ * consider all instances.
+ * @returns {Object} The buckets of scrape attempts (each one with a
+ * 'timestamp' Date object, the number of attempts per 'outcomes' and the
+ * latest 'error'), plus the time range and step parameters adjusted by the
+ * storage API (e.g., aligned to step boundaries).
+ */
+export async function getScrapes(from, to, step, instance) {
+  const params = buildParams({
+    from: helpers.dateToUnix(from),
+    to: helpers.dateToUnix(to),
+    step: step,
+    instance: instance,
+  });
+  return await fetchCached(`/storage/scrapes?${params.toString()}`, data => ({
+    from: helpers.unixToDate(data.from),
+    to: helpers.unixToDate(data.to),
+    step: data.step,
+    scrapes: data.scrapes.map(bucket => ({
+      timestamp: helpers.unixToDate(bucket.timestamp),
+      outcomes: bucket.outcomes,
+      error: bucket.error,
+    })),
+  }));
+}
+
+/******************************************************************************
+ * TOP.
+ ******************************************************************************/
+
+/**
+ * Retrieves the top keys (e.g., URLs) of a dimension in a time range from the
+ * storage API, as aggregated from 'varnishncsa' logs.
+ *
+ * @param {Date} from - The start of the time range.
+ * @param {Date} to - The end of the time range.
+ * @param {string} dimension - One of 'url', 'host', 'status' or 'backend'.
+ * @param {string} order - Either 'requests' or 'bytes'.
+ * @param {number} limit - The maximum number of keys.
+ * @param {string} instance - The Varnish instance, or an empty string to
+ * consider all instances.
+ * @returns {Array} The top keys, each one with its 'key', number of 'requests'
+ * and 'bytes'.
+ */
+export async function getTop(from, to, dimension, order, limit, instance) {
+  const params = buildParams({
+    from: helpers.dateToUnix(from),
+    to: helpers.dateToUnix(to),
+    dimension: dimension,
+    order: order,
+    limit: limit,
+    instance: instance,
+  });
+  return await fetchCached(`/storage/top?${params.toString()}`, data => data.items);
+}
+
+/******************************************************************************
+ * TRANSACTIONS.
+ ******************************************************************************/
+
+/**
+ * Retrieves the slow transactions captured from 'varnishlog' in a time range
+ * from the storage API.
+ *
+ * @param {Date} from - The start of the time range.
+ * @param {Date} to - The end of the time range.
+ * @param {string} instance - The Varnish instance, or an empty string to
+ * consider all instances.
+ * @returns {Array} The transactions, each one with a 'timestamp' Date object,
+ * its 'vxid', 'method', 'url', 'host', 'status', 'backend', 'duration' in
+ * seconds and 'timings' breakdown.
+ */
+export async function getTransactions(from, to, instance) {
+  const params = buildParams({
+    from: helpers.dateToUnix(from),
+    to: helpers.dateToUnix(to),
+    instance: instance,
+  });
+  return await fetchCached(`/storage/transactions?${params.toString()}`, data => {
+    return data.transactions.map(transaction => ({
+      ...transaction,
+      timestamp: helpers.unixToDate(transaction.timestamp),
+    }));
+  });
+}
+
+/******************************************************************************
+ * EXPORT.
+ ******************************************************************************/
+
+/**
+ * Builds the URL of the storage API endpoint exporting aggregated samples of
+ * all metrics in a time range. The file is downloaded by the browser itself,
+ * so it's never loaded in memory here.
+ *
+ * @param {Date} from - The start of the time range.
+ * @param {Date} to - The end of the time range.
+ * @param {number} step - The time step in seconds.
+ * @param {string} aggregator - The aggregation function to use.
+ * @param {string} filter - Whitespace-separated terms, one of which must be
+ * contained in the name of exported metrics, or an empty string to export all
+ * metrics.
+ * @param {string} instance - The Varnish instance. It can only be an empty
+ * string if there is a single instance.
+ * @param {string} format - The format of the file ('csv', 'parquet' or
+ * 'ndjson').
+ * @returns {string} The URL.
+ */
+export function getExportUrl(from, to, step, aggregator, filter, instance, format) {
+  const params = buildParams({
+    from: helpers.dateToUnix(from),
+    to: helpers.dateToUnix(to),
+    step: step,
+    aggregator: aggregator,
+    metric: filter,
+    instance: instance,
+    format: format,
+  });
+  return `/storage/export?${params.toString()}`;
+}
+
+/******************************************************************************
+ * ARCHIVES.
+ ******************************************************************************/
+
+/**
+ * Retrieves the catalog of archived databases (i.e., database files rotated
+ * by varnishmon) from the storage API.
+ *
+ * @returns {Array} The archives, sorted by time range, each one with its
+ * 'file' name, 'hostname', 'earliest' and 'latest' Date objects, number of
+ * 'metrics' and 'size' in bytes.
+ */
+export async function getArchives() {
+  return await fetchCached('/storage/archives', data => {
+    return data.archives.map(archive => ({
+      ...archive,
+      earliest: helpers.unixToDate(archive.earliest),
+      latest: helpers.unixToDate(archive.latest),
+    }));
+  });
+}
+
+/**
+ * Builds the query string parameters of a storage API request. When browsing
+ * an archived database, requests are served using it.
+ *
+ * @param {Object} params - The parameters of the request.
+ * @returns {URLSearchParams} The query string parameters.
+ */
+function buildParams(params) {
+  if (varnishmon.storage.archive) {
+    params.archive = varnishmon.storage.archive;
+  }
+  return new URLSearchParams(params);
+}
+
+/******************************************************************************
+ * CACHE.
+ ******************************************************************************/
+
+// Some resources (e.g., bursts) are requested by every chart on each refresh,
+// so responses are briefly cached to avoid hammering the storage API with
+// identical requests.
+const CACHE_TTL = 5000;
+const cache = new Map();
+
+/**
+ * Fetches and transforms a JSON resource from the storage API, reusing the
+ * result of an identical request issued less than 'CACHE_TTL' ms ago.
+ *
+ * @param {string} url - The URL of the resource.
+ * @param {Function} transform - The function applied to the parsed response.
+ * @returns {Object} The transformed response.
+ */
+async function fetchCached(url, transform) {
+  // Prune expired entries.
+  const now = Date.now();
+  for (const [key, entry] of cache) {
+    if (now - entry.timestamp > CACHE_TTL) {
+      cache.delete(key);
     }
   }
 
-  return preprocessedSamples;
+  // Fetch the resource, if not cached.
+  if (!cache.has(url)) {
+    const promise = (async () => {
+      const response = await fetch(url);
+      if (!response.ok) {
+        throw new Error(`Unexpected API response (${response.status}): ${response.statusText}`);
+      }
+      return transform(await response.json());
+    })();
+    cache.set(url, { timestamp: now, promise: promise });
+
+    // Don't cache failures.
+    promise.catch(() => cache.delete(url));
+  }
+
+  return await cache.get(url).promise;
 }
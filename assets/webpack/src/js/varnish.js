@@ -420,6 +420,7 @@ export const ADHOC_CLUSTERING_PREFIXES = [
 
 // Clusters are sorted by name, unless explicitly overridden here using a regex.
 export const ORDER_OF_CLUSTERS = [
+  /^KPI[.]/,
   /^MGT[.]/,
   /^MAIN[.][*]$/,
   /^MAIN[.]/,
@@ -0,0 +1,138 @@
+package application
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	burstRequestTimeout = 30 * time.Second
+)
+
+var (
+	errBurstRequestFailed = errors.New("burst request failed")
+	errBurstTokenMissing  = errors.New("burst token not configured")
+)
+
+var (
+	burstCmd = &cobra.Command{ //nolint:gochecknoglobals
+		Use:   "burst",
+		Short: "Temporarily increase the scraping frequency",
+		Long: `Asks a running varnishmon instance to temporarily scrape metrics using a
+shorter period (e.g., to troubleshoot an ongoing incident). The burst is
+recorded in the database, so it can be highlighted in the web interface, and
+the regular period is automatically restored once the burst is over. The
+running instance is located using the API settings in the configuration, and
+the request is authenticated using the 'api.burst.token' setting.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) { //nolint:revive
+			if err := requestBurst(); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	burstPeriod   time.Duration //nolint:gochecknoglobals
+	burstDuration time.Duration //nolint:gochecknoglobals
+	burstURL      string        //nolint:gochecknoglobals
+	burstInsecure bool          //nolint:gochecknoglobals
+	burstToken    string        //nolint:gochecknoglobals
+)
+
+func init() {
+	RootCmd.AddCommand(burstCmd)
+
+	burstCmd.Flags().DurationVar(
+		&burstPeriod, "period", 1*time.Second,
+		"set scraping period during the burst")
+	burstCmd.Flags().DurationVar(
+		&burstDuration, "duration", 10*time.Minute,
+		"set duration of the burst")
+	burstCmd.Flags().StringVar(
+		&burstURL, "url", "",
+		"set base URL of the running instance (defaults to the one derived from the 'api.*' settings)")
+	burstCmd.Flags().BoolVar(
+		&burstInsecure, "insecure", false,
+		"skip verification of the TLS certificate of the running instance")
+	burstCmd.Flags().StringVar(
+		&burstToken, "token", "",
+		"set bearer token of the burst endpoint (defaults to the 'api.burst.token' setting)")
+}
+
+func requestBurst() error {
+	// Build the request URL. Unless explicitly provided, the base URL is
+	// derived from the API settings, assuming the running instance shares the
+	// same configuration.
+	base := burstURL
+	if base == "" {
+		scheme := "http"
+		if cfg.APITLSCertfile() != "" && cfg.APITLSKeyfile() != "" {
+			scheme = "https"
+		}
+		host := cfg.APIListenIP()
+		if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+			host = "127.0.0.1"
+		}
+		base = fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(host, strconv.Itoa(cfg.APIListenPort())))
+	}
+	query := url.Values{}
+	query.Set("period", burstPeriod.String())
+	query.Set("duration", burstDuration.String())
+	endpoint := strings.TrimSuffix(base, "/") + "/scraper/burst?" + query.Encode()
+
+	// Prepare the request.
+	ctx, cancel := context.WithTimeout(context.Background(), burstRequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, nil)
+	if err != nil {
+		return fmt.Errorf("failed to prepare burst request: %w", err)
+	}
+	token := burstToken
+	if token == "" {
+		token = cfg.APIBurstToken()
+	}
+	if token == "" {
+		return fmt.Errorf("%w: use the '--token' flag or the 'api.burst.token' setting", errBurstTokenMissing)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	// Send the request.
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: burstInsecure, //nolint:gosec
+			},
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send burst request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// Check the response.
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read burst response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s: %s", errBurstRequestFailed, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	// Done!
+	fmt.Fprintln(os.Stdout, strings.TrimSpace(string(body)))
+	return nil
+}
@@ -69,7 +69,7 @@ func init() {
 		"set log level (overrides 'global.loglevel' setting)")
 	RootCmd.PersistentFlags().String(
 		"db", "",
-		"set DB file (overrides 'db.file' setting)")
+		"set DB file, or directory / glob pattern of DB files to browse (overrides 'db.file' setting)")
 	RootCmd.PersistentFlags().String(
 		"memory-limit", "",
 		"set DB memory limit (overrides 'db.memory-limit' setting)")
@@ -0,0 +1,93 @@
+package application
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/allenta/varnishmon/pkg/workers/storage"
+)
+
+var (
+	errDBMissingDB = errors.New("a database file is required (see the '--db' flag)")
+)
+
+var (
+	dbCmd = &cobra.Command{ //nolint:gochecknoglobals
+		Use:   "db",
+		Short: "Manage the database",
+		PersistentPreRun: func(cmd *cobra.Command, args []string) { //nolint:revive
+			// Database management doesn't depend on a local Varnish instance,
+			// so the scraper settings are not validated.
+			if err := cmd.Root().PersistentFlags().Set("no-scraper", "true"); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			cfg = boot(cmd.Root())
+		},
+	}
+
+	dbMigrateCmd = &cobra.Command{ //nolint:gochecknoglobals
+		Use:   "migrate",
+		Short: "Upgrade the schema of a database",
+		Long: `Upgrades the schema of a database created by an older version of varnishmon
+(e.g., an archived database file) to the latest one. This is also done
+automatically when varnishmon opens a database, but migrations may take a while
+on large files. Databases created by newer versions of varnishmon are refused.
+The database is located using the 'db.file' setting or the '--db' flag, and it
+must not be in use by a running varnishmon process.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) { //nolint:revive
+			if err := dbMigrate(); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	dbMigrateDryRun bool //nolint:gochecknoglobals
+)
+
+func init() {
+	RootCmd.AddCommand(dbCmd)
+	dbCmd.AddCommand(dbMigrateCmd)
+
+	dbMigrateCmd.Flags().BoolVar(
+		&dbMigrateDryRun, "dry-run", false,
+		"list pending migrations without applying them")
+}
+
+func dbMigrate() error {
+	if cfg.DBFile() == "" {
+		return errDBMissingDB
+	}
+	if _, err := os.Stat(cfg.DBFile()); err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+
+	plan, err := storage.Migrate(cfg.DBFile(), dbMigrateDryRun)
+	if err != nil {
+		return err
+	}
+
+	if len(plan.Migrations) == 0 {
+		fmt.Fprintf(os.Stdout,
+			"Database %s is up to date (schema version: %d)\n",
+			cfg.DBFile(), plan.From)
+		return nil
+	}
+
+	verb := "Applied"
+	if dbMigrateDryRun {
+		verb = "Pending"
+	}
+	fmt.Fprintf(os.Stdout,
+		"%s migrations of %s from schema version %d to %d:\n",
+		verb, cfg.DBFile(), plan.From, plan.To)
+	for _, migration := range plan.Migrations {
+		fmt.Fprintf(os.Stdout, "  %d: %s\n", migration.Version, migration.Description)
+	}
+	return nil
+}
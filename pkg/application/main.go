@@ -45,6 +45,7 @@ func (app *Application) Start() {
 	app.startTst = time.Now().Unix()
 
 	app.updateLogging()
+	app.handleReloads()
 
 	app.manager.Start()
 	app.cfg.Log().Info().
@@ -105,7 +106,7 @@ func (app *Application) updateLogging() {
 
 				app.cfg.Log().Info().
 					Stringer("signal", sig).
-					Msg("Got system signal: using stdout, so ignoring it")
+					Msg("Got system signal: using stdout, so no log file to reopen")
 			}
 		}()
 	}
@@ -126,6 +127,27 @@ func (app *Application) updateLogging() {
 	app.cfg.SetLog(config.NewLogger(&log))
 }
 
+func (app *Application) handleReloads() {
+	// Get ready to listen to SIGUSR1 events. SIGHUP is not used here because
+	// it also reopens the database, the log file and the raw archive (and
+	// wipes in-memory databases), which is not desired when just reloading
+	// the configuration.
+	channel := make(chan os.Signal, 1)
+	signal.Notify(channel, syscall.SIGUSR1)
+
+	go func() {
+		for {
+			sig := <-channel
+
+			app.cfg.Log().Info().
+				Stringer("signal", sig).
+				Msg("Got system signal: reloading configuration")
+
+			app.cfg.Reload()
+		}
+	}()
+}
+
 func (app *Application) waitForShutdown() {
 	signals := []os.Signal{syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGINT}
 	channel := make(chan os.Signal, len(signals))
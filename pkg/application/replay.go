@@ -0,0 +1,247 @@
+package application
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/allenta/varnishmon/pkg/config"
+	"github.com/allenta/varnishmon/pkg/helpers"
+	"github.com/allenta/varnishmon/pkg/workers"
+	"github.com/allenta/varnishmon/pkg/workers/storage"
+)
+
+var (
+	errReplayMissingDB     = errors.New("a database file is required (see the '--db' flag)")
+	errReplayNoFiles       = errors.New("no files found")
+	errReplayInvalidSource = errors.New("invalid timestamp source")
+)
+
+var (
+	replayCmd = &cobra.Command{ //nolint:gochecknoglobals
+		Use:   "replay <path> [<path>...]",
+		Short: "Import saved varnishstat JSON dumps into a database",
+		Long: `Imports the output of 'varnishstat -1 -j' saved by other means (e.g., a cron
+job) into a database, which can then be explored using the web interface as
+usual. Paths may be files, directories (scanned recursively) or glob patterns.
+Files may contain a single document or several documents one after another
+(e.g., newline-delimited JSON), and they may be compressed using gzip or zstd
+(e.g., raw archives written when the 'scraper.raw-archive.enabled' setting is
+on). Documents are sorted by timestamp and processed exactly as if they had
+been scraped: counters are turned into rates, derived metrics are computed and
+the 'scraper.include' / 'scraper.exclude' settings are honored. The database
+is located using the 'db.file' setting or the '--db' flag.`,
+		Args: cobra.MinimumNArgs(1),
+		PersistentPreRun: func(cmd *cobra.Command, args []string) { //nolint:revive
+			// Replays don't depend on a local Varnish instance, so the
+			// scraper settings are not validated.
+			if err := cmd.Root().PersistentFlags().Set("no-scraper", "true"); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			cfg = boot(cmd.Root())
+		},
+		Run: func(cmd *cobra.Command, args []string) { //nolint:revive
+			if err := replay(args, cmd.Flags().Changed("instance")); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	replayTimestampSource string //nolint:gochecknoglobals
+	replayTimestampTZ     string //nolint:gochecknoglobals
+	replayInstance        string //nolint:gochecknoglobals
+)
+
+func init() {
+	RootCmd.AddCommand(replayCmd)
+
+	replayCmd.Flags().StringVar(
+		&replayTimestampSource, "timestamp-source", helpers.DumpTimestampSourceVarnishstat,
+		"set source of the timestamp of every document ('varnishstat', 'filename' or 'mtime')")
+	replayCmd.Flags().StringVar(
+		&replayTimestampTZ, "timestamp-tz", "",
+		"set timezone of timestamps without timezone information (defaults to the 'scraper.timestamp-tz' setting)")
+	replayCmd.Flags().StringVar(
+		&replayInstance, "instance", config.DefaultScraperTarget,
+		"set name of the Varnish instance the documents belong to (overrides the one in raw archives)")
+}
+
+func replay(paths []string, overrideInstance bool) error {
+	// Check arguments.
+	if cfg.DBFile() == "" {
+		return errReplayMissingDB
+	}
+	switch replayTimestampSource {
+	case helpers.DumpTimestampSourceVarnishstat, helpers.DumpTimestampSourceFilename,
+		helpers.DumpTimestampSourceMtime:
+	default:
+		return fmt.Errorf("%w: %q", errReplayInvalidSource, replayTimestampSource)
+	}
+	loc := cfg.ScraperTimestampTZ()
+	if replayTimestampTZ != "" {
+		var err error
+		if loc, err = time.LoadLocation(replayTimestampTZ); err != nil {
+			return fmt.Errorf("invalid timezone: %w", err)
+		}
+	}
+
+	// Locate the documents and sort them by timestamp. Invalid files are
+	// skipped, so a few corrupted dumps don't prevent importing the rest.
+	// Compressed files (e.g., raw archives) are decompressed into a temporary
+	// directory first.
+	files, err := findReplayFiles(paths)
+	if err != nil {
+		return err
+	}
+	tmpDir, err := os.MkdirTemp("", "varnishmon-replay-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dumps := make([]*helpers.VarnishstatDump, 0, len(files))
+	skippedFiles := 0
+	for i, file := range files {
+		input := file
+		decompressed := filepath.Join(tmpDir, fmt.Sprintf("%d-%s", i, filepath.Base(file)))
+		if ok, err := helpers.DecompressFile(file, decompressed); err != nil {
+			skippedFiles++
+			cfg.Log().Warn().
+				Err(err).
+				Str("file", file).
+				Msg("Skipping file!")
+			continue
+		} else if ok {
+			input = decompressed
+		}
+
+		fileDumps, err := helpers.ScanVarnishstatDumps(input, replayTimestampSource, loc)
+		if err != nil {
+			skippedFiles++
+			cfg.Log().Warn().
+				Err(err).
+				Str("file", file).
+				Msg("Skipping file!")
+			continue
+		}
+		dumps = append(dumps, fileDumps...)
+	}
+	sort.SliceStable(dumps, func(i, j int) bool {
+		return dumps[i].Timestamp.Before(dumps[j].Timestamp)
+	})
+
+	// Process & store the documents one by one.
+	app := &Application{cfg: cfg}
+	stg := storage.NewStorage(app)
+	processor := workers.NewSampleProcessor(app)
+	var stats workers.SampleProcessorStats
+	imported, samples := 0, 0
+	for _, dump := range dumps {
+		metrics, err := dump.Load()
+		if err != nil {
+			cfg.Log().Warn().
+				Err(err).
+				Str("file", dump.File).
+				Msg("Skipping document!")
+			continue
+		}
+		// Records of raw archives include the instance they belong to,
+		// unless explicitly overridden.
+		if metrics.Instance == "" || overrideInstance {
+			metrics.Instance = replayInstance
+		}
+		cfg.ScraperFilter().Apply(metrics)
+
+		batch, batchStats := processor.Process(metrics)
+		stats.OutOfOrderSamples += batchStats.OutOfOrderSamples
+		stats.ResetCounters += batchStats.ResetCounters
+		stats.TruncatedSamples += batchStats.TruncatedSamples
+
+		if err := stg.PushMetricSamples(metrics.Instance, metrics.Timestamp, batch); err != nil {
+			stg.Shutdown() //nolint:errcheck
+			return fmt.Errorf("failed to store samples of %s: %w", dump.File, err)
+		}
+		if err := stg.PushScrape(&storage.Scrape{
+			Instance:  metrics.Instance,
+			Timestamp: metrics.Timestamp,
+			Outcome:   storage.ScrapeOutcomeOK,
+			Metrics:   len(metrics.Items),
+		}); err != nil {
+			stg.Shutdown() //nolint:errcheck
+			return fmt.Errorf("failed to store scrape outcome of %s: %w", dump.File, err)
+		}
+		imported++
+		samples += len(batch)
+	}
+	if err := stg.Shutdown(); err != nil {
+		return err
+	}
+
+	// Done!
+	fmt.Fprintf(os.Stdout,
+		"Imported %d of %d documents (%d samples) from %d files into %s "+
+			"(skipped files: %d, out-of-order samples: %d, reset counters: %d, truncated samples: %d)\n",
+		imported, len(dumps), samples, len(files)-skippedFiles, cfg.DBFile(),
+		skippedFiles, stats.OutOfOrderSamples, stats.ResetCounters, stats.TruncatedSamples)
+	return nil
+}
+
+// Expands the given paths (files, directories or glob patterns) into a sorted
+// list of regular files. Hidden files found while scanning directories are
+// ignored.
+func findReplayFiles(paths []string) ([]string, error) {
+	seen := make(map[string]bool)
+	result := make([]string, 0)
+	add := func(file string) {
+		if !seen[file] {
+			seen[file] = true
+			result = append(result, file)
+		}
+	}
+
+	for _, path := range paths {
+		matches := []string{path}
+		if _, err := os.Stat(path); err != nil {
+			if matches, err = filepath.Glob(path); err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %w", path, err)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("%w: %q", errReplayNoFiles, path)
+			}
+		}
+
+		for _, match := range matches {
+			if err := filepath.WalkDir(match, func(file string, entry fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if file != match && strings.HasPrefix(entry.Name(), ".") {
+					if entry.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+				if entry.Type().IsRegular() {
+					add(file)
+				}
+				return nil
+			}); err != nil {
+				return nil, fmt.Errorf("failed to scan %q: %w", match, err)
+			}
+		}
+	}
+
+	if len(result) == 0 {
+		return nil, fmt.Errorf("%w: %s", errReplayNoFiles, strings.Join(paths, ", "))
+	}
+	sort.Strings(result)
+	return result, nil
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"fmt"
 	"math"
 	"net"
 	"os"
@@ -10,15 +11,70 @@ import (
 
 	"github.com/kballard/go-shellquote"
 	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
+
+	"github.com/allenta/varnishmon/pkg/helpers"
+)
+
+const (
+	defaultVarnishstat = "/usr/bin/varnishstat -1 -j"
+	defaultVarnishncsa = "/usr/bin/varnishncsa -c -b -F '%{Varnish:side}x %{Host}i %U %s %b %{VSL:BackendOpen[2]}x'"
+	defaultVarnishlog  = "/usr/bin/varnishlog -g request -q 'Timestamp:Resp[2] > 1.0'"
 )
 
 func (cfg *Config) init() {
 	cfg.initGlobalConfig()
 	cfg.initDBConfig()
 	cfg.initScraperConfig()
+	cfg.initMetricsConfig()
+	cfg.initTopConfig()
+	cfg.initTransactionsConfig()
 	cfg.initAPIConfig()
 }
 
+// Re-reads the configuration file and applies the subset of settings that can
+// be safely updated without restarting the service (i.e., 'scraper.include'
+// and 'scraper.exclude'). Invalid values are reported and ignored, keeping the
+// current ones.
+func (cfg *Config) Reload() {
+	if cfg.vpr.ConfigFileUsed() == "" {
+		cfg.log.Warn().Msg("No configuration file in use, so nothing to reload")
+		return
+	}
+
+	// Same setup used during boot, so environment variables keep overriding
+	// whatever is defined in the configuration file.
+	vpr := viper.New()
+	vpr.SetConfigType("yml")
+	vpr.SetConfigFile(cfg.vpr.ConfigFileUsed())
+	vpr.SetEnvPrefix("VARNISHMON")
+	vpr.SetEnvKeyReplacer(strings.NewReplacer(".", "_", "-", "_"))
+	vpr.AllowEmptyEnv(true)
+	vpr.AutomaticEnv()
+	if err := vpr.ReadInConfig(); err != nil {
+		cfg.log.Error().
+			Err(err).
+			Str("file", vpr.ConfigFileUsed()).
+			Msg("Failed to reload configuration file!")
+		return
+	}
+
+	filter, err := helpers.NewMetricsFilter(
+		vpr.GetStringSlice("scraper.include"),
+		vpr.GetStringSlice("scraper.exclude"))
+	if err != nil {
+		cfg.log.Error().
+			Err(err).
+			Msg("Invalid 'scraper.include' / 'scraper.exclude' values, keeping current ones!")
+		return
+	}
+	cfg.scraperFilter.Store(filter)
+
+	cfg.log.Info().
+		Str("file", vpr.ConfigFileUsed()).
+		Msg("Configuration has been successfully reloaded")
+}
+
 // ----------------------------------------------------------------------------
 // GLOBAL
 // ----------------------------------------------------------------------------
@@ -41,6 +97,21 @@ func (cfg *Config) initGlobalConfig() {
 func (cfg *Config) initDBConfig() {
 	cfg.vpr.SetDefault("db.file", "")
 
+	// A glob pattern or a directory in 'db.file' (e.g., provided using the
+	// '--db' flag) is a shortcut for 'db.files'.
+	cfg.vpr.SetDefault("db.files", []string{})
+	if file := cfg.vpr.GetString("db.file"); file != "" {
+		info, err := os.Stat(file)
+		if (err == nil && info.IsDir()) || (err != nil && strings.ContainsAny(file, "*?[")) {
+			cfg.vpr.Set("db.files", []string{file})
+			cfg.vpr.Set("db.file", "")
+		}
+	}
+	if len(cfg.vpr.GetStringSlice("db.files")) > 0 && cfg.vpr.GetString("db.file") != "" {
+		cfg.log.Fatal().Msg(
+			"Non-empty 'db.file' & 'db.files' values! Only one of them can be used")
+	}
+
 	cfg.vpr.SetDefault("db.memory-limit", 512)
 	cfg.checkInt("db.memory-limit", 1, math.MaxInt32)
 
@@ -51,6 +122,79 @@ func (cfg *Config) initDBConfig() {
 
 	cfg.vpr.SetDefault("db.max-temp-directory-size", 128)
 	cfg.checkInt("db.max-temp-directory-size", 1, math.MaxInt32)
+
+	cfg.vpr.SetDefault("db.batch-size", 1)
+	cfg.checkInt("db.batch-size", 1, 1000)
+
+	cfg.vpr.SetDefault("db.batch-max-delay", 30*time.Second)
+	cfg.checkDuration("db.batch-max-delay", 1*time.Second, 1*time.Hour)
+
+	cfg.vpr.SetDefault("db.queue-size", 1024)
+	cfg.checkInt("db.queue-size", 1, 1000000)
+
+	cfg.vpr.SetDefault("db.shutdown-timeout", 30*time.Second)
+	cfg.checkDuration("db.shutdown-timeout", 0, 10*time.Minute)
+
+	cfg.vpr.SetDefault("db.spool.enabled", false)
+	if cfg.vpr.GetBool("db.spool.enabled") {
+		// By default, the spool is stored next to the database file.
+		if file := cfg.vpr.GetString("db.file"); file != "" {
+			cfg.vpr.SetDefault("db.spool.directory", file+".spool")
+		}
+		if cfg.vpr.GetString("db.spool.directory") == "" {
+			cfg.log.Fatal().Msg(
+				"Empty 'db.spool.directory' value! Required when using an in-memory database")
+		}
+
+		cfg.vpr.SetDefault("db.spool.max-size", 256)
+		cfg.checkInt("db.spool.max-size", 1, math.MaxInt32)
+	}
+
+	cfg.vpr.SetDefault("db.retention.max-age", 0)
+	cfg.checkDuration("db.retention.max-age", 0, 100*365*24*time.Hour)
+
+	// By default, rollups are kept as long as raw samples.
+	cfg.vpr.SetDefault("db.retention.max-age-1m", cfg.vpr.GetDuration("db.retention.max-age"))
+	cfg.checkDuration("db.retention.max-age-1m", 0, 100*365*24*time.Hour)
+
+	cfg.vpr.SetDefault("db.retention.max-age-1h", cfg.vpr.GetDuration("db.retention.max-age"))
+	cfg.checkDuration("db.retention.max-age-1h", 0, 100*365*24*time.Hour)
+
+	cfg.vpr.SetDefault("db.retention.max-size", 0)
+	cfg.checkInt("db.retention.max-size", 0, math.MaxInt32)
+	if cfg.vpr.GetInt("db.retention.max-size") > 0 && cfg.vpr.GetString("db.file") == "" &&
+		len(cfg.vpr.GetStringSlice("db.files")) == 0 {
+		cfg.log.Fatal().Msg(
+			"Non-zero 'db.retention.max-size' value! Not supported when using an in-memory database")
+	}
+
+	cfg.vpr.SetDefault("db.retention.period", 10*time.Minute)
+	cfg.checkDuration("db.retention.period", 1*time.Minute, 24*time.Hour)
+
+	cfg.vpr.SetDefault("db.retention.batch-size", 1000000)
+	cfg.checkInt("db.retention.batch-size", 1000, math.MaxInt32)
+
+	cfg.vpr.SetDefault("db.rotation.interval", 0)
+	cfg.checkDuration("db.rotation.interval", 0, 365*24*time.Hour)
+	if cfg.vpr.GetDuration("db.rotation.interval")%time.Hour != 0 {
+		// Otherwise hourly rollups would span across rotated files.
+		cfg.log.Fatal().Msg(
+			"Invalid 'db.rotation.interval' value! Must be a multiple of one hour")
+	}
+
+	cfg.vpr.SetDefault("db.rotation.size", 0)
+	cfg.checkInt("db.rotation.size", 0, math.MaxInt32)
+
+	if (cfg.vpr.GetDuration("db.rotation.interval") > 0 || cfg.vpr.GetInt("db.rotation.size") > 0) &&
+		cfg.vpr.GetString("db.file") == "" && len(cfg.vpr.GetStringSlice("db.files")) == 0 {
+		cfg.log.Fatal().Msg(
+			"Non-zero 'db.rotation.interval' / 'db.rotation.size' value! Not supported when using an in-memory database")
+	}
+
+	cfg.vpr.SetDefault("db.rotation.keep", 7)
+	cfg.checkInt("db.rotation.keep", 0, math.MaxInt32)
+
+	cfg.vpr.SetDefault("db.rotation.compress", false)
 }
 
 // ----------------------------------------------------------------------------
@@ -59,37 +203,149 @@ func (cfg *Config) initDBConfig() {
 
 func (cfg *Config) initScraperConfig() {
 	cfg.vpr.SetDefault("scraper.enabled", true)
+	cfg.checkReadOnlyDB("scraper.enabled")
+
+	// Filters are also applied to metrics pushed to the ingest endpoint of the
+	// API, so they are initialized even if the scraper is disabled.
+	cfg.vpr.SetDefault("scraper.include", []string{})
+	cfg.vpr.SetDefault("scraper.exclude", []string{})
+	cfg.checkMetricsFilter("scraper.include", "scraper.exclude")
+
+	// Same for timestamp settings.
+	cfg.vpr.SetDefault("scraper.timestamp-source", ScraperTimestampSourceLocal)
+	cfg.checkScraperTimestampSource("scraper.timestamp-source")
+
+	cfg.vpr.SetDefault("scraper.timestamp-tz", "Local")
+	cfg.checkTimezone("scraper.timestamp-tz")
 
 	if cfg.vpr.GetBool("scraper.enabled") {
 		cfg.vpr.SetDefault("scraper.period", 1*time.Minute)
 		cfg.checkDuration("scraper.period", 1*time.Second, 24*time.Hour)
 
+		cfg.vpr.SetDefault("scraper.mode", ScraperModeExec)
+		cfg.checkScraperMode("scraper.mode", cfg.vpr.GetString("scraper.mode"))
+
+		cfg.vpr.SetDefault("scraper.overlap-policy", ScraperOverlapPolicySkip)
+		cfg.checkScraperOverlapPolicy("scraper.overlap-policy")
+
 		cfg.vpr.SetDefault("scraper.timeout", 5*time.Second)
 		cfg.checkDuration("scraper.timeout", 1*time.Second, 10*time.Minute)
 
-		{
-			cfg.vpr.SetDefault("scraper.varnishstat", "/usr/bin/varnishstat -1 -j")
+		cfg.vpr.SetDefault("scraper.varnishstat", defaultVarnishstat)
 
-			varnishstat := cfg.vpr.GetString("scraper.varnishstat")
-			command, err := shellquote.Split(os.ExpandEnv(varnishstat))
-			if err != nil {
-				cfg.log.Fatal().
-					Err(err).
-					Str("value", varnishstat).
-					Msg("Failed to split 'scraper.varnishstat' command!")
-			}
-			if len(command) > 0 {
-				if info, err := os.Stat(command[0]); os.IsNotExist(err) || info.IsDir() {
-					cfg.log.Fatal().
-						Err(err).
-						Str("value", varnishstat).
-						Msgf("'scraper.varnishstat' command not found!")
+		cfg.vpr.SetDefault("scraper.host-metrics.enabled", false)
+
+		cfg.vpr.SetDefault("scraper.host-metrics.proc", "/proc")
+		if cfg.vpr.GetBool("scraper.host-metrics.enabled") {
+			cfg.checkDirectory("scraper.host-metrics.proc")
+		}
+
+		cfg.vpr.SetDefault("scraper.targets", []interface{}{})
+		cfg.checkScraperTargets("scraper.targets")
+
+		cfg.vpr.SetDefault("scraper.raw-archive.enabled", false)
+		if cfg.vpr.GetBool("scraper.raw-archive.enabled") {
+			cfg.vpr.SetDefault("scraper.raw-archive.compression", helpers.RawArchiveCompressionZstd)
+			cfg.checkRawArchiveCompression("scraper.raw-archive.compression")
+
+			// By default, the archive is stored next to the database file.
+			if file := cfg.vpr.GetString("db.file"); file != "" {
+				extension := ".zst"
+				if cfg.vpr.GetString("scraper.raw-archive.compression") == helpers.RawArchiveCompressionGzip {
+					extension = ".gz"
 				}
-			} else {
-				cfg.log.Fatal().Msg("Empty 'scraper.varnishstat' command!")
+				cfg.vpr.SetDefault("scraper.raw-archive.file", file+".raw.ndjson"+extension)
+			}
+			if cfg.vpr.GetString("scraper.raw-archive.file") == "" {
+				cfg.log.Fatal().Msg(
+					"Empty 'scraper.raw-archive.file' value! Required when using an in-memory database")
 			}
-			cfg.vpr.Set("scraper.command", command)
+
+			cfg.vpr.SetDefault("scraper.raw-archive.max-size", 64)
+			cfg.checkInt("scraper.raw-archive.max-size", 1, math.MaxInt32)
+
+			cfg.vpr.SetDefault("scraper.raw-archive.max-files", 5)
+			cfg.checkInt("scraper.raw-archive.max-files", 0, 1000)
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------
+// METRICS
+// ----------------------------------------------------------------------------
+
+func (cfg *Config) initMetricsConfig() {
+	// Derived metrics are also computed for metrics pushed to the ingest
+	// endpoint of the API, so they are initialized even if the scraper is
+	// disabled.
+	cfg.vpr.SetDefault("metrics.default-derived", true)
+
+	cfg.vpr.SetDefault("metrics.derived", []interface{}{})
+	cfg.checkDerivedMetrics("metrics.derived")
+
+	// Maximum age of the raw values of counters found in the database when
+	// resuming after a restart. Zero disables resuming.
+	cfg.vpr.SetDefault("metrics.resume-max-age", 15*time.Minute)
+	cfg.checkDuration("metrics.resume-max-age", 0, 7*24*time.Hour)
+
+	// Number of consecutive scrapes that must be missed to consider an
+	// interval between samples a gap.
+	cfg.vpr.SetDefault("metrics.gap-periods", 2)
+	cfg.checkInt("metrics.gap-periods", 1, 1000)
+}
+
+// ----------------------------------------------------------------------------
+// TOP
+// ----------------------------------------------------------------------------
+
+func (cfg *Config) initTopConfig() {
+	cfg.vpr.SetDefault("top.enabled", false)
+	cfg.checkReadOnlyDB("top.enabled")
+
+	if cfg.vpr.GetBool("top.enabled") {
+		cfg.vpr.SetDefault("top.instance", DefaultScraperTarget)
+		if cfg.vpr.GetString("top.instance") == "" {
+			cfg.log.Fatal().Msg("Empty 'top.instance' value!")
+		}
+
+		cfg.vpr.SetDefault("top.period", 1*time.Minute)
+		cfg.checkDuration("top.period", 1*time.Second, 24*time.Hour)
+
+		cfg.vpr.SetDefault("top.limit", 10)
+		cfg.checkInt("top.limit", 1, 1000)
+
+		cfg.vpr.SetDefault("top.varnishncsa", defaultVarnishncsa)
+		cfg.vpr.Set("top.varnishncsa", cfg.checkCommand(
+			"top.varnishncsa", cfg.vpr.GetString("top.varnishncsa")))
+	}
+}
+
+// ----------------------------------------------------------------------------
+// TRANSACTIONS
+// ----------------------------------------------------------------------------
+
+func (cfg *Config) initTransactionsConfig() {
+	cfg.vpr.SetDefault("transactions.enabled", false)
+	cfg.checkReadOnlyDB("transactions.enabled")
+
+	if cfg.vpr.GetBool("transactions.enabled") {
+		cfg.vpr.SetDefault("transactions.instance", DefaultScraperTarget)
+		if cfg.vpr.GetString("transactions.instance") == "" {
+			cfg.log.Fatal().Msg("Empty 'transactions.instance' value!")
 		}
+
+		cfg.vpr.SetDefault("transactions.period", 1*time.Minute)
+		cfg.checkDuration("transactions.period", 1*time.Second, 24*time.Hour)
+
+		cfg.vpr.SetDefault("transactions.limit", 100)
+		cfg.checkInt("transactions.limit", 1, 100000)
+
+		cfg.vpr.SetDefault("transactions.retention", 7*24*time.Hour)
+		cfg.checkDuration("transactions.retention", 1*time.Hour, 10*365*24*time.Hour)
+
+		cfg.vpr.SetDefault("transactions.varnishlog", defaultVarnishlog)
+		cfg.vpr.Set("transactions.varnishlog", cfg.checkCommand(
+			"transactions.varnishlog", cfg.vpr.GetString("transactions.varnishlog")))
 	}
 }
 
@@ -114,6 +370,25 @@ func (cfg *Config) initAPIConfig() {
 
 		cfg.vpr.SetDefault("api.basic-auth.password", "")
 
+		cfg.vpr.SetDefault("api.ingest.enabled", false)
+		cfg.checkReadOnlyDB("api.ingest.enabled")
+
+		if cfg.vpr.GetBool("api.ingest.enabled") {
+			cfg.vpr.SetDefault("api.ingest.token", "")
+			if cfg.vpr.GetString("api.ingest.token") == "" {
+				cfg.log.Fatal().Msg("Empty 'api.ingest.token' value!")
+			}
+		}
+
+		cfg.vpr.SetDefault("api.burst.enabled", false)
+
+		if cfg.vpr.GetBool("api.burst.enabled") {
+			cfg.vpr.SetDefault("api.burst.token", "")
+			if cfg.vpr.GetString("api.burst.token") == "" {
+				cfg.log.Fatal().Msg("Empty 'api.burst.token' value!")
+			}
+		}
+
 		cfg.vpr.SetDefault("api.tls.certfile", "")
 		if cfg.vpr.GetString("api.tls.certfile") != "" {
 			cfg.checkFile("api.tls.certfile")
@@ -203,6 +478,28 @@ func (cfg *Config) checkIP(key string) {
 	}
 }
 
+func (cfg *Config) checkTimezone(key string) {
+	value := cfg.vpr.GetString(key)
+	if loc, err := time.LoadLocation(value); err == nil {
+		cfg.vpr.Set(key, loc)
+	} else {
+		cfg.log.Fatal().
+			Err(err).
+			Str("value", value).
+			Msgf("'%s' is an invalid timezone value", key)
+	}
+}
+
+// Checks a boolean setting enabling a source of data is disabled when several
+// database files are browsed using 'db.files', which are opened in read-only
+// mode.
+func (cfg *Config) checkReadOnlyDB(key string) {
+	if cfg.vpr.GetBool(key) && len(cfg.vpr.GetStringSlice("db.files")) > 0 {
+		cfg.log.Fatal().Msgf(
+			"Enabled '%s' setting! Not supported when using 'db.files'", key)
+	}
+}
+
 func (cfg *Config) checkFile(key string) {
 	value := cfg.vpr.GetString(key)
 	if info, err := os.Stat(value); os.IsNotExist(err) || info.IsDir() {
@@ -212,3 +509,243 @@ func (cfg *Config) checkFile(key string) {
 			Msgf("'%s' is an invalid file value", key)
 	}
 }
+
+func (cfg *Config) checkDirectory(key string) {
+	value := cfg.vpr.GetString(key)
+	if info, err := os.Stat(value); os.IsNotExist(err) || !info.IsDir() {
+		cfg.log.Fatal().
+			Err(err).
+			Str("value", value).
+			Msgf("'%s' is an invalid directory value", key)
+	}
+}
+
+func (cfg *Config) checkCommand(key, value string) []string {
+	command, err := shellquote.Split(os.ExpandEnv(value))
+	if err != nil {
+		cfg.log.Fatal().
+			Err(err).
+			Str("value", value).
+			Msgf("Failed to split '%s' command!", key)
+	}
+	if len(command) > 0 {
+		if info, err := os.Stat(command[0]); os.IsNotExist(err) || info.IsDir() {
+			cfg.log.Fatal().
+				Err(err).
+				Str("value", value).
+				Msgf("'%s' command not found!", key)
+		}
+	} else {
+		cfg.log.Fatal().Msgf("Empty '%s' command!", key)
+	}
+	return command
+}
+
+func (cfg *Config) checkScraperMode(key, value string) {
+	if value != ScraperModeExec && value != ScraperModeStream {
+		cfg.log.Fatal().
+			Str("value", value).
+			Msgf("'%s' is an invalid scraper mode value", key)
+	}
+}
+
+func (cfg *Config) checkScraperOverlapPolicy(key string) {
+	value := cfg.vpr.GetString(key)
+	if value != ScraperOverlapPolicySkip &&
+		value != ScraperOverlapPolicyQueue &&
+		value != ScraperOverlapPolicyAllow {
+		cfg.log.Fatal().
+			Str("value", value).
+			Msgf("'%s' is an invalid overlap policy value", key)
+	}
+}
+
+func (cfg *Config) checkScraperTimestampSource(key string) {
+	value := cfg.vpr.GetString(key)
+	if value != ScraperTimestampSourceLocal && value != ScraperTimestampSourceVarnishstat {
+		cfg.log.Fatal().
+			Str("value", value).
+			Msgf("'%s' is an invalid timestamp source value", key)
+	}
+}
+
+func (cfg *Config) checkRawArchiveCompression(key string) {
+	value := cfg.vpr.GetString(key)
+	if value != helpers.RawArchiveCompressionGzip && value != helpers.RawArchiveCompressionZstd {
+		cfg.log.Fatal().
+			Str("value", value).
+			Msgf("'%s' is an invalid compression value", key)
+	}
+}
+
+func (cfg *Config) checkMetricsFilter(includeKey, excludeKey string) {
+	include := cfg.vpr.GetStringSlice(includeKey)
+	exclude := cfg.vpr.GetStringSlice(excludeKey)
+	filter, err := helpers.NewMetricsFilter(include, exclude)
+	if err != nil {
+		cfg.log.Fatal().
+			Err(err).
+			Strs("include", include).
+			Strs("exclude", exclude).
+			Msgf("'%s' / '%s' are invalid lists of patterns", includeKey, excludeKey)
+	}
+	cfg.scraperFilter.Store(filter)
+}
+
+func (cfg *Config) checkDerivedMetrics(key string) {
+	var items []struct {
+		Name        string `mapstructure:"name"`
+		Expression  string `mapstructure:"expression"`
+		Description string `mapstructure:"description"`
+		Flag        string `mapstructure:"flag"`
+		Format      string `mapstructure:"format"`
+	}
+	if err := cfg.vpr.UnmarshalKey(key, &items); err != nil {
+		cfg.log.Fatal().
+			Err(err).
+			Msgf("'%s' is an invalid list of derived metrics", key)
+	}
+
+	metrics := make([]*helpers.DerivedMetric, 0, len(items))
+	names := make(map[string]bool, len(items))
+	for i, item := range items {
+		itemKey := fmt.Sprintf("%s[%d]", key, i)
+
+		if item.Name == "" {
+			cfg.log.Fatal().Msgf("Empty '%s.name' value!", itemKey)
+		}
+		if names[item.Name] {
+			cfg.log.Fatal().
+				Str("value", item.Name).
+				Msgf("Duplicated '%s.name' value!", itemKey)
+		}
+		names[item.Name] = true
+
+		if item.Flag == "" {
+			item.Flag = "g"
+		} else if item.Flag != "c" && item.Flag != "g" {
+			cfg.log.Fatal().
+				Str("value", item.Flag).
+				Msgf("'%s.flag' is an invalid flag value", itemKey)
+		}
+
+		if item.Format == "" {
+			item.Format = "i"
+		} else if item.Format != "i" && item.Format != "B" && item.Format != "d" {
+			cfg.log.Fatal().
+				Str("value", item.Format).
+				Msgf("'%s.format' is an invalid format value", itemKey)
+		}
+
+		if item.Description == "" {
+			item.Description = item.Expression
+		}
+
+		metric, err := helpers.NewDerivedMetric(
+			item.Name, item.Expression, item.Flag, item.Format, item.Description)
+		if err != nil {
+			cfg.log.Fatal().
+				Err(err).
+				Str("value", item.Expression).
+				Msgf("'%s.expression' is an invalid expression", itemKey)
+		}
+		metrics = append(metrics, metric)
+	}
+
+	// Explicitly defined metrics override default ones with the same name.
+	if cfg.vpr.GetBool("metrics.default-derived") {
+		defaults := make([]*helpers.DerivedMetric, 0)
+		for _, metric := range helpers.DefaultDerivedMetrics() {
+			if !names[metric.Name] {
+				defaults = append(defaults, metric)
+			}
+		}
+		metrics = append(defaults, metrics...)
+	}
+
+	cfg.vpr.Set(key, metrics)
+}
+
+func (cfg *Config) checkScraperTargets(key string) {
+	var items []struct {
+		Name        string        `mapstructure:"name"`
+		Mode        string        `mapstructure:"mode"`
+		Varnishstat string        `mapstructure:"varnishstat"`
+		Period      time.Duration `mapstructure:"period"`
+		HostMetrics *bool         `mapstructure:"host-metrics"`
+	}
+	if err := cfg.vpr.UnmarshalKey(key, &items); err != nil {
+		cfg.log.Fatal().
+			Err(err).
+			Msgf("'%s' is an invalid list of targets", key)
+	}
+
+	// If no explicit targets are provided, fall back to a single target built
+	// from the 'scraper.varnishstat' & 'scraper.period' settings. That's the
+	// most common setup: a single Varnish instance per host.
+	if len(items) == 0 {
+		cfg.vpr.Set(key, []*ScraperTarget{
+			{
+				Name:        DefaultScraperTarget,
+				Mode:        cfg.vpr.GetString("scraper.mode"),
+				Command:     cfg.checkCommand("scraper.varnishstat", cfg.vpr.GetString("scraper.varnishstat")),
+				Period:      cfg.vpr.GetDuration("scraper.period"),
+				HostMetrics: cfg.vpr.GetBool("scraper.host-metrics.enabled"),
+			},
+		})
+		return
+	}
+
+	if varnishstat := cfg.vpr.GetString("scraper.varnishstat"); varnishstat != "" && varnishstat != defaultVarnishstat {
+		cfg.log.Warn().Msgf("'scraper.varnishstat' is ignored when '%s' is defined", key)
+	}
+
+	targets := make([]*ScraperTarget, 0, len(items))
+	names := make(map[string]bool, len(items))
+	for i, item := range items {
+		itemKey := fmt.Sprintf("%s[%d]", key, i)
+
+		if item.Name == "" {
+			cfg.log.Fatal().Msgf("Empty '%s.name' value!", itemKey)
+		}
+		if names[item.Name] {
+			cfg.log.Fatal().
+				Str("value", item.Name).
+				Msgf("Duplicated '%s.name' value!", itemKey)
+		}
+		names[item.Name] = true
+
+		if item.Mode == "" {
+			item.Mode = cfg.vpr.GetString("scraper.mode")
+		} else {
+			cfg.checkScraperMode(itemKey+".mode", item.Mode)
+		}
+
+		if item.Period == 0 {
+			item.Period = cfg.vpr.GetDuration("scraper.period")
+		} else if item.Period < 1*time.Second || item.Period > 24*time.Hour {
+			cfg.log.Fatal().
+				Str("value", item.Period.String()).
+				Str("min", (1*time.Second).String()).
+				Str("max", (24*time.Hour).String()).
+				Msgf("'%s.period' is an invalid duration value", itemKey)
+		}
+
+		// Host metrics only make sense for targets running on the same host
+		// (e.g., not for targets scraped through SSH), so they can be
+		// enabled / disabled per target.
+		hostMetrics := cfg.vpr.GetBool("scraper.host-metrics.enabled")
+		if item.HostMetrics != nil {
+			hostMetrics = *item.HostMetrics
+		}
+
+		targets = append(targets, &ScraperTarget{
+			Name:        item.Name,
+			Mode:        item.Mode,
+			Command:     cfg.checkCommand(itemKey+".varnishstat", item.Varnishstat),
+			Period:      item.Period,
+			HostMetrics: hostMetrics,
+		})
+	}
+	cfg.vpr.Set(key, targets)
+}
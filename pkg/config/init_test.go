@@ -1,12 +1,16 @@
 package config
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/suite"
+
+	"github.com/allenta/varnishmon/pkg/helpers"
 )
 
 type InitTestSuite struct {
@@ -92,6 +96,24 @@ func (suite *InitTestSuite) TestCheckIP() {
 	}
 }
 
+func (suite *InitTestSuite) TestCheckTimezone() {
+	assert := suite.Require()
+
+	for _, value := range []string{"", "UTC", "Local", "Europe/Madrid"} {
+		suite.cfg.vpr.Set("foo", value)
+		assert.NotPanics(func() {
+			suite.cfg.checkTimezone("foo")
+		})
+		_, ok := suite.cfg.vpr.Get("foo").(*time.Location)
+		assert.True(ok)
+	}
+
+	suite.cfg.vpr.Set("foo", "Europe/Whatever")
+	assert.Panics(func() {
+		suite.cfg.checkTimezone("foo")
+	})
+}
+
 func (suite *InitTestSuite) TestCheckFile() {
 	assert := suite.Require()
 
@@ -106,6 +128,208 @@ func (suite *InitTestSuite) TestCheckFile() {
 	})
 }
 
+func (suite *InitTestSuite) TestCheckDirectory() {
+	assert := suite.Require()
+
+	suite.cfg.vpr.Set("foo", "/tmp")
+	assert.NotPanics(func() {
+		suite.cfg.checkDirectory("foo")
+	})
+
+	for _, value := range []string{"/dev/null", "/this/probably/does/not/exist"} {
+		suite.cfg.vpr.Set("foo", value)
+		assert.Panics(func() {
+			suite.cfg.checkDirectory("foo")
+		})
+	}
+}
+
+func (suite *InitTestSuite) TestCheckScraperTargets() {
+	assert := suite.Require()
+
+	suite.cfg.vpr.Set("foo", []interface{}{})
+	assert.NotPanics(func() {
+		suite.cfg.checkScraperTargets("foo")
+	})
+	targets, ok := suite.cfg.vpr.Get("foo").([]*ScraperTarget)
+	assert.True(ok)
+	assert.Len(targets, 1)
+	assert.Equal(DefaultScraperTarget, targets[0].Name)
+	assert.Equal(ScraperModeExec, targets[0].Mode)
+	assert.Equal([]string{"/dev/null"}, targets[0].Command)
+	assert.Equal(1*time.Minute, targets[0].Period)
+	assert.False(targets[0].HostMetrics)
+
+	suite.cfg.vpr.Set("scraper.host-metrics.enabled", true)
+	suite.cfg.vpr.Set("foo", []interface{}{
+		map[string]interface{}{"name": "tls", "mode": "stream", "varnishstat": "/dev/null -n tls", "period": "15s", "host-metrics": false},
+		map[string]interface{}{"name": "internal", "varnishstat": "/dev/null -n internal"},
+	})
+	assert.NotPanics(func() {
+		suite.cfg.checkScraperTargets("foo")
+	})
+	targets, ok = suite.cfg.vpr.Get("foo").([]*ScraperTarget)
+	assert.True(ok)
+	assert.Len(targets, 2)
+	assert.Equal("tls", targets[0].Name)
+	assert.Equal(ScraperModeStream, targets[0].Mode)
+	assert.Equal([]string{"/dev/null", "-n", "tls"}, targets[0].Command)
+	assert.Equal(15*time.Second, targets[0].Period)
+	assert.Equal("internal", targets[1].Name)
+	assert.Equal(ScraperModeExec, targets[1].Mode)
+	assert.Equal(1*time.Minute, targets[1].Period)
+	assert.False(targets[0].HostMetrics)
+	assert.True(targets[1].HostMetrics)
+
+	for _, value := range [][]interface{}{
+		{map[string]interface{}{"varnishstat": "/dev/null"}},
+		{map[string]interface{}{"name": "tls", "varnishstat": "/this/probably/does/not/exist"}},
+		{map[string]interface{}{"name": "tls", "varnishstat": "/dev/null", "period": "100ms"}},
+		{map[string]interface{}{"name": "tls", "varnishstat": "/dev/null", "mode": "whatever"}},
+		{
+			map[string]interface{}{"name": "tls", "varnishstat": "/dev/null"},
+			map[string]interface{}{"name": "tls", "varnishstat": "/dev/null"},
+		},
+	} {
+		suite.cfg.vpr.Set("foo", value)
+		assert.Panics(func() {
+			suite.cfg.checkScraperTargets("foo")
+		})
+	}
+}
+
+func (suite *InitTestSuite) TestCheckDerivedMetrics() {
+	assert := suite.Require()
+
+	suite.cfg.vpr.Set("metrics.default-derived", false)
+	suite.cfg.vpr.Set("foo", []interface{}{
+		map[string]interface{}{"name": "hits", "expression": "MAIN.cache_hit * 60"},
+		map[string]interface{}{
+			"name": "traffic", "expression": "sum(VBE.*.beresp_bodybytes)",
+			"description": "Backend traffic", "flag": "c", "format": "B",
+		},
+	})
+	assert.NotPanics(func() {
+		suite.cfg.checkDerivedMetrics("foo")
+	})
+	metrics, ok := suite.cfg.vpr.Get("foo").([]*helpers.DerivedMetric)
+	assert.True(ok)
+	assert.Len(metrics, 2)
+	assert.Equal("hits", metrics[0].Name)
+	assert.Equal("g", metrics[0].Flag)
+	assert.Equal("i", metrics[0].Format)
+	assert.Equal("MAIN.cache_hit * 60", metrics[0].Description)
+	assert.Equal("traffic", metrics[1].Name)
+	assert.Equal("c", metrics[1].Flag)
+	assert.Equal("B", metrics[1].Format)
+	assert.Equal("Backend traffic", metrics[1].Description)
+
+	// Default metrics are included, unless overridden.
+	suite.cfg.vpr.Set("metrics.default-derived", true)
+	suite.cfg.vpr.Set("foo", []interface{}{
+		map[string]interface{}{"name": "KPI.cache_hit_ratio", "expression": "MAIN.cache_hit"},
+	})
+	assert.NotPanics(func() {
+		suite.cfg.checkDerivedMetrics("foo")
+	})
+	metrics, ok = suite.cfg.vpr.Get("foo").([]*helpers.DerivedMetric)
+	assert.True(ok)
+	assert.Len(metrics, len(helpers.DefaultDerivedMetrics()))
+	assert.Equal("KPI.cache_hit_ratio", metrics[len(metrics)-1].Name)
+	assert.Equal("MAIN.cache_hit", metrics[len(metrics)-1].Expression)
+
+	for _, value := range [][]interface{}{
+		{map[string]interface{}{"expression": "1"}},
+		{map[string]interface{}{"name": "foo", "expression": "1 +"}},
+		{map[string]interface{}{"name": "foo", "expression": "1", "flag": "b"}},
+		{map[string]interface{}{"name": "foo", "expression": "1", "format": "b"}},
+		{
+			map[string]interface{}{"name": "foo", "expression": "1"},
+			map[string]interface{}{"name": "foo", "expression": "2"},
+		},
+	} {
+		suite.cfg.vpr.Set("foo", value)
+		assert.Panics(func() {
+			suite.cfg.checkDerivedMetrics("foo")
+		})
+	}
+}
+
+func (suite *InitTestSuite) TestCheckScraperOverlapPolicy() {
+	assert := suite.Require()
+
+	for _, value := range []string{"skip", "queue", "allow"} {
+		suite.cfg.vpr.Set("foo", value)
+		assert.NotPanics(func() {
+			suite.cfg.checkScraperOverlapPolicy("foo")
+		})
+	}
+
+	for _, value := range []string{"", "whatever"} {
+		suite.cfg.vpr.Set("foo", value)
+		assert.Panics(func() {
+			suite.cfg.checkScraperOverlapPolicy("foo")
+		})
+	}
+}
+
+func (suite *InitTestSuite) TestCheckRawArchiveCompression() {
+	assert := suite.Require()
+
+	for _, value := range []string{"gzip", "zstd"} {
+		suite.cfg.vpr.Set("foo", value)
+		assert.NotPanics(func() {
+			suite.cfg.checkRawArchiveCompression("foo")
+		})
+	}
+
+	for _, value := range []string{"", "lz4"} {
+		suite.cfg.vpr.Set("foo", value)
+		assert.Panics(func() {
+			suite.cfg.checkRawArchiveCompression("foo")
+		})
+	}
+}
+
+func (suite *InitTestSuite) TestCheckMetricsFilter() {
+	assert := suite.Require()
+
+	suite.cfg.vpr.Set("foo", []string{"MAIN.*"})
+	suite.cfg.vpr.Set("bar", []string{"/^MAIN\\.cache_/"})
+	assert.NotPanics(func() {
+		suite.cfg.checkMetricsFilter("foo", "bar")
+	})
+	assert.True(suite.cfg.ScraperFilter().Match("MAIN.uptime"))
+	assert.False(suite.cfg.ScraperFilter().Match("MAIN.cache_hit"))
+	assert.False(suite.cfg.ScraperFilter().Match("LCK.vbe.creat"))
+
+	for _, value := range []string{"", "/(/"} {
+		suite.cfg.vpr.Set("foo", []string{value})
+		assert.Panics(func() {
+			suite.cfg.checkMetricsFilter("foo", "bar")
+		})
+	}
+}
+
+func (suite *InitTestSuite) TestReload() {
+	assert := suite.Require()
+
+	file := filepath.Join(suite.T().TempDir(), "varnishmon.yml")
+	suite.cfg.vpr.SetConfigFile(file)
+	assert.True(suite.cfg.ScraperFilter().Match("LCK.vbe.creat"))
+
+	// Valid filters are applied.
+	assert.NoError(os.WriteFile(file, []byte("scraper:\n  exclude: ['LCK.*']\n"), 0600))
+	suite.cfg.Reload()
+	assert.False(suite.cfg.ScraperFilter().Match("LCK.vbe.creat"))
+	assert.True(suite.cfg.ScraperFilter().Match("MAIN.uptime"))
+
+	// Invalid filters are ignored.
+	assert.NoError(os.WriteFile(file, []byte("scraper:\n  exclude: ['/(/']\n"), 0600))
+	suite.cfg.Reload()
+	assert.False(suite.cfg.ScraperFilter().Match("LCK.vbe.creat"))
+}
+
 func TestInitTestSuite(t *testing.T) {
 	suite.Run(t, &InitTestSuite{})
 }
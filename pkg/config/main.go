@@ -1,10 +1,40 @@
 package config
 
 import (
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/spf13/viper"
+
+	"github.com/allenta/varnishmon/pkg/helpers"
+)
+
+const (
+	// Name of the implicit scraper target used when no explicit targets are
+	// defined in the 'scraper.targets' setting.
+	DefaultScraperTarget = "default"
+
+	// Scraping modes: 'exec' runs the command on every tick, expecting a single
+	// JSON document on stdout; 'stream' runs a long-lived command expecting
+	// newline-delimited JSON documents on stdout, one per sample.
+	ScraperModeExec   = "exec"
+	ScraperModeStream = "stream"
+
+	// Policies applied in 'exec' mode when a tick arrives while the previous
+	// scrape is still running: 'skip' ignores the tick; 'queue' runs the scrape
+	// as soon as the previous one completes (at most one scrape is queued);
+	// 'allow' runs the scrape concurrently with the previous one.
+	ScraperOverlapPolicySkip  = "skip"
+	ScraperOverlapPolicyQueue = "queue"
+	ScraperOverlapPolicyAllow = "allow"
+
+	// Sources of the timestamps of samples: 'local' uses the local clock
+	// (i.e., the start of the scrape, or the reception time for pushed
+	// metrics); 'varnishstat' uses the 'timestamp' field of the 'varnishstat'
+	// output, interpreted in the 'scraper.timestamp-tz' timezone.
+	ScraperTimestampSourceLocal       = "local"
+	ScraperTimestampSourceVarnishstat = "varnishstat"
 )
 
 var (
@@ -25,10 +55,25 @@ func IsDevelopment() bool {
 	return environment == "development"
 }
 
+type ScraperTarget struct {
+	Name    string
+	Mode    string
+	Command []string
+	Period  time.Duration
+	// Whether host metrics (CPU, memory, etc.) are collected along with the
+	// 'varnishstat' output.
+	HostMetrics bool
+}
+
 type Config struct {
 	log     *Logger
 	vpr     *viper.Viper
 	metrics *Metrics
+
+	// Compiled 'scraper.include' & 'scraper.exclude' settings. Unlike the rest
+	// of settings, this can be replaced at any time by 'Reload()', so it's kept
+	// out of Viper, which is not safe for concurrent use.
+	scraperFilter atomic.Pointer[helpers.MetricsFilter]
 }
 
 func NewConfig(log *Logger, vpr *viper.Viper) *Config {
@@ -73,6 +118,10 @@ func (cfg *Config) DBFile() string {
 	return cfg.vpr.GetString("db.file")
 }
 
+func (cfg *Config) DBFiles() []string {
+	return cfg.vpr.GetStringSlice("db.files")
+}
+
 func (cfg *Config) DBMemoryLimit() int {
 	return cfg.vpr.GetInt("db.memory-limit")
 }
@@ -89,6 +138,89 @@ func (cfg *Config) DBMaxTempDirectorySize() int {
 	return cfg.vpr.GetInt("db.max-temp-directory-size")
 }
 
+func (cfg *Config) DBBatchSize() int {
+	return cfg.vpr.GetInt("db.batch-size")
+}
+
+func (cfg *Config) DBBatchMaxDelay() time.Duration {
+	return cfg.vpr.GetDuration("db.batch-max-delay")
+}
+
+func (cfg *Config) DBQueueSize() int {
+	return cfg.vpr.GetInt("db.queue-size")
+}
+
+func (cfg *Config) DBShutdownTimeout() time.Duration {
+	return cfg.vpr.GetDuration("db.shutdown-timeout")
+}
+
+func (cfg *Config) DBSpoolEnabled() bool {
+	return cfg.vpr.GetBool("db.spool.enabled")
+}
+
+func (cfg *Config) DBSpoolDirectory() string {
+	return cfg.vpr.GetString("db.spool.directory")
+}
+
+func (cfg *Config) DBSpoolMaxSize() int {
+	return cfg.vpr.GetInt("db.spool.max-size")
+}
+
+// Retention and rotation don't apply to database files browsed using
+// 'db.files', which are opened in read-only mode.
+func (cfg *Config) DBRetentionEnabled() bool {
+	return len(cfg.DBFiles()) == 0 &&
+		(cfg.DBRetentionMaxAge() > 0 ||
+			cfg.DBRetentionMaxAge1m() > 0 ||
+			cfg.DBRetentionMaxAge1h() > 0 ||
+			cfg.DBRetentionMaxSize() > 0)
+}
+
+func (cfg *Config) DBRetentionMaxAge() time.Duration {
+	return cfg.vpr.GetDuration("db.retention.max-age")
+}
+
+func (cfg *Config) DBRetentionMaxAge1m() time.Duration {
+	return cfg.vpr.GetDuration("db.retention.max-age-1m")
+}
+
+func (cfg *Config) DBRetentionMaxAge1h() time.Duration {
+	return cfg.vpr.GetDuration("db.retention.max-age-1h")
+}
+
+func (cfg *Config) DBRetentionMaxSize() int {
+	return cfg.vpr.GetInt("db.retention.max-size")
+}
+
+func (cfg *Config) DBRetentionPeriod() time.Duration {
+	return cfg.vpr.GetDuration("db.retention.period")
+}
+
+func (cfg *Config) DBRetentionBatchSize() int {
+	return cfg.vpr.GetInt("db.retention.batch-size")
+}
+
+func (cfg *Config) DBRotationEnabled() bool {
+	return len(cfg.DBFiles()) == 0 &&
+		(cfg.DBRotationInterval() > 0 || cfg.DBRotationSize() > 0)
+}
+
+func (cfg *Config) DBRotationInterval() time.Duration {
+	return cfg.vpr.GetDuration("db.rotation.interval")
+}
+
+func (cfg *Config) DBRotationSize() int {
+	return cfg.vpr.GetInt("db.rotation.size")
+}
+
+func (cfg *Config) DBRotationKeep() int {
+	return cfg.vpr.GetInt("db.rotation.keep")
+}
+
+func (cfg *Config) DBRotationCompress() bool {
+	return cfg.vpr.GetBool("db.rotation.compress")
+}
+
 // ----------------------------------------------------------------------------
 // SCRAPER
 // ----------------------------------------------------------------------------
@@ -101,12 +233,136 @@ func (cfg *Config) ScraperPeriod() time.Duration {
 	return cfg.vpr.GetDuration("scraper.period")
 }
 
+func (cfg *Config) ScraperMode() string {
+	return cfg.vpr.GetString("scraper.mode")
+}
+
+func (cfg *Config) ScraperOverlapPolicy() string {
+	return cfg.vpr.GetString("scraper.overlap-policy")
+}
+
+func (cfg *Config) ScraperTimestampSource() string {
+	return cfg.vpr.GetString("scraper.timestamp-source")
+}
+
+func (cfg *Config) ScraperTimestampTZ() *time.Location {
+	return cfg.vpr.Get("scraper.timestamp-tz").(*time.Location)
+}
+
 func (cfg *Config) ScraperTimeout() time.Duration {
 	return cfg.vpr.GetDuration("scraper.timeout")
 }
 
-func (cfg *Config) ScraperCommand() []string {
-	return cfg.vpr.GetStringSlice("scraper.command")
+func (cfg *Config) ScraperFilter() *helpers.MetricsFilter {
+	return cfg.scraperFilter.Load()
+}
+
+func (cfg *Config) ScraperHostMetricsProc() string {
+	return cfg.vpr.GetString("scraper.host-metrics.proc")
+}
+
+func (cfg *Config) ScraperTargets() []*ScraperTarget {
+	return cfg.vpr.Get("scraper.targets").([]*ScraperTarget)
+}
+
+func (cfg *Config) ScraperRawArchiveEnabled() bool {
+	return cfg.vpr.GetBool("scraper.raw-archive.enabled")
+}
+
+func (cfg *Config) ScraperRawArchiveFile() string {
+	return cfg.vpr.GetString("scraper.raw-archive.file")
+}
+
+func (cfg *Config) ScraperRawArchiveCompression() string {
+	return cfg.vpr.GetString("scraper.raw-archive.compression")
+}
+
+func (cfg *Config) ScraperRawArchiveMaxSize() int {
+	return cfg.vpr.GetInt("scraper.raw-archive.max-size")
+}
+
+func (cfg *Config) ScraperRawArchiveMaxFiles() int {
+	return cfg.vpr.GetInt("scraper.raw-archive.max-files")
+}
+
+// Returns the shortest scraping period of all targets. That's the finest
+// resolution available in the stored timeseries.
+func (cfg *Config) ScraperMinPeriod() time.Duration {
+	var result time.Duration
+	for _, target := range cfg.ScraperTargets() {
+		if result == 0 || target.Period < result {
+			result = target.Period
+		}
+	}
+	return result
+}
+
+// ----------------------------------------------------------------------------
+// METRICS
+// ----------------------------------------------------------------------------
+
+func (cfg *Config) DerivedMetrics() []*helpers.DerivedMetric {
+	return cfg.vpr.Get("metrics.derived").([]*helpers.DerivedMetric)
+}
+
+func (cfg *Config) MetricsResumeMaxAge() time.Duration {
+	return cfg.vpr.GetDuration("metrics.resume-max-age")
+}
+
+func (cfg *Config) MetricsGapPeriods() int {
+	return cfg.vpr.GetInt("metrics.gap-periods")
+}
+
+// ----------------------------------------------------------------------------
+// TOP
+// ----------------------------------------------------------------------------
+
+func (cfg *Config) TopEnabled() bool {
+	return cfg.vpr.GetBool("top.enabled")
+}
+
+func (cfg *Config) TopInstance() string {
+	return cfg.vpr.GetString("top.instance")
+}
+
+func (cfg *Config) TopPeriod() time.Duration {
+	return cfg.vpr.GetDuration("top.period")
+}
+
+func (cfg *Config) TopLimit() int {
+	return cfg.vpr.GetInt("top.limit")
+}
+
+func (cfg *Config) TopVarnishncsa() []string {
+	return cfg.vpr.Get("top.varnishncsa").([]string)
+}
+
+// ----------------------------------------------------------------------------
+// TRANSACTIONS
+// ----------------------------------------------------------------------------
+
+func (cfg *Config) TransactionsEnabled() bool {
+	return cfg.vpr.GetBool("transactions.enabled")
+}
+
+func (cfg *Config) TransactionsInstance() string {
+	return cfg.vpr.GetString("transactions.instance")
+}
+
+func (cfg *Config) TransactionsPeriod() time.Duration {
+	return cfg.vpr.GetDuration("transactions.period")
+}
+
+func (cfg *Config) TransactionsLimit() int {
+	return cfg.vpr.GetInt("transactions.limit")
+}
+
+func (cfg *Config) TransactionsRetention() time.Duration {
+	return cfg.vpr.GetDuration("transactions.retention")
+}
+
+func (cfg *Config) TransactionsVarnishlog() []string {
+	return cfg.vpr.Get("transactions.varnishlog").([]string)
 }
 
 // ----------------------------------------------------------------------------
@@ -137,6 +393,22 @@ func (cfg *Config) APIBasicAuthPassword() string {
 	return cfg.vpr.GetString("api.basic-auth.password")
 }
 
+func (cfg *Config) APIIngestEnabled() bool {
+	return cfg.vpr.GetBool("api.ingest.enabled")
+}
+
+func (cfg *Config) APIIngestToken() string {
+	return cfg.vpr.GetString("api.ingest.token")
+}
+
+func (cfg *Config) APIBurstEnabled() bool {
+	return cfg.vpr.GetBool("api.burst.enabled")
+}
+
+func (cfg *Config) APIBurstToken() string {
+	return cfg.vpr.GetString("api.burst.token")
+}
+
 func (cfg *Config) APITLSCertfile() string {
 	return cfg.vpr.GetString("api.tls.certfile")
 }
@@ -0,0 +1,459 @@
+package helpers
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var (
+	errInvalidExpression = errors.New("invalid expression")
+)
+
+// DerivedMetric is a metric computed from other metrics of the same sample
+// using an arithmetic expression. Expressions support numbers (e.g., '0.5' or
+// '1e3'), metric names (e.g., 'MAIN.cache_hit'; names including unusual
+// characters can be enclosed in double quotes), the '+', '-', '*' and '/'
+// operators, parentheses, and the 'sum', 'avg', 'min', 'max' and 'count'
+// functions, which aggregate all metrics matching a glob pattern (e.g.,
+// 'sum(VBE.*.bereq_bodybytes)').
+// Beware 'sum' and 'count' evaluate to zero when no metric matches the
+// pattern, so they are also useful to reference metrics which may be missing,
+// but expressions where no metric at all is found are not evaluated.
+type DerivedMetric struct {
+	Name        string
+	Expression  string
+	Flag        string
+	Format      string
+	Description string
+	root        exprNode
+}
+
+func NewDerivedMetric(name, expression, flag, format, description string) (*DerivedMetric, error) {
+	root, err := parseExpression(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DerivedMetric{
+		Name:        name,
+		Expression:  expression,
+		Flag:        flag,
+		Format:      format,
+		Description: description,
+		root:        root,
+	}, nil
+}
+
+// Evaluates the expression using the given values, indexed by metric name.
+// The second return value is false if the expression cannot be evaluated
+// (e.g., a referenced metric is missing, none of the referenced metrics is
+// found, or a division by zero).
+func (dm *DerivedMetric) Evaluate(values map[string]float64) (float64, bool) {
+	env := &exprEnv{values: values}
+	result, ok := dm.root.eval(env)
+	if !ok || !env.matched || math.IsNaN(result) || math.IsInf(result, 0) {
+		return 0, false
+	}
+	return result, true
+}
+
+// Catalog of derived metrics available out of the box. Inputs are the values
+// stored by the archiver, so counters are rates per second.
+func DefaultDerivedMetrics() []*DerivedMetric {
+	result := make([]*DerivedMetric, 0)
+	for _, item := range []struct {
+		name, expression, flag, format, description string
+	}{
+		{
+			"KPI.cache_hit_ratio",
+			"100 * MAIN.cache_hit / (MAIN.cache_hit + MAIN.cache_miss + sum(MAIN.cache_hitpass) + sum(MAIN.cache_hitmiss))",
+			"g", "i", "Percentage of cache lookups resulting in a hit",
+		},
+		{
+			"KPI.pass_ratio",
+			"100 * MAIN.s_pass / MAIN.client_req",
+			"g", "i", "Percentage of client requests passed to the backend",
+		},
+		{
+			"KPI.backend_error_ratio",
+			"100 * MAIN.fetch_failed / MAIN.s_fetch",
+			"g", "i", "Percentage of backend fetches failed",
+		},
+		{
+			"KPI.backend_conn_failure_ratio",
+			"100 * (MAIN.backend_fail + MAIN.backend_unhealthy) / (MAIN.backend_conn + MAIN.backend_reuse + MAIN.backend_fail + MAIN.backend_unhealthy)",
+			"g", "i", "Percentage of backend connections failed or not attempted",
+		},
+		{
+			"KPI.sess_queued_ratio",
+			"100 * MAIN.sess_queued / MAIN.sess_conn",
+			"g", "i", "Percentage of sessions queued waiting for a worker thread",
+		},
+		{
+			"KPI.thread_pool_saturation",
+			"sum(MAIN.threads_limited) + sum(MAIN.sess_queued) + sum(MAIN.thread_queue_len)",
+			"g", "i", "Thread pool saturation: threads not created because of the limit & sessions queued " +
+				"(per second), plus requests waiting for a worker thread (zero unless saturated)",
+		},
+		{
+			"KPI.sess_dropped_ratio",
+			"100 * (MAIN.sess_dropped + MAIN.sess_fail) / MAIN.sess_conn",
+			"g", "i", "Percentage of sessions dropped or failed",
+		},
+		{
+			"KPI.client_traffic",
+			"MAIN.s_req_hdrbytes + MAIN.s_req_bodybytes + MAIN.s_resp_hdrbytes + MAIN.s_resp_bodybytes",
+			"c", "B", "Client traffic (request & response headers and bodies)",
+		},
+		{
+			"KPI.backend_traffic",
+			"sum(VBE.*.bereq_hdrbytes) + sum(VBE.*.bereq_bodybytes) + sum(VBE.*.beresp_hdrbytes) + sum(VBE.*.beresp_bodybytes)",
+			"c", "B", "Backend traffic (request & response headers and bodies)",
+		},
+		{
+			"KPI.storage_used",
+			"sum(SMA.*.g_bytes) + sum(SMF.*.g_bytes)",
+			"g", "B", "Bytes allocated from all malloc & file storages",
+		},
+	} {
+		dm, err := NewDerivedMetric(item.name, item.expression, item.flag, item.format, item.description)
+		if err != nil {
+			panic(fmt.Sprintf("invalid default derived metric %q: %s", item.name, err))
+		}
+		result = append(result, dm)
+	}
+	return result
+}
+
+// ----------------------------------------------------------------------------
+// AST
+// ----------------------------------------------------------------------------
+
+type exprNode interface {
+	eval(env *exprEnv) (float64, bool)
+}
+
+type exprEnv struct {
+	values map[string]float64
+	// Whether any of the referenced metrics has been found.
+	matched bool
+}
+
+type numberNode struct {
+	value float64
+}
+
+func (n *numberNode) eval(*exprEnv) (float64, bool) {
+	return n.value, true
+}
+
+type metricNode struct {
+	name string
+}
+
+func (n *metricNode) eval(env *exprEnv) (float64, bool) {
+	value, ok := env.values[n.name]
+	env.matched = env.matched || ok
+	return value, ok
+}
+
+type negNode struct {
+	operand exprNode
+}
+
+func (n *negNode) eval(env *exprEnv) (float64, bool) {
+	value, ok := n.operand.eval(env)
+	return -value, ok
+}
+
+type binaryNode struct {
+	op          byte
+	left, right exprNode
+}
+
+func (n *binaryNode) eval(env *exprEnv) (float64, bool) {
+	left, ok := n.left.eval(env)
+	if !ok {
+		return 0, false
+	}
+	right, ok := n.right.eval(env)
+	if !ok {
+		return 0, false
+	}
+
+	switch n.op {
+	case '+':
+		return left + right, true
+	case '-':
+		return left - right, true
+	case '*':
+		return left * right, true
+	case '/':
+		if right == 0 {
+			return 0, false
+		}
+		return left / right, true
+	}
+	return 0, false
+}
+
+type aggregateNode struct {
+	function string
+	pattern  *regexp.Regexp
+}
+
+func (n *aggregateNode) eval(env *exprEnv) (float64, bool) {
+	var result float64
+	count := 0
+	for name, value := range env.values {
+		if !n.pattern.MatchString(name) {
+			continue
+		}
+		switch {
+		case count == 0:
+			result = value
+		case n.function == "min":
+			result = math.Min(result, value)
+		case n.function == "max":
+			result = math.Max(result, value)
+		default:
+			result += value
+		}
+		count++
+	}
+	env.matched = env.matched || count > 0
+
+	switch n.function {
+	case "count":
+		return float64(count), true
+	case "sum":
+		return result, true
+	case "avg":
+		if count == 0 {
+			return 0, false
+		}
+		return result / float64(count), true
+	default:
+		return result, count > 0
+	}
+}
+
+// ----------------------------------------------------------------------------
+// PARSER
+// ----------------------------------------------------------------------------
+
+// Recursive descent parser of expressions:
+//
+//	expr    := term (('+' | '-') term)*
+//	term    := unary (('*' | '/') unary)*
+//	unary   := '-' unary | primary
+//	primary := number | name | function '(' name ')' | '(' expr ')'
+type exprParser struct {
+	input string
+	pos   int
+}
+
+func parseExpression(input string) (exprNode, error) {
+	p := &exprParser{input: input}
+	node, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpaces()
+	if p.pos < len(p.input) {
+		return nil, p.errorf("unexpected %q", p.input[p.pos])
+	}
+	return node, nil
+}
+
+func (p *exprParser) parseExpr() (exprNode, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		p.skipSpaces()
+		if p.pos >= len(p.input) || (p.input[p.pos] != '+' && p.input[p.pos] != '-') {
+			return left, nil
+		}
+		op := p.input[p.pos]
+		p.pos++
+		right, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: op, left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseTerm() (exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		p.skipSpaces()
+		if p.pos >= len(p.input) || (p.input[p.pos] != '*' && p.input[p.pos] != '/') {
+			return left, nil
+		}
+		op := p.input[p.pos]
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: op, left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	p.skipSpaces()
+	if p.pos < len(p.input) && p.input[p.pos] == '-' {
+		p.pos++
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &negNode{operand: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	p.skipSpaces()
+	if p.pos >= len(p.input) {
+		return nil, p.errorf("unexpected end of expression")
+	}
+
+	c := p.input[p.pos]
+	switch {
+	case c == '(':
+		p.pos++
+		node, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(')'); err != nil {
+			return nil, err
+		}
+		return node, nil
+	case c >= '0' && c <= '9':
+		start := p.pos
+		for p.pos < len(p.input) && (isDigit(p.input[p.pos]) || p.input[p.pos] == '.') {
+			p.pos++
+		}
+		p.skipExponent()
+		value, err := strconv.ParseFloat(p.input[start:p.pos], 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %q", p.input[start:p.pos])
+		}
+		return &numberNode{value: value}, nil
+	}
+
+	name, err := p.parseName()
+	if err != nil {
+		return nil, err
+	}
+
+	// Function call?
+	p.skipSpaces()
+	if p.pos < len(p.input) && p.input[p.pos] == '(' {
+		switch name {
+		case "sum", "avg", "min", "max", "count":
+		default:
+			return nil, p.errorf("unknown function %q", name)
+		}
+		p.pos++
+		p.skipSpaces()
+		pattern, err := p.parseName()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(')'); err != nil {
+			return nil, err
+		}
+		re, err := regexp.Compile(globToRegexp(pattern))
+		if err != nil {
+			return nil, p.errorf("invalid pattern %q", pattern)
+		}
+		return &aggregateNode{function: name, pattern: re}, nil
+	}
+
+	if strings.ContainsAny(name, "*?") {
+		return nil, p.errorf("pattern %q outside of an aggregation function", name)
+	}
+	return &metricNode{name: name}, nil
+}
+
+func (p *exprParser) parseName() (string, error) {
+	if p.pos < len(p.input) && p.input[p.pos] == '"' {
+		end := strings.IndexByte(p.input[p.pos+1:], '"')
+		if end <= 0 {
+			return "", p.errorf("unterminated or empty quoted name")
+		}
+		name := p.input[p.pos+1 : p.pos+1+end]
+		p.pos += end + 2
+		return name, nil
+	}
+
+	start := p.pos
+	for p.pos < len(p.input) && isNameChar(rune(p.input[p.pos])) {
+		p.pos++
+	}
+	if start == p.pos || isDigit(p.input[start]) {
+		return "", p.errorf("invalid name at %q", p.input[start:])
+	}
+	return p.input[start:p.pos], nil
+}
+
+// Skips the exponent of a number (e.g., 'e3' or 'E-3'), if any. Otherwise
+// (e.g., '1e'), the position is left untouched, so parsing fails later.
+func (p *exprParser) skipExponent() {
+	pos := p.pos
+	if pos >= len(p.input) || (p.input[pos] != 'e' && p.input[pos] != 'E') {
+		return
+	}
+	pos++
+	if pos < len(p.input) && (p.input[pos] == '+' || p.input[pos] == '-') {
+		pos++
+	}
+	if pos >= len(p.input) || !isDigit(p.input[pos]) {
+		return
+	}
+	for pos < len(p.input) && isDigit(p.input[pos]) {
+		pos++
+	}
+	p.pos = pos
+}
+
+func (p *exprParser) expect(c byte) error {
+	p.skipSpaces()
+	if p.pos >= len(p.input) || p.input[p.pos] != c {
+		return p.errorf("expected %q", c)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *exprParser) skipSpaces() {
+	for p.pos < len(p.input) && unicode.IsSpace(rune(p.input[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *exprParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("%w: %s at position %d", errInvalidExpression, fmt.Sprintf(format, args...), p.pos)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isNameChar(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '.' || r == '*' || r == '?'
+}
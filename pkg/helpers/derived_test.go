@@ -0,0 +1,123 @@
+package helpers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type DerivedMetricTestSuite struct {
+	suite.Suite
+}
+
+func (suite *DerivedMetricTestSuite) TestEvaluate() {
+	assert := suite.Require()
+
+	values := map[string]float64{
+		"MAIN.cache_hit":                   90,
+		"MAIN.cache_miss":                  10,
+		"MAIN.n_object":                    0,
+		"VBE.boot.default.bereq_bodybytes": 100,
+		"VBE.boot.api.bereq_bodybytes":     300,
+		"VBE.boot.api(1.2.3.4).happy":      1,
+	}
+
+	for expression, expected := range map[string]float64{
+		"42 + MAIN.n_object":                                        42,
+		"1 + 2 * 3 + MAIN.n_object":                                 7,
+		"(1 + 2) * 3 + MAIN.n_object":                               9,
+		"10 - 4 - 3 + MAIN.n_object":                                3,
+		"12 / 3 / 2 + MAIN.n_object":                                2,
+		"-MAIN.cache_miss + 2":                                      -8,
+		"1e3 + MAIN.n_object":                                       1000,
+		"2.5E-1 * 4 + MAIN.n_object":                                1,
+		"1e+2 - MAIN.cache_miss":                                    90,
+		"--2 + MAIN.n_object":                                       2,
+		"100 * MAIN.cache_hit / (MAIN.cache_hit + MAIN.cache_miss)": 90,
+		"sum(VBE.*.bereq_bodybytes)":                                400,
+		"avg(VBE.*.bereq_bodybytes)":                                200,
+		"min(VBE.*.bereq_bodybytes)":                                100,
+		"max( VBE.*.bereq_bodybytes )":                              300,
+		"count(VBE.*.bereq_bodybytes)":                              2,
+		"sum(MAIN.whatever) + count(MAIN.whatever) + MAIN.n_object": 0,
+		`"VBE.boot.api(1.2.3.4).happy" * 2`:                         2,
+		`sum("VBE.boot.api(*).happy")`:                              1,
+	} {
+		dm, err := NewDerivedMetric("foo", expression, "g", "i", "")
+		assert.NoError(err, expression)
+		value, ok := dm.Evaluate(values)
+		assert.True(ok, expression)
+		assert.InDelta(expected, value, 1e-9, expression)
+	}
+
+	for _, expression := range []string{
+		"42",
+		"sum(MAIN.whatever)",
+		"MAIN.whatever",
+		"MAIN.cache_hit / MAIN.n_object",
+		"avg(MAIN.whatever)",
+		"max(MAIN.whatever)",
+	} {
+		dm, err := NewDerivedMetric("foo", expression, "g", "i", "")
+		assert.NoError(err, expression)
+		_, ok := dm.Evaluate(values)
+		assert.False(ok, expression)
+	}
+}
+
+func (suite *DerivedMetricTestSuite) TestInvalidExpressions() {
+	assert := suite.Require()
+
+	for _, expression := range []string{
+		"",
+		"1 +",
+		"(1 + 2",
+		"1 + 2)",
+		"MAIN.*",
+		"foo(MAIN.cache_hit)",
+		"sum(1)",
+		"sum(MAIN.*",
+		`"MAIN.cache_hit`,
+		"1.2.3",
+		"1e",
+		"1e+",
+		"1e3e3",
+		"MAIN.cache_hit $ 2",
+	} {
+		_, err := NewDerivedMetric("foo", expression, "g", "i", "")
+		assert.ErrorIs(err, errInvalidExpression, expression)
+	}
+}
+
+func (suite *DerivedMetricTestSuite) TestDefaultDerivedMetrics() {
+	assert := suite.Require()
+
+	metrics := DefaultDerivedMetrics()
+	assert.NotEmpty(metrics)
+
+	values := map[string]float64{
+		"MAIN.cache_hit":        75,
+		"MAIN.cache_miss":       20,
+		"MAIN.cache_hitpass":    5,
+		"MAIN.threads_limited":  2,
+		"MAIN.sess_queued":      3,
+		"MAIN.thread_queue_len": 10,
+	}
+	expected := map[string]float64{
+		"KPI.cache_hit_ratio":        75,
+		"KPI.thread_pool_saturation": 15,
+	}
+	for _, dm := range metrics {
+		if value, ok := expected[dm.Name]; ok {
+			result, ok := dm.Evaluate(values)
+			assert.True(ok, dm.Name)
+			assert.InDelta(value, result, 1e-9, dm.Name)
+			delete(expected, dm.Name)
+		}
+	}
+	assert.Empty(expected)
+}
+
+func TestDerivedMetricTestSuite(t *testing.T) {
+	suite.Run(t, new(DerivedMetricTestSuite))
+}
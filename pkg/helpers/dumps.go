@@ -0,0 +1,200 @@
+package helpers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// Sources of the timestamps of saved 'varnishstat' documents.
+const (
+	// The 'timestamp' field embedded in the document.
+	DumpTimestampSourceVarnishstat = "varnishstat"
+	// A date & time (e.g., '20240131T235900', '2024-01-31_23-59-00') or an
+	// epoch (e.g., '1706745540') included in the name of the file.
+	DumpTimestampSourceFilename = "filename"
+	// The modification time of the file.
+	DumpTimestampSourceMtime = "mtime"
+)
+
+var (
+	errInvalidTimestampSource = errors.New("invalid timestamp source")
+	errMissingFilenameTime    = errors.New("no timestamp found in file name")
+	errAmbiguousTimestamp     = errors.New("several documents share the timestamp of the file")
+
+	filenameDateTimeRegexp = regexp.MustCompile(
+		`(\d{4})-?(\d{2})-?(\d{2})[T_ -]?(\d{2})[:.-]?(\d{2})[:.-]?(\d{2})`)
+	filenameEpochRegexp = regexp.MustCompile(`(?:^|\D)(\d{10})(?:\D|$)`)
+)
+
+// VarnishstatDump locates a 'varnishstat -1 -j' document saved in a file. Files
+// may contain a single document (e.g., the output of a cron job) or several
+// documents, one after another (e.g., newline-delimited JSON, including the
+// decompressed files written by 'RawArchiveWriter'). Only the location and the
+// timestamp of every document are kept, so large sets of dumps can be sorted
+// without loading all metrics in memory.
+type VarnishstatDump struct {
+	File      string
+	Offset    int64
+	Length    int64
+	Timestamp time.Time
+	// Instance the document belongs to, if known (i.e., only for records
+	// written by 'RawArchiveWriter').
+	Instance string
+}
+
+// Scans a file of saved 'varnishstat -1 -j' documents, using any of the
+// output versions supported by 'VarnishMetrics', and returns their locations
+// and timestamps. Timestamps not including timezone information are
+// interpreted in the given location. Records written by 'RawArchiveWriter'
+// always use their own timestamps, whatever the source.
+func ScanVarnishstatDumps(file, source string, loc *time.Location) ([]*VarnishstatDump, error) {
+	// Failures to get the timestamp of the file are only relevant if it
+	// includes documents other than records written by 'RawArchiveWriter'.
+	var fileTimestamp time.Time
+	var fileTimestampErr error
+	switch source {
+	case DumpTimestampSourceVarnishstat:
+	case DumpTimestampSourceFilename:
+		fileTimestamp, fileTimestampErr = ParseFilenameTimestamp(file, loc)
+	case DumpTimestampSourceMtime:
+		if info, err := os.Stat(file); err == nil {
+			fileTimestamp = info.ModTime()
+		} else {
+			fileTimestampErr = fmt.Errorf("failed to stat file: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("%w: %q", errInvalidTimestampSource, source)
+	}
+
+	input, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer input.Close()
+
+	result := make([]*VarnishstatDump, 0)
+	documents := 0
+	decoder := json.NewDecoder(input)
+	for {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, fmt.Errorf("failed to decode document #%d: %w", len(result)+1, err)
+		}
+		end := decoder.InputOffset()
+
+		dump := &VarnishstatDump{
+			File:   file,
+			Offset: end - int64(len(raw)),
+			Length: int64(len(raw)),
+		}
+
+		metrics, record, err := parseVarnishstatDump(raw)
+		if err != nil {
+			return nil, fmt.Errorf("document #%d: %w", len(result)+1, err)
+		}
+
+		switch {
+		case record != nil:
+			dump.Timestamp = record.Timestamp
+			dump.Instance = record.Instance
+		case source == DumpTimestampSourceVarnishstat:
+			if dump.Timestamp, err = metrics.ParseVarnishstatTimestamp(loc); err != nil {
+				return nil, fmt.Errorf("document #%d: %w", len(result)+1, err)
+			}
+			documents++
+		default:
+			if fileTimestampErr != nil {
+				return nil, fileTimestampErr
+			}
+			dump.Timestamp = fileTimestamp
+			documents++
+		}
+
+		result = append(result, dump)
+	}
+
+	if documents > 1 && source != DumpTimestampSourceVarnishstat {
+		return nil, fmt.Errorf("%w: %d documents found", errAmbiguousTimestamp, documents)
+	}
+
+	return result, nil
+}
+
+// Loads and parses the document. The timestamp of the returned metrics is the
+// one of the dump.
+func (vd *VarnishstatDump) Load() (*VarnishMetrics, error) {
+	input, err := os.Open(vd.File)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer input.Close()
+
+	raw := make([]byte, vd.Length)
+	if _, err := input.ReadAt(raw, vd.Offset); err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	metrics, _, err := parseVarnishstatDump(bytes.TrimSpace(raw))
+	if err != nil {
+		return nil, err
+	}
+	metrics.Instance = vd.Instance
+	metrics.Timestamp = vd.Timestamp
+
+	return metrics, nil
+}
+
+// Parses a 'varnishstat -1 -j' document, which may be wrapped in a record
+// written by 'RawArchiveWriter'.
+func parseVarnishstatDump(raw []byte) (*VarnishMetrics, *RawArchiveRecord, error) {
+	var record RawArchiveRecord
+	if err := json.Unmarshal(raw, &record); err == nil && len(record.Output) > 0 {
+		metrics, err := ParseVarnishMetrics(record.Output)
+		if err != nil {
+			return nil, nil, err
+		}
+		return metrics, &record, nil
+	}
+
+	metrics, err := ParseVarnishMetrics(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	return metrics, nil, nil
+}
+
+// Extracts a timestamp from the base name of a file. Both date & times (e.g.,
+// 'varnishstat-20240131T235900.json', interpreted in the given location) and
+// epochs (e.g., 'varnishstat.1706745540.json') are supported.
+func ParseFilenameTimestamp(file string, loc *time.Location) (time.Time, error) {
+	name := filepath.Base(file)
+
+	if match := filenameDateTimeRegexp.FindStringSubmatch(name); match != nil {
+		result, err := time.ParseInLocation(
+			"20060102150405",
+			match[1]+match[2]+match[3]+match[4]+match[5]+match[6],
+			loc)
+		if err == nil {
+			return result, nil
+		}
+	}
+
+	if match := filenameEpochRegexp.FindStringSubmatch(name); match != nil {
+		if epoch, err := strconv.ParseInt(match[1], 10, 64); err == nil {
+			return time.Unix(epoch, 0), nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("%w: %q", errMissingFilenameTime, name)
+}
@@ -0,0 +1,103 @@
+package helpers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type DumpsTestSuite struct {
+	suite.Suite
+}
+
+func (suite *DumpsTestSuite) TestScanVarnishstatDumps() {
+	assert := suite.Require()
+
+	dumps, err := ScanVarnishstatDumps(
+		"testdata/dumps/varnishstat.ndjson", DumpTimestampSourceVarnishstat, time.UTC)
+	assert.NoError(err)
+	assert.Len(dumps, 2)
+	assert.Equal(time.Date(2025, 1, 15, 10, 21, 30, 0, time.UTC), dumps[0].Timestamp)
+	assert.Equal(time.Date(2025, 1, 15, 10, 20, 30, 0, time.UTC), dumps[1].Timestamp)
+
+	metrics, err := dumps[1].Load()
+	assert.NoError(err)
+	assert.Equal(1, metrics.Version)
+	assert.Equal(dumps[1].Timestamp, metrics.Timestamp)
+	assert.Equal(uint64(100), metrics.Items["MAIN.client_req"].Value)
+
+	// Several documents can't share the timestamp of the file.
+	_, err = ScanVarnishstatDumps(
+		"testdata/dumps/varnishstat.ndjson", DumpTimestampSourceMtime, time.UTC)
+	assert.ErrorIs(err, errAmbiguousTimestamp)
+
+	_, err = ScanVarnishstatDumps(
+		"testdata/dumps/varnishstat.ndjson", "foo", time.UTC)
+	assert.ErrorIs(err, errInvalidTimestampSource)
+}
+
+func (suite *DumpsTestSuite) TestScanVarnishstatDumpsVersion0() {
+	assert := suite.Require()
+
+	madrid, err := time.LoadLocation("Europe/Madrid")
+	assert.NoError(err)
+
+	for _, source := range []string{DumpTimestampSourceVarnishstat, DumpTimestampSourceFilename} {
+		dumps, err := ScanVarnishstatDumps(
+			"testdata/dumps/varnishstat-20250115T102230.json", source, madrid)
+		assert.NoError(err)
+		assert.Len(dumps, 1)
+		assert.Equal(time.Date(2025, 1, 15, 9, 22, 30, 0, time.UTC), dumps[0].Timestamp.UTC())
+
+		metrics, err := dumps[0].Load()
+		assert.NoError(err)
+		assert.Equal(0, metrics.Version)
+		assert.Equal(uint64(220), metrics.Items["MAIN.client_req"].Value)
+	}
+}
+
+func (suite *DumpsTestSuite) TestScanVarnishstatDumpsRawArchive() {
+	assert := suite.Require()
+
+	// Records use their own timestamps & instances, whatever the source.
+	for _, source := range []string{DumpTimestampSourceVarnishstat, DumpTimestampSourceFilename} {
+		dumps, err := ScanVarnishstatDumps("testdata/dumps/raw-archive.ndjson", source, time.UTC)
+		assert.NoError(err)
+		assert.Len(dumps, 2)
+		assert.Equal(time.Date(2025, 1, 15, 10, 20, 30, 500000000, time.UTC), dumps[0].Timestamp.UTC())
+		assert.Equal("varnish1", dumps[0].Instance)
+		assert.Equal("varnish2", dumps[1].Instance)
+
+		metrics, err := dumps[1].Load()
+		assert.NoError(err)
+		assert.Equal(0, metrics.Version)
+		assert.Equal("varnish2", metrics.Instance)
+		assert.Equal(uint64(7), metrics.Items["MAIN.client_req"].Value)
+	}
+}
+
+func (suite *DumpsTestSuite) TestParseFilenameTimestamp() {
+	assert := suite.Require()
+
+	for name, expected := range map[string]time.Time{
+		"varnishstat-20250115T102230.json":         time.Date(2025, 1, 15, 10, 22, 30, 0, time.UTC),
+		"/tmp/2025-01-15_10-22-30.json":            time.Date(2025, 1, 15, 10, 22, 30, 0, time.UTC),
+		"stats.2025-01-15 10:22:30":                time.Date(2025, 1, 15, 10, 22, 30, 0, time.UTC),
+		"varnishstat.1736936550.json":              time.Unix(1736936550, 0),
+		"/var/tmp/20250115/varnishstat.1736936550": time.Unix(1736936550, 0),
+	} {
+		result, err := ParseFilenameTimestamp(name, time.UTC)
+		assert.NoError(err, name)
+		assert.True(expected.Equal(result), name)
+	}
+
+	for _, name := range []string{"varnishstat.json", "varnishstat-20251399T999999.json", "12345.json"} {
+		_, err := ParseFilenameTimestamp(name, time.UTC)
+		assert.ErrorIs(err, errMissingFilenameTime, name)
+	}
+}
+
+func TestDumpsTestSuite(t *testing.T) {
+	suite.Run(t, new(DumpsTestSuite))
+}
@@ -0,0 +1,115 @@
+package helpers
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	errEmptyPattern = errors.New("empty pattern")
+)
+
+// MetricsFilter decides which 'varnishstat' metrics are kept, based on lists of
+// include & exclude patterns. Patterns are globs (e.g., 'MAIN.*', where '*'
+// matches any sequence of characters and '?' matches any single character),
+// unless enclosed in slashes (e.g., '/^(LCK|MEMPOOL)\./'), in which case they
+// are regular expressions. A metric is kept if it matches any of the include
+// patterns (or if there are no include patterns) and none of the exclude
+// patterns. A nil filter keeps everything.
+type MetricsFilter struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+func NewMetricsFilter(include, exclude []string) (*MetricsFilter, error) {
+	var err error
+	mf := &MetricsFilter{}
+
+	if mf.include, err = compileMetricsFilterPatterns(include); err != nil {
+		return nil, fmt.Errorf("invalid include pattern: %w", err)
+	}
+
+	if mf.exclude, err = compileMetricsFilterPatterns(exclude); err != nil {
+		return nil, fmt.Errorf("invalid exclude pattern: %w", err)
+	}
+
+	return mf, nil
+}
+
+func (mf *MetricsFilter) Match(name string) bool {
+	if mf == nil {
+		return true
+	}
+
+	if len(mf.include) > 0 && !matchAnyRegexp(mf.include, name) {
+		return false
+	}
+
+	return !matchAnyRegexp(mf.exclude, name)
+}
+
+// Removes metrics not matching the filter from the given set of metrics, and
+// returns the number of metrics removed.
+func (mf *MetricsFilter) Apply(metrics *VarnishMetrics) int {
+	if mf == nil || (len(mf.include) == 0 && len(mf.exclude) == 0) {
+		return 0
+	}
+
+	dropped := 0
+	for name := range metrics.Items {
+		if !mf.Match(name) {
+			delete(metrics.Items, name)
+			dropped++
+		}
+	}
+	return dropped
+}
+
+func compileMetricsFilterPatterns(patterns []string) ([]*regexp.Regexp, error) {
+	result := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		var expr string
+		if len(pattern) >= 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+			expr = pattern[1 : len(pattern)-1]
+		} else if pattern != "" {
+			expr = globToRegexp(pattern)
+		} else {
+			return nil, errEmptyPattern
+		}
+
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", pattern, err)
+		}
+		result = append(result, re)
+	}
+	return result, nil
+}
+
+func globToRegexp(glob string) string {
+	var sb strings.Builder
+	sb.WriteString("^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	sb.WriteString("$")
+	return sb.String()
+}
+
+func matchAnyRegexp(res []*regexp.Regexp, value string) bool {
+	for _, re := range res {
+		if re.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package helpers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type MetricsFilterTestSuite struct {
+	suite.Suite
+}
+
+func (suite *MetricsFilterTestSuite) TestNilFilter() {
+	assert := suite.Require()
+
+	var mf *MetricsFilter
+	assert.True(mf.Match("MAIN.uptime"))
+
+	metrics := &VarnishMetrics{Items: map[string]*VarnishMetricDetails{
+		"MAIN.uptime": {},
+	}}
+	assert.Equal(0, mf.Apply(metrics))
+	assert.Len(metrics.Items, 1)
+}
+
+func (suite *MetricsFilterTestSuite) TestGlobs() {
+	assert := suite.Require()
+
+	mf, err := NewMetricsFilter([]string{"MAIN.*", "LCK.*"}, []string{"LCK.sma.*", "MAIN.?ache_hit"})
+	assert.NoError(err)
+
+	assert.True(mf.Match("MAIN.uptime"))
+	assert.True(mf.Match("MAIN.cache_miss"))
+	assert.True(mf.Match("LCK.vbe.creat"))
+	assert.False(mf.Match("MAIN.cache_hit"))
+	assert.False(mf.Match("LCK.sma.creat"))
+	assert.False(mf.Match("MEMPOOL.req0.live"))
+	assert.False(mf.Match("XMAIN.uptime"))
+}
+
+func (suite *MetricsFilterTestSuite) TestRegexps() {
+	assert := suite.Require()
+
+	mf, err := NewMetricsFilter(nil, []string{`/^(LCK|MEMPOOL)\./`, `/\.happy$/`})
+	assert.NoError(err)
+
+	assert.True(mf.Match("MAIN.uptime"))
+	assert.True(mf.Match("VBE.boot.default.req"))
+	assert.False(mf.Match("LCK.vbe.creat"))
+	assert.False(mf.Match("MEMPOOL.req0.live"))
+	assert.False(mf.Match("VBE.boot.default.happy"))
+}
+
+func (suite *MetricsFilterTestSuite) TestApply() {
+	assert := suite.Require()
+
+	mf, err := NewMetricsFilter(nil, []string{"LCK.*", "MEMPOOL.*"})
+	assert.NoError(err)
+
+	metrics := &VarnishMetrics{Items: map[string]*VarnishMetricDetails{
+		"MAIN.uptime":       {},
+		"MAIN.client_req":   {},
+		"LCK.vbe.creat":     {},
+		"MEMPOOL.req0.live": {},
+	}}
+	assert.Equal(2, mf.Apply(metrics))
+	assert.Len(metrics.Items, 2)
+	assert.Contains(metrics.Items, "MAIN.uptime")
+	assert.Contains(metrics.Items, "MAIN.client_req")
+}
+
+func (suite *MetricsFilterTestSuite) TestInvalidPatterns() {
+	assert := suite.Require()
+
+	for _, patterns := range [][]string{{""}, {"/(/"}, {"MAIN.*", "/[a-/"}} {
+		_, err := NewMetricsFilter(patterns, nil)
+		assert.Error(err)
+
+		_, err = NewMetricsFilter(nil, patterns)
+		assert.Error(err)
+	}
+}
+
+func TestMetricsFilterTestSuite(t *testing.T) {
+	suite.Run(t, &MetricsFilterTestSuite{})
+}
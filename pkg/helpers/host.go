@@ -0,0 +1,580 @@
+package helpers
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Clock ticks per second used by the kernel to report CPU times in the
+	// '/proc' filesystem. Beware this is hardcoded: it can't be queried without
+	// cgo, and it's 100 in pretty much every Linux platform out there.
+	hostClockTicks = 100
+
+	// Name of the Varnish manager process. Beware the child process may use a
+	// different name (e.g., 'cache-main'), so it's identified by its parent.
+	varnishdProcessName = "varnishd"
+)
+
+var (
+	errInvalidProcFile = errors.New("invalid /proc file")
+)
+
+// HostMetricsCollector reads CPU, memory, swap, network, load and pressure
+// metrics of the host, as well as per-process metrics of the 'varnishd'
+// manager and child processes, from a '/proc' filesystem. Metrics are returned
+// using the same structure as the 'varnishstat' output, so they can be merged
+// with it and flow through the same pipeline.
+type HostMetricsCollector struct {
+	proc     string
+	pageSize uint64
+}
+
+func NewHostMetricsCollector(proc string) *HostMetricsCollector {
+	return &HostMetricsCollector{
+		proc:     proc,
+		pageSize: uint64(os.Getpagesize()), //nolint:gosec
+	}
+}
+
+// Collects all host metrics. Failures reading some source don't prevent the
+// rest of the metrics from being collected: whatever is available is always
+// returned, along with the errors found. Optional sources (e.g., pressure
+// stall information, not available in old kernels) are silently ignored if
+// missing.
+func (hmc *HostMetricsCollector) Collect() (map[string]*VarnishMetricDetails, error) {
+	items := make(map[string]*VarnishMetricDetails)
+	errs := make([]error, 0)
+
+	for _, collect := range []func(map[string]*VarnishMetricDetails) error{
+		hmc.collectStat,
+		hmc.collectMeminfo,
+		hmc.collectNetDev,
+		hmc.collectLoadavg,
+	} {
+		if err := collect(items); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, collect := range []func(map[string]*VarnishMetricDetails) error{
+		hmc.collectVmstat,
+		hmc.collectPressure,
+		hmc.collectVarnishdProcesses,
+	} {
+		if err := collect(items); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+
+	return items, errors.Join(errs...)
+}
+
+func (hmc *HostMetricsCollector) collectStat(items map[string]*VarnishMetricDetails) error {
+	path := filepath.Join(hmc.proc, "stat")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	cpus := uint64(0)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		switch {
+		case fields[0] == "cpu":
+			// Aggregated CPU times, in clock ticks. Older kernels report less
+			// fields.
+			for i, name := range []string{
+				"user", "nice", "system", "idle", "iowait",
+				"irq", "softirq", "steal", "guest", "guest_nice",
+			} {
+				if i+1 >= len(fields) {
+					break
+				}
+				value, err := strconv.ParseUint(fields[i+1], 10, 64)
+				if err != nil {
+					return fmt.Errorf("%w: %s: %w", errInvalidProcFile, path, err)
+				}
+				items["CPU.time."+name] = &VarnishMetricDetails{
+					Description: fmt.Sprintf("CPU time spent in '%s' mode, in milliseconds", name),
+					Flag:        "c",
+					Format:      "i",
+					Value:       value * 1000 / hostClockTicks,
+				}
+			}
+		case strings.HasPrefix(fields[0], "cpu"):
+			cpus++
+		case fields[0] == "ctxt":
+			if err := hmc.setUint(items, path, "CPU.context_switches",
+				"Context switches", "c", "i", fields[1]); err != nil {
+				return err
+			}
+		case fields[0] == "processes":
+			if err := hmc.setUint(items, path, "CPU.forks",
+				"Processes and threads created", "c", "i", fields[1]); err != nil {
+				return err
+			}
+		case fields[0] == "procs_running":
+			if err := hmc.setUint(items, path, "CPU.procs_running",
+				"Processes in runnable state", "g", "i", fields[1]); err != nil {
+				return err
+			}
+		case fields[0] == "procs_blocked":
+			if err := hmc.setUint(items, path, "CPU.procs_blocked",
+				"Processes blocked waiting for I/O", "g", "i", fields[1]); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, ok := items["CPU.time.user"]; !ok {
+		return fmt.Errorf("%w: %s: missing 'cpu' line", errInvalidProcFile, path)
+	}
+
+	items["CPU.count"] = &VarnishMetricDetails{
+		Description: "Number of CPUs",
+		Flag:        "g",
+		Format:      "i",
+		Value:       cpus,
+	}
+
+	return nil
+}
+
+func (hmc *HostMetricsCollector) collectMeminfo(items map[string]*VarnishMetricDetails) error {
+	path := filepath.Join(hmc.proc, "meminfo")
+	values, err := hmc.readKeyValueFile(path, ":")
+	if err != nil {
+		return err
+	}
+
+	// All values are reported in kB.
+	get := func(key string) uint64 {
+		return values[key] * 1024
+	}
+	if _, ok := values["MemTotal"]; !ok {
+		return fmt.Errorf("%w: %s: missing 'MemTotal' field", errInvalidProcFile, path)
+	}
+
+	// Memory. 'used' is calculated as 'psutil' does.
+	total := get("MemTotal")
+	free := get("MemFree")
+	available := get("MemAvailable")
+	used := total - free
+	if cachedAndBuffers := get("Buffers") + get("Cached"); cachedAndBuffers < used {
+		used -= cachedAndBuffers
+	}
+	percent := uint64(0)
+	if total > 0 && available <= total {
+		percent = (total - available) * 100 / total
+	}
+	for name, value := range map[string]uint64{
+		"total":     total,
+		"available": available,
+		"used":      used,
+		"free":      free,
+		"active":    get("Active"),
+		"inactive":  get("Inactive"),
+		"buffers":   get("Buffers"),
+		"cached":    get("Cached"),
+		"shared":    get("Shmem"),
+		"slab":      get("Slab"),
+		"dirty":     get("Dirty"),
+	} {
+		items["MEMORY."+name] = &VarnishMetricDetails{
+			Description: fmt.Sprintf("Memory: %s", name),
+			Flag:        "g",
+			Format:      "B",
+			Value:       value,
+		}
+	}
+	items["MEMORY.percent"] = &VarnishMetricDetails{
+		Description: "Memory: percentage of memory not available",
+		Flag:        "g",
+		Format:      "i",
+		Value:       percent,
+	}
+
+	// Swap.
+	swapTotal := get("SwapTotal")
+	swapFree := min(get("SwapFree"), swapTotal)
+	swapPercent := uint64(0)
+	if swapTotal > 0 {
+		swapPercent = (swapTotal - swapFree) * 100 / swapTotal
+	}
+	for name, value := range map[string]uint64{
+		"total": swapTotal,
+		"used":  swapTotal - swapFree,
+		"free":  swapFree,
+	} {
+		items["SWAP."+name] = &VarnishMetricDetails{
+			Description: fmt.Sprintf("Swap: %s", name),
+			Flag:        "g",
+			Format:      "B",
+			Value:       value,
+		}
+	}
+	items["SWAP.percent"] = &VarnishMetricDetails{
+		Description: "Swap: percentage of swap used",
+		Flag:        "g",
+		Format:      "i",
+		Value:       swapPercent,
+	}
+
+	return nil
+}
+
+func (hmc *HostMetricsCollector) collectVmstat(items map[string]*VarnishMetricDetails) error {
+	values, err := hmc.readKeyValueFile(filepath.Join(hmc.proc, "vmstat"), " ")
+	if err != nil {
+		return err
+	}
+
+	// Pages swapped in / out since boot.
+	for name, field := range map[string]struct {
+		key         string
+		description string
+	}{
+		"sin":  {"pswpin", "Swap: bytes swapped in from disk"},
+		"sout": {"pswpout", "Swap: bytes swapped out to disk"},
+	} {
+		if value, ok := values[field.key]; ok {
+			items["SWAP."+name] = &VarnishMetricDetails{
+				Description: field.description,
+				Flag:        "c",
+				Format:      "B",
+				Value:       value * hmc.pageSize,
+			}
+		}
+	}
+
+	return nil
+}
+
+func (hmc *HostMetricsCollector) collectNetDev(items map[string]*VarnishMetricDetails) error {
+	path := filepath.Join(hmc.proc, "net", "dev")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// Skip the two header lines. Every other line looks like
+	// '<nic>: <8 receive fields> <8 transmit fields>'.
+	names := map[int]string{
+		0:  "bytes_recv",
+		1:  "packets_recv",
+		2:  "errin",
+		3:  "dropin",
+		8:  "bytes_sent",
+		9:  "packets_sent",
+		10: "errout",
+		11: "dropout",
+	}
+	lines := strings.Split(string(data), "\n")
+	for _, line := range lines[min(2, len(lines)):] {
+		nic, counters, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		nic = strings.TrimSpace(nic)
+		fields := strings.Fields(counters)
+		if len(fields) < 16 {
+			return fmt.Errorf("%w: %s: unexpected number of fields for '%s'", errInvalidProcFile, path, nic)
+		}
+		for i, name := range names {
+			format := "i"
+			if strings.HasPrefix(name, "bytes") {
+				format = "B"
+			}
+			if err := hmc.setUint(items, path, fmt.Sprintf("NET.%s.%s", nic, name),
+				fmt.Sprintf("Network interface '%s': %s", nic, name),
+				"c", format, fields[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (hmc *HostMetricsCollector) collectLoadavg(items map[string]*VarnishMetricDetails) error {
+	path := filepath.Join(hmc.proc, "loadavg")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// Looks like '0.52 0.58 0.59 2/1234 5678'. Load averages are stored in
+	// thousandths, given only integer values are supported.
+	fields := strings.Fields(string(data))
+	if len(fields) < 4 {
+		return fmt.Errorf("%w: %s: unexpected number of fields", errInvalidProcFile, path)
+	}
+	for i, name := range []string{"avg1", "avg5", "avg15"} {
+		value, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil || value < 0 {
+			return fmt.Errorf("%w: %s: invalid load average '%s'", errInvalidProcFile, path, fields[i])
+		}
+		items["LOAD."+name] = &VarnishMetricDetails{
+			Description: fmt.Sprintf("Load average (%s), in thousandths", strings.TrimPrefix(name, "avg")+"m"),
+			Flag:        "g",
+			Format:      "i",
+			Value:       uint64(value * 1000),
+		}
+	}
+	running, total, found := strings.Cut(fields[3], "/")
+	if !found {
+		return fmt.Errorf("%w: %s: invalid tasks field '%s'", errInvalidProcFile, path, fields[3])
+	}
+	if err := hmc.setUint(items, path, "LOAD.tasks_running",
+		"Tasks in runnable state", "g", "i", running); err != nil {
+		return err
+	}
+	if err := hmc.setUint(items, path, "LOAD.tasks_total",
+		"Tasks", "g", "i", total); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (hmc *HostMetricsCollector) collectPressure(items map[string]*VarnishMetricDetails) error {
+	// Pressure stall information. Each file looks like:
+	//   some avg10=0.00 avg60=0.00 avg300=0.00 total=12345
+	//   full avg10=0.00 avg60=0.00 avg300=0.00 total=6789
+	// Only the 'total' fields (stall time, in microseconds) are collected;
+	// averages can be derived from them.
+	errs := make([]error, 0)
+	for _, resource := range []string{"cpu", "memory", "io", "irq"} {
+		path := filepath.Join(hmc.proc, "pressure", resource)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			for _, field := range fields[1:] {
+				if value, found := strings.CutPrefix(field, "total="); found {
+					if err := hmc.setUint(items, path, fmt.Sprintf("PRESSURE.%s.%s", resource, fields[0]),
+						fmt.Sprintf("Stall time ('%s') due to lack of %s, in microseconds", fields[0], resource),
+						"c", "i", value); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (hmc *HostMetricsCollector) collectVarnishdProcesses(items map[string]*VarnishMetricDetails) error {
+	entries, err := os.ReadDir(hmc.proc)
+	if err != nil {
+		return err
+	}
+
+	// Read the stats of all processes. Processes may terminate at any moment,
+	// so errors are ignored here.
+	processes := make(map[uint64]*processStat)
+	for _, entry := range entries {
+		pid, err := strconv.ParseUint(entry.Name(), 10, 64)
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		if stat, err := hmc.readProcessStat(filepath.Join(hmc.proc, entry.Name(), "stat")); err == nil {
+			processes[pid] = stat
+		}
+	}
+
+	// Managers are 'varnishd' processes not started by another 'varnishd'
+	// process. Children are processes started by a manager. If several
+	// Varnish instances are running, their stats are aggregated.
+	isManager := func(stat *processStat) bool {
+		if stat.comm != varnishdProcessName {
+			return false
+		}
+		parent, ok := processes[stat.ppid]
+		return !ok || parent.comm != varnishdProcessName
+	}
+	aggregated := map[string]*processStat{
+		"manager": {},
+		"child":   {},
+	}
+	counts := map[string]uint64{}
+	for _, stat := range processes {
+		var role string
+		if isManager(stat) {
+			role = "manager"
+		} else if parent, ok := processes[stat.ppid]; ok && isManager(parent) {
+			role = "child"
+		} else {
+			continue
+		}
+		counts[role]++
+		aggregated[role].utime += stat.utime
+		aggregated[role].stime += stat.stime
+		aggregated[role].threads += stat.threads
+		aggregated[role].vsize += stat.vsize
+		aggregated[role].rss += stat.rss
+	}
+
+	for role, stat := range aggregated {
+		prefix := fmt.Sprintf("PROCESS.varnishd.%s.", role)
+		items[prefix+"count"] = &VarnishMetricDetails{
+			Description: fmt.Sprintf("Running 'varnishd' %s processes", role),
+			Flag:        "g",
+			Format:      "i",
+			Value:       counts[role],
+		}
+		if counts[role] == 0 {
+			continue
+		}
+		for name, details := range map[string]*VarnishMetricDetails{
+			"cpu_user": {
+				Description: fmt.Sprintf("CPU time of the 'varnishd' %s process spent in user mode, in milliseconds", role),
+				Flag:        "c",
+				Format:      "i",
+				Value:       stat.utime * 1000 / hostClockTicks,
+			},
+			"cpu_system": {
+				Description: fmt.Sprintf("CPU time of the 'varnishd' %s process spent in kernel mode, in milliseconds", role),
+				Flag:        "c",
+				Format:      "i",
+				Value:       stat.stime * 1000 / hostClockTicks,
+			},
+			"threads": {
+				Description: fmt.Sprintf("Threads of the 'varnishd' %s process", role),
+				Flag:        "g",
+				Format:      "i",
+				Value:       stat.threads,
+			},
+			"vsize": {
+				Description: fmt.Sprintf("Virtual memory size of the 'varnishd' %s process", role),
+				Flag:        "g",
+				Format:      "B",
+				Value:       stat.vsize,
+			},
+			"rss": {
+				Description: fmt.Sprintf("Resident set size of the 'varnishd' %s process", role),
+				Flag:        "g",
+				Format:      "B",
+				Value:       stat.rss * hmc.pageSize,
+			},
+		} {
+			items[prefix+name] = details
+		}
+	}
+
+	return nil
+}
+
+type processStat struct {
+	comm    string
+	ppid    uint64
+	utime   uint64
+	stime   uint64
+	threads uint64
+	vsize   uint64
+	rss     uint64
+}
+
+func (hmc *HostMetricsCollector) readProcessStat(path string) (*processStat, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// The command name is enclosed in parentheses and may contain spaces and
+	// parentheses itself, so the last closing parenthesis is searched. See
+	// 'man 5 proc' for the meaning of the rest of the fields.
+	start := bytes.IndexByte(data, '(')
+	end := bytes.LastIndexByte(data, ')')
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("%w: %s: missing command name", errInvalidProcFile, path)
+	}
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 22 {
+		return nil, fmt.Errorf("%w: %s: unexpected number of fields", errInvalidProcFile, path)
+	}
+
+	stat := &processStat{
+		comm: string(data[start+1 : end]),
+	}
+	for i, value := range map[int]*uint64{
+		1:  &stat.ppid,
+		11: &stat.utime,
+		12: &stat.stime,
+		17: &stat.threads,
+		20: &stat.vsize,
+		21: &stat.rss,
+	} {
+		if *value, err = strconv.ParseUint(fields[i], 10, 64); err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", errInvalidProcFile, path, err)
+		}
+	}
+
+	return stat, nil
+}
+
+// Reads files such as '/proc/meminfo' or '/proc/vmstat', where every line
+// includes a key, a separator, a numeric value and an optional unit. Lines
+// with unexpected values are ignored.
+func (hmc *HostMetricsCollector) readKeyValueFile(path, separator string) (map[string]uint64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	values := make(map[string]uint64)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		key, rest, found := strings.Cut(scanner.Text(), separator)
+		if !found {
+			continue
+		}
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			continue
+		}
+		if value, err := strconv.ParseUint(fields[0], 10, 64); err == nil {
+			values[strings.TrimSpace(key)] = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return values, nil
+}
+
+func (hmc *HostMetricsCollector) setUint(
+	items map[string]*VarnishMetricDetails, path, name, description, flag, format, raw string) error {
+	value, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", errInvalidProcFile, path, err)
+	}
+	items[name] = &VarnishMetricDetails{
+		Description: description,
+		Flag:        flag,
+		Format:      format,
+		Value:       value,
+	}
+	return nil
+}
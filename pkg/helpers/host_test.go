@@ -0,0 +1,113 @@
+package helpers
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type HostMetricsCollectorTestSuite struct {
+	suite.Suite
+}
+
+func (suite *HostMetricsCollectorTestSuite) TestCollect() {
+	assert := suite.Require()
+
+	hmc := NewHostMetricsCollector("testdata/proc")
+	items, err := hmc.Collect()
+	assert.NoError(err)
+
+	pageSize := uint64(os.Getpagesize()) //nolint:gosec
+	for name, expected := range map[string]struct {
+		flag   string
+		format string
+		value  uint64
+	}{
+		"CPU.time.user":                       {"c", "i", 100000},
+		"CPU.time.idle":                       {"c", "i", 5000000},
+		"CPU.time.guest_nice":                 {"c", "i", 0},
+		"CPU.count":                           {"g", "i", 2},
+		"CPU.context_switches":                {"c", "i", 987654},
+		"CPU.forks":                           {"c", "i", 4321},
+		"CPU.procs_running":                   {"g", "i", 3},
+		"CPU.procs_blocked":                   {"g", "i", 1},
+		"MEMORY.total":                        {"g", "B", 8000000 * 1024},
+		"MEMORY.available":                    {"g", "B", 5000000 * 1024},
+		"MEMORY.used":                         {"g", "B", 3500000 * 1024},
+		"MEMORY.shared":                       {"g", "B", 200000 * 1024},
+		"MEMORY.percent":                      {"g", "i", 37},
+		"SWAP.total":                          {"g", "B", 2000000 * 1024},
+		"SWAP.used":                           {"g", "B", 500000 * 1024},
+		"SWAP.percent":                        {"g", "i", 25},
+		"SWAP.sin":                            {"c", "B", 10 * pageSize},
+		"SWAP.sout":                           {"c", "B", 20 * pageSize},
+		"NET.lo.bytes_recv":                   {"c", "B", 1000},
+		"NET.eth0.bytes_recv":                 {"c", "B", 5000000},
+		"NET.eth0.packets_recv":               {"c", "i", 4000},
+		"NET.eth0.errin":                      {"c", "i", 1},
+		"NET.eth0.dropin":                     {"c", "i", 2},
+		"NET.eth0.bytes_sent":                 {"c", "B", 9000000},
+		"NET.eth0.packets_sent":               {"c", "i", 6000},
+		"NET.eth0.errout":                     {"c", "i", 3},
+		"NET.eth0.dropout":                    {"c", "i", 4},
+		"LOAD.avg1":                           {"g", "i", 520},
+		"LOAD.avg5":                           {"g", "i", 1250},
+		"LOAD.avg15":                          {"g", "i", 50},
+		"LOAD.tasks_running":                  {"g", "i", 2},
+		"LOAD.tasks_total":                    {"g", "i", 345},
+		"PRESSURE.cpu.some":                   {"c", "i", 1000},
+		"PRESSURE.io.full":                    {"c", "i", 1500},
+		"PROCESS.varnishd.manager.count":      {"g", "i", 1},
+		"PROCESS.varnishd.manager.cpu_user":   {"c", "i", 1000},
+		"PROCESS.varnishd.manager.threads":    {"g", "i", 2},
+		"PROCESS.varnishd.child.count":        {"g", "i", 1},
+		"PROCESS.varnishd.child.cpu_user":     {"c", "i", 30000},
+		"PROCESS.varnishd.child.cpu_system":   {"c", "i", 15000},
+		"PROCESS.varnishd.child.threads":      {"g", "i", 250},
+		"PROCESS.varnishd.child.vsize":        {"g", "B", 900000000},
+		"PROCESS.varnishd.child.rss":          {"g", "B", 50000 * pageSize},
+		"PROCESS.varnishd.manager.cpu_system": {"c", "i", 2000},
+	} {
+		item, ok := items[name]
+		assert.True(ok, name)
+		assert.Equal(expected.flag, item.Flag, name)
+		assert.Equal(expected.format, item.Format, name)
+		assert.Equal(expected.value, item.Value, name)
+		assert.NotEmpty(item.Description, name)
+	}
+
+	// Missing optional sources (e.g., '/proc/pressure/memory') are ignored.
+	assert.NotContains(items, "PRESSURE.memory.some")
+}
+
+func (suite *HostMetricsCollectorTestSuite) TestCollectWithMissingSources() {
+	assert := suite.Require()
+
+	// Only '/proc/loadavg' is available.
+	proc := suite.T().TempDir()
+	assert.NoError(os.WriteFile(filepath.Join(proc, "loadavg"), []byte("0.00 0.00 0.00 1/1 1\n"), 0o600))
+
+	hmc := NewHostMetricsCollector(proc)
+	items, err := hmc.Collect()
+	assert.ErrorIs(err, os.ErrNotExist)
+	assert.Contains(items, "LOAD.avg1")
+	assert.Equal(uint64(0), items["PROCESS.varnishd.manager.count"].Value)
+	assert.NotContains(items, "PROCESS.varnishd.manager.rss")
+}
+
+func (suite *HostMetricsCollectorTestSuite) TestCollectWithInvalidSources() {
+	assert := suite.Require()
+
+	proc := suite.T().TempDir()
+	assert.NoError(os.WriteFile(filepath.Join(proc, "loadavg"), []byte("whatever\n"), 0o600))
+
+	hmc := NewHostMetricsCollector(proc)
+	_, err := hmc.Collect()
+	assert.ErrorIs(err, errInvalidProcFile)
+}
+
+func TestHostMetricsCollectorTestSuite(t *testing.T) {
+	suite.Run(t, &HostMetricsCollectorTestSuite{})
+}
@@ -0,0 +1,311 @@
+package helpers
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression algorithms supported by 'RawArchiveWriter'.
+const (
+	RawArchiveCompressionGzip = "gzip"
+	RawArchiveCompressionZstd = "zstd"
+)
+
+var (
+	errInvalidCompression = errors.New("invalid compression algorithm")
+)
+
+// RawArchiveRecord is a 'varnishstat -1 -j' output, as-is, together with the
+// timestamp and the instance it was stored with. Records are written as
+// newline-delimited JSON.
+type RawArchiveRecord struct {
+	Timestamp time.Time       `json:"timestamp"`
+	Instance  string          `json:"instance"`
+	Output    json.RawMessage `json:"output"`
+}
+
+// RawArchiveWriter writes records to a compressed file. The file is rotated
+// once its size exceeds a limit (e.g., 'foo.ndjson.zst' is renamed to
+// 'foo.ndjson.zst.1', 'foo.ndjson.zst.1' to 'foo.ndjson.zst.2', etc.), and it
+// can be reopened (e.g., after being moved away by 'logrotate'). Every time
+// the file is opened a new gzip member / zstd frame is started; concatenated
+// members / frames are valid streams, so appending to an existing file is
+// fine. The compressor is flushed after every record, so the file is always
+// readable (maybe missing the trailer) even if the process is killed.
+type RawArchiveWriter struct {
+	name        string
+	mode        os.FileMode
+	compression string
+	maxSize     int64
+	maxFiles    int
+	mutex       sync.Mutex
+	file        *os.File
+	encoder     rawArchiveEncoder
+	size        int64
+}
+
+type rawArchiveEncoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+func NewRawArchiveWriter(
+	name string, mode os.FileMode, compression string,
+	maxSize int64, maxFiles int) (*RawArchiveWriter, error) {
+	if compression != RawArchiveCompressionGzip && compression != RawArchiveCompressionZstd {
+		return nil, fmt.Errorf("%w: %q", errInvalidCompression, compression)
+	}
+
+	writer := &RawArchiveWriter{
+		name:        name,
+		mode:        mode,
+		compression: compression,
+		maxSize:     maxSize,
+		maxFiles:    maxFiles,
+	}
+	if err := writer.unsafeReopen(); err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
+func (rw *RawArchiveWriter) Write(record *RawArchiveRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode record: %w", err)
+	}
+	line = append(line, '\n')
+
+	rw.mutex.Lock()
+	defer rw.mutex.Unlock()
+
+	if rw.encoder == nil {
+		if err := rw.unsafeReopen(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := rw.encoder.Write(line); err != nil {
+		return fmt.Errorf("failed to write underlying file: %w", err)
+	}
+	if err := rw.encoder.Flush(); err != nil {
+		return fmt.Errorf("failed to flush underlying file: %w", err)
+	}
+
+	if rw.size >= rw.maxSize {
+		if err := rw.unsafeRotate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (rw *RawArchiveWriter) Reopen() error {
+	rw.mutex.Lock()
+	defer rw.mutex.Unlock()
+	return rw.unsafeReopen()
+}
+
+func (rw *RawArchiveWriter) Close() error {
+	rw.mutex.Lock()
+	defer rw.mutex.Unlock()
+	return rw.unsafeClose()
+}
+
+func (rw *RawArchiveWriter) unsafeClose() error {
+	if rw.encoder == nil {
+		return nil
+	}
+
+	err := rw.encoder.Close()
+	if closeErr := rw.file.Close(); err == nil {
+		err = closeErr
+	}
+	rw.encoder = nil
+	rw.file = nil
+	if err != nil {
+		return fmt.Errorf("failed to close underlying file: %w", err)
+	}
+	return nil
+}
+
+func (rw *RawArchiveWriter) unsafeReopen() error {
+	// Close previous file? Failures are ignored: the new file is opened
+	// anyway.
+	rw.unsafeClose() //nolint:errcheck
+
+	// Open new file.
+	file, err := os.OpenFile(rw.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, rw.mode) //nolint:nosnakecase
+	if err != nil {
+		return fmt.Errorf("failed to open underlying file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat underlying file: %w", err)
+	}
+	rw.size = info.Size()
+
+	// Wrap it with a compressor. Compressed bytes are counted in order to
+	// decide when to rotate the file.
+	counter := &rawArchiveCounter{writer: file, size: &rw.size}
+	switch rw.compression {
+	case RawArchiveCompressionGzip:
+		rw.encoder = gzip.NewWriter(counter)
+	case RawArchiveCompressionZstd:
+		encoder, err := zstd.NewWriter(counter)
+		if err != nil {
+			file.Close()
+			return fmt.Errorf("failed to initialize compressor: %w", err)
+		}
+		rw.encoder = encoder
+	}
+	rw.file = file
+
+	// Done!
+	return nil
+}
+
+func (rw *RawArchiveWriter) unsafeRotate() error {
+	if err := rw.unsafeClose(); err != nil {
+		return err
+	}
+
+	// Shift rotated files, discarding the oldest one.
+	for i := rw.maxFiles; i > 0; i-- {
+		source := rw.name
+		if i > 1 {
+			source = fmt.Sprintf("%s.%d", rw.name, i-1)
+		}
+		if err := os.Rename(source, fmt.Sprintf("%s.%d", rw.name, i)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to rotate underlying file: %w", err)
+		}
+	}
+	if rw.maxFiles == 0 {
+		if err := os.Remove(rw.name); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to rotate underlying file: %w", err)
+		}
+	}
+
+	return rw.unsafeReopen()
+}
+
+type rawArchiveCounter struct {
+	writer io.Writer
+	size   *int64
+}
+
+func (rc *rawArchiveCounter) Write(p []byte) (int, error) {
+	n, err := rc.writer.Write(p)
+	*rc.size += int64(n)
+	return n, err //nolint:wrapcheck
+}
+
+// Decompresses a gzip or zstd file, depending on its extension (i.e., '.gz' or
+// '.zst', maybe followed by the suffix of a rotated file, like '.gz.1'), into
+// a new file, preserving the modification time. Returns false if the file is
+// not compressed.
+func DecompressFile(source, destination string) (bool, error) {
+	input, err := os.Open(source)
+	if err != nil {
+		return false, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer input.Close()
+
+	extension := filepath.Ext(source)
+	if _, err := strconv.Atoi(strings.TrimPrefix(extension, ".")); err == nil {
+		extension = filepath.Ext(strings.TrimSuffix(source, extension))
+	}
+
+	var reader io.Reader
+	switch extension {
+	case ".gz":
+		decoder, err := gzip.NewReader(input)
+		if err != nil {
+			return false, fmt.Errorf("failed to initialize decompressor: %w", err)
+		}
+		defer decoder.Close()
+		reader = decoder
+	case ".zst":
+		decoder, err := zstd.NewReader(input)
+		if err != nil {
+			return false, fmt.Errorf("failed to initialize decompressor: %w", err)
+		}
+		defer decoder.Close()
+		reader = decoder
+	default:
+		return false, nil
+	}
+
+	output, err := os.Create(destination)
+	if err != nil {
+		return false, fmt.Errorf("failed to create file: %w", err)
+	}
+
+	// Files written by 'RawArchiveWriter' may be truncated if the process was
+	// killed, so whatever was decompressed before an unexpected end of file
+	// is kept.
+	if _, err := io.Copy(output, reader); err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		output.Close()
+		return false, fmt.Errorf("failed to decompress file: %w", err)
+	}
+	if err := output.Close(); err != nil {
+		return false, fmt.Errorf("failed to close file: %w", err)
+	}
+
+	if info, err := input.Stat(); err == nil {
+		if err := os.Chtimes(destination, info.ModTime(), info.ModTime()); err != nil {
+			return false, fmt.Errorf("failed to update modification time: %w", err)
+		}
+	}
+
+	return true, nil
+}
+
+// Compresses a file using gzip into a new file, preserving the modification
+// time. The source file is left untouched.
+func CompressFile(source, destination string) error {
+	input, err := os.Open(source)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer input.Close()
+
+	output, err := os.Create(destination)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+
+	encoder := gzip.NewWriter(output)
+	if _, err := io.Copy(encoder, input); err != nil {
+		output.Close()
+		return fmt.Errorf("failed to compress file: %w", err)
+	}
+	if err := encoder.Close(); err != nil {
+		output.Close()
+		return fmt.Errorf("failed to close compressor: %w", err)
+	}
+	if err := output.Close(); err != nil {
+		return fmt.Errorf("failed to close file: %w", err)
+	}
+
+	if info, err := input.Stat(); err == nil {
+		if err := os.Chtimes(destination, info.ModTime(), info.ModTime()); err != nil {
+			return fmt.Errorf("failed to update modification time: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,127 @@
+package helpers
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type RawArchiveWriterTestSuite struct {
+	suite.Suite
+	tmpDir string
+}
+
+func (suite *RawArchiveWriterTestSuite) readRecords(name string) []*RawArchiveRecord {
+	assert := suite.Require()
+
+	decompressed := name + ".ndjson"
+	ok, err := DecompressFile(name, decompressed)
+	assert.NoError(err)
+	assert.True(ok)
+	defer os.Remove(decompressed)
+
+	file, err := os.Open(decompressed)
+	assert.NoError(err)
+	defer file.Close()
+
+	result := make([]*RawArchiveRecord, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record RawArchiveRecord
+		assert.NoError(json.Unmarshal(scanner.Bytes(), &record))
+		result = append(result, &record)
+	}
+	assert.NoError(scanner.Err())
+	return result
+}
+
+func (suite *RawArchiveWriterTestSuite) TestWriteAndReopen() {
+	assert := suite.Require()
+
+	for _, item := range []struct {
+		compression, extension string
+	}{
+		{RawArchiveCompressionGzip, ".gz"},
+		{RawArchiveCompressionZstd, ".zst"},
+	} {
+		name := filepath.Join(suite.tmpDir, "reopen.ndjson"+item.extension)
+		writer, err := NewRawArchiveWriter(name, 0640, item.compression, 1024*1024, 1)
+		assert.NoError(err)
+
+		timestamp := time.Date(2025, 1, 15, 10, 20, 30, 0, time.UTC)
+		assert.NoError(writer.Write(&RawArchiveRecord{
+			Timestamp: timestamp,
+			Instance:  "varnish1",
+			Output:    json.RawMessage(`{"version": 1, "counters": {}}`),
+		}))
+
+		// Reopening starts a new member / frame in the same file.
+		assert.NoError(writer.Reopen())
+		assert.NoError(writer.Write(&RawArchiveRecord{
+			Timestamp: timestamp.Add(time.Minute),
+			Instance:  "varnish2",
+			Output:    json.RawMessage(`{"version": 1, "counters": {}}`),
+		}))
+
+		// Records can be read even before the file is closed.
+		records := suite.readRecords(name)
+		assert.Len(records, 2)
+		assert.NoError(writer.Close())
+
+		records = suite.readRecords(name)
+		assert.Len(records, 2, item.compression)
+		assert.True(timestamp.Equal(records[0].Timestamp))
+		assert.Equal("varnish1", records[0].Instance)
+		assert.JSONEq(`{"version": 1, "counters": {}}`, string(records[0].Output))
+		assert.Equal("varnish2", records[1].Instance)
+	}
+}
+
+func (suite *RawArchiveWriterTestSuite) TestRotate() {
+	assert := suite.Require()
+
+	name := filepath.Join(suite.tmpDir, "rotate.ndjson.gz")
+	writer, err := NewRawArchiveWriter(name, 0640, RawArchiveCompressionGzip, 1, 2)
+	assert.NoError(err)
+
+	// Every record exceeds the maximum size, so the file is rotated after
+	// every write, and only the last two rotated files are kept.
+	for i := range 4 {
+		assert.NoError(writer.Write(&RawArchiveRecord{
+			Timestamp: time.Unix(int64(i), 0),
+			Output:    json.RawMessage(fmt.Sprintf(`{"id": %d}`, i)),
+		}))
+	}
+	assert.NoError(writer.Close())
+
+	for i, expected := range map[int]string{1: `{"id": 3}`, 2: `{"id": 2}`} {
+		records := suite.readRecords(fmt.Sprintf("%s.%d", name, i))
+		assert.Len(records, 1)
+		assert.JSONEq(expected, string(records[0].Output))
+	}
+	_, err = os.Stat(name + ".3")
+	assert.True(os.IsNotExist(err))
+}
+
+func (suite *RawArchiveWriterTestSuite) TestInvalidCompression() {
+	assert := suite.Require()
+
+	_, err := NewRawArchiveWriter(filepath.Join(suite.tmpDir, "foo"), 0640, "lz4", 1, 1)
+	assert.ErrorIs(err, errInvalidCompression)
+
+	ok, err := DecompressFile("testdata/varnishlog.log", filepath.Join(suite.tmpDir, "foo"))
+	assert.NoError(err)
+	assert.False(ok)
+}
+
+func TestRawArchiveWriterTestSuite(t *testing.T) {
+	suite.Run(t, &RawArchiveWriterTestSuite{
+		tmpDir: t.TempDir(),
+	})
+}
@@ -0,0 +1,211 @@
+package helpers
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrSpoolFull = errors.New("spool is full")
+)
+
+const spoolExtension = ".spool"
+
+// Spool is a FIFO queue of opaque entries persisted in a directory, one file
+// per entry. Entries survive restarts: existing files are loaded when the
+// spool is created. Files are named after a sequence number and the timestamp
+// of the entry, so the order and the age of entries are known without reading
+// them. Entries are written to a temporary file first and then renamed, so
+// partially written entries are never loaded. Safe for concurrent use.
+type Spool struct {
+	directory string
+	mode      os.FileMode
+	maxSize   int64
+	mutex     sync.Mutex
+	entries   []*spoolEntry
+	size      int64
+	sequence  uint64
+}
+
+type spoolEntry struct {
+	name      string
+	timestamp time.Time
+	size      int64
+}
+
+func NewSpool(directory string, mode os.FileMode, maxSize int64) (*Spool, error) {
+	if err := os.MkdirAll(directory, 0750); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+
+	spool := &Spool{
+		directory: directory,
+		mode:      mode,
+		maxSize:   maxSize,
+		entries:   make([]*spoolEntry, 0),
+	}
+
+	files, err := os.ReadDir(directory)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spool directory: %w", err)
+	}
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+
+		// Remove leftovers of interrupted writes.
+		if strings.HasSuffix(file.Name(), spoolExtension+".tmp") {
+			if err := os.Remove(filepath.Join(directory, file.Name())); err != nil {
+				return nil, fmt.Errorf("failed to remove spool leftover: %w", err)
+			}
+			continue
+		}
+
+		sequence, timestamp, ok := parseSpoolName(file.Name())
+		if !ok {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat spool entry: %w", err)
+		}
+		spool.entries = append(spool.entries, &spoolEntry{
+			name:      file.Name(),
+			timestamp: timestamp,
+			size:      info.Size(),
+		})
+		spool.size += info.Size()
+		if sequence >= spool.sequence {
+			spool.sequence = sequence + 1
+		}
+	}
+
+	// Names are zero-padded, so lexical order is the sequence order.
+	sort.Slice(spool.entries, func(i, j int) bool {
+		return spool.entries[i].name < spool.entries[j].name
+	})
+
+	return spool, nil
+}
+
+// Appends an entry to the spool. Fails with 'ErrSpoolFull' if the total size
+// of the spool would exceed the limit.
+func (s *Spool) Push(timestamp time.Time, data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.size+int64(len(data)) > s.maxSize {
+		return ErrSpoolFull
+	}
+
+	name := fmt.Sprintf("%020d-%020d%s", s.sequence, timestamp.UnixNano(), spoolExtension)
+	path := filepath.Join(s.directory, name)
+	if err := os.WriteFile(path+".tmp", data, s.mode); err != nil {
+		os.Remove(path + ".tmp") //nolint:errcheck
+		return fmt.Errorf("failed to write spool entry: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		os.Remove(path + ".tmp") //nolint:errcheck
+		return fmt.Errorf("failed to rename spool entry: %w", err)
+	}
+
+	s.sequence++
+	s.entries = append(s.entries, &spoolEntry{
+		name:      name,
+		timestamp: timestamp,
+		size:      int64(len(data)),
+	})
+	s.size += int64(len(data))
+
+	return nil
+}
+
+// Returns the oldest entry of the spool, without removing it. 'ok' is false
+// if the spool is empty.
+func (s *Spool) Peek() (data []byte, timestamp time.Time, ok bool, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.entries) == 0 {
+		return nil, time.Time{}, false, nil
+	}
+
+	entry := s.entries[0]
+	if data, err = os.ReadFile(filepath.Join(s.directory, entry.name)); err != nil {
+		return nil, time.Time{}, false, fmt.Errorf("failed to read spool entry: %w", err)
+	}
+	return data, entry.timestamp, true, nil
+}
+
+// Removes the oldest entry of the spool, if any.
+func (s *Spool) Pop() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.entries) == 0 {
+		return nil
+	}
+
+	entry := s.entries[0]
+	if err := os.Remove(filepath.Join(s.directory, entry.name)); err != nil &&
+		!errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove spool entry: %w", err)
+	}
+	s.entries[0] = nil
+	s.entries = s.entries[1:]
+	s.size -= entry.size
+
+	return nil
+}
+
+// Returns the number of entries in the spool.
+func (s *Spool) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.entries)
+}
+
+// Returns the total size, in bytes, of the entries in the spool.
+func (s *Spool) Size() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.size
+}
+
+// Returns the timestamp of the oldest entry of the spool. Zero if the spool
+// is empty.
+func (s *Spool) Oldest() time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.entries) == 0 {
+		return time.Time{}
+	}
+	return s.entries[0].timestamp
+}
+
+func parseSpoolName(name string) (uint64, time.Time, bool) {
+	if !strings.HasSuffix(name, spoolExtension) {
+		return 0, time.Time{}, false
+	}
+	parts := strings.Split(strings.TrimSuffix(name, spoolExtension), "-")
+	if len(parts) != 2 {
+		return 0, time.Time{}, false
+	}
+	sequence, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+	nanos, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+	return sequence, time.Unix(0, nanos), true
+}
@@ -0,0 +1,89 @@
+package helpers
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type SpoolTestSuite struct {
+	suite.Suite
+	tmpDir string
+}
+
+func (suite *SpoolTestSuite) TestPushPeekPop() {
+	assert := suite.Require()
+
+	directory := filepath.Join(suite.tmpDir, "fifo")
+	spool, err := NewSpool(directory, 0640, 1024)
+	assert.NoError(err)
+
+	_, _, ok, err := spool.Peek()
+	assert.NoError(err)
+	assert.False(ok)
+	assert.True(spool.Oldest().IsZero())
+
+	timestamp := time.Date(2025, 1, 15, 10, 20, 30, 0, time.UTC)
+	for i, data := range []string{"foo", "bar", "baz"} {
+		assert.NoError(spool.Push(timestamp.Add(time.Duration(i)*time.Second), []byte(data)))
+	}
+	assert.Equal(3, spool.Len())
+	assert.Equal(int64(9), spool.Size())
+	assert.True(timestamp.Equal(spool.Oldest()))
+
+	// Entries survive reopening the spool, and leftovers of interrupted writes
+	// are removed.
+	assert.NoError(os.WriteFile(filepath.Join(directory, "foo.spool.tmp"), []byte("foo"), 0640))
+	spool, err = NewSpool(directory, 0640, 1024)
+	assert.NoError(err)
+	assert.Equal(3, spool.Len())
+	assert.NoFileExists(filepath.Join(directory, "foo.spool.tmp"))
+
+	for i, expected := range []string{"foo", "bar", "baz"} {
+		data, ts, ok, err := spool.Peek()
+		assert.NoError(err)
+		assert.True(ok)
+		assert.Equal(expected, string(data))
+		assert.True(timestamp.Add(time.Duration(i) * time.Second).Equal(ts))
+		assert.NoError(spool.Pop())
+
+		// New entries go after existing ones.
+		if i == 0 {
+			assert.NoError(spool.Push(timestamp, []byte("qux")))
+		}
+	}
+
+	data, _, ok, err := spool.Peek()
+	assert.NoError(err)
+	assert.True(ok)
+	assert.Equal("qux", string(data))
+	assert.NoError(spool.Pop())
+	assert.Equal(0, spool.Len())
+	assert.Equal(int64(0), spool.Size())
+	assert.NoError(spool.Pop())
+}
+
+func (suite *SpoolTestSuite) TestMaxSize() {
+	assert := suite.Require()
+
+	spool, err := NewSpool(filepath.Join(suite.tmpDir, "full"), 0640, 8)
+	assert.NoError(err)
+
+	assert.NoError(spool.Push(time.Now(), []byte("foo")))
+	assert.NoError(spool.Push(time.Now(), []byte("bar")))
+	assert.ErrorIs(spool.Push(time.Now(), []byte("baz")), ErrSpoolFull)
+	assert.Equal(2, spool.Len())
+
+	assert.NoError(spool.Pop())
+	assert.NoError(spool.Push(time.Now(), []byte("baz")))
+	assert.Equal(2, spool.Len())
+}
+
+func TestSpoolTestSuite(t *testing.T) {
+	suite.Run(t, &SpoolTestSuite{
+		tmpDir: t.TempDir(),
+	})
+}
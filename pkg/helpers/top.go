@@ -0,0 +1,179 @@
+package helpers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// Dimensions of the requests aggregated by 'TopAggregator'.
+const (
+	TopDimensionURL     = "url"
+	TopDimensionHost    = "host"
+	TopDimensionStatus  = "status"
+	TopDimensionBackend = "backend"
+)
+
+const (
+	// Key used to account requests once the maximum number of distinct keys
+	// of a dimension has been reached.
+	TopOtherKey = "<other>"
+)
+
+var (
+	errInvalidLogLine = errors.New("invalid log line")
+)
+
+// TopEntry is the number of requests and bytes accounted for a key (e.g., an
+// URL) of a dimension (e.g., 'url') during an aggregation period.
+type TopEntry struct {
+	Dimension string
+	Key       string
+	Requests  uint64
+	Bytes     uint64
+}
+
+// TopAggregator accumulates 'varnishncsa' log lines, one per transaction, in
+// the following format:
+//
+//	<side> <host> <url> <status> <bytes> [<backend>]
+//
+// Where '<side>' is 'c' for client transactions and 'b' for backend ones (i.e.,
+// '%{Varnish:side}x'), and missing values are replaced by '-'. Client
+// transactions are accounted in the 'url', 'host' and 'status' dimensions,
+// while backend ones are accounted in the 'backend' dimension. In order to
+// keep memory usage under control, the number of distinct keys per dimension
+// is limited; anything beyond that limit is accounted under 'TopOtherKey'.
+// Not safe for concurrent use.
+type TopAggregator struct {
+	maxKeys  int
+	counters map[string]map[string]*TopEntry
+}
+
+func NewTopAggregator(maxKeys int) *TopAggregator {
+	ta := &TopAggregator{
+		maxKeys: maxKeys,
+	}
+	ta.reset()
+	return ta
+}
+
+func (ta *TopAggregator) Add(line []byte) error {
+	fields := bytes.Fields(line)
+	if len(fields) < 5 {
+		return fmt.Errorf("%w: expected at least 5 fields, got %d", errInvalidLogLine, len(fields))
+	}
+
+	var size uint64
+	if value := string(fields[4]); value != "-" {
+		var err error
+		if size, err = strconv.ParseUint(value, 10, 64); err != nil {
+			return fmt.Errorf("%w: invalid bytes value %q", errInvalidLogLine, value)
+		}
+	}
+
+	switch string(fields[0]) {
+	case "c":
+		ta.account(TopDimensionHost, string(fields[1]), size)
+		ta.account(TopDimensionURL, string(fields[2]), size)
+		ta.account(TopDimensionStatus, string(fields[3]), size)
+	case "b":
+		if len(fields) > 5 {
+			ta.account(TopDimensionBackend, string(fields[5]), size)
+		} else {
+			ta.account(TopDimensionBackend, "-", size)
+		}
+	default:
+		return fmt.Errorf("%w: invalid side %q", errInvalidLogLine, fields[0])
+	}
+
+	return nil
+}
+
+// Returns the entries accumulated since the previous flush and resets the
+// aggregator. For every dimension, only the top 'limit' keys by number of
+// requests and the top 'limit' keys by number of bytes are returned, so the
+// result includes between 'limit' and '2*limit' entries per dimension.
+// Entries are sorted by dimension, number of requests (descending) and key.
+func (ta *TopAggregator) Flush(limit int) []*TopEntry {
+	result := make([]*TopEntry, 0)
+
+	dimensions := make([]string, 0, len(ta.counters))
+	for dimension := range ta.counters {
+		dimensions = append(dimensions, dimension)
+	}
+	sort.Strings(dimensions)
+
+	for _, dimension := range dimensions {
+		entries := make([]*TopEntry, 0, len(ta.counters[dimension]))
+		for _, entry := range ta.counters[dimension] {
+			entries = append(entries, entry)
+		}
+
+		selected := make(map[string]bool)
+		for _, bytesFirst := range []bool{false, true} {
+			sortTopEntries(entries, bytesFirst)
+			for _, entry := range entries[:min(limit, len(entries))] {
+				selected[entry.Key] = true
+			}
+		}
+
+		sortTopEntries(entries, false)
+		for _, entry := range entries {
+			if selected[entry.Key] {
+				result = append(result, entry)
+			}
+		}
+	}
+
+	ta.reset()
+	return result
+}
+
+func (ta *TopAggregator) account(dimension, key string, size uint64) {
+	counters, ok := ta.counters[dimension]
+	if !ok {
+		counters = make(map[string]*TopEntry)
+		ta.counters[dimension] = counters
+	}
+
+	entry, ok := counters[key]
+	if !ok {
+		if len(counters) >= ta.maxKeys {
+			key = TopOtherKey
+			entry = counters[key]
+		}
+		if entry == nil {
+			entry = &TopEntry{
+				Dimension: dimension,
+				Key:       key,
+			}
+			counters[key] = entry
+		}
+	}
+
+	entry.Requests++
+	entry.Bytes += size
+}
+
+func (ta *TopAggregator) reset() {
+	ta.counters = make(map[string]map[string]*TopEntry)
+}
+
+func sortTopEntries(entries []*TopEntry, bytesFirst bool) {
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if bytesFirst && a.Bytes != b.Bytes {
+			return a.Bytes > b.Bytes
+		}
+		if a.Requests != b.Requests {
+			return a.Requests > b.Requests
+		}
+		if !bytesFirst && a.Bytes != b.Bytes {
+			return a.Bytes > b.Bytes
+		}
+		return a.Key < b.Key
+	})
+}
@@ -0,0 +1,112 @@
+package helpers
+
+import (
+	"bufio"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type TopAggregatorTestSuite struct {
+	suite.Suite
+}
+
+func (suite *TopAggregatorTestSuite) replay(ta *TopAggregator, file string) {
+	assert := suite.Require()
+
+	f, err := os.Open(file)
+	assert.NoError(err)
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		assert.NoError(ta.Add(scanner.Bytes()))
+	}
+	assert.NoError(scanner.Err())
+}
+
+func (suite *TopAggregatorTestSuite) TestFlush() {
+	assert := suite.Require()
+
+	ta := NewTopAggregator(1000)
+	suite.replay(ta, "testdata/varnishncsa.log")
+
+	entries := ta.Flush(2)
+	index := make(map[string]*TopEntry)
+	for _, entry := range entries {
+		index[entry.Dimension+" "+entry.Key] = entry
+	}
+
+	for key, expected := range map[string][2]uint64{
+		"url /index.html":         {3, 3000},
+		"url /logo.png":           {2, 2000},
+		"url /video.mp4":          {1, 50000000},
+		"host www.example.com":    {7, 50004250},
+		"host static.example.com": {2, 2000},
+		"status 200":              {6, 50005800},
+		"status 503":              {1, 300},
+		"backend api":             {2, 1100},
+		"backend origin":          {1, 50000000},
+		"backend -":               {1, 2000},
+	} {
+		entry, ok := index[key]
+		assert.True(ok, key)
+		assert.Equal(expected[0], entry.Requests, key)
+		assert.Equal(expected[1], entry.Bytes, key)
+	}
+
+	// Only the top 2 keys by requests plus the top 2 keys by bytes are kept.
+	assert.NotContains(index, "url /api/items")
+	assert.NotContains(index, "status 404")
+	assert.Len(entries, 10)
+
+	// Entries are sorted by dimension and number of requests.
+	assert.Equal(TopDimensionBackend, entries[0].Dimension)
+	assert.Equal("api", entries[0].Key)
+	assert.Equal(TopDimensionURL, entries[len(entries)-1].Dimension)
+
+	// The aggregator is reset after flushing.
+	assert.Empty(ta.Flush(2))
+}
+
+func (suite *TopAggregatorTestSuite) TestMaxKeys() {
+	assert := suite.Require()
+
+	ta := NewTopAggregator(2)
+	for _, line := range []string{
+		"c www.example.com /a 200 10",
+		"c www.example.com /b 200 10",
+		"c www.example.com /c 200 10",
+		"c www.example.com /d 200 10",
+		"c www.example.com /a 200 10",
+	} {
+		assert.NoError(ta.Add([]byte(line)))
+	}
+
+	urls := make(map[string]uint64)
+	for _, entry := range ta.Flush(10) {
+		if entry.Dimension == TopDimensionURL {
+			urls[entry.Key] = entry.Requests
+		}
+	}
+	assert.Equal(map[string]uint64{"/a": 2, "/b": 1, TopOtherKey: 2}, urls)
+}
+
+func (suite *TopAggregatorTestSuite) TestInvalidLines() {
+	assert := suite.Require()
+
+	ta := NewTopAggregator(10)
+	for _, line := range []string{
+		"c www.example.com /a 200",
+		"c www.example.com /a 200 abc",
+		"x www.example.com /a 200 10",
+	} {
+		assert.ErrorIs(ta.Add([]byte(line)), errInvalidLogLine, line)
+	}
+	assert.Empty(ta.Flush(10))
+}
+
+func TestTopAggregatorTestSuite(t *testing.T) {
+	suite.Run(t, new(TopAggregatorTestSuite))
+}
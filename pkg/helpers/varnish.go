@@ -7,16 +7,40 @@ import (
 	"time"
 )
 
+const (
+	// Layout of the 'timestamp' field in the 'varnishstat -1 -j' output.
+	// Beware it does not include timezone information. Fractional seconds are
+	// accepted too, just in case.
+	varnishstatTimestampLayout = "2006-01-02T15:04:05.999999999"
+)
+
 var (
-	//nolint:godot
-	// errMissingTimestamp = errors.New("timestamp field is missing")
-	errMissingCounters = errors.New("counters field is missing")
+	errMissingTimestamp = errors.New("timestamp field is missing")
+	errMissingCounters  = errors.New("counters field is missing")
 )
 
 type VarnishMetrics struct {
-	Version   int                              `json:"version"`
-	Timestamp time.Time                        `json:"timestamp"`
-	Items     map[string]*VarnishMetricDetails `json:"items"`
+	// Name of the Varnish instance (i.e., scraper target) the metrics belong
+	// to. This is not part of the 'varnishstat' output; it is set by whoever
+	// collects the metrics.
+	Instance string `json:"-"`
+	Version  int    `json:"version"`
+	// Point in time the metrics are stored at. By default this is the time the
+	// output was parsed, but it's usually adjusted by whoever collects the
+	// metrics (e.g., to the start of the scrape, to the 'varnishstat' own
+	// timestamp, etc.).
+	Timestamp time.Time `json:"timestamp"`
+	// Raw 'timestamp' field of the 'varnishstat' output, if any.
+	VarnishstatTimestamp string `json:"-"`
+	// Start time of the scrape, including a monotonic clock reading, and its
+	// duration. Zero if the metrics were not scraped by this process (e.g.,
+	// pushed by a remote agent).
+	Scraped  time.Time     `json:"-"`
+	Duration time.Duration `json:"-"`
+	// Expected interval between consecutive samples (i.e., the scraping
+	// period of the target). Zero if unknown (e.g., pushed by a remote agent).
+	Period time.Duration                    `json:"-"`
+	Items  map[string]*VarnishMetricDetails `json:"items"`
 }
 
 type VarnishMetricDetails struct {
@@ -42,24 +66,15 @@ func (vm *VarnishMetrics) UnmarshalJSON(data []byte) error {
 		vm.Version = 0
 	}
 
-	// Unmarshal the timestamp: ideally we'd prefer to parse the timestamp and
-	// use it later as the timestamp of the metrics, but the timestamp value
-	// does not include the timezone information. That results in the timestamp
-	// string being parsed as UTC, which is not correct. For now, we use the
-	// current time as the timestamp of the metrics.
-	// if timestamp, ok := raw["timestamp"]; ok {
-	// 	var ts string
-	// 	if err := json.Unmarshal(timestamp, &ts); err != nil {
-	// 		return fmt.Errorf("invalid timestamp: %w", err)
-	// 	}
-	// 	parsedTimestamp, err := time.Parse("2006-01-02T15:04:05", ts)
-	// 	if err != nil {
-	// 		return fmt.Errorf("invalid timestamp: %w", err)
-	// 	}
-	// 	vm.Timestamp = parsedTimestamp
-	// } else {
-	// 	 return fmt.Errorf("invalid timestamp: %w", errMissingTimestamp)
-	// }
+	// Unmarshal the timestamp: it's kept as-is because the value does not
+	// include timezone information, so it can't be blindly trusted. See
+	// 'ParseVarnishstatTimestamp()'. For now, the current time is used as the
+	// timestamp of the metrics.
+	if timestamp, ok := raw["timestamp"]; ok {
+		if err := json.Unmarshal(timestamp, &vm.VarnishstatTimestamp); err != nil {
+			return fmt.Errorf("invalid timestamp: %w", err)
+		}
+	}
 	vm.Timestamp = time.Now()
 
 	// Unmarshal the metric details.
@@ -105,6 +120,21 @@ func (vmd *VarnishMetricDetails) HasDurationFormat() bool {
 	return vmd.Format == "d"
 }
 
+// Parses the 'timestamp' field of the 'varnishstat' output as a time in the
+// given location.
+func (vm *VarnishMetrics) ParseVarnishstatTimestamp(loc *time.Location) (time.Time, error) {
+	if vm.VarnishstatTimestamp == "" {
+		return time.Time{}, fmt.Errorf("invalid timestamp: %w", errMissingTimestamp)
+	}
+
+	result, err := time.ParseInLocation(varnishstatTimestampLayout, vm.VarnishstatTimestamp, loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp: %w", err)
+	}
+
+	return result, nil
+}
+
 func ParseVarnishMetrics(input []byte) (*VarnishMetrics, error) {
 	var metrics VarnishMetrics
 	if err := json.Unmarshal(input, &metrics); err != nil {
@@ -0,0 +1,87 @@
+package helpers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type VarnishTestSuite struct {
+	suite.Suite
+}
+
+func (suite *VarnishTestSuite) TestParseVersion0() {
+	assert := suite.Require()
+
+	metrics, err := ParseVarnishMetrics([]byte(`{
+		"timestamp": "2025-01-15T10:20:30",
+		"MAIN.uptime": {"description": "Child process uptime", "flag": "c", "format": "d", "value": 42},
+		"MAIN.client_req": {"description": "Good client requests received", "flag": "c", "format": "i", "value": 7}
+	}`))
+	assert.NoError(err)
+	assert.Equal(0, metrics.Version)
+	assert.Equal("2025-01-15T10:20:30", metrics.VarnishstatTimestamp)
+	assert.WithinDuration(time.Now(), metrics.Timestamp, 5*time.Second)
+	assert.Len(metrics.Items, 2)
+	assert.Equal(uint64(42), metrics.Items["MAIN.uptime"].Value)
+	assert.True(metrics.Items["MAIN.uptime"].HasDurationFormat())
+	assert.True(metrics.Items["MAIN.client_req"].IsCounter())
+}
+
+func (suite *VarnishTestSuite) TestParseVersion1() {
+	assert := suite.Require()
+
+	metrics, err := ParseVarnishMetrics([]byte(`{
+		"version": 1,
+		"timestamp": "2025-01-15T10:20:30",
+		"counters": {
+			"MAIN.n_object": {"description": "object structs made", "flag": "g", "format": "i", "value": 3},
+			"MGT.child_panic": {"description": "Child process panic", "flag": "b", "format": "b", "value": 0}
+		}
+	}`))
+	assert.NoError(err)
+	assert.Equal(1, metrics.Version)
+	assert.Equal("2025-01-15T10:20:30", metrics.VarnishstatTimestamp)
+	assert.Len(metrics.Items, 2)
+	assert.Equal(uint64(3), metrics.Items["MAIN.n_object"].Value)
+	assert.True(metrics.Items["MGT.child_panic"].IsBitmap())
+
+	_, err = ParseVarnishMetrics([]byte(`{"version": 1, "timestamp": "2025-01-15T10:20:30"}`))
+	assert.ErrorIs(err, errMissingCounters)
+
+	_, err = ParseVarnishMetrics([]byte(`whatever`))
+	assert.Error(err)
+}
+
+func (suite *VarnishTestSuite) TestParseVarnishstatTimestamp() {
+	assert := suite.Require()
+
+	madrid, err := time.LoadLocation("Europe/Madrid")
+	assert.NoError(err)
+
+	metrics := &VarnishMetrics{VarnishstatTimestamp: "2025-01-15T10:20:30"}
+	timestamp, err := metrics.ParseVarnishstatTimestamp(time.UTC)
+	assert.NoError(err)
+	assert.Equal(time.Date(2025, 1, 15, 10, 20, 30, 0, time.UTC), timestamp)
+	timestamp, err = metrics.ParseVarnishstatTimestamp(madrid)
+	assert.NoError(err)
+	assert.Equal(time.Date(2025, 1, 15, 9, 20, 30, 0, time.UTC), timestamp.UTC())
+
+	metrics = &VarnishMetrics{VarnishstatTimestamp: "2025-01-15T10:20:30.250"}
+	timestamp, err = metrics.ParseVarnishstatTimestamp(time.UTC)
+	assert.NoError(err)
+	assert.Equal(250*time.Millisecond, time.Duration(timestamp.Nanosecond()))
+
+	metrics = &VarnishMetrics{}
+	_, err = metrics.ParseVarnishstatTimestamp(time.UTC)
+	assert.ErrorIs(err, errMissingTimestamp)
+
+	metrics = &VarnishMetrics{VarnishstatTimestamp: "Wed Jan 15 10:20:30 2025"}
+	_, err = metrics.ParseVarnishstatTimestamp(time.UTC)
+	assert.Error(err)
+}
+
+func TestVarnishTestSuite(t *testing.T) {
+	suite.Run(t, &VarnishTestSuite{})
+}
@@ -0,0 +1,220 @@
+package helpers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Beware of the hardcoded limit here: groups longer than this are
+	// discarded, as they most likely are the result of a parsing issue.
+	maxVarnishlogGroupLines = 100000
+)
+
+var (
+	errInvalidVarnishlogGroup = errors.New("invalid 'varnishlog' group")
+	errVarnishlogGroupTooLong = errors.New("'varnishlog' group too long")
+)
+
+// VarnishTransaction is a client request as reported by 'varnishlog -g
+// request', including a summary of the first backend request it triggered,
+// if any.
+type VarnishTransaction struct {
+	VXID uint64
+	// Start of the request, as reported by the 'Timestamp:Start' record.
+	Timestamp time.Time
+	Method    string
+	URL       string
+	Host      string
+	Status    int
+	Backend   string
+	// Time elapsed until the response was delivered, as reported by the
+	// 'Timestamp:Resp' record.
+	Duration time.Duration
+	// Seconds elapsed since the start of the request for every 'Timestamp'
+	// record of the request (e.g., 'Req', 'Fetch', 'Process', 'Resp') and of
+	// the backend request (prefixed by 'BeReq.', e.g., 'BeReq.Beresp').
+	Timings map[string]float64
+}
+
+// VarnishlogReader rebuilds groups of transactions from the output of
+// 'varnishlog -g request', line by line. Groups are expected to be separated
+// by empty lines, but a new top-level transaction is also considered the end
+// of the previous group. Not safe for concurrent use.
+type VarnishlogReader struct {
+	lines [][]byte
+}
+
+func NewVarnishlogReader() *VarnishlogReader {
+	return &VarnishlogReader{}
+}
+
+// Feeds a line into the reader. Whenever a group is completed, the
+// transaction is returned.
+func (vr *VarnishlogReader) Add(line []byte) (*VarnishTransaction, error) {
+	trimmed := bytes.TrimSpace(line)
+
+	if len(trimmed) == 0 {
+		return vr.flush()
+	}
+
+	var result *VarnishTransaction
+	var err error
+	if bytes.HasPrefix(trimmed, []byte("* ")) && len(vr.lines) > 0 {
+		result, err = vr.flush()
+	}
+
+	if len(vr.lines) >= maxVarnishlogGroupLines {
+		vr.lines = nil
+		return nil, errVarnishlogGroupTooLong
+	}
+	vr.lines = append(vr.lines, bytes.Clone(trimmed))
+
+	return result, err
+}
+
+func (vr *VarnishlogReader) flush() (*VarnishTransaction, error) {
+	if len(vr.lines) == 0 {
+		return nil, nil //nolint:nilnil
+	}
+	lines := vr.lines
+	vr.lines = nil
+	return ParseVarnishlogGroup(lines)
+}
+
+// Parses a group of transactions as reported by 'varnishlog -g request'
+// (e.g., '*   << Request  >> 32770', followed by '-   ReqURL  /foo' records,
+// and nested transactions like '**  << BeReq    >> 32771').
+func ParseVarnishlogGroup(lines [][]byte) (*VarnishTransaction, error) {
+	var start float64
+	tx := &VarnishTransaction{
+		Timings: make(map[string]float64),
+	}
+	backend := false
+	types := make(map[int]string)
+
+	for _, line := range lines {
+		marker, rest, _ := strings.Cut(string(line), " ")
+		rest = strings.TrimSpace(rest)
+		level := len(marker)
+
+		// Transaction header (e.g., '** << BeReq >> 32771').
+		if strings.HasPrefix(marker, "*") {
+			fields := strings.Fields(rest)
+			if len(fields) < 4 || fields[0] != "<<" || fields[2] != ">>" {
+				return nil, fmt.Errorf("%w: invalid header %q", errInvalidVarnishlogGroup, line)
+			}
+			types[level] = fields[1]
+			if level == 1 {
+				if fields[1] != "Request" {
+					return nil, fmt.Errorf("%w: unexpected %q transaction",
+						errInvalidVarnishlogGroup, fields[1])
+				}
+				vxid, err := strconv.ParseUint(fields[3], 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("%w: invalid VXID %q", errInvalidVarnishlogGroup, fields[3])
+				}
+				tx.VXID = vxid
+			} else if level == 2 && fields[1] == "BeReq" {
+				// Only the first backend request is considered.
+				if backend {
+					types[level] = ""
+				}
+				backend = true
+			}
+			continue
+		}
+
+		// Record (e.g., '-- BackendOpen 25 default 127.0.0.1 8080 ...').
+		tag, value, _ := strings.Cut(rest, " ")
+		value = strings.TrimSpace(value)
+		switch {
+		case level == 1:
+			switch tag {
+			case "ReqMethod":
+				if tx.Method == "" {
+					tx.Method = value
+				}
+			case "ReqURL":
+				if tx.URL == "" {
+					tx.URL = value
+				}
+			case "ReqHeader":
+				if name, header, ok := strings.Cut(value, ":"); ok &&
+					tx.Host == "" && strings.EqualFold(name, "host") {
+					tx.Host = strings.TrimSpace(header)
+				}
+			case "RespStatus":
+				if status, err := strconv.Atoi(value); err == nil {
+					tx.Status = status
+				}
+			case "Timestamp":
+				name, timestamp, elapsed, err := parseVarnishlogTimestamp(value)
+				if err != nil {
+					return nil, err
+				}
+				if name == "Start" {
+					start = timestamp
+					tx.Timestamp = unixFloatToTime(timestamp)
+				}
+				tx.Timings[name] = elapsed
+				if name == "Resp" {
+					tx.Duration = time.Duration(elapsed * float64(time.Second))
+				}
+			}
+		case level == 2 && types[level] == "BeReq":
+			switch tag {
+			case "BackendOpen":
+				if fields := strings.Fields(value); len(fields) > 1 {
+					tx.Backend = fields[1]
+				}
+			case "Timestamp":
+				name, timestamp, _, err := parseVarnishlogTimestamp(value)
+				if err != nil {
+					return nil, err
+				}
+				if start > 0 {
+					tx.Timings["BeReq."+name] = math.Max(0, timestamp-start)
+				}
+			}
+		}
+	}
+
+	if tx.Timestamp.IsZero() {
+		return nil, fmt.Errorf("%w: missing 'Timestamp:Start' record", errInvalidVarnishlogGroup)
+	}
+
+	return tx, nil
+}
+
+// Parses the value of a 'Timestamp' record (e.g., 'Resp: 1700000000.500000
+// 1.500000 0.000100').
+func parseVarnishlogTimestamp(value string) (string, float64, float64, error) {
+	name, rest, ok := strings.Cut(value, ":")
+	fields := strings.Fields(rest)
+	if !ok || len(fields) < 2 {
+		return "", 0, 0, fmt.Errorf("%w: invalid timestamp %q", errInvalidVarnishlogGroup, value)
+	}
+
+	timestamp, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("%w: invalid timestamp %q", errInvalidVarnishlogGroup, value)
+	}
+
+	elapsed, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("%w: invalid timestamp %q", errInvalidVarnishlogGroup, value)
+	}
+
+	return name, timestamp, elapsed, nil
+}
+
+func unixFloatToTime(value float64) time.Time {
+	seconds, fraction := math.Modf(value)
+	return time.Unix(int64(seconds), int64(math.Round(fraction*1e9)))
+}
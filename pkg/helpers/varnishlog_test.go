@@ -0,0 +1,103 @@
+package helpers
+
+import (
+	"bufio"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type VarnishlogReaderTestSuite struct {
+	suite.Suite
+}
+
+func (suite *VarnishlogReaderTestSuite) TestAdd() {
+	assert := suite.Require()
+
+	f, err := os.Open("testdata/varnishlog.log")
+	assert.NoError(err)
+	defer f.Close()
+
+	vr := NewVarnishlogReader()
+	txs := make([]*VarnishTransaction, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		tx, err := vr.Add(scanner.Bytes())
+		assert.NoError(err)
+		if tx != nil {
+			txs = append(txs, tx)
+		}
+	}
+	assert.NoError(scanner.Err())
+
+	// The last group is only completed once an empty line is found.
+	assert.Len(txs, 1)
+	tx, err := vr.Add([]byte(""))
+	assert.NoError(err)
+	assert.NotNil(tx)
+	txs = append(txs, tx)
+
+	assert.Equal(uint64(32770), txs[0].VXID)
+	assert.Equal(time.Unix(1735736400, 0), txs[0].Timestamp)
+	assert.Equal("GET", txs[0].Method)
+	assert.Equal("/slow?id=1", txs[0].URL)
+	assert.Equal("www.example.com", txs[0].Host)
+	assert.Equal(200, txs[0].Status)
+	assert.Equal("default", txs[0].Backend)
+	assert.Equal(1750*time.Millisecond, txs[0].Duration)
+	assert.InDelta(1.5, txs[0].Timings["Fetch"], 1e-6)
+	assert.InDelta(1.75, txs[0].Timings["Resp"], 1e-6)
+	assert.InDelta(0.0001, txs[0].Timings["BeReq.Start"], 1e-6)
+	assert.InDelta(1.4, txs[0].Timings["BeReq.Beresp"], 1e-6)
+	assert.InDelta(1.5, txs[0].Timings["BeReq.BerespBody"], 1e-6)
+
+	assert.Equal(uint64(5), txs[1].VXID)
+	assert.Equal(time.Unix(1735736460, 250000000), txs[1].Timestamp)
+	assert.Equal("POST", txs[1].Method)
+	assert.Equal("api.example.com", txs[1].Host)
+	assert.Equal(503, txs[1].Status)
+	assert.Empty(txs[1].Backend)
+	assert.Equal(2*time.Second, txs[1].Duration)
+}
+
+func (suite *VarnishlogReaderTestSuite) TestNewGroupWithoutEmptyLine() {
+	assert := suite.Require()
+
+	vr := NewVarnishlogReader()
+	for _, line := range []string{
+		"*   << Request  >> 1",
+		"-   Timestamp      Start: 1735736400.000000 0.000000 0.000000",
+	} {
+		tx, err := vr.Add([]byte(line))
+		assert.NoError(err)
+		assert.Nil(tx)
+	}
+
+	tx, err := vr.Add([]byte("*   << Request  >> 2"))
+	assert.NoError(err)
+	assert.Equal(uint64(1), tx.VXID)
+}
+
+func (suite *VarnishlogReaderTestSuite) TestInvalidGroups() {
+	assert := suite.Require()
+
+	for _, group := range [][]string{
+		{"*   << Session  >> 1", "-   Timestamp      Start: 1735736400.000000 0.000000 0.000000"},
+		{"*   << Request  >> foo", "-   Timestamp      Start: 1735736400.000000 0.000000 0.000000"},
+		{"*   << Request  >> 1", "-   Timestamp      Start: foo 0.000000 0.000000"},
+		{"*   << Request  >> 1", "-   ReqURL         /"},
+	} {
+		lines := make([][]byte, 0, len(group))
+		for _, line := range group {
+			lines = append(lines, []byte(line))
+		}
+		_, err := ParseVarnishlogGroup(lines)
+		assert.ErrorIs(err, errInvalidVarnishlogGroup, group)
+	}
+}
+
+func TestVarnishlogReaderTestSuite(t *testing.T) {
+	suite.Run(t, new(VarnishlogReaderTestSuite))
+}
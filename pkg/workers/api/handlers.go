@@ -2,12 +2,14 @@ package api
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/base64"
 	"strconv"
 	"strings"
 	"text/template"
 	"time"
 
+	"github.com/allenta/varnishmon/pkg/helpers"
 	"github.com/allenta/varnishmon/pkg/workers/storage"
 	"github.com/fasthttp/router"
 	"github.com/prometheus/client_golang/prometheus"
@@ -17,23 +19,37 @@ import (
 	"github.com/valyala/fasthttp/pprofhandler"
 )
 
+const (
+	ingestPath = "/storage/ingest"
+	burstPath  = "/scraper/burst"
+)
+
 type Handler struct {
-	app     Application
-	storage *storage.Storage
-	router  *router.Router
+	app          Application
+	storage      *storage.Storage
+	metricsQueue chan *helpers.VarnishMetrics
+	scheduler    Scheduler
+	router       *router.Router
 
 	homeTemplate *template.Template
 
 	requestsTotal          *prometheus.CounterVec
 	requestsInflightTotal  prometheus.Gauge
 	requestDurationSeconds *prometheus.SummaryVec
+	ingestAccepted         prometheus.Counter
+	ingestRejected         *prometheus.CounterVec
+	ingestDroppedMetrics   prometheus.Counter
 }
 
-func NewHandler(app Application, storage *storage.Storage) *Handler {
+func NewHandler(
+	app Application, storage *storage.Storage,
+	metricsQueue chan *helpers.VarnishMetrics, scheduler Scheduler) *Handler {
 	h := &Handler{
-		app:     app,
-		storage: storage,
-		router:  router.New(),
+		app:          app,
+		storage:      storage,
+		metricsQueue: metricsQueue,
+		scheduler:    scheduler,
+		router:       router.New(),
 
 		requestsTotal: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
@@ -56,6 +72,25 @@ func NewHandler(app Application, storage *storage.Storage) *Handler {
 				MaxAge:     1 * time.Minute,
 			},
 			[]string{"method", "code"}),
+
+		ingestAccepted: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "api_ingest_accepted_total",
+				Help: "Pushes of 'varnishstat' output accepted by the ingest endpoint",
+			}),
+
+		ingestRejected: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "api_ingest_rejected_total",
+				Help: "Pushes of 'varnishstat' output rejected by the ingest endpoint, partitioned by reason",
+			},
+			[]string{"reason"}),
+
+		ingestDroppedMetrics: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "api_ingest_dropped_metrics_total",
+				Help: "Metrics pushed to the ingest endpoint dropped by the 'scraper.include' / 'scraper.exclude' filters",
+			}),
 	}
 
 	h.router.RedirectTrailingSlash = true
@@ -63,12 +98,27 @@ func NewHandler(app Application, storage *storage.Storage) *Handler {
 	h.router.GET("/metrics", h.handleMetricsRequest)
 	h.router.GET("/storage/metrics", h.handleStorageMetricsRequest)
 	h.router.GET("/storage/metrics/{id:[0-9]+}", h.handleStorageMetricsRequest)
+	h.router.GET("/storage/bursts", h.handleStorageBurstsRequest)
+	h.router.GET("/storage/scrapes", h.handleStorageScrapesRequest)
+	h.router.GET("/storage/top", h.handleStorageTopRequest)
+	h.router.GET("/storage/transactions", h.handleStorageTransactionsRequest)
+	h.router.GET("/storage/archives", h.handleStorageArchivesRequest)
+	h.router.GET("/storage/export", h.handleStorageExportRequest)
+	if h.app.Cfg().APIIngestEnabled() {
+		h.router.POST(ingestPath, h.handleStorageIngestRequest)
+	}
+	if h.app.Cfg().APIBurstEnabled() {
+		h.router.POST(burstPath, h.handleScraperBurstRequest)
+	}
 	h.router.GET("/", h.handleHomeRequest)
 	h.router.ServeFilesCustom("/{filepath:*}", h.filesystemHandler())
 
 	h.app.Cfg().Metrics().Registry.MustRegister(h.requestsTotal)
 	h.app.Cfg().Metrics().Registry.MustRegister(h.requestsInflightTotal)
 	h.app.Cfg().Metrics().Registry.MustRegister(h.requestDurationSeconds)
+	h.app.Cfg().Metrics().Registry.MustRegister(h.ingestAccepted)
+	h.app.Cfg().Metrics().Registry.MustRegister(h.ingestRejected)
+	h.app.Cfg().Metrics().Registry.MustRegister(h.ingestDroppedMetrics)
 
 	return h
 }
@@ -90,8 +140,20 @@ func (h *Handler) HandleRequest(_ context.Context, rctx *fasthttp.RequestCtx) {
 	rctx.Response.Header.Set("Pragma", "no-cache")
 	rctx.Response.Header.Set("Expires", "0")
 
-	// Check authentication.
-	if h.app.Cfg().APIBasicAuthUsername() != "" && h.app.Cfg().APIBasicAuthPassword() != "" {
+	// Check authentication. Ingest and burst requests are authenticated using
+	// their own bearer tokens, so remote agents and operators triggering
+	// bursts don't need to know the credentials used to access the web UI,
+	// and vice versa.
+	if h.app.Cfg().APIIngestEnabled() && string(rctx.Path()) == ingestPath {
+		if !h.checkBearerToken(rctx, h.app.Cfg().APIIngestToken()) {
+			h.ingestRejected.WithLabelValues("unauthorized").Inc()
+			return
+		}
+	} else if h.app.Cfg().APIBurstEnabled() && string(rctx.Path()) == burstPath {
+		if !h.checkBearerToken(rctx, h.app.Cfg().APIBurstToken()) {
+			return
+		}
+	} else if h.app.Cfg().APIBasicAuthUsername() != "" && h.app.Cfg().APIBasicAuthPassword() != "" {
 		authorized := false
 
 		const prefix = "Basic "
@@ -117,6 +179,21 @@ func (h *Handler) HandleRequest(_ context.Context, rctx *fasthttp.RequestCtx) {
 	h.router.Handler(rctx)
 }
 
+// Checks the 'Authorization' header of the request contains the given bearer
+// token. Otherwise, a 401 response is prepared.
+func (h *Handler) checkBearerToken(rctx *fasthttp.RequestCtx, token string) bool {
+	const prefix = "Bearer "
+	authHeader := string(rctx.Request.Header.Peek("Authorization"))
+	if strings.HasPrefix(authHeader, prefix) &&
+		subtle.ConstantTimeCompare([]byte(authHeader[len(prefix):]), []byte(token)) == 1 {
+		return true
+	}
+
+	rctx.SetStatusCode(fasthttp.StatusUnauthorized)
+	rctx.Response.Header.Add("WWW-Authenticate", "Bearer realm=Restricted")
+	return false
+}
+
 func (h *Handler) handlePprofRequest(rctx *fasthttp.RequestCtx) {
 	pprofhandler.PprofHandler(rctx)
 }
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/allenta/varnishmon/pkg/config"
+	"github.com/allenta/varnishmon/pkg/helpers"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// Maximum length of the 'hostname' parameter, which is used as the name of
+	// the Varnish instance the pushed metrics belong to.
+	maxIngestHostnameLength = 255
+
+	// Tolerance for pushed timestamps in the future, in order to absorb small
+	// clock differences between remote agents and the local host. Samples too
+	// far in the future would cause all subsequent samples of the same
+	// instance to be considered out-of-order by the archiver.
+	maxIngestClockSkew = 1 * time.Minute
+)
+
+func (h *Handler) handleStorageIngestRequest(rctx *fasthttp.RequestCtx) {
+	// Check the request body. Oversized bodies are usually rejected by the
+	// server itself according to 'api.max-request-body-size', but this check
+	// is kept here to be on the safe side.
+	body := rctx.PostBody()
+	if len(body) == 0 {
+		h.rejectIngestRequest(rctx, "empty_body", fasthttp.StatusBadRequest,
+			"Empty request body")
+		return
+	}
+	if len(body) > h.app.Cfg().APIMaxRequestBodySize() {
+		h.rejectIngestRequest(rctx, "too_large", fasthttp.StatusRequestEntityTooLarge,
+			"Request body too large")
+		return
+	}
+
+	// Parse the 'varnishstat -1 -j' output. Both the old (version 0) and the
+	// new (version 1) layouts are supported.
+	metrics, err := helpers.ParseVarnishMetrics(body)
+	if err != nil {
+		h.rejectIngestRequest(rctx, "invalid_body", fasthttp.StatusBadRequest,
+			fmt.Sprintf("Invalid 'varnishstat' output: %s", err))
+		return
+	}
+
+	// Extract optional 'timestamp' query string parameter. If not provided,
+	// depending on the 'scraper.timestamp-source' setting, the 'varnishstat'
+	// own timestamp or the time of reception is used.
+	if rctx.QueryArgs().Has("timestamp") {
+		timestamp, err := h.getQueryArgsTimeParam(rctx, "timestamp")
+		if err != nil || timestamp.After(time.Now().Add(maxIngestClockSkew)) {
+			h.rejectIngestRequest(rctx, "invalid_params", fasthttp.StatusBadRequest,
+				"Invalid 'timestamp' parameter")
+			return
+		}
+		metrics.Timestamp = timestamp
+	} else if h.app.Cfg().ScraperTimestampSource() == config.ScraperTimestampSourceVarnishstat {
+		timestamp, err := metrics.ParseVarnishstatTimestamp(h.app.Cfg().ScraperTimestampTZ())
+		if err != nil || timestamp.After(time.Now().Add(maxIngestClockSkew)) {
+			h.rejectIngestRequest(rctx, "invalid_body", fasthttp.StatusBadRequest,
+				"Invalid 'varnishstat' timestamp")
+			return
+		}
+		metrics.Timestamp = timestamp
+	}
+
+	// Extract optional 'hostname' query string parameter. If not provided,
+	// the remote IP address is used. Either way, the value is used as the
+	// name of the Varnish instance, and it must not clash with the name of
+	// any local scraper target; otherwise samples from different sources
+	// would be mixed up.
+	hostname := string(rctx.QueryArgs().Peek("hostname"))
+	if hostname == "" {
+		hostname = rctx.RemoteIP().String()
+	}
+	if len(hostname) > maxIngestHostnameLength || h.isScraperTarget(hostname) {
+		h.rejectIngestRequest(rctx, "invalid_params", fasthttp.StatusBadRequest,
+			"Invalid 'hostname' parameter")
+		return
+	}
+	metrics.Instance = hostname
+
+	// Apply the same filters used for locally scraped metrics.
+	h.ingestDroppedMetrics.Add(float64(h.app.Cfg().ScraperFilter().Apply(metrics)))
+
+	// Feed the metrics into the archiver pipeline. Avoid blocking if the
+	// metrics queue is full, letting the agent decide whether to retry.
+	select {
+	case h.metricsQueue <- metrics:
+		h.ingestAccepted.Inc()
+		rctx.SetStatusCode(fasthttp.StatusAccepted)
+	default:
+		h.app.Cfg().Log().Error().
+			Str("hostname", hostname).
+			Msg("Metrics queue is full, rejecting pushed metrics!")
+		h.rejectIngestRequest(rctx, "queue_full", fasthttp.StatusServiceUnavailable,
+			"Metrics queue is full")
+	}
+}
+
+func (h *Handler) rejectIngestRequest(rctx *fasthttp.RequestCtx, reason string, code int, msg string) {
+	h.ingestRejected.WithLabelValues(reason).Inc()
+	rctx.SetStatusCode(code)
+	rctx.SetBodyString(msg)
+}
+
+func (h *Handler) isScraperTarget(name string) bool {
+	if h.app.Cfg().ScraperEnabled() {
+		for _, target := range h.app.Cfg().ScraperTargets() {
+			if target.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
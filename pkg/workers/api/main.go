@@ -1,9 +1,26 @@
 package api
 
 import (
+	"errors"
+	"time"
+
 	"github.com/allenta/varnishmon/pkg/config"
+	"github.com/allenta/varnishmon/pkg/workers/storage"
+)
+
+var (
+	ErrScraperDisabled    = errors.New("scraper is disabled")
+	ErrInvalidBurstPeriod = errors.New("invalid burst period")
+	ErrInvalidBurstLength = errors.New("invalid burst duration")
 )
 
 type Application interface {
 	Cfg() *config.Config
 }
+
+type Scheduler interface {
+	// Temporarily changes the scraping period of all scraper targets (as long
+	// as the new period is shorter than their own) during the given duration,
+	// and returns the recorded burst.
+	StartBurst(period, duration time.Duration) (*storage.Burst, error)
+}
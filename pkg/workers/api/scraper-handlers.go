@@ -0,0 +1,70 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func (h *Handler) handleScraperBurstRequest(rctx *fasthttp.RequestCtx) {
+	// Extract 'period' query string parameter.
+	period, err := h.getQueryArgsDurationParam(rctx, "period")
+	if err != nil {
+		rctx.SetStatusCode(fasthttp.StatusBadRequest)
+		rctx.SetBodyString("Invalid 'period' parameter")
+		return
+	}
+
+	// Extract 'duration' query string parameter.
+	duration, err := h.getQueryArgsDurationParam(rctx, "duration")
+	if err != nil {
+		rctx.SetStatusCode(fasthttp.StatusBadRequest)
+		rctx.SetBodyString("Invalid 'duration' parameter")
+		return
+	}
+
+	// Start the burst.
+	burst, err := h.scheduler.StartBurst(period, duration)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrScraperDisabled):
+			rctx.SetStatusCode(fasthttp.StatusConflict)
+			rctx.SetBodyString("Scraper is disabled")
+		case errors.Is(err, ErrInvalidBurstPeriod):
+			rctx.SetStatusCode(fasthttp.StatusBadRequest)
+			rctx.SetBodyString("Invalid 'period' parameter")
+		case errors.Is(err, ErrInvalidBurstLength):
+			rctx.SetStatusCode(fasthttp.StatusBadRequest)
+			rctx.SetBodyString("Invalid 'duration' parameter")
+		default:
+			h.app.Cfg().Log().Error().
+				Err(err).
+				Msg("Failed to start burst!")
+			rctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		}
+		return
+	}
+
+	// Encode response.
+	h.encodeJSONResponse(rctx, map[string]interface{}{
+		"from":   burst.From.Unix(),
+		"to":     burst.To.Unix(),
+		"period": int(burst.Period.Seconds()),
+	})
+}
+
+func (h *Handler) getQueryArgsDurationParam(rctx *fasthttp.RequestCtx, name string) (time.Duration, error) {
+	value := rctx.QueryArgs().Peek(name)
+	if value == nil {
+		return 0, fmt.Errorf("%w: %s", errMissingQueryArgsParam, name)
+	}
+
+	duration, err := time.ParseDuration(string(value))
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", errInvalidQueryArgsParam, name)
+	}
+
+	return duration, nil
+}
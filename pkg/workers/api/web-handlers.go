@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"mime"
 	"strconv"
 	"text/template"
 	"time"
@@ -17,11 +18,31 @@ import (
 
 const (
 	developmentAssetsRoot = "/mnt/host/assets"
+
+	// Maximum number of items returned by the '/storage/top' endpoint.
+	maxTopLimit = 1000
+
+	// Default & maximum number of items returned by the
+	// '/storage/transactions' endpoint.
+	defaultTransactionsLimit = 1000
+	maxTransactionsLimit     = 10000
+
+	// Layout of the time range in the names of files returned by the
+	// '/storage/export' endpoint.
+	exportTimeLayout = "20060102T150405Z"
 )
 
 var (
 	errMissingQueryArgsParam = errors.New("missing query string parameter")
 	errInvalidQueryArgsParam = errors.New("invalid query string parameter")
+
+	// Content types of the formats supported by the '/storage/export'
+	// endpoint.
+	exportContentTypes = map[string]string{ //nolint:gochecknoglobals
+		storage.ExportFormatCSV:     "text/csv; charset=utf-8",
+		storage.ExportFormatParquet: "application/vnd.apache.parquet",
+		storage.ExportFormatNDJSON:  "application/x-ndjson",
+	}
 )
 
 func (h *Handler) filesystemHandler() *fasthttp.FS {
@@ -86,10 +107,18 @@ func (h *Handler) handleHomeRequest(rctx *fasthttp.RequestCtx) {
 		}
 	}
 
+	// Extract optional 'archive' query string parameter. If provided, the
+	// archived database is browsed instead of the current one.
+	stg, release, ok := h.acquireStorage(rctx)
+	if !ok {
+		return
+	}
+	defer release()
+
 	// Prepare template data & render it.
 	scraperPeriod := 0
 	if h.app.Cfg().ScraperEnabled() {
-		scraperPeriod = int(h.app.Cfg().ScraperPeriod().Seconds())
+		scraperPeriod = int(h.app.Cfg().ScraperMinPeriod().Seconds())
 	}
 	cfg, err := json.Marshal(map[string]interface{}{
 		"version":  config.Version(),
@@ -99,11 +128,19 @@ func (h *Handler) handleHomeRequest(rctx *fasthttp.RequestCtx) {
 				"enabled": h.app.Cfg().ScraperEnabled(),
 				"period":  scraperPeriod,
 			},
+			"top": map[string]interface{}{
+				"enabled": h.app.Cfg().TopEnabled(),
+			},
+			"transactions": map[string]interface{}{
+				"enabled": h.app.Cfg().TransactionsEnabled(),
+			},
 		},
 		"storage": map[string]interface{}{
-			"hostname": h.storage.Hostname(),
-			"earliest": h.storage.Earliest().Unix(),
-			"latest":   h.storage.Latest().Unix(),
+			"hostname":  stg.Hostname(),
+			"instances": stg.Instances(),
+			"earliest":  stg.Earliest().Unix(),
+			"latest":    stg.Latest().Unix(),
+			"archive":   string(rctx.QueryArgs().Peek("archive")),
 		},
 	})
 	if err != nil {
@@ -116,7 +153,7 @@ func (h *Handler) handleHomeRequest(rctx *fasthttp.RequestCtx) {
 	tmplData := map[string]interface{}{
 		"Version":  config.Version(),
 		"Revision": config.Revision(),
-		"Hostname": h.storage.Hostname(),
+		"Hostname": stg.Hostname(),
 		"Config":   string(cfg),
 	}
 	var renderedTmpl bytes.Buffer
@@ -139,6 +176,14 @@ func (h *Handler) handleStorageMetricsRequest(rctx *fasthttp.RequestCtx) {
 	var result map[string]interface{}
 	var err error
 
+	// Extract optional 'archive' query string parameter. If not provided, the
+	// current database is used.
+	stg, release, ok := h.acquireStorage(rctx)
+	if !ok {
+		return
+	}
+	defer release()
+
 	// Extract 'from' query string parameter.
 	from, err := h.getQueryArgsTimeParam(rctx, "from")
 	if err != nil {
@@ -163,10 +208,15 @@ func (h *Handler) handleStorageMetricsRequest(rctx *fasthttp.RequestCtx) {
 		return
 	}
 
+	// Extract 'instance' query string parameter. If not provided, samples of
+	// all instances are considered when listing metrics, but it's required to
+	// get samples of a metric if there are several instances.
+	instance := string(rctx.QueryArgs().Peek("instance"))
+
 	// If no metric ID is provided, return info about all metrics, filtering
 	// out the irrelevant (i.e., without samples) ones.
 	if idRaw == nil {
-		result, err = h.storage.GetMetrics(from, to, step)
+		result, err = stg.GetMetrics(from, to, step, instance)
 	} else {
 		// Validate metric ID.
 		var id int
@@ -185,8 +235,12 @@ func (h *Handler) handleStorageMetricsRequest(rctx *fasthttp.RequestCtx) {
 		}
 		aggregator := string(rctx.QueryArgs().Peek("aggregator"))
 
+		// Extract optional 'fill' query string parameter. If not provided,
+		// missing buckets inside gaps are left out.
+		fill := string(rctx.QueryArgs().Peek("fill"))
+
 		// Get metric data.
-		result, err = h.storage.GetMetric(id, from, to, step, aggregator)
+		result, err = stg.GetMetric(id, from, to, step, aggregator, fill, instance)
 	}
 
 	// Check for errors.
@@ -201,6 +255,12 @@ func (h *Handler) handleStorageMetricsRequest(rctx *fasthttp.RequestCtx) {
 		case errors.Is(err, storage.ErrInvalidAggregator):
 			rctx.SetStatusCode(fasthttp.StatusBadRequest)
 			rctx.SetBodyString("Invalid 'aggregator' parameter")
+		case errors.Is(err, storage.ErrInvalidFill):
+			rctx.SetStatusCode(fasthttp.StatusBadRequest)
+			rctx.SetBodyString("Invalid 'fill' parameter")
+		case errors.Is(err, storage.ErrInstanceRequired):
+			rctx.SetStatusCode(fasthttp.StatusBadRequest)
+			rctx.SetBodyString("Missing 'instance' parameter (required when there are several instances)")
 		default:
 			h.app.Cfg().Log().Error().
 				Err(err).
@@ -211,15 +271,7 @@ func (h *Handler) handleStorageMetricsRequest(rctx *fasthttp.RequestCtx) {
 	}
 
 	// Encode response.
-	if err := json.NewEncoder(rctx).Encode(result); err == nil {
-		rctx.SetContentType("application/json; charset=utf-8")
-		rctx.SetStatusCode(fasthttp.StatusOK)
-	} else {
-		h.app.Cfg().Log().Error().
-			Err(err).
-			Msg("Failed to encode response!")
-		rctx.SetStatusCode(fasthttp.StatusInternalServerError)
-	}
+	h.encodeJSONResponse(rctx, result)
 }
 
 func (h *Handler) getQueryArgsTimeParam(rctx *fasthttp.RequestCtx, name string) (time.Time, error) {
@@ -235,3 +287,411 @@ func (h *Handler) getQueryArgsTimeParam(rctx *fasthttp.RequestCtx, name string)
 
 	return time.Unix(int64(seconds), 0), nil
 }
+
+func (h *Handler) handleStorageBurstsRequest(rctx *fasthttp.RequestCtx) {
+	// Extract optional 'archive' query string parameter. If not provided, the
+	// current database is used.
+	stg, release, ok := h.acquireStorage(rctx)
+	if !ok {
+		return
+	}
+	defer release()
+
+	// Extract 'from' query string parameter.
+	from, err := h.getQueryArgsTimeParam(rctx, "from")
+	if err != nil {
+		rctx.SetStatusCode(fasthttp.StatusBadRequest)
+		rctx.SetBodyString("Invalid 'from' parameter")
+		return
+	}
+
+	// Extract 'to' query string parameter.
+	to, err := h.getQueryArgsTimeParam(rctx, "to")
+	if err != nil {
+		rctx.SetStatusCode(fasthttp.StatusBadRequest)
+		rctx.SetBodyString("Invalid 'to' parameter")
+		return
+	}
+
+	// Get bursts.
+	result, err := stg.GetBursts(from, to)
+	if err != nil {
+		if errors.Is(err, storage.ErrInvalidFromTo) {
+			rctx.SetStatusCode(fasthttp.StatusBadRequest)
+			rctx.SetBodyString("Invalid 'from' and 'to' parameters")
+		} else {
+			h.app.Cfg().Log().Error().
+				Err(err).
+				Msg("Failed to get bursts from storage!")
+			rctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		}
+		return
+	}
+
+	// Encode response.
+	h.encodeJSONResponse(rctx, result)
+}
+
+func (h *Handler) handleStorageScrapesRequest(rctx *fasthttp.RequestCtx) {
+	// Extract optional 'archive' query string parameter. If not provided, the
+	// current database is used.
+	stg, release, ok := h.acquireStorage(rctx)
+	if !ok {
+		return
+	}
+	defer release()
+
+	// Extract 'from' query string parameter.
+	from, err := h.getQueryArgsTimeParam(rctx, "from")
+	if err != nil {
+		rctx.SetStatusCode(fasthttp.StatusBadRequest)
+		rctx.SetBodyString("Invalid 'from' parameter")
+		return
+	}
+
+	// Extract 'to' query string parameter.
+	to, err := h.getQueryArgsTimeParam(rctx, "to")
+	if err != nil {
+		rctx.SetStatusCode(fasthttp.StatusBadRequest)
+		rctx.SetBodyString("Invalid 'to' parameter")
+		return
+	}
+
+	// Extract 'step' query string parameter.
+	step, err := rctx.QueryArgs().GetUint("step")
+	if err != nil {
+		rctx.SetStatusCode(fasthttp.StatusBadRequest)
+		rctx.SetBodyString("Invalid 'step' parameter")
+		return
+	}
+
+	// Extract optional 'instance' query string parameter. If not provided,
+	// scrape attempts of all instances are considered.
+	instance := string(rctx.QueryArgs().Peek("instance"))
+
+	// Get scrape attempts.
+	result, err := stg.GetScrapes(from, to, step, instance)
+	if err != nil {
+		if errors.Is(err, storage.ErrInvalidFromTo) {
+			rctx.SetStatusCode(fasthttp.StatusBadRequest)
+			rctx.SetBodyString("Invalid 'from' and 'to' parameters")
+		} else {
+			h.app.Cfg().Log().Error().
+				Err(err).
+				Msg("Failed to get scrapes from storage!")
+			rctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		}
+		return
+	}
+
+	// Encode response.
+	h.encodeJSONResponse(rctx, result)
+}
+
+func (h *Handler) handleStorageTopRequest(rctx *fasthttp.RequestCtx) {
+	// Extract optional 'archive' query string parameter. If not provided, the
+	// current database is used.
+	stg, release, ok := h.acquireStorage(rctx)
+	if !ok {
+		return
+	}
+	defer release()
+
+	// Extract 'from' query string parameter.
+	from, err := h.getQueryArgsTimeParam(rctx, "from")
+	if err != nil {
+		rctx.SetStatusCode(fasthttp.StatusBadRequest)
+		rctx.SetBodyString("Invalid 'from' parameter")
+		return
+	}
+
+	// Extract 'to' query string parameter.
+	to, err := h.getQueryArgsTimeParam(rctx, "to")
+	if err != nil {
+		rctx.SetStatusCode(fasthttp.StatusBadRequest)
+		rctx.SetBodyString("Invalid 'to' parameter")
+		return
+	}
+
+	// Extract 'dimension' query string parameter.
+	dimension := string(rctx.QueryArgs().Peek("dimension"))
+
+	// Extract optional 'order' query string parameter.
+	order := string(rctx.QueryArgs().Peek("order"))
+	if order == "" {
+		order = storage.TopOrderRequests
+	}
+
+	// Extract optional 'limit' query string parameter.
+	limit := 10
+	if rctx.QueryArgs().Has("limit") {
+		limit, err = rctx.QueryArgs().GetUint("limit")
+		if err != nil || limit < 1 || limit > maxTopLimit {
+			rctx.SetStatusCode(fasthttp.StatusBadRequest)
+			rctx.SetBodyString("Invalid 'limit' parameter")
+			return
+		}
+	}
+
+	// Extract optional 'instance' query string parameter. If not provided,
+	// rollups of all instances are considered.
+	instance := string(rctx.QueryArgs().Peek("instance"))
+
+	// Get top requests.
+	result, err := stg.GetTopRequests(from, to, dimension, order, limit, instance)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrInvalidFromTo):
+			rctx.SetStatusCode(fasthttp.StatusBadRequest)
+			rctx.SetBodyString("Invalid 'from' and 'to' parameters")
+		case errors.Is(err, storage.ErrInvalidTopDimension):
+			rctx.SetStatusCode(fasthttp.StatusBadRequest)
+			rctx.SetBodyString("Invalid 'dimension' parameter")
+		case errors.Is(err, storage.ErrInvalidTopOrder):
+			rctx.SetStatusCode(fasthttp.StatusBadRequest)
+			rctx.SetBodyString("Invalid 'order' parameter")
+		default:
+			h.app.Cfg().Log().Error().
+				Err(err).
+				Msg("Failed to get top requests from storage!")
+			rctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		}
+		return
+	}
+
+	// Encode response.
+	h.encodeJSONResponse(rctx, result)
+}
+
+func (h *Handler) handleStorageTransactionsRequest(rctx *fasthttp.RequestCtx) {
+	// Extract optional 'archive' query string parameter. If not provided, the
+	// current database is used.
+	stg, release, ok := h.acquireStorage(rctx)
+	if !ok {
+		return
+	}
+	defer release()
+
+	// Extract 'from' query string parameter.
+	from, err := h.getQueryArgsTimeParam(rctx, "from")
+	if err != nil {
+		rctx.SetStatusCode(fasthttp.StatusBadRequest)
+		rctx.SetBodyString("Invalid 'from' parameter")
+		return
+	}
+
+	// Extract 'to' query string parameter.
+	to, err := h.getQueryArgsTimeParam(rctx, "to")
+	if err != nil {
+		rctx.SetStatusCode(fasthttp.StatusBadRequest)
+		rctx.SetBodyString("Invalid 'to' parameter")
+		return
+	}
+
+	// Extract optional 'limit' query string parameter.
+	limit := defaultTransactionsLimit
+	if rctx.QueryArgs().Has("limit") {
+		limit, err = rctx.QueryArgs().GetUint("limit")
+		if err != nil || limit < 1 || limit > maxTransactionsLimit {
+			rctx.SetStatusCode(fasthttp.StatusBadRequest)
+			rctx.SetBodyString("Invalid 'limit' parameter")
+			return
+		}
+	}
+
+	// Extract optional 'instance' query string parameter. If not provided,
+	// transactions of all instances are considered.
+	instance := string(rctx.QueryArgs().Peek("instance"))
+
+	// Get transactions.
+	result, err := stg.GetTransactions(from, to, limit, instance)
+	if err != nil {
+		if errors.Is(err, storage.ErrInvalidFromTo) {
+			rctx.SetStatusCode(fasthttp.StatusBadRequest)
+			rctx.SetBodyString("Invalid 'from' and 'to' parameters")
+		} else {
+			h.app.Cfg().Log().Error().
+				Err(err).
+				Msg("Failed to get transactions from storage!")
+			rctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		}
+		return
+	}
+
+	// Encode response.
+	h.encodeJSONResponse(rctx, result)
+}
+
+func (h *Handler) handleStorageArchivesRequest(rctx *fasthttp.RequestCtx) {
+	// Get the catalog of archived database files.
+	archives, err := h.storage.Archives()
+	if err != nil {
+		h.app.Cfg().Log().Error().
+			Err(err).
+			Msg("Failed to get archives from storage!")
+		rctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		return
+	}
+
+	// Encode response.
+	items := make([]map[string]interface{}, 0, len(archives))
+	for _, archive := range archives {
+		items = append(items, map[string]interface{}{
+			"file":     archive.File,
+			"hostname": archive.Hostname,
+			"earliest": archive.Earliest.Unix(),
+			"latest":   archive.Latest.Unix(),
+			"metrics":  archive.Metrics,
+			"size":     archive.Size,
+		})
+	}
+	h.encodeJSONResponse(rctx, map[string]interface{}{
+		"archives": items,
+	})
+}
+
+func (h *Handler) handleStorageExportRequest(rctx *fasthttp.RequestCtx) {
+	// Extract optional 'archive' query string parameter. If not provided, the
+	// current database is used.
+	stg, release, ok := h.acquireStorage(rctx)
+	if !ok {
+		return
+	}
+	defer release()
+
+	// Extract 'from' query string parameter.
+	from, err := h.getQueryArgsTimeParam(rctx, "from")
+	if err != nil {
+		rctx.SetStatusCode(fasthttp.StatusBadRequest)
+		rctx.SetBodyString("Invalid 'from' parameter")
+		return
+	}
+
+	// Extract 'to' query string parameter.
+	to, err := h.getQueryArgsTimeParam(rctx, "to")
+	if err != nil {
+		rctx.SetStatusCode(fasthttp.StatusBadRequest)
+		rctx.SetBodyString("Invalid 'to' parameter")
+		return
+	}
+
+	// Extract 'step' query string parameter.
+	step, err := rctx.QueryArgs().GetUint("step")
+	if err != nil {
+		rctx.SetStatusCode(fasthttp.StatusBadRequest)
+		rctx.SetBodyString("Invalid 'step' parameter")
+		return
+	}
+
+	// Extract 'aggregator' query string parameter.
+	if !rctx.QueryArgs().Has("aggregator") {
+		rctx.SetStatusCode(fasthttp.StatusBadRequest)
+		rctx.SetBodyString("Missing 'aggregator' parameter")
+		return
+	}
+	aggregator := string(rctx.QueryArgs().Peek("aggregator"))
+
+	// Extract optional 'format' query string parameter.
+	format := string(rctx.QueryArgs().Peek("format"))
+	if format == "" {
+		format = storage.ExportFormatCSV
+	}
+	contentType, ok := exportContentTypes[format]
+	if !ok {
+		rctx.SetStatusCode(fasthttp.StatusBadRequest)
+		rctx.SetBodyString("Invalid 'format' parameter")
+		return
+	}
+
+	// Extract optional 'metric' query string parameter. If not provided, all
+	// metrics are exported.
+	filter := string(rctx.QueryArgs().Peek("metric"))
+
+	// Extract 'instance' query string parameter. It's optional only if
+	// there is a single instance.
+	instance := string(rctx.QueryArgs().Peek("instance"))
+
+	// Export samples.
+	export, err := stg.Export(from, to, step, aggregator, filter, instance, format)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrInvalidFromTo):
+			rctx.SetStatusCode(fasthttp.StatusBadRequest)
+			rctx.SetBodyString("Invalid 'from' and 'to' parameters")
+		case errors.Is(err, storage.ErrInvalidAggregator):
+			rctx.SetStatusCode(fasthttp.StatusBadRequest)
+			rctx.SetBodyString("Invalid 'aggregator' parameter")
+		case errors.Is(err, storage.ErrInstanceRequired):
+			rctx.SetStatusCode(fasthttp.StatusBadRequest)
+			rctx.SetBodyString("Missing 'instance' parameter (required when there are several instances)")
+		case errors.Is(err, storage.ErrRawSamplesExpired):
+			rctx.SetStatusCode(fasthttp.StatusBadRequest)
+			rctx.SetBodyString(
+				"Raw samples in the requested range have been removed by the retention policy; " +
+					"use a 'step' multiple of 60 seconds and an aggregator other than 'first'")
+		default:
+			h.app.Cfg().Log().Error().
+				Err(err).
+				Msg("Failed to export samples from storage!")
+			rctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		}
+		return
+	}
+
+	// Stream the exported file. It's closed (and removed) by fasthttp once
+	// the response is sent. The name of the file includes the hostname, so
+	// it's properly quoted (or encoded, if needed).
+	disposition := mime.FormatMediaType("attachment", map[string]string{
+		"filename": fmt.Sprintf("varnishmon-%s-%s-%s.%s",
+			stg.Hostname(),
+			from.UTC().Format(exportTimeLayout),
+			to.UTC().Format(exportTimeLayout),
+			format),
+	})
+	if disposition == "" {
+		disposition = "attachment"
+	}
+	rctx.SetContentType(contentType)
+	rctx.Response.Header.Set("Content-Disposition", disposition)
+	rctx.SetStatusCode(fasthttp.StatusOK)
+	rctx.SetBodyStream(export, int(export.Size))
+}
+
+// Returns the storage used to serve the request: the current database or, if
+// the 'archive' query string parameter is provided, an archived one. The
+// returned function must be called once the storage is not needed anymore. On
+// failure, the response is already set.
+func (h *Handler) acquireStorage(rctx *fasthttp.RequestCtx) (*storage.Storage, func(), bool) {
+	archive := string(rctx.QueryArgs().Peek("archive"))
+	if archive == "" {
+		return h.storage, func() {}, true
+	}
+
+	stg, release, err := h.storage.AcquireArchive(archive)
+	if err != nil {
+		if errors.Is(err, storage.ErrUnknownArchive) {
+			rctx.SetStatusCode(fasthttp.StatusNotFound)
+			rctx.SetBodyString("Unknown archive")
+		} else {
+			h.app.Cfg().Log().Error().
+				Err(err).
+				Str("archive", archive).
+				Msg("Failed to open archive!")
+			rctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		}
+		return nil, nil, false
+	}
+	return stg, release, true
+}
+
+func (h *Handler) encodeJSONResponse(rctx *fasthttp.RequestCtx, result interface{}) {
+	if err := json.NewEncoder(rctx).Encode(result); err == nil {
+		rctx.SetContentType("application/json; charset=utf-8")
+		rctx.SetStatusCode(fasthttp.StatusOK)
+	} else {
+		h.app.Cfg().Log().Error().
+			Err(err).
+			Msg("Failed to encode response!")
+		rctx.SetStatusCode(fasthttp.StatusInternalServerError)
+	}
+}
@@ -1,12 +1,16 @@
 package workers
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
 	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"gitlab.com/stone.code/assert"
 
 	"github.com/allenta/varnishmon/pkg/helpers"
 	"github.com/allenta/varnishmon/pkg/workers/storage"
@@ -15,28 +19,69 @@ import (
 type ArchiverWorker struct {
 	*worker
 	metricsQueue chan *helpers.VarnishMetrics
-	lastMetrics  map[string]*lastMetrics
-	storage      *storage.Storage
+	scrapesQueue chan *storage.Scrape
+	processor    *SampleProcessor
+	storage      archiverStorage
+	pending      []*pendingBatch
+
+	// Nil unless the spool is enabled. In that case, batches are stored by a
+	// dedicated goroutine, so the main loop never blocks on storage: batches
+	// are handed over using 'storeQueue', and they're spooled instead if the
+	// goroutine is still busy (i.e., storage is lagging behind) or if they
+	// can't be stored. The spool is opened (and never replaced) in the
+	// constructor, so it's safely read by the Prometheus collectors.
+	spool      *helpers.Spool
+	storeQueue chan []*pendingBatch
+	storerDone chan struct{}
+	// Deadline to replay the spool on shutdown. Set before closing
+	// 'storeQueue'.
+	shutdownDeadline time.Time
 
 	outOfOrderSamples prometheus.Counter
 	resetCounters     prometheus.Counter
 	truncatedSamples  prometheus.Counter
+	gapSamples        prometheus.Counter
 	pushCompleted     prometheus.Counter
 	pushFailed        prometheus.Counter
+	spoolSpooled      prometheus.Counter
+	spoolReplayed     prometheus.Counter
+	spoolDropped      prometheus.Counter
+}
+
+// Subset of the storage used by the archiver worker.
+type archiverStorage interface {
+	GetLatestCounters(since time.Time) ([]*storage.CounterValue, error)
+	PushMetricSampleBatches(batches []*storage.MetricSampleBatch) error
+	PushScrape(scrape *storage.Scrape) error
 }
 
-type lastMetrics struct {
-	timestamp time.Time
-	value     uint64
+// A batch of samples waiting to be stored, together with the outcome of the
+// scrape attempt, which is only recorded once the batch has been stored (or
+// discarded). Fields are exported so they can be encoded in the spool.
+type pendingBatch struct {
+	Batch  *storage.MetricSampleBatch
+	Scrape *storage.Scrape
 }
 
+const (
+	// Time to wait before trying to replay the spool again after a failure.
+	spoolReplayBackoff = 5 * time.Second
+)
+
+var (
+	errStorageLagging = errors.New("storage is lagging behind")
+	errSpoolNotEmpty  = errors.New("spooled batches are waiting to be replayed")
+)
+
 func NewArchiverWorker(
 	ctx context.Context, wg *sync.WaitGroup, app Application,
 	metricsQueue chan *helpers.VarnishMetrics,
+	scrapesQueue chan *storage.Scrape,
 	storage *storage.Storage) *ArchiverWorker {
 	aw := &ArchiverWorker{
 		metricsQueue: metricsQueue,
-		lastMetrics:  make(map[string]*lastMetrics),
+		scrapesQueue: scrapesQueue,
+		processor:    NewSampleProcessor(app),
 		storage:      storage,
 
 		outOfOrderSamples: prometheus.NewCounter(
@@ -54,6 +99,11 @@ func NewArchiverWorker(
 				Name: "archiver_truncated_samples_total",
 				Help: "Samples (bitmaps excluded) truncated by the archiver worker",
 			}),
+		gapSamples: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "archiver_gap_samples_total",
+				Help: "Rates discarded by the archiver worker because of gaps since the previous sample",
+			}),
 		pushCompleted: prometheus.NewCounter(
 			prometheus.CounterOpts{
 				Name: "archiver_push_completed_total",
@@ -64,6 +114,21 @@ func NewArchiverWorker(
 				Name: "archiver_push_failed_total",
 				Help: "Failed pushes of batches of samples by the archiver worker",
 			}),
+		spoolSpooled: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "archiver_spool_spooled_total",
+				Help: "Batches of samples written to the spool by the archiver worker",
+			}),
+		spoolReplayed: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "archiver_spool_replayed_total",
+				Help: "Batches of samples replayed from the spool by the archiver worker",
+			}),
+		spoolDropped: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "archiver_spool_dropped_total",
+				Help: "Batches of samples that could not be written to or replayed from the spool",
+			}),
 	}
 
 	aw.worker = &worker{
@@ -79,116 +144,469 @@ func NewArchiverWorker(
 	aw.app.Cfg().Metrics().Registry.MustRegister(aw.outOfOrderSamples)
 	aw.app.Cfg().Metrics().Registry.MustRegister(aw.resetCounters)
 	aw.app.Cfg().Metrics().Registry.MustRegister(aw.truncatedSamples)
+	aw.app.Cfg().Metrics().Registry.MustRegister(aw.gapSamples)
 	aw.app.Cfg().Metrics().Registry.MustRegister(aw.pushCompleted)
 	aw.app.Cfg().Metrics().Registry.MustRegister(aw.pushFailed)
 
+	if aw.app.Cfg().DBSpoolEnabled() {
+		// Open the spool, loading entries left by previous executions, if
+		// any.
+		var err error
+		directory := aw.app.Cfg().DBSpoolDirectory()
+		if aw.spool, err = helpers.NewSpool(
+			directory, 0640,
+			int64(aw.app.Cfg().DBSpoolMaxSize())*1024*1024); err != nil {
+			aw.app.Cfg().Log().Fatal().
+				Err(err).
+				Str("directory", directory).
+				Msg("Failed to open spool!")
+		}
+		if depth := aw.spool.Len(); depth > 0 {
+			aw.app.Cfg().Log().Info().
+				Int("count", depth).
+				Str("directory", directory).
+				Msg("Found spooled batches of samples, they will be replayed")
+		}
+
+		// The queue is unbuffered, so batches are only handed over when the
+		// storer goroutine is idle, and they're never overtaken by newer
+		// batches spooled in the meantime.
+		aw.storeQueue = make(chan []*pendingBatch)
+		aw.storerDone = make(chan struct{})
+
+		aw.app.Cfg().Metrics().Registry.MustRegister(aw.spoolSpooled)
+		aw.app.Cfg().Metrics().Registry.MustRegister(aw.spoolReplayed)
+		aw.app.Cfg().Metrics().Registry.MustRegister(aw.spoolDropped)
+		aw.app.Cfg().Metrics().Registry.MustRegister(prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name: "archiver_spool_depth",
+				Help: "Entries (i.e., sets of batches of samples) in the archiver spool",
+			},
+			func() float64 {
+				return float64(aw.spool.Len())
+			},
+		))
+		aw.app.Cfg().Metrics().Registry.MustRegister(prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name: "archiver_spool_size_bytes",
+				Help: "Size of the archiver spool",
+			},
+			func() float64 {
+				return float64(aw.spool.Size())
+			},
+		))
+		aw.app.Cfg().Metrics().Registry.MustRegister(prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name: "archiver_spool_replay_lag_seconds",
+				Help: "Age of the oldest samples waiting to be replayed from the archiver spool",
+			},
+			func() float64 {
+				if oldest := aw.spool.Oldest(); !oldest.IsZero() {
+					return time.Since(oldest).Seconds()
+				}
+				return 0
+			},
+		))
+	}
+
 	return aw
 }
 
 func (aw *ArchiverWorker) init() {
+	// Resume from the latest raw values of counters stored in the database,
+	// so the first sample of every counter after a restart is not lost.
+	maxAge := aw.app.Cfg().MetricsResumeMaxAge()
+	if maxAge == 0 {
+		return
+	}
+	counters, err := aw.storage.GetLatestCounters(time.Now().Add(-maxAge))
+	if err != nil {
+		aw.app.Cfg().Log().Error().
+			Err(err).
+			Msg("Failed to fetch latest raw values of counters!")
+		return
+	}
+	aw.processor.Seed(counters)
+	aw.app.Cfg().Log().Info().
+		Int("count", len(counters)).
+		Msg("Resumed latest raw values of counters")
 }
 
 func (aw *ArchiverWorker) run() {
+	if aw.spool != nil {
+		go aw.store()
+	}
+
+	// Batches of samples are stored once 'db.batch-size' scrapes are pending,
+	// or once the oldest one has been pending for 'db.batch-max-delay'.
+	var flushTimer *time.Timer
+	var flushC <-chan time.Time
+	flush := func() {
+		if flushTimer != nil {
+			flushTimer.Stop()
+			flushTimer, flushC = nil, nil
+		}
+		aw.flush()
+	}
+
 	for {
 		select {
 		case <-aw.ctx.Done():
+			aw.shutdown()
 			return
+		case <-flushC:
+			flush()
+		case scrape := <-aw.scrapesQueue:
+			aw.pushScrape(scrape)
 		case metrics := <-aw.metricsQueue:
-			batch := make([]*storage.MetricSample, 0, len(metrics.Items))
-
-			for name, details := range metrics.Items {
-				// Check if this is the first time seeing the metric.
-				previousMetric, ok := aw.lastMetrics[name]
-				if !ok {
-					aw.lastMetrics[name] = &lastMetrics{
-						timestamp: metrics.Timestamp,
-						value:     details.Value,
-					}
-				}
+			if aw.enqueue(metrics) {
+				flush()
+			} else if flushTimer == nil {
+				flushTimer = time.NewTimer(aw.app.Cfg().DBBatchMaxDelay())
+				flushC = flushTimer.C
+			}
+		}
+	}
+}
 
-				var value any
-				if details.IsCounter() && !details.HasDurationFormat() {
-					// Counters are stored as rates, so we need to calculate the
-					// rate based on the previously seen value. However, there
-					// is a special case for uptimes (i.e., 'd' format in the
-					// 'varnishstat' output) which are handled as gauges.
-					// Otherwise, the rate per second of an uptime would be
-					// pretty much useless.
-
-					// Skip if this is the first time seeing the metric:
-					// counters are stored as rates calculated based on the
-					// previously seen value.
-					if previousMetric == nil {
-						continue
-					}
-
-					// Skip if this is an out-of-order sample.
-					if !metrics.Timestamp.After(previousMetric.timestamp) {
-						aw.outOfOrderSamples.Inc()
-						continue
-					}
-
-					// Skip if this looks like a reset of the counter.
-					if details.Value < previousMetric.value {
-						previousMetric.timestamp = metrics.Timestamp
-						previousMetric.value = details.Value
-						aw.resetCounters.Inc()
-						continue
-					}
-
-					// Transform the 'uint64' value of the counter into a
-					// 'float64' rate per second.
-					value = float64(details.Value-previousMetric.value) /
-						metrics.Timestamp.Sub(previousMetric.timestamp).Seconds()
-				} else {
-					// Skip if this is an out-of-order sample. Not strictly
-					// necessary here, but it is nice to keep things consistent.
-					if previousMetric != nil &&
-						!metrics.Timestamp.After(previousMetric.timestamp) {
-						aw.outOfOrderSamples.Inc()
-						continue
-					}
-
-					// Transform the 'uint64' value of the metric by dropping
-					// the highest bit. See: https://github.com/golang/go/issues/6113.
-					if !details.IsBitmap() && details.Value&0x8000000000000000 != 0 {
-						aw.truncatedSamples.Inc()
-					}
-					value = details.Value & 0x7FFFFFFFFFFFFFFF
-				}
+// Stores whatever is still queued or pending before termination, for up to
+// 'db.shutdown-timeout'. Storage is shut down only after all workers have
+// stopped. Producers have been requested to stop too, so queues are expected
+// to be drained quickly.
+func (aw *ArchiverWorker) shutdown() {
+	deadline := time.Now().Add(aw.app.Cfg().DBShutdownTimeout())
 
-				// At this point a value should have been set.
-				assert.Assert(value != nil, "invalid value")
+loop:
+	for time.Now().Before(deadline) {
+		select {
+		case scrape := <-aw.scrapesQueue:
+			aw.pushScrape(scrape)
+		case metrics := <-aw.metricsQueue:
+			if aw.enqueue(metrics) {
+				aw.flush()
+			}
+		default:
+			break loop
+		}
+	}
+	aw.flush()
 
-				// Update the last seen value of the metric.
-				if previousMetric != nil {
-					previousMetric.timestamp = metrics.Timestamp
-					previousMetric.value = details.Value
-				}
+	// Wait for the storer goroutine, which replays the spool until it's empty
+	// or the deadline is reached.
+	if aw.spool != nil {
+		aw.shutdownDeadline = deadline
+		close(aw.storeQueue)
+		<-aw.storerDone
+	}
+}
+
+// Processes the metrics and appends them to the pending batches. Returns true
+// if the pending batches should be flushed.
+func (aw *ArchiverWorker) enqueue(metrics *helpers.VarnishMetrics) bool {
+	batch, stats := aw.processor.Process(metrics)
+	aw.outOfOrderSamples.Add(float64(stats.OutOfOrderSamples))
+	aw.resetCounters.Add(float64(stats.ResetCounters))
+	aw.truncatedSamples.Add(float64(stats.TruncatedSamples))
+	aw.gapSamples.Add(float64(stats.GapSamples))
+
+	// Queue the batch, along with the outcome of the scrape attempt, so gaps
+	// in the timeseries can be explained later on.
+	aw.pending = append(aw.pending, &pendingBatch{
+		Batch: &storage.MetricSampleBatch{
+			Instance:  metrics.Instance,
+			Timestamp: metrics.Timestamp,
+			Samples:   batch,
+		},
+		Scrape: &storage.Scrape{
+			Instance:  metrics.Instance,
+			Timestamp: metrics.Timestamp,
+			Duration:  metrics.Duration,
+			Outcome:   storage.ScrapeOutcomeOK,
+			Metrics:   len(metrics.Items),
+		},
+	})
+
+	return len(aw.pending) >= aw.app.Cfg().DBBatchSize()
+}
+
+// Stores pending batches of samples in a single transaction, either directly
+// or, if the spool is enabled, handing them over to the storer goroutine.
+func (aw *ArchiverWorker) flush() {
+	if len(aw.pending) == 0 {
+		return
+	}
+	pending := aw.pending
+	aw.pending = nil
+
+	if aw.spool == nil {
+		aw.storeBatches(pending)
+		return
+	}
+
+	// Avoid blocking if the storer goroutine is still busy with previous
+	// batches.
+	select {
+	case aw.storeQueue <- pending:
+	default:
+		aw.spoolBatches(pending, errStorageLagging)
+	}
+}
+
+// Stores batches of samples in a single transaction and records the outcome
+// of the corresponding scrape attempts. Failed batches are spooled, if
+// enabled, unless some of them were stored: batches rejected one by one
+// would be rejected again, so they're discarded.
+func (aw *ArchiverWorker) storeBatches(pending []*pendingBatch) {
+	if err := aw.storage.PushMetricSampleBatches(pendingBatches(pending)); err != nil {
+		var partial *storage.PartialPushError
+		if errors.As(err, &partial) {
+			aw.storePartialBatches(pending, partial)
+			return
+		}
+
+		aw.pushFailed.Add(float64(len(pending)))
+		if aw.spool != nil {
+			aw.spoolBatches(pending, err)
+		} else {
+			aw.discardBatches(pending, err)
+		}
+		return
+	}
 
-				// Append the metric sample to the batch.
-				batch = append(batch, &storage.MetricSample{
-					Name:        name,
-					Flag:        details.Flag,
-					Format:      details.Format,
-					Description: details.Description,
-					Value:       value,
-				})
+	aw.pushCompleted.Add(float64(len(pending)))
+	for _, p := range pending {
+		aw.pushScrape(p.Scrape)
+	}
+}
+
+// Records the outcome of scrape attempts after a push where only some of the
+// batches of samples could be stored. Returns the number of stored batches.
+func (aw *ArchiverWorker) storePartialBatches(
+	pending []*pendingBatch, partial *storage.PartialPushError) int {
+	stored := 0
+	for i, p := range pending {
+		if err := partial.Errors[i]; err != nil {
+			aw.pushFailed.Inc()
+			aw.discardBatches([]*pendingBatch{p}, err)
+		} else {
+			stored++
+			aw.pushCompleted.Inc()
+			aw.pushScrape(p.Scrape)
+		}
+	}
+	return stored
+}
+
+// Records the outcome of scrape attempts whose batches of samples could not be
+// stored.
+func (aw *ArchiverWorker) discardBatches(pending []*pendingBatch, err error) {
+	samples := 0
+	for _, p := range pending {
+		samples += len(p.Batch.Samples)
+	}
+	aw.app.Cfg().Log().Error().
+		Err(err).
+		Int("batches", len(pending)).
+		Int("count", samples).
+		Msg("Failed to store batches of samples!")
+
+	for _, p := range pending {
+		p.Scrape.Outcome = storage.ScrapeOutcomeStoreFailed
+		p.Scrape.Error = err.Error()
+		aw.pushScrape(p.Scrape)
+	}
+}
+
+// Writes batches of samples that could not be stored because of 'cause' to
+// the spool, so they're replayed later.
+func (aw *ArchiverWorker) spoolBatches(pending []*pendingBatch, cause error) {
+	data, err := encodePendingBatches(pending)
+	if err == nil {
+		err = aw.spool.Push(pending[0].Batch.Timestamp, data)
+	}
+	if err != nil {
+		aw.spoolDropped.Add(float64(len(pending)))
+		aw.app.Cfg().Log().Error().
+			Err(err).
+			Int("batches", len(pending)).
+			Msg("Failed to spool batches of samples!")
+		aw.discardBatches(pending, cause)
+		return
+	}
+
+	aw.spoolSpooled.Add(float64(len(pending)))
+	aw.app.Cfg().Log().Warn().
+		Err(cause).
+		Int("batches", len(pending)).
+		Int("depth", aw.spool.Len()).
+		Msg("Batches of samples spooled")
+}
+
+// Core logic of the storer goroutine: stores batches handed over by the main
+// loop, and replays the spool whenever it's not empty. Spooled batches are
+// replayed first, and new batches are appended to the spool until it's empty,
+// so samples are stored in order. On shutdown (i.e., once 'storeQueue' is
+// closed), the spool is replayed until it's empty or the shutdown deadline is
+// reached. Whatever is left is kept for the next start.
+func (aw *ArchiverWorker) store() {
+	defer close(aw.storerDone)
+
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+	var nextReplay time.Time
+
+	handle := func(pending []*pendingBatch, ok bool) bool {
+		switch {
+		case !ok:
+			aw.drainSpool()
+			return false
+		case aw.spool.Len() > 0:
+			aw.spoolBatches(pending, errSpoolNotEmpty)
+		default:
+			aw.storeBatches(pending)
+		}
+		return true
+	}
+
+	for {
+		select {
+		case pending, ok := <-aw.storeQueue:
+			if !handle(pending, ok) {
+				return
+			}
+			continue
+		default:
+		}
+
+		if aw.spool.Len() > 0 && time.Now().After(nextReplay) {
+			if !aw.replay() {
+				nextReplay = time.Now().Add(spoolReplayBackoff)
+			}
+			continue
+		}
+
+		select {
+		case pending, ok := <-aw.storeQueue:
+			if !handle(pending, ok) {
+				return
 			}
+		case <-ticker.C:
+		}
+	}
+}
 
-			if err := aw.storage.PushMetricSamples(metrics.Timestamp, batch); err != nil {
-				aw.pushFailed.Inc()
-				aw.app.Cfg().Log().Error().
-					Err(err).
-					Time("timestamp", metrics.Timestamp).
-					Int("count", len(batch)).
-					Msg("Failed to store batch of samples!")
-			} else {
-				aw.pushCompleted.Inc()
+func (aw *ArchiverWorker) drainSpool() {
+	for aw.spool.Len() > 0 && time.Now().Before(aw.shutdownDeadline) {
+		if !aw.replay() {
+			break
+		}
+	}
+
+	if depth := aw.spool.Len(); depth > 0 {
+		aw.app.Cfg().Log().Warn().
+			Int("count", depth).
+			Msg("Spooled batches of samples kept for the next start")
+	}
+}
+
+// Stores the oldest entry of the spool. Returns false if it failed and should
+// be retried later.
+func (aw *ArchiverWorker) replay() bool {
+	data, _, ok, err := aw.spool.Peek()
+	if err != nil {
+		aw.app.Cfg().Log().Error().
+			Err(err).
+			Msg("Failed to read spooled batches of samples!")
+		return false
+	}
+	if !ok {
+		return true
+	}
+
+	pending, err := decodePendingBatches(data)
+	if err != nil {
+		// Corrupted entries can't ever be replayed, so they're discarded.
+		aw.spoolDropped.Inc()
+		aw.app.Cfg().Log().Error().
+			Err(err).
+			Msg("Failed to decode spooled batches of samples, discarding them!")
+	} else {
+		// Batches rejected one by one would be rejected again, so they're
+		// discarded.
+		var partial *storage.PartialPushError
+		err = aw.storage.PushMetricSampleBatches(pendingBatches(pending))
+		switch {
+		case err == nil:
+			aw.pushCompleted.Add(float64(len(pending)))
+			aw.spoolReplayed.Add(float64(len(pending)))
+			for _, p := range pending {
+				aw.pushScrape(p.Scrape)
 			}
+		case errors.As(err, &partial):
+			aw.spoolReplayed.Add(float64(aw.storePartialBatches(pending, partial)))
+		default:
+			aw.app.Cfg().Log().Warn().
+				Err(err).
+				Int("depth", aw.spool.Len()).
+				Msg("Failed to replay spooled batches of samples")
+			return false
 		}
 	}
+
+	if err := aw.spool.Pop(); err != nil {
+		aw.app.Cfg().Log().Error().
+			Err(err).
+			Msg("Failed to remove spooled batches of samples!")
+		return false
+	}
+	return true
+}
+
+func (aw *ArchiverWorker) pushScrape(scrape *storage.Scrape) {
+	if err := aw.storage.PushScrape(scrape); err != nil {
+		aw.app.Cfg().Log().Error().
+			Err(err).
+			Str("instance", scrape.Instance).
+			Str("outcome", scrape.Outcome).
+			Msg("Failed to store scrape outcome!")
+	}
 }
 
 func (aw *ArchiverWorker) stop() {
 }
+
+func pendingBatches(pending []*pendingBatch) []*storage.MetricSampleBatch {
+	result := make([]*storage.MetricSampleBatch, 0, len(pending))
+	for _, p := range pending {
+		result = append(result, p.Batch)
+	}
+	return result
+}
+
+func encodePendingBatches(pending []*pendingBatch) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer, err := gzip.NewWriterLevel(&buffer, gzip.BestSpeed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gzip writer: %w", err)
+	}
+	if err := gob.NewEncoder(writer).Encode(pending); err != nil {
+		return nil, fmt.Errorf("failed to encode batches: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close gzip writer: %w", err)
+	}
+	return buffer.Bytes(), nil
+}
+
+func decodePendingBatches(data []byte) ([]*pendingBatch, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gzip reader: %w", err)
+	}
+	defer reader.Close()
+	var pending []*pendingBatch
+	if err := gob.NewDecoder(reader).Decode(&pending); err != nil {
+		return nil, fmt.Errorf("failed to decode batches: %w", err)
+	}
+	return pending, nil
+}
@@ -0,0 +1,244 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/allenta/varnishmon/pkg/helpers"
+	"github.com/allenta/varnishmon/pkg/testutil"
+	"github.com/allenta/varnishmon/pkg/workers/storage"
+	"github.com/stretchr/testify/suite"
+)
+
+type ArchiverTestSuite struct {
+	suite.Suite
+	spoolDir string
+}
+
+// Fake storage recording the timestamps of stored batches. Pushes fail while
+// 'fail' is set, and take 'delay' to complete. Batches with timestamps in
+// 'reject' are never stored, but the rest of batches pushed along with them
+// are.
+type fakeArchiverStorage struct {
+	mutex      sync.Mutex
+	fail       bool
+	delay      time.Duration
+	reject     map[time.Time]bool
+	timestamps []time.Time
+}
+
+func (fs *fakeArchiverStorage) GetLatestCounters(since time.Time) ([]*storage.CounterValue, error) {
+	return nil, nil
+}
+
+func (fs *fakeArchiverStorage) PushMetricSampleBatches(batches []*storage.MetricSampleBatch) error {
+	time.Sleep(fs.delay)
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if fs.fail {
+		return errors.New("storage is down")
+	}
+	errs := make([]error, len(batches))
+	rejected := 0
+	for i, batch := range batches {
+		if fs.reject[batch.Timestamp] {
+			errs[i] = errors.New("duplicated samples")
+			rejected++
+		} else {
+			fs.timestamps = append(fs.timestamps, batch.Timestamp)
+		}
+	}
+	if rejected > 0 {
+		return &storage.PartialPushError{Errors: errs}
+	}
+	return nil
+}
+
+func (fs *fakeArchiverStorage) PushScrape(scrape *storage.Scrape) error {
+	return nil
+}
+
+func (fs *fakeArchiverStorage) stored() []time.Time {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	return append([]time.Time(nil), fs.timestamps...)
+}
+
+func (suite *ArchiverTestSuite) BeforeTest(suiteName, testName string) {
+	suite.spoolDir = suite.T().TempDir()
+}
+
+// Starts an archiver worker using a spool in 'spoolDir' and the given fake
+// storage. Returns a function stopping the worker and waiting for it.
+func (suite *ArchiverTestSuite) start(
+	fs *fakeArchiverStorage, settings ...interface{}) (*ArchiverWorker, chan *helpers.VarnishMetrics, func()) {
+	app := new(MockApplication)
+	app.
+		On("Cfg").
+		Return(testutil.NewConfig(
+			suite.T(),
+			append([]interface{}{
+				"global.loglevel", "error",
+				"scraper.enabled", false,
+				"api.enabled", false,
+				"db.file", "",
+				"db.spool.enabled", true,
+				"db.spool.directory", suite.spoolDir,
+			}, settings...)...))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	metricsQueue := make(chan *helpers.VarnishMetrics)
+	aw := NewArchiverWorker(ctx, wg, app, metricsQueue, make(chan *storage.Scrape), nil)
+	aw.storage = fs
+	aw.Start()
+
+	return aw, metricsQueue, func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+// Writes batches with the given timestamps to the spool, one entry per batch.
+func (suite *ArchiverTestSuite) spool(timestamps ...time.Time) {
+	spool, err := helpers.NewSpool(suite.spoolDir, 0640, 1024*1024)
+	suite.Require().NoError(err)
+	for _, timestamp := range timestamps {
+		data, err := encodePendingBatches([]*pendingBatch{{
+			Batch:  &storage.MetricSampleBatch{Instance: "foo", Timestamp: timestamp},
+			Scrape: &storage.Scrape{Instance: "foo", Timestamp: timestamp, Outcome: storage.ScrapeOutcomeOK},
+		}})
+		suite.Require().NoError(err)
+		suite.Require().NoError(spool.Push(timestamp, data))
+	}
+}
+
+func metrics(timestamp time.Time) *helpers.VarnishMetrics {
+	return &helpers.VarnishMetrics{
+		Instance:  "foo",
+		Timestamp: timestamp,
+		Items: map[string]*helpers.VarnishMetricDetails{
+			"MAIN.n_backend": {Description: "Number of backends", Flag: "g", Format: "i", Value: 1},
+		},
+	}
+}
+
+func (suite *ArchiverTestSuite) TestFailingStorageSpoolsBatches() {
+	assert := suite.Require()
+
+	fs := &fakeArchiverStorage{fail: true}
+	aw, metricsQueue, stop := suite.start(fs, "db.shutdown-timeout", 0)
+
+	base := time.Date(2025, time.January, 1, 13, 0, 0, 0, time.UTC)
+	for i := range 3 {
+		metricsQueue <- metrics(base.Add(time.Duration(i) * time.Minute))
+	}
+	assert.Eventually(func() bool {
+		return aw.spool.Len() == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	stop()
+
+	// Nothing is stored, and everything is kept for the next start.
+	assert.Empty(fs.stored())
+	assert.Equal(3, aw.spool.Len())
+	assert.Equal(base, aw.spool.Oldest())
+
+	assert.Len(aw.app.Cfg().Log().Buffer().Events(), 0)
+}
+
+func (suite *ArchiverTestSuite) TestRecoveringStorageReplaysInOrder() {
+	assert := suite.Require()
+
+	base := time.Date(2025, time.January, 1, 13, 0, 0, 0, time.UTC)
+	suite.spool(base, base.Add(time.Minute), base.Add(2*time.Minute))
+
+	// New batches are only stored once older spooled ones have been replayed,
+	// even if the storage is slow.
+	fs := &fakeArchiverStorage{delay: 50 * time.Millisecond}
+	aw, metricsQueue, stop := suite.start(fs)
+	metricsQueue <- metrics(base.Add(3 * time.Minute))
+	metricsQueue <- metrics(base.Add(4 * time.Minute))
+	assert.Eventually(func() bool {
+		return len(fs.stored()) == 5
+	}, 5*time.Second, 10*time.Millisecond)
+	stop()
+
+	assert.Equal([]time.Time{
+		base,
+		base.Add(time.Minute),
+		base.Add(2 * time.Minute),
+		base.Add(3 * time.Minute),
+		base.Add(4 * time.Minute),
+	}, fs.stored())
+	assert.Equal(0, aw.spool.Len())
+
+	assert.Len(aw.app.Cfg().Log().Buffer().Events(), 0)
+}
+
+func (suite *ArchiverTestSuite) TestPartialReplayDiscardsRejectedBatches() {
+	assert := suite.Require()
+
+	// A single spool entry with three batches, one of them rejected.
+	base := time.Date(2025, time.January, 1, 13, 0, 0, 0, time.UTC)
+	pending := make([]*pendingBatch, 0, 3)
+	for i := range 3 {
+		timestamp := base.Add(time.Duration(i) * time.Minute)
+		pending = append(pending, &pendingBatch{
+			Batch:  &storage.MetricSampleBatch{Instance: "foo", Timestamp: timestamp},
+			Scrape: &storage.Scrape{Instance: "foo", Timestamp: timestamp, Outcome: storage.ScrapeOutcomeOK},
+		})
+	}
+	spool, err := helpers.NewSpool(suite.spoolDir, 0640, 1024*1024)
+	assert.NoError(err)
+	data, err := encodePendingBatches(pending)
+	assert.NoError(err)
+	assert.NoError(spool.Push(base, data))
+
+	// The rest of batches are stored, and the entry is not retried.
+	fs := &fakeArchiverStorage{reject: map[time.Time]bool{base.Add(time.Minute): true}}
+	aw, _, stop := suite.start(fs)
+	assert.Eventually(func() bool {
+		return len(fs.stored()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	stop()
+
+	assert.Equal([]time.Time{base, base.Add(2 * time.Minute)}, fs.stored())
+	assert.Equal(0, aw.spool.Len())
+	assert.InDelta(2, promtestutil.ToFloat64(aw.spoolReplayed), 0)
+	assert.InDelta(1, promtestutil.ToFloat64(aw.pushFailed), 0)
+
+	events := aw.app.Cfg().Log().Buffer().Events()
+	assert.Len(events, 1)
+	assert.Equal("Failed to store batches of samples!", events[0]["message"])
+}
+
+func (suite *ArchiverTestSuite) TestShutdownHonorsDeadline() {
+	assert := suite.Require()
+
+	base := time.Date(2025, time.January, 1, 13, 0, 0, 0, time.UTC)
+	timestamps := make([]time.Time, 0, 50)
+	for i := range 50 {
+		timestamps = append(timestamps, base.Add(time.Duration(i)*time.Minute))
+	}
+	suite.spool(timestamps...)
+
+	// Replaying the whole spool would take 5 seconds.
+	fs := &fakeArchiverStorage{delay: 100 * time.Millisecond}
+	aw, _, stop := suite.start(fs, "db.shutdown-timeout", "500ms")
+	start := time.Now()
+	stop()
+
+	assert.Less(time.Since(start), 2*time.Second)
+	assert.NotEmpty(fs.stored())
+	assert.Equal(50, len(fs.stored())+aw.spool.Len())
+	assert.Equal(timestamps[:len(fs.stored())], fs.stored())
+}
+
+func TestArchiverTestSuite(t *testing.T) {
+	suite.Run(t, &ArchiverTestSuite{})
+}
@@ -0,0 +1,62 @@
+package workers
+
+import (
+	"sync"
+	"time"
+)
+
+// Shared state of on-demand high-resolution scraping windows (a.k.a. bursts).
+// During a burst, scraper targets running in 'exec' mode temporarily use the
+// burst period instead of their own, if shorter.
+type bursts struct {
+	mutex  sync.RWMutex
+	period time.Duration
+	until  time.Time
+	// Closed (and replaced) every time a new burst is started, so scrapers
+	// waiting for the next tick can reschedule it right away.
+	changed chan struct{}
+}
+
+func newBursts() *bursts {
+	return &bursts{
+		changed: make(chan struct{}),
+	}
+}
+
+func (b *bursts) start(period time.Duration, until time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.period = period
+	b.until = until
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// Returns the time of the next tick of a scraper using 'period', aligned to the
+// wall clock, the period actually used to schedule it (i.e., the one of the
+// ongoing burst, if any), and a channel closed as soon as a new burst is
+// started. Ticks of an ongoing burst past its end are discarded in favour of
+// the regular ones.
+func (b *bursts) nextTick(period time.Duration) (time.Time, time.Duration, <-chan struct{}) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	now := time.Now()
+	if now.Before(b.until) && b.period < period {
+		if next := nextAlignedTick(now, b.period); !next.After(b.until) {
+			return next, b.period, b.changed
+		}
+	}
+	return nextAlignedTick(now, period), period, b.changed
+}
+
+// Returns the first multiple of 'period' since the Unix epoch after 'now'.
+// Unlike 'time.Truncate()', which works since the zero time, this keeps ticks
+// aligned to Unix timestamps (i.e., the ones used as bucket boundaries when
+// aggregating timeseries) for any period, and not only for those dividing a
+// day.
+func nextAlignedTick(now time.Time, period time.Duration) time.Time {
+	offset := time.Duration(now.UnixNano() % int64(period))
+	return now.Add(period - offset)
+}
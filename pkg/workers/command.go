@@ -0,0 +1,134 @@
+package workers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	supervisedCommandMinBackoff = 1 * time.Second
+	supervisedCommandMaxBackoff = 1 * time.Minute
+	supervisedCommandWaitDelay  = 5 * time.Second
+
+	// Beware of the hardcoded limit here: lines longer than this (e.g., huge
+	// 'varnishstat' JSON documents) are considered a failure of the command,
+	// which is then restarted.
+	supervisedCommandMaxLineSize = 64 * 1024 * 1024
+)
+
+// Long-lived child process owned by a worker. The command is (re)started, with
+// exponential backoff, whenever it terminates, until the context is cancelled.
+// Every non-empty line (see 'emptyLines') written by the command to stdout is
+// passed to the 'onLine' callback (beware the slice is only valid during the
+// call), while lines written to stderr are logged.
+type supervisedCommand struct {
+	app     Application
+	id      string
+	command []string
+	onLine  func(line []byte)
+	// Whether empty lines are also passed to the 'onLine' callback (e.g., when
+	// they are used as separators).
+	emptyLines bool
+	// Optional callback executed every time the command terminates, unless
+	// the termination is caused by the cancellation of the context.
+	onExit func(err error)
+}
+
+func (sc *supervisedCommand) run(ctx context.Context) {
+	backoff := supervisedCommandMinBackoff
+	for {
+		start := time.Now()
+		err := sc.runOnce(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if sc.onExit != nil {
+			sc.onExit(err)
+		}
+
+		// Reset the backoff if the command has been running long enough.
+		// Otherwise, keep increasing it to avoid hammering the system with a
+		// command failing again and again.
+		if time.Since(start) >= supervisedCommandMaxBackoff {
+			backoff = supervisedCommandMinBackoff
+		}
+
+		sc.app.Cfg().Log().Error().
+			Err(err).
+			Str("command", sc.id).
+			Dur("backoff", backoff).
+			Msg("Long-lived command terminated, restarting it!")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff = min(2*backoff, supervisedCommandMaxBackoff)
+	}
+}
+
+func (sc *supervisedCommand) runOnce(ctx context.Context) error {
+	// See notes in 'ScraperWorker.scrape()' about killing the whole process
+	// group on cancellation.
+	cmd := exec.CommandContext(ctx, sc.command[0], sc.command[1:]...) //nolint:gosec
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = supervisedCommandWaitDelay
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	// Log whatever is written to stderr.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			sc.app.Cfg().Log().Warn().
+				Str("command", sc.id).
+				Str("output", scanner.Text()).
+				Msg("Long-lived command wrote to stderr")
+		}
+	}()
+
+	// Process stdout line by line until EOF. If reading fails (e.g., line too
+	// long), kill the command; it will be restarted by the caller.
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 0, 64*1024), supervisedCommandMaxLineSize)
+	for scanner.Scan() {
+		if line := scanner.Bytes(); sc.emptyLines || len(bytes.TrimSpace(line)) > 0 {
+			sc.onLine(line)
+		}
+	}
+	scanErr := scanner.Err()
+	if scanErr != nil {
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+
+	waitErr := cmd.Wait()
+	wg.Wait()
+
+	return errors.Join(scanErr, waitErr)
+}
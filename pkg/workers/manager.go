@@ -2,7 +2,12 @@ package workers
 
 import (
 	"context"
+	"fmt"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/allenta/varnishmon/pkg/helpers"
 	"github.com/allenta/varnishmon/pkg/workers/api"
@@ -17,16 +22,21 @@ type Manager struct {
 	app        Application
 
 	metricsQueue chan *helpers.VarnishMetrics
+	scrapesQueue chan *storage.Scrape
+	bursts       *bursts
 
 	storage *storage.Storage
+	// Nil unless the raw archive is enabled.
+	rawArchive *helpers.RawArchiveWriter
 }
 
 func NewManager(app Application) *Manager {
 	m := &Manager{
-		wg:  &sync.WaitGroup{},
-		app: app,
-		// Beware of the hardcoded buffer size here.
-		metricsQueue: make(chan *helpers.VarnishMetrics, 1024),
+		wg:           &sync.WaitGroup{},
+		app:          app,
+		metricsQueue: make(chan *helpers.VarnishMetrics, app.Cfg().DBQueueSize()),
+		scrapesQueue: make(chan *storage.Scrape, app.Cfg().DBQueueSize()),
+		bursts:       newBursts(),
 	}
 
 	m.ctx, m.cancelFunc = context.WithCancel(context.Background())
@@ -48,12 +58,40 @@ func (m *Manager) Start() {
 	m.storage = storage.NewStorage(m.app)
 
 	if m.app.Cfg().ScraperEnabled() {
-		NewScraperWorker(m.ctx, m.wg, m.app, m.metricsQueue).Start()
-		NewArchiverWorker(m.ctx, m.wg, m.app, m.metricsQueue, m.storage).Start()
+		if m.app.Cfg().ScraperRawArchiveEnabled() {
+			m.startRawArchive()
+		}
+		for _, target := range m.app.Cfg().ScraperTargets() {
+			NewScraperWorker(
+				m.ctx, m.wg, m.app, target, m.bursts, m.metricsQueue, m.scrapesQueue, m.rawArchive).Start()
+		}
+	}
+
+	// The archiver consumes the metrics queue, which may be fed by both local
+	// scrapers and the ingest endpoint of the API, and the queue of failed
+	// scrape attempts.
+	if m.app.Cfg().ScraperEnabled() || m.app.Cfg().APIIngestEnabled() {
+		NewArchiverWorker(m.ctx, m.wg, m.app, m.metricsQueue, m.scrapesQueue, m.storage).Start()
+	}
+
+	if m.app.Cfg().DBRetentionEnabled() {
+		NewRetentionWorker(m.ctx, m.wg, m.app, m.storage).Start()
+	}
+
+	if m.app.Cfg().DBRotationEnabled() {
+		NewRotationWorker(m.ctx, m.wg, m.app, m.storage).Start()
+	}
+
+	if m.app.Cfg().TopEnabled() {
+		NewTopWorker(m.ctx, m.wg, m.app, m.storage).Start()
+	}
+
+	if m.app.Cfg().TransactionsEnabled() {
+		NewTransactionsWorker(m.ctx, m.wg, m.app, m.storage).Start()
 	}
 
 	if m.app.Cfg().APIEnabled() {
-		apiHandler := api.NewHandler(m.app, m.storage)
+		apiHandler := api.NewHandler(m.app, m.storage, m.metricsQueue, m)
 		for i := range m.app.Cfg().APIWorkers() {
 			NewAPIWorker(m.ctx, m.wg, m.app, i, apiHandler).Start()
 		}
@@ -72,10 +110,110 @@ func (m *Manager) Stop() {
 			Msg("Failed to shutdown storage!")
 	}
 
-	// We intentionally discard pending messages in 'm.metricsQueue'.
+	// Close the raw archive, so the trailer of the compressed stream is
+	// written.
+	if m.rawArchive != nil {
+		if err := m.rawArchive.Close(); err != nil {
+			m.app.Cfg().Log().Error().Err(err).
+				Msg("Failed to close raw archive!")
+		}
+	}
+
+	// Pending messages in 'm.metricsQueue' are stored by the archiver before
+	// termination, but only for up to 'db.shutdown-timeout'. Anything left is
+	// intentionally discarded.
 	pending := len(m.metricsQueue)
 	if pending > 0 {
 		m.app.Cfg().Log().Warn().
 			Msgf("%d messages in metrics queue dropped during shutdown!", pending)
 	}
 }
+
+func (m *Manager) startRawArchive() {
+	// Open the archive file. It's rotated independently of the database, but
+	// it's also reopened on SIGHUP (e.g., after being moved away by
+	// 'logrotate').
+	var err error
+	file := m.app.Cfg().ScraperRawArchiveFile()
+	if m.rawArchive, err = helpers.NewRawArchiveWriter(
+		file, 0640,
+		m.app.Cfg().ScraperRawArchiveCompression(),
+		int64(m.app.Cfg().ScraperRawArchiveMaxSize())*1024*1024,
+		m.app.Cfg().ScraperRawArchiveMaxFiles()); err != nil {
+		m.app.Cfg().Log().Fatal().
+			Err(err).
+			Str("file", file).
+			Msg("Failed to open raw archive!")
+	}
+
+	// Listen to SIGHUP events until the manager is stopped. The goroutine is
+	// tracked by the wait group, so the archive is never reopened while it's
+	// being closed.
+	channel := make(chan os.Signal, 1)
+	signal.Notify(channel, syscall.SIGHUP)
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer signal.Stop(channel)
+
+		for {
+			var sig os.Signal
+			select {
+			case <-m.ctx.Done():
+				return
+			case sig = <-channel:
+			}
+
+			m.app.Cfg().Log().Info().
+				Stringer("signal", sig).
+				Msg("Got system signal: reopening raw archive")
+
+			if err := m.rawArchive.Reopen(); err == nil {
+				m.app.Cfg().Log().Info().
+					Str("file", file).
+					Msg("Raw archive has been reopened")
+			} else {
+				m.app.Cfg().Log().Error().
+					Err(err).
+					Str("file", file).
+					Msg("Failed to reopen raw archive!")
+			}
+		}
+	}()
+}
+
+func (m *Manager) StartBurst(period, duration time.Duration) (*storage.Burst, error) {
+	if !m.app.Cfg().ScraperEnabled() {
+		return nil, api.ErrScraperDisabled
+	}
+
+	// Periods are limited to whole seconds, which is the resolution used when
+	// aggregating samples.
+	if period < 1*time.Second || period > 24*time.Hour || period%time.Second != 0 {
+		return nil, api.ErrInvalidBurstPeriod
+	}
+
+	if duration < period || duration > 24*time.Hour {
+		return nil, api.ErrInvalidBurstLength
+	}
+
+	// Record the burst before starting it, so the UI is able to highlight it
+	// and the storage is able to adjust the minimum step of queries.
+	now := time.Now()
+	burst := &storage.Burst{
+		From:   now,
+		To:     now.Add(duration),
+		Period: period,
+	}
+	if err := m.storage.PushBurst(burst); err != nil {
+		return nil, fmt.Errorf("failed to record burst: %w", err)
+	}
+	m.bursts.start(period, burst.To)
+
+	m.app.Cfg().Log().Info().
+		Dur("period", period).
+		Dur("duration", duration).
+		Msg("Burst started")
+
+	return burst, nil
+}
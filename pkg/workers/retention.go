@@ -0,0 +1,142 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/allenta/varnishmon/pkg/workers/storage"
+)
+
+// RetentionWorker periodically deletes old data from the storage, according
+// to the 'db.retention.*' settings.
+type RetentionWorker struct {
+	*worker
+	storage *storage.Storage
+
+	runs          prometheus.Counter
+	failedRuns    prometheus.Counter
+	deletedRows   *prometheus.CounterVec
+	prunedMetrics prometheus.Counter
+	checkpoints   prometheus.Counter
+	lastDuration  prometheus.Gauge
+}
+
+func NewRetentionWorker(
+	ctx context.Context, wg *sync.WaitGroup, app Application,
+	storage *storage.Storage) *RetentionWorker {
+	rw := &RetentionWorker{
+		storage: storage,
+
+		runs: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "retention_runs_total",
+				Help: "Executions of the retention worker",
+			}),
+		failedRuns: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "retention_failed_runs_total",
+				Help: "Failed executions of the retention worker",
+			}),
+		deletedRows: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "retention_deleted_rows_total",
+				Help: "Rows deleted by the retention worker",
+			},
+			[]string{"table"}),
+		prunedMetrics: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "retention_pruned_metrics_total",
+				Help: "Metrics without samples deleted by the retention worker",
+			}),
+		checkpoints: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "retention_checkpoints_total",
+				Help: "Database checkpoints executed by the retention worker",
+			}),
+		lastDuration: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "retention_last_run_duration_seconds",
+				Help: "Duration of the last execution of the retention worker",
+			}),
+	}
+
+	rw.worker = &worker{
+		ctx:  ctx,
+		wg:   wg,
+		app:  app,
+		id:   "Retention",
+		init: rw.init,
+		run:  rw.run,
+		stop: rw.stop,
+	}
+
+	rw.app.Cfg().Metrics().Registry.MustRegister(rw.runs)
+	rw.app.Cfg().Metrics().Registry.MustRegister(rw.failedRuns)
+	rw.app.Cfg().Metrics().Registry.MustRegister(rw.deletedRows)
+	rw.app.Cfg().Metrics().Registry.MustRegister(rw.prunedMetrics)
+	rw.app.Cfg().Metrics().Registry.MustRegister(rw.checkpoints)
+	rw.app.Cfg().Metrics().Registry.MustRegister(rw.lastDuration)
+
+	return rw
+}
+
+func (rw *RetentionWorker) init() {
+}
+
+func (rw *RetentionWorker) run() {
+	// Enforce retention on start too, so limits are honored even if the
+	// service is restarted often.
+	timer := time.NewTimer(0)
+	for {
+		select {
+		case <-rw.worker.ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+			rw.enforce()
+			timer.Reset(rw.worker.app.Cfg().DBRetentionPeriod())
+		}
+	}
+}
+
+func (rw *RetentionWorker) stop() {
+}
+
+func (rw *RetentionWorker) enforce() {
+	start := time.Now()
+	stats, err := rw.storage.EnforceRetention(rw.worker.ctx)
+	duration := time.Since(start)
+
+	rw.runs.Inc()
+	rw.lastDuration.Set(duration.Seconds())
+	deleted := int64(0)
+	for table, n := range stats.DeletedRows {
+		rw.deletedRows.WithLabelValues(table).Add(float64(n))
+		deleted += n
+	}
+	rw.prunedMetrics.Add(float64(stats.PrunedMetrics))
+	rw.checkpoints.Add(float64(stats.Checkpoints))
+
+	if err != nil {
+		rw.failedRuns.Inc()
+		if !errors.Is(err, context.Canceled) {
+			rw.worker.app.Cfg().Log().Error().
+				Err(err).
+				Msg("Failed to enforce retention!")
+		}
+		return
+	}
+
+	if deleted > 0 {
+		rw.worker.app.Cfg().Log().Info().
+			Int64("rows", deleted).
+			Int64("samples", stats.DeletedRows["metric_values"]).
+			Int("metrics", stats.PrunedMetrics).
+			Str("duration", duration.String()).
+			Msg("Retention enforced")
+	}
+}
@@ -0,0 +1,124 @@
+package workers
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/allenta/varnishmon/pkg/workers/storage"
+)
+
+const (
+	// How often the rotation worker checks if the database should be rotated.
+	rotationCheckPeriod = 1 * time.Minute
+)
+
+// RotationWorker periodically archives the database file, according to the
+// 'db.rotation.*' settings.
+type RotationWorker struct {
+	*worker
+	storage *storage.Storage
+
+	rotations       prometheus.Counter
+	failedRotations prometheus.Counter
+	deletedArchives prometheus.Counter
+	lastDuration    prometheus.Gauge
+}
+
+func NewRotationWorker(
+	ctx context.Context, wg *sync.WaitGroup, app Application,
+	storage *storage.Storage) *RotationWorker {
+	rw := &RotationWorker{
+		storage: storage,
+
+		rotations: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "rotation_rotations_total",
+				Help: "Database files archived by the rotation worker",
+			}),
+		failedRotations: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "rotation_failed_rotations_total",
+				Help: "Failed rotations of the database file",
+			}),
+		deletedArchives: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "rotation_deleted_archives_total",
+				Help: "Archived database files deleted by the rotation worker",
+			}),
+		lastDuration: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "rotation_last_rotation_duration_seconds",
+				Help: "Duration of the last rotation of the database file",
+			}),
+	}
+
+	rw.worker = &worker{
+		ctx:  ctx,
+		wg:   wg,
+		app:  app,
+		id:   "Rotation",
+		init: rw.init,
+		run:  rw.run,
+		stop: rw.stop,
+	}
+
+	rw.app.Cfg().Metrics().Registry.MustRegister(rw.rotations)
+	rw.app.Cfg().Metrics().Registry.MustRegister(rw.failedRotations)
+	rw.app.Cfg().Metrics().Registry.MustRegister(rw.deletedArchives)
+	rw.app.Cfg().Metrics().Registry.MustRegister(rw.lastDuration)
+
+	return rw
+}
+
+func (rw *RotationWorker) init() {
+}
+
+func (rw *RotationWorker) run() {
+	// Check on start too, so a database left behind by a stopped service is
+	// rotated as soon as possible.
+	timer := time.NewTimer(0)
+	for {
+		select {
+		case <-rw.worker.ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+			if rw.storage.RotationDue(time.Now()) {
+				rw.rotate()
+			}
+			timer.Reset(rotationCheckPeriod)
+		}
+	}
+}
+
+func (rw *RotationWorker) stop() {
+}
+
+func (rw *RotationWorker) rotate() {
+	start := time.Now()
+	stats, err := rw.storage.Rotate()
+	duration := time.Since(start)
+
+	rw.deletedArchives.Add(float64(stats.DeletedArchives))
+
+	if err != nil {
+		rw.failedRotations.Inc()
+		rw.worker.app.Cfg().Log().Error().
+			Err(err).
+			Msg("Failed to rotate database!")
+		return
+	}
+
+	if stats.Archive != nil {
+		rw.rotations.Inc()
+		rw.lastDuration.Set(duration.Seconds())
+		rw.worker.app.Cfg().Log().Info().
+			Str("file", stats.Archive.File).
+			Int("deleted_archives", stats.DeletedArchives).
+			Str("duration", duration.String()).
+			Msg("Database rotated")
+	}
+}
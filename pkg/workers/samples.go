@@ -0,0 +1,220 @@
+package workers
+
+import (
+	"math"
+	"time"
+
+	"gitlab.com/stone.code/assert"
+
+	"github.com/allenta/varnishmon/pkg/helpers"
+	"github.com/allenta/varnishmon/pkg/workers/storage"
+)
+
+// SampleProcessor transforms metrics, as reported by 'varnishstat', into the
+// samples stored in the database: counters are turned into rates per second
+// based on the previously seen values (keeping their raw values too), gauges
+// are truncated to fit in a signed 64 bits integer, and derived metrics are
+// computed. This is the logic used by the archiver worker, but it's also
+// useful to import metrics collected by other means. Not safe for concurrent
+// use.
+type SampleProcessor struct {
+	app Application
+	// Last seen value of each metric, indexed by instance and metric name.
+	lastMetrics map[string]map[string]*lastMetrics
+}
+
+// SampleProcessorStats summarizes the issues found while processing a set of
+// metrics.
+type SampleProcessorStats struct {
+	OutOfOrderSamples int
+	ResetCounters     int
+	TruncatedSamples  int
+	GapSamples        int
+}
+
+type lastMetrics struct {
+	timestamp time.Time
+	scraped   time.Time
+	value     uint64
+}
+
+func NewSampleProcessor(app Application) *SampleProcessor {
+	return &SampleProcessor{
+		app:         app,
+		lastMetrics: make(map[string]map[string]*lastMetrics),
+	}
+}
+
+// Initializes the last seen values of counters (e.g., using the latest raw
+// values found in the database after a restart), so rates can be calculated
+// from the very first sample. Metrics already seen are ignored.
+func (sp *SampleProcessor) Seed(counters []*storage.CounterValue) {
+	for _, counter := range counters {
+		instanceLastMetrics, ok := sp.lastMetrics[counter.Instance]
+		if !ok {
+			instanceLastMetrics = make(map[string]*lastMetrics)
+			sp.lastMetrics[counter.Instance] = instanceLastMetrics
+		}
+		if _, ok := instanceLastMetrics[counter.Name]; !ok {
+			instanceLastMetrics[counter.Name] = &lastMetrics{
+				timestamp: counter.Timestamp,
+				value:     counter.Value,
+			}
+		}
+	}
+}
+
+func (sp *SampleProcessor) Process(
+	metrics *helpers.VarnishMetrics) ([]*storage.MetricSample, SampleProcessorStats) {
+	var stats SampleProcessorStats
+	batch := make([]*storage.MetricSample, 0, len(metrics.Items))
+
+	// Values of the batch (bitmaps excluded), as used when computing derived
+	// metrics.
+	values := make(map[string]float64, len(metrics.Items))
+
+	// Fetch the last seen values of the instance the metrics belong to.
+	instanceLastMetrics, ok := sp.lastMetrics[metrics.Instance]
+	if !ok {
+		instanceLastMetrics = make(map[string]*lastMetrics)
+		sp.lastMetrics[metrics.Instance] = instanceLastMetrics
+	}
+
+	for name, details := range metrics.Items {
+		// Check if this is the first time seeing the metric.
+		previousMetric, ok := instanceLastMetrics[name]
+		if !ok {
+			instanceLastMetrics[name] = &lastMetrics{
+				timestamp: metrics.Timestamp,
+				scraped:   metrics.Scraped,
+				value:     details.Value,
+			}
+		}
+
+		var value any
+		var rawValue *uint64
+		if details.IsCounter() && !details.HasDurationFormat() {
+			// Counters are stored as rates, so we need to calculate the rate
+			// based on the previously seen value. However, there is a special
+			// case for uptimes (i.e., 'd' format in the 'varnishstat' output)
+			// which are handled as gauges. Otherwise, the rate per second of
+			// an uptime would be pretty much useless.
+
+			// Skip if this is an out-of-order sample.
+			if previousMetric != nil && !metrics.Timestamp.After(previousMetric.timestamp) {
+				stats.OutOfOrderSamples++
+				continue
+			}
+
+			// Raw values of counters are stored too, so exact rates and
+			// increases can be calculated later at any step. Same as with
+			// gauges, the highest bit is dropped.
+			raw := details.Value & 0x7FFFFFFFFFFFFFFF
+			rawValue = &raw
+
+			switch {
+			case previousMetric == nil:
+				// Only the raw value is stored if this is the first time
+				// seeing the metric: the rate can't be calculated yet.
+			case details.Value < previousMetric.value:
+				// Same if this looks like a reset of the counter.
+				stats.ResetCounters++
+			default:
+				// Transform the 'uint64' value of the counter into a
+				// 'float64' rate per second. Whenever possible, the elapsed
+				// time is calculated using the monotonic clock readings taken
+				// at the start of both scrapes, which are immune to wall
+				// clock adjustments and to the source of the timestamps.
+				elapsed := metrics.Timestamp.Sub(previousMetric.timestamp)
+				if !metrics.Scraped.IsZero() && !previousMetric.scraped.IsZero() {
+					if scrapedElapsed := metrics.Scraped.Sub(previousMetric.scraped); scrapedElapsed > 0 {
+						elapsed = scrapedElapsed
+					}
+				}
+
+				// Same if too many scrapes were missed since the previous
+				// sample: the rate would be averaged over the whole gap.
+				if sp.isGap(elapsed, metrics.Period) {
+					stats.GapSamples++
+					break
+				}
+
+				value = float64(details.Value-previousMetric.value) / elapsed.Seconds()
+			}
+		} else {
+			// Skip if this is an out-of-order sample. Not strictly necessary
+			// here, but it is nice to keep things consistent.
+			if previousMetric != nil &&
+				!metrics.Timestamp.After(previousMetric.timestamp) {
+				stats.OutOfOrderSamples++
+				continue
+			}
+
+			// Transform the 'uint64' value of the metric by dropping the
+			// highest bit. See: https://github.com/golang/go/issues/6113.
+			if !details.IsBitmap() && details.Value&0x8000000000000000 != 0 {
+				stats.TruncatedSamples++
+			}
+			value = details.Value & 0x7FFFFFFFFFFFFFFF
+		}
+
+		// At this point a value or a raw value should have been set.
+		assert.Assert(value != nil || rawValue != nil, "invalid value")
+		if !details.IsBitmap() {
+			switch v := value.(type) {
+			case float64:
+				values[name] = v
+			case uint64:
+				values[name] = float64(v)
+			}
+		}
+
+		// Update the last seen value of the metric.
+		if previousMetric != nil {
+			previousMetric.timestamp = metrics.Timestamp
+			previousMetric.scraped = metrics.Scraped
+			previousMetric.value = details.Value
+		}
+
+		// Append the metric sample to the batch.
+		batch = append(batch, &storage.MetricSample{
+			Name:        name,
+			Flag:        details.Flag,
+			Format:      details.Format,
+			Description: details.Description,
+			Value:       value,
+			RawValue:    rawValue,
+		})
+	}
+
+	// Compute derived metrics. They're stored as ordinary float64 series, so
+	// counters used as inputs are rates per second. Derived metrics are
+	// skipped if any input is missing (e.g., on the first sample of counters)
+	// or if their name clashes with a scraped metric.
+	for _, derived := range sp.app.Cfg().DerivedMetrics() {
+		if _, ok := metrics.Items[derived.Name]; ok {
+			continue
+		}
+		if value, ok := derived.Evaluate(values); ok {
+			batch = append(batch, &storage.MetricSample{
+				Name:        derived.Name,
+				Flag:        derived.Flag,
+				Format:      derived.Format,
+				Description: derived.Description,
+				Value:       value,
+			})
+		}
+	}
+
+	return batch, stats
+}
+
+// Returns true if at least 'metrics.gap-periods' scrapes were missed during
+// the elapsed time, according to the given scraping period (zero if unknown).
+func (sp *SampleProcessor) isGap(elapsed, period time.Duration) bool {
+	if period <= 0 {
+		return false
+	}
+	missed := int(math.Round(elapsed.Seconds()/period.Seconds())) - 1
+	return missed >= sp.app.Cfg().MetricsGapPeriods()
+}
@@ -0,0 +1,182 @@
+package workers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/allenta/varnishmon/pkg/helpers"
+	"github.com/allenta/varnishmon/pkg/testutil"
+	"github.com/allenta/varnishmon/pkg/workers/storage"
+	"github.com/stretchr/testify/suite"
+)
+
+type SampleProcessorTestSuite struct {
+	suite.Suite
+}
+
+// Value expected when the metric is not included in the batch at all.
+type noSample struct{}
+
+func (suite *SampleProcessorTestSuite) TestProcess() {
+	base := time.Date(2025, time.January, 1, 13, 0, 0, 0, time.UTC)
+
+	type step struct {
+		offset time.Duration
+		value  uint64
+	}
+
+	tests := []struct {
+		name   string
+		flag   string
+		format string
+		period time.Duration
+		// Raw value of the counter stored one minute before 'base', if any.
+		seed  *uint64
+		steps []step
+		// Value of the sample produced by every step.
+		expected []any
+		stats    SampleProcessorStats
+	}{
+		{
+			name:     "first sample of a counter",
+			flag:     "c",
+			format:   "i",
+			steps:    []step{{0, 100}},
+			expected: []any{nil},
+		},
+		{
+			name:     "rate of a counter",
+			flag:     "c",
+			format:   "i",
+			steps:    []step{{0, 100}, {time.Minute, 160}, {2 * time.Minute, 280}},
+			expected: []any{nil, 1.0, 2.0},
+		},
+		{
+			name:     "counter reset",
+			flag:     "c",
+			format:   "i",
+			steps:    []step{{0, 100}, {time.Minute, 50}, {2 * time.Minute, 110}},
+			expected: []any{nil, nil, 1.0},
+			stats:    SampleProcessorStats{ResetCounters: 1},
+		},
+		{
+			name:   "gap longer than the period",
+			flag:   "c",
+			format: "i",
+			period: time.Minute,
+			steps: []step{
+				{0, 100},
+				// A single missed scrape is tolerated.
+				{2 * time.Minute, 220},
+				// But not two of them.
+				{5 * time.Minute, 400},
+				{6 * time.Minute, 460},
+			},
+			expected: []any{nil, 1.0, nil, 1.0},
+			stats:    SampleProcessorStats{GapSamples: 1},
+		},
+		{
+			name:     "gaps are ignored if the period is unknown",
+			flag:     "c",
+			format:   "i",
+			steps:    []step{{0, 100}, {5 * time.Minute, 400}},
+			expected: []any{nil, 1.0},
+		},
+		{
+			name:     "gauge",
+			flag:     "g",
+			format:   "i",
+			steps:    []step{{0, 5}, {time.Minute, 3}, {2 * time.Minute, 1<<63 | 7}},
+			expected: []any{uint64(5), uint64(3), uint64(7)},
+			stats:    SampleProcessorStats{TruncatedSamples: 1},
+		},
+		{
+			name:     "uptimes are handled as gauges",
+			flag:     "c",
+			format:   "d",
+			steps:    []step{{0, 5}, {time.Minute, 65}},
+			expected: []any{uint64(5), uint64(65)},
+		},
+		{
+			name:     "out-of-order samples",
+			flag:     "g",
+			format:   "i",
+			steps:    []step{{time.Minute, 5}, {0, 3}, {time.Minute, 4}},
+			expected: []any{uint64(5), noSample{}, noSample{}},
+			stats:    SampleProcessorStats{OutOfOrderSamples: 2},
+		},
+		{
+			name:     "counter seeded from the database",
+			flag:     "c",
+			format:   "i",
+			seed:     func() *uint64 { v := uint64(40); return &v }(),
+			steps:    []step{{0, 100}},
+			expected: []any{1.0},
+		},
+	}
+
+	for _, test := range tests {
+		suite.Run(test.name, func() {
+			assert := suite.Require()
+
+			app := new(MockApplication)
+			app.
+				On("Cfg").
+				Return(testutil.NewConfig(
+					suite.T(),
+					"global.loglevel", "error",
+					"scraper.enabled", false,
+					"api.enabled", false))
+			sp := NewSampleProcessor(app)
+			if test.seed != nil {
+				sp.Seed([]*storage.CounterValue{{
+					Instance:  "foo",
+					Name:      "MAIN.foo",
+					Timestamp: base.Add(-time.Minute),
+					Value:     *test.seed,
+				}})
+			}
+
+			var stats SampleProcessorStats
+			for i, step := range test.steps {
+				batch, stepStats := sp.Process(&helpers.VarnishMetrics{
+					Instance:  "foo",
+					Timestamp: base.Add(step.offset),
+					Period:    test.period,
+					Items: map[string]*helpers.VarnishMetricDetails{
+						"MAIN.foo": {
+							Description: "Foo",
+							Flag:        test.flag,
+							Format:      test.format,
+							Value:       step.value,
+						},
+					},
+				})
+				stats.OutOfOrderSamples += stepStats.OutOfOrderSamples
+				stats.ResetCounters += stepStats.ResetCounters
+				stats.TruncatedSamples += stepStats.TruncatedSamples
+				stats.GapSamples += stepStats.GapSamples
+
+				if _, ok := test.expected[i].(noSample); ok {
+					assert.Empty(batch, "step %d", i)
+					continue
+				}
+				assert.Len(batch, 1, "step %d", i)
+				assert.Equal(test.expected[i], batch[0].Value, "step %d", i)
+				if test.flag == "c" && test.format != "d" {
+					assert.NotNil(batch[0].RawValue, "step %d", i)
+					assert.Equal(step.value, *batch[0].RawValue, "step %d", i)
+				} else {
+					assert.Nil(batch[0].RawValue, "step %d", i)
+				}
+			}
+			assert.Equal(test.stats, stats)
+
+			assert.Len(app.Cfg().Log().Buffer().Events(), 0)
+		})
+	}
+}
+
+func TestSampleProcessorTestSuite(t *testing.T) {
+	suite.Run(t, &SampleProcessorTestSuite{})
+}
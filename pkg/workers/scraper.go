@@ -1,55 +1,128 @@
 package workers
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"os/exec"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/allenta/varnishmon/pkg/config"
 	"github.com/allenta/varnishmon/pkg/helpers"
+	"github.com/allenta/varnishmon/pkg/workers/storage"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+var (
+	errStreamTerminated = errors.New("long-lived command terminated")
+)
+
 type ScraperWorker struct {
 	*worker
 	wg           sync.WaitGroup
+	target       *config.ScraperTarget
+	bursts       *bursts
 	metricsQueue chan *helpers.VarnishMetrics
+	// Failed scrape attempts are recorded through this queue. Successful ones
+	// are recorded by the archiver once the metrics have been stored.
+	scrapesQueue chan *storage.Scrape
+	// Nil unless host metrics are enabled for the target.
+	hostMetrics *helpers.HostMetricsCollector
+	// Nil unless the raw archive is enabled. Shared by all targets.
+	rawArchive *helpers.RawArchiveWriter
+
+	// State used to enforce the 'scraper.overlap-policy' setting.
+	mutex   sync.Mutex
+	running int
+	queued  bool
+	// Period of the queued scrape, if any.
+	queuedPeriod time.Duration
 
 	executionCompleted prometheus.Counter
 	executionFailed    prometheus.Counter
 	queuingFailed      prometheus.Counter
+	droppedMetrics     prometheus.Counter
+	restarts           prometheus.Counter
+	skippedTicks       prometheus.Counter
+	hostMetricsFailed  prometheus.Counter
+	rawArchiveFailed   prometheus.Counter
 }
 
 func NewScraperWorker(
 	ctx context.Context, wg *sync.WaitGroup, app Application,
-	metricsQueue chan *helpers.VarnishMetrics) *ScraperWorker {
+	target *config.ScraperTarget, bursts *bursts,
+	metricsQueue chan *helpers.VarnishMetrics,
+	scrapesQueue chan *storage.Scrape,
+	rawArchive *helpers.RawArchiveWriter) *ScraperWorker {
 	sw := &ScraperWorker{
+		target:       target,
+		bursts:       bursts,
 		metricsQueue: metricsQueue,
+		scrapesQueue: scrapesQueue,
+		rawArchive:   rawArchive,
 
 		executionCompleted: prometheus.NewCounter(
 			prometheus.CounterOpts{
-				Name: "scrapper_execution_completed_total",
-				Help: "Successful 'varnishstat' executions by the scraper worker",
+				Name:        "scrapper_execution_completed_total",
+				Help:        "Successful 'varnishstat' executions, partitioned by scraper target",
+				ConstLabels: prometheus.Labels{"target": target.Name},
 			}),
 		executionFailed: prometheus.NewCounter(
 			prometheus.CounterOpts{
-				Name: "scrapper_execution_failed_total",
-				Help: "Failed 'varnishstat' executions by the scraper worker",
+				Name:        "scrapper_execution_failed_total",
+				Help:        "Failed 'varnishstat' executions, partitioned by scraper target",
+				ConstLabels: prometheus.Labels{"target": target.Name},
 			}),
 		queuingFailed: prometheus.NewCounter(
 			prometheus.CounterOpts{
-				Name: "scrapper_queuing_failed_total",
-				Help: "Failed attempts to queue metrics by the scraper worker",
+				Name:        "scrapper_queuing_failed_total",
+				Help:        "Failed attempts to queue metrics, partitioned by scraper target",
+				ConstLabels: prometheus.Labels{"target": target.Name},
+			}),
+		droppedMetrics: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name:        "scrapper_dropped_metrics_total",
+				Help:        "Metrics dropped by the 'scraper.include' / 'scraper.exclude' filters, partitioned by scraper target",
+				ConstLabels: prometheus.Labels{"target": target.Name},
+			}),
+		restarts: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name:        "scrapper_restarts_total",
+				Help:        "Restarts of the long-lived 'varnishstat' command in streaming mode, partitioned by scraper target",
+				ConstLabels: prometheus.Labels{"target": target.Name},
+			}),
+		skippedTicks: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name:        "scrapper_skipped_ticks_total",
+				Help:        "Ticks skipped because the previous scrape was still running, partitioned by scraper target",
+				ConstLabels: prometheus.Labels{"target": target.Name},
+			}),
+		hostMetricsFailed: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name:        "scrapper_host_metrics_failed_total",
+				Help:        "Failed (maybe partially) collections of host metrics, partitioned by scraper target",
+				ConstLabels: prometheus.Labels{"target": target.Name},
+			}),
+		rawArchiveFailed: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name:        "scrapper_raw_archive_failed_total",
+				Help:        "Failed writes of 'varnishstat' outputs to the raw archive, partitioned by scraper target",
+				ConstLabels: prometheus.Labels{"target": target.Name},
 			}),
 	}
 
+	if target.HostMetrics {
+		sw.hostMetrics = helpers.NewHostMetricsCollector(app.Cfg().ScraperHostMetricsProc())
+	}
+
 	sw.worker = &worker{
 		ctx:  ctx,
 		wg:   wg,
 		app:  app,
-		id:   "Scraper",
+		id:   fmt.Sprintf("Scraper (%s)", target.Name),
 		init: sw.init,
 		run:  sw.run,
 		stop: sw.stop,
@@ -58,6 +131,11 @@ func NewScraperWorker(
 	sw.app.Cfg().Metrics().Registry.MustRegister(sw.executionCompleted)
 	sw.app.Cfg().Metrics().Registry.MustRegister(sw.executionFailed)
 	sw.app.Cfg().Metrics().Registry.MustRegister(sw.queuingFailed)
+	sw.app.Cfg().Metrics().Registry.MustRegister(sw.droppedMetrics)
+	sw.app.Cfg().Metrics().Registry.MustRegister(sw.restarts)
+	sw.app.Cfg().Metrics().Registry.MustRegister(sw.skippedTicks)
+	sw.app.Cfg().Metrics().Registry.MustRegister(sw.hostMetricsFailed)
+	sw.app.Cfg().Metrics().Registry.MustRegister(sw.rawArchiveFailed)
 
 	return sw
 }
@@ -66,33 +144,94 @@ func (sw *ScraperWorker) init() {
 }
 
 func (sw *ScraperWorker) run() {
-	// Do an initial scrape.
-	sw.scrape()
-
-	// Start a ticker to go on scraping periodically.
-	ticker := time.NewTicker(sw.worker.app.Cfg().ScraperPeriod())
-	defer ticker.Stop()
+	if sw.target.Mode == config.ScraperModeStream {
+		sw.stream()
+		return
+	}
 
+	// Scrape right away, so there's no need to wait for a whole period to get
+	// the first sample, and then periodically, with ticks aligned to multiples
+	// of the scraping period on the wall clock (e.g., :00, :15, :30 and :45 for
+	// a 15s period). That way samples match the boundaries of the buckets used
+	// when aggregating timeseries. The next tick is recalculated every time in
+	// order to avoid accumulating drift, and to switch to / from the period of
+	// bursts.
+	sw.tick(sw.target.Period)
 	for {
+		next, period, burstsChanged := sw.bursts.nextTick(sw.target.Period)
+		timer := time.NewTimer(time.Until(next))
 		select {
 		case <-sw.worker.ctx.Done():
+			timer.Stop()
 			sw.wg.Wait() // Wait for all goroutines to finish.
 			return
-		case <-ticker.C:
-			sw.scrape()
+		case <-burstsChanged:
+			timer.Stop()
+		case <-timer.C:
+			sw.tick(period)
 		}
 	}
 }
 
-func (sw *ScraperWorker) scrape() {
+// Decides whether to scrape or not according to the 'scraper.overlap-policy'
+// setting. 'period' is the one used to schedule the tick, which may be the
+// period of an ongoing burst instead of the one of the target.
+func (sw *ScraperWorker) tick(period time.Duration) {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+
+	if sw.running > 0 {
+		switch sw.worker.app.Cfg().ScraperOverlapPolicy() {
+		case config.ScraperOverlapPolicySkip:
+			sw.skipTick()
+			return
+		case config.ScraperOverlapPolicyQueue:
+			if sw.queued {
+				sw.skipTick()
+			} else {
+				sw.queued = true
+				sw.queuedPeriod = period
+			}
+			return
+		}
+	}
+
+	sw.running++
+	sw.scrape(period)
+}
+
+func (sw *ScraperWorker) skipTick() {
+	sw.skippedTicks.Inc()
+	sw.worker.app.Cfg().Log().Warn().
+		Str("policy", sw.worker.app.Cfg().ScraperOverlapPolicy()).
+		Msg("Previous 'varnishstat' execution still running, skipping tick!")
+}
+
+// Executed when a scrape completes. If a scrape was queued while this one was
+// running, it's launched right away.
+func (sw *ScraperWorker) scrapeCompleted() {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+
+	if sw.queued && sw.worker.ctx.Err() == nil {
+		sw.queued = false
+		sw.scrape(sw.queuedPeriod)
+	} else {
+		sw.running--
+	}
+}
+
+func (sw *ScraperWorker) scrape(period time.Duration) {
 	sw.wg.Add(1)
 	go func() {
 		defer sw.wg.Done()
+		defer sw.scrapeCompleted()
 
 		// Create a new context with a timeout to limit 'varnishstat'
-		// time execution.
+		// time execution. If the timeout is longer than the scraping
+		// period, executions may overlap; see 'tick()'.
 		contextWithTimeout, cancel := context.WithTimeout(
-			sw.worker.ctx, sw.worker.app.Cfg().ScraperPeriod())
+			sw.worker.ctx, sw.worker.app.Cfg().ScraperTimeout())
 		defer cancel()
 
 		//nolint:lll
@@ -102,40 +241,23 @@ func (sw *ScraperWorker) scrape() {
 		//   - https://hackernoon.com/everything-you-need-to-know-about-managing-go-processes#h-enhanced-cancellation-with-wait-delay-and-cancel
 		cmd := exec.CommandContext( //nolint:gosec
 			contextWithTimeout,
-			sw.worker.app.Cfg().ScraperCommand()[0],
-			sw.worker.app.Cfg().ScraperCommand()[1:]...)
+			sw.target.Command[0],
+			sw.target.Command[1:]...)
 		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 		cmd.Cancel = func() error {
 			return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
 		}
 
-		// Parse the output and send the metrics to the queue.
-		if out, err := cmd.CombinedOutput(); err == nil {
-			if metrics, err := helpers.ParseVarnishMetrics(out); err == nil {
-				sw.executionCompleted.Inc()
-				sw.worker.app.Cfg().Log().Debug().
-					Interface("metrics", metrics).
-					Msg("Successfully fetched 'varnishstat' output")
-
-				// Avoid blocking indefinitely if the metrics queue is full.
-				// This is unlikely, but if insertions into the storage are slow,
-				// the queue may fill up, causing a backlog of goroutines
-				// waiting to insert metrics.
-				select {
-				case sw.metricsQueue <- metrics:
-				case <-sw.worker.ctx.Done():
-				default:
-					sw.queuingFailed.Inc()
-					sw.worker.app.Cfg().Log().Error().
-						Msg("Metrics queue is full, dropping metrics!")
-				}
-			} else {
-				sw.executionFailed.Inc()
-				sw.worker.app.Cfg().Log().Error().
-					Err(err).
-					Str("output", string(out)).
-					Msg("Failed to parse 'varnishstat' output!")
-			}
+		// Parse the output and send the metrics to the queue. Stdout and
+		// stderr are collected separately, so warnings written to stderr
+		// don't break the parsing of the output, while still being available
+		// to diagnose failures.
+		var stdout, stderr bytes.Buffer
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		start := time.Now()
+		if err := cmd.Run(); err == nil {
+			sw.process(stdout.Bytes(), stderr.Bytes(), start, time.Since(start), period)
 		} else {
 			sw.executionFailed.Inc()
 
@@ -147,17 +269,157 @@ func (sw *ScraperWorker) scrape() {
 			// conditions.
 			if errors.Is(contextWithTimeout.Err(), context.DeadlineExceeded) {
 				sw.worker.app.Cfg().Log().Error().
-					Dur("timeout", sw.worker.app.Cfg().ScraperPeriod()).
+					Dur("timeout", sw.worker.app.Cfg().ScraperTimeout()).
 					Msg("'varnishstat' execution timed out!")
-			} else if errors.Is(contextWithTimeout.Err(), context.Canceled) {
+				sw.recordFailure(storage.ScrapeOutcomeTimeout, start, time.Since(start), err, stderr.Bytes(), 0)
+			} else if !errors.Is(contextWithTimeout.Err(), context.Canceled) {
 				sw.worker.app.Cfg().Log().Error().
 					Err(err).
-					Str("output", string(out)).
+					Str("output", stdout.String()+stderr.String()).
 					Msg("Failed to execute 'varnishstat'!")
+				sw.recordFailure(storage.ScrapeOutcomeFailed, start, time.Since(start), err, stderr.Bytes(), 0)
 			}
 		}
 	}()
 }
 
+// Runs a long-lived command emitting newline-delimited JSON documents, one per
+// sample, as an alternative to executing 'varnishstat' on every tick. Samples
+// are timestamped on arrival. The command is restarted with backoff if it
+// terminates for whatever reason.
+func (sw *ScraperWorker) stream() {
+	sc := &supervisedCommand{
+		app:     sw.worker.app,
+		id:      sw.worker.id,
+		command: sw.target.Command,
+		onLine: func(line []byte) {
+			sw.process(line, nil, time.Now(), 0, sw.target.Period)
+		},
+		onExit: func(err error) {
+			sw.restarts.Inc()
+			if err == nil {
+				err = errStreamTerminated
+			}
+			sw.recordFailure(storage.ScrapeOutcomeFailed, time.Now(), 0, err, nil, 0)
+		},
+	}
+	sc.run(sw.worker.ctx)
+}
+
+// Parses a 'varnishstat -1 -j' JSON document, timestamps & filters the metrics
+// and sends them to the queue. Shared by both scraping modes. 'period' is the
+// scraping period in effect for this sample (i.e., the one of the ongoing
+// burst, if any), used later on to detect gaps.
+func (sw *ScraperWorker) process(
+	out, stderr []byte, scraped time.Time, duration, period time.Duration) {
+	metrics, err := helpers.ParseVarnishMetrics(out)
+	if err != nil {
+		sw.executionFailed.Inc()
+		sw.worker.app.Cfg().Log().Error().
+			Err(err).
+			Str("output", string(out)).
+			Msg("Failed to parse 'varnishstat' output!")
+		sw.recordFailure(storage.ScrapeOutcomeInvalidOutput, scraped, duration, err, stderr, 0)
+		return
+	}
+
+	metrics.Instance = sw.target.Name
+	metrics.Scraped = scraped
+	metrics.Duration = duration
+	metrics.Period = period
+	metrics.Timestamp = scraped
+	if sw.worker.app.Cfg().ScraperTimestampSource() == config.ScraperTimestampSourceVarnishstat {
+		if timestamp, err := metrics.ParseVarnishstatTimestamp(sw.worker.app.Cfg().ScraperTimestampTZ()); err == nil {
+			metrics.Timestamp = timestamp
+		} else {
+			sw.worker.app.Cfg().Log().Warn().
+				Err(err).
+				Msg("Failed to parse 'varnishstat' timestamp, using local time instead!")
+		}
+	}
+	if sw.rawArchive != nil {
+		sw.archiveRawOutput(out, metrics.Timestamp)
+	}
+	if sw.hostMetrics != nil {
+		sw.addHostMetrics(metrics)
+	}
+	sw.droppedMetrics.Add(float64(
+		sw.worker.app.Cfg().ScraperFilter().Apply(metrics)))
+	sw.executionCompleted.Inc()
+	sw.worker.app.Cfg().Log().Debug().
+		Interface("metrics", metrics).
+		Msg("Successfully fetched 'varnishstat' output")
+
+	// Avoid blocking indefinitely if the metrics queue is full. This is
+	// unlikely, but if insertions into the storage are slow, the queue may
+	// fill up, causing a backlog of goroutines waiting to insert metrics.
+	select {
+	case sw.metricsQueue <- metrics:
+	case <-sw.worker.ctx.Done():
+	default:
+		sw.queuingFailed.Inc()
+		sw.worker.app.Cfg().Log().Error().
+			Msg("Metrics queue is full, dropping metrics!")
+		sw.recordFailure(storage.ScrapeOutcomeQueueFull, metrics.Timestamp, duration, nil, stderr, len(metrics.Items))
+	}
+}
+
+// Writes the 'varnishstat' output, as-is, to the raw archive. That's a lossless
+// record of the scrape, as opposed to the post-processed values stored in the
+// database.
+func (sw *ScraperWorker) archiveRawOutput(out []byte, timestamp time.Time) {
+	if err := sw.rawArchive.Write(&helpers.RawArchiveRecord{
+		Timestamp: timestamp,
+		Instance:  sw.target.Name,
+		Output:    out,
+	}); err != nil {
+		sw.rawArchiveFailed.Inc()
+		sw.worker.app.Cfg().Log().Error().
+			Err(err).
+			Msg("Failed to write 'varnishstat' output to the raw archive!")
+	}
+}
+
+// Merges host metrics into the 'varnishstat' output. Metrics already present in
+// the output (e.g., added by a wrapper script) take precedence.
+func (sw *ScraperWorker) addHostMetrics(metrics *helpers.VarnishMetrics) {
+	items, err := sw.hostMetrics.Collect()
+	if err != nil {
+		sw.hostMetricsFailed.Inc()
+		sw.worker.app.Cfg().Log().Warn().
+			Err(err).
+			Msg("Failed to collect some host metrics!")
+	}
+	for name, details := range items {
+		if _, ok := metrics.Items[name]; !ok {
+			metrics.Items[name] = details
+		}
+	}
+}
+
+// Sends a failed scrape attempt to the archiver to be recorded in the storage.
+// As with metrics, this never blocks: if the queue is full, the attempt is
+// silently discarded.
+func (sw *ScraperWorker) recordFailure(
+	outcome string, scraped time.Time, duration time.Duration,
+	err error, stderr []byte, metrics int) {
+	scrape := &storage.Scrape{
+		Instance:  sw.target.Name,
+		Timestamp: scraped,
+		Duration:  duration,
+		Outcome:   outcome,
+		Stderr:    string(stderr),
+		Metrics:   metrics,
+	}
+	if err != nil {
+		scrape.Error = err.Error()
+	}
+
+	select {
+	case sw.scrapesQueue <- scrape:
+	default:
+	}
+}
+
 func (sw *ScraperWorker) stop() {
 }
@@ -0,0 +1,253 @@
+package workers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/allenta/varnishmon/pkg/config"
+	"github.com/allenta/varnishmon/pkg/helpers"
+	"github.com/allenta/varnishmon/pkg/testutil"
+	"github.com/allenta/varnishmon/pkg/workers/storage"
+	"github.com/stretchr/testify/suite"
+)
+
+type ScraperTestSuite struct {
+	suite.Suite
+}
+
+// Creates a script printing a minimal 'varnishstat -1 -j' output after
+// sleeping for the given time.
+func (suite *ScraperTestSuite) varnishstat(delay time.Duration) string {
+	path := filepath.Join(suite.T().TempDir(), "varnishstat")
+	suite.Require().NoError(os.WriteFile(path, []byte(fmt.Sprintf(`#!/bin/sh
+sleep %.2f
+echo '{"version": 1, "counters": {"MAIN.uptime": {"description": "Child process uptime", "flag": "c", "format": "d", "value": 1}}}'
+`, delay.Seconds())), 0750))
+	return path
+}
+
+func (suite *ScraperTestSuite) TestNextAlignedTick() {
+	assert := suite.Require()
+
+	// Ticks are aligned to Unix timestamps, even for periods not dividing a
+	// day.
+	assert.Equal(
+		time.Unix(1001, 0),
+		nextAlignedTick(time.Unix(1000, 500000000), 7*time.Second))
+	assert.Equal(
+		time.Unix(1008, 0),
+		nextAlignedTick(time.Unix(1001, 0), 7*time.Second))
+	assert.Equal(
+		time.Unix(1740000000, 0),
+		nextAlignedTick(time.Unix(1739999999, 0), time.Minute))
+}
+
+func (suite *ScraperTestSuite) TestInitialScrape() {
+	assert := suite.Require()
+
+	app := new(MockApplication)
+	app.
+		On("Cfg").
+		Return(testutil.NewConfig(
+			suite.T(),
+			"global.loglevel", "error",
+			"scraper.enabled", true,
+			"api.enabled", false))
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	metricsQueue := make(chan *helpers.VarnishMetrics, 10)
+	sw := NewScraperWorker(
+		ctx, wg, app,
+		&config.ScraperTarget{
+			Name:    "foo",
+			Mode:    config.ScraperModeExec,
+			Command: []string{suite.varnishstat(0)},
+			Period:  time.Hour,
+		},
+		newBursts(), metricsQueue, make(chan *storage.Scrape, 10), nil)
+	sw.Start()
+
+	// No need to wait for the next hour.
+	select {
+	case metrics := <-metricsQueue:
+		assert.Equal("foo", metrics.Instance)
+	case <-time.After(5 * time.Second):
+		suite.Fail("No initial scrape")
+	}
+	cancel()
+	wg.Wait()
+
+	assert.Len(app.Cfg().Log().Buffer().Events(), 0)
+}
+
+func (suite *ScraperTestSuite) TestOverlapPolicies() {
+	tests := []struct {
+		policy  string
+		scrapes int
+		skipped int
+	}{
+		{config.ScraperOverlapPolicySkip, 1, 2},
+		{config.ScraperOverlapPolicyQueue, 2, 1},
+		{config.ScraperOverlapPolicyAllow, 3, 0},
+	}
+
+	command := suite.varnishstat(300 * time.Millisecond)
+	for _, test := range tests {
+		suite.Run(test.policy, func() {
+			assert := suite.Require()
+
+			app := new(MockApplication)
+			app.
+				On("Cfg").
+				Return(testutil.NewConfig(
+					suite.T(),
+					"global.loglevel", "error",
+					"scraper.enabled", true,
+					"scraper.overlap-policy", test.policy,
+					"api.enabled", false))
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			metricsQueue := make(chan *helpers.VarnishMetrics, 10)
+			sw := NewScraperWorker(
+				ctx, &sync.WaitGroup{}, app,
+				&config.ScraperTarget{
+					Name:    "foo",
+					Mode:    config.ScraperModeExec,
+					Command: []string{command},
+					Period:  time.Second,
+				},
+				newBursts(), metricsQueue, make(chan *storage.Scrape, 10), nil)
+
+			// Three ticks while the first scrape is still running.
+			for range 3 {
+				sw.tick(time.Second)
+			}
+			sw.wg.Wait()
+
+			assert.Len(metricsQueue, test.scrapes)
+			assert.InDelta(float64(test.skipped), promtestutil.ToFloat64(sw.skippedTicks), 0)
+			assert.InDelta(float64(test.scrapes), promtestutil.ToFloat64(sw.executionCompleted), 0)
+
+			assert.Len(app.Cfg().Log().Buffer().Events(), 0)
+		})
+	}
+}
+
+func (suite *ScraperTestSuite) TestBurstPeriod() {
+	assert := suite.Require()
+
+	app := new(MockApplication)
+	app.
+		On("Cfg").
+		Return(testutil.NewConfig(
+			suite.T(),
+			"global.loglevel", "error",
+			"scraper.enabled", true,
+			"api.enabled", false))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bursts := newBursts()
+	metricsQueue := make(chan *helpers.VarnishMetrics, 10)
+	sw := NewScraperWorker(
+		ctx, &sync.WaitGroup{}, app,
+		&config.ScraperTarget{
+			Name:    "foo",
+			Mode:    config.ScraperModeExec,
+			Command: []string{suite.varnishstat(0)},
+			Period:  time.Hour,
+		},
+		bursts, metricsQueue, make(chan *storage.Scrape, 10), nil)
+
+	// Ticks scheduled during a burst use its period, and samples are tagged
+	// with it (i.e., not with the period of the target).
+	bursts.start(time.Second, time.Now().Add(time.Minute))
+	_, period, _ := bursts.nextTick(sw.target.Period)
+	assert.Equal(time.Second, period)
+	sw.tick(period)
+	sw.wg.Wait()
+
+	assert.Len(metricsQueue, 1)
+	assert.Equal(time.Second, (<-metricsQueue).Period)
+
+	// Once the burst is over, the period of the target is used again.
+	bursts.start(time.Second, time.Now())
+	_, period, _ = bursts.nextTick(sw.target.Period)
+	assert.Equal(time.Hour, period)
+
+	assert.Len(app.Cfg().Log().Buffer().Events(), 0)
+}
+
+func (suite *ScraperTestSuite) TestStream() {
+	assert := suite.Require()
+
+	// Long-lived command emitting two documents (plus an empty line) and
+	// exiting.
+	command := filepath.Join(suite.T().TempDir(), "varnishstat")
+	assert.NoError(os.WriteFile(command, []byte(`#!/bin/sh
+echo '{"version": 1, "counters": {"MAIN.uptime": {"description": "Child process uptime", "flag": "c", "format": "d", "value": 1}}}'
+echo
+echo '{"version": 1, "counters": {"MAIN.uptime": {"description": "Child process uptime", "flag": "c", "format": "d", "value": 2}}}'
+`), 0750))
+
+	app := new(MockApplication)
+	app.
+		On("Cfg").
+		Return(testutil.NewConfig(
+			suite.T(),
+			"global.loglevel", "error",
+			"scraper.enabled", true,
+			"api.enabled", false))
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	metricsQueue := make(chan *helpers.VarnishMetrics, 10)
+	scrapesQueue := make(chan *storage.Scrape, 10)
+	sw := NewScraperWorker(
+		ctx, wg, app,
+		&config.ScraperTarget{
+			Name:    "foo",
+			Mode:    config.ScraperModeStream,
+			Command: []string{command},
+			Period:  time.Second,
+		},
+		newBursts(), metricsQueue, scrapesQueue, nil)
+	sw.Start()
+
+	// Both documents are received, and then again once the command has been
+	// restarted after the backoff.
+	values := make([]uint64, 0, 4)
+	for range 4 {
+		select {
+		case metrics := <-metricsQueue:
+			assert.Equal("foo", metrics.Instance)
+			values = append(values, metrics.Items["MAIN.uptime"].Value)
+		case <-time.After(5 * time.Second):
+			suite.FailNow("Missing samples", "%v", values)
+		}
+	}
+	cancel()
+	wg.Wait()
+	assert.Equal([]uint64{1, 2, 1, 2}, values)
+
+	// Terminations are recorded as failed scrape attempts.
+	assert.GreaterOrEqual(promtestutil.ToFloat64(sw.restarts), 1.0)
+	scrape := <-scrapesQueue
+	assert.Equal(storage.ScrapeOutcomeFailed, scrape.Outcome)
+	assert.Equal(errStreamTerminated.Error(), scrape.Error)
+
+	events := app.Cfg().Log().Buffer().Events()
+	assert.NotEmpty(events)
+	for _, event := range events {
+		assert.Equal("Long-lived command terminated, restarting it!", event["message"])
+	}
+}
+
+func TestScraperTestSuite(t *testing.T) {
+	suite.Run(t, &ScraperTestSuite{})
+}
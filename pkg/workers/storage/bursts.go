@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+)
+
+// Burst is a time window during which metrics were scraped using a shorter
+// period than usual.
+type Burst struct {
+	From   time.Time
+	To     time.Time
+	Period time.Duration
+}
+
+// Records a burst. Previously recorded bursts still running when the new one
+// starts are truncated, so bursts never overlap.
+func (stg *Storage) PushBurst(burst *Burst) error {
+	// Lock 'db' instance.
+	stg.mutex.RLock()
+	defer stg.mutex.RUnlock()
+
+	// Begin transaction.
+	tx, err := stg.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	// Truncate overlapping bursts & insert the new one.
+	if _, err := tx.Exec(`
+		UPDATE bursts
+		SET ended = $1
+		WHERE started < $1 AND ended > $1`, burst.From); err != nil {
+		return fmt.Errorf("failed to update 'bursts' table: %w", err)
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO bursts (started, ended, period)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (started) DO UPDATE SET
+			ended = excluded.ended,
+			period = excluded.period`,
+		burst.From, burst.To, int(burst.Period.Seconds())); err != nil {
+		return fmt.Errorf("failed to insert into 'bursts' table: %w", err)
+	}
+
+	// Commit transaction.
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	// Update 'bursts' cache value. Beware of locking order: 'stg.mutex' was
+	// locked before 'stg.cache.mutex'.
+	stg.cache.mutex.Lock()
+	defer stg.cache.mutex.Unlock()
+	if err := stg.unsafeLoadBursts(); err != nil {
+		return fmt.Errorf("failed to reload bursts: %w", err)
+	}
+
+	// Done!
+	return nil
+}
+
+// Returns the bursts overlapping the requested time range.
+func (stg *Storage) GetBursts(from, to time.Time) (map[string]interface{}, error) {
+	// Validate 'from' and 'to' parameters.
+	if from.After(to) {
+		return nil, ErrInvalidFromTo
+	}
+
+	// Lock 'cache'.
+	stg.cache.mutex.RLock()
+	defer stg.cache.mutex.RUnlock()
+
+	// Build result.
+	bursts := make([]interface{}, 0)
+	for _, burst := range stg.unsafeOverlappingBursts(from, to) {
+		bursts = append(bursts, map[string]interface{}{
+			"from":   burst.From.Unix(),
+			"to":     burst.To.Unix(),
+			"period": int(burst.Period.Seconds()),
+		})
+	}
+
+	// Done!
+	return map[string]interface{}{
+		"from":   from.Unix(),
+		"to":     to.Unix(),
+		"bursts": bursts,
+	}, nil
+}
+
+func (stg *Storage) unsafeOverlappingBursts(from, to time.Time) []*Burst {
+	result := make([]*Burst, 0)
+	for _, burst := range stg.cache.bursts {
+		if burst.From.Before(to) && burst.To.After(from) {
+			result = append(result, burst)
+		}
+	}
+	return result
+}
+
+func (stg *Storage) unsafeLoadBursts() error {
+	rows, err := stg.db.Query(`
+		SELECT started, ended, period
+		FROM bursts
+		ORDER BY started`)
+	if err != nil {
+		return fmt.Errorf("failed to query 'bursts' table: %w", err)
+	}
+	defer rows.Close()
+
+	bursts := make([]*Burst, 0)
+	for rows.Next() {
+		var burst Burst
+		var period int
+		if err := rows.Scan(&burst.From, &burst.To, &period); err != nil {
+			return fmt.Errorf("failed to scan 'bursts' rows: %w", err)
+		}
+		burst.Period = time.Duration(period) * time.Second
+		bursts = append(bursts, &burst)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to iterate over 'bursts' rows: %w", err)
+	}
+
+	stg.cache.bursts = bursts
+	return nil
+}
@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type BurstsTestSuite struct {
+	suite.Suite
+	stg *Storage
+}
+
+func (suite *BurstsTestSuite) BeforeTest(suiteName, testName string) {
+	suite.stg = newTestStorage(suite.T(), "scraper.enabled", true, "scraper.period", "60s")
+}
+
+func (suite *BurstsTestSuite) TestPushAndGetBursts() {
+	assert := suite.Require()
+
+	base := time.Date(2025, time.January, 1, 13, 0, 0, 0, time.UTC)
+
+	// Push a burst, and then a second one starting before the end of the
+	// first one, which must be truncated.
+	assert.NoError(suite.stg.PushBurst(&Burst{
+		From:   base,
+		To:     base.Add(10 * time.Minute),
+		Period: 1 * time.Second,
+	}))
+	assert.NoError(suite.stg.PushBurst(&Burst{
+		From:   base.Add(5 * time.Minute),
+		To:     base.Add(15 * time.Minute),
+		Period: 5 * time.Second,
+	}))
+
+	result, err := suite.stg.GetBursts(base.Add(-1*time.Hour), base.Add(1*time.Hour))
+	assert.NoError(err)
+	assert.Equal([]interface{}{
+		map[string]interface{}{
+			"from":   base.Unix(),
+			"to":     base.Add(5 * time.Minute).Unix(),
+			"period": 1,
+		},
+		map[string]interface{}{
+			"from":   base.Add(5 * time.Minute).Unix(),
+			"to":     base.Add(15 * time.Minute).Unix(),
+			"period": 5,
+		},
+	}, result["bursts"])
+
+	// Only overlapping bursts are returned.
+	result, err = suite.stg.GetBursts(base.Add(10*time.Minute), base.Add(1*time.Hour))
+	assert.NoError(err)
+	assert.Len(result["bursts"], 1)
+	result, err = suite.stg.GetBursts(base.Add(15*time.Minute), base.Add(1*time.Hour))
+	assert.NoError(err)
+	assert.Len(result["bursts"], 0)
+
+	// Invalid ranges are rejected.
+	_, err = suite.stg.GetBursts(base, base.Add(-1*time.Hour))
+	assert.ErrorIs(err, ErrInvalidFromTo)
+}
+
+func (suite *BurstsTestSuite) TestNormalizeStepWithBursts() {
+	assert := suite.Require()
+
+	base := time.Date(2025, time.January, 1, 13, 0, 0, 0, time.UTC)
+	assert.NoError(suite.stg.PushBurst(&Burst{
+		From:   base,
+		To:     base.Add(10 * time.Minute),
+		Period: 5 * time.Second,
+	}))
+
+	tests := []struct {
+		from time.Time
+		to   time.Time
+		step int
+	}{
+		{from: base.Add(-1 * time.Hour), to: base.Add(-30 * time.Minute), step: 60},
+		{from: base.Add(-1 * time.Hour), to: base.Add(1 * time.Minute), step: 5},
+		{from: base.Add(5 * time.Minute), to: base.Add(1 * time.Hour), step: 5},
+		{from: base.Add(10 * time.Minute), to: base.Add(1 * time.Hour), step: 60},
+	}
+
+	for _, test := range tests {
+		_, _, step, err := suite.stg.unsafeNormalizeFromToAndStep(test.from, test.to, 1)
+		assert.NoError(err)
+		assert.Equal(test.step, step)
+	}
+}
+
+func TestBurstsTestSuite(t *testing.T) {
+	suite.Run(t, &BurstsTestSuite{})
+}
@@ -0,0 +1,307 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Aggregators only available for counters, computed from the raw values in
+// the 'counter_values' table.
+const (
+	// Per-second rate of the counter during every bucket.
+	AggregatorRate = "rate"
+	// Increase of the counter during every bucket.
+	AggregatorIncrease = "increase"
+)
+
+// Returns true if the metric is a counter stored as a rate. That's the case
+// of all counters except uptimes (i.e., 'd' format), which are handled as
+// gauges.
+func (cm *CachedMetric) IsRate() bool {
+	return cm.Flag == "c" && cm.Format != "d" && cm.Class == "float64"
+}
+
+// Returns the rate or the increase of a counter for every bucket of the
+// requested time range. Values are calculated from the raw values in the
+// 'counter_values' table, so they're exact no matter the step. Resets are
+// handled like Prometheus' 'increase()' does: a value lower than the previous
+// one is assumed to be a restart from zero. The increase between two
+// consecutive samples is accounted in the bucket of the latest one, and the
+// last sample before the requested time range is considered too, so the
+// increases of adjacent time ranges add up. If 'instance' is empty, the rates
+// and increases of all instances are summed up. Pairs of consecutive samples
+// where at least 'metrics.gap-periods' scrapes were missed, according to the
+// given scraping period (in seconds, or zero if unknown), are ignored, so
+// buckets after a gap are left to 'fillGaps()' instead of averaging the rate
+// over the whole gap.
+//
+// Instances without raw values in the requested time range (e.g., samples
+// stored before raw values were introduced, or derived metrics) fall back to
+// the stored rates: rates are averaged, and increases are estimated by
+// multiplying every rate by the time elapsed since the previous sample. Both
+// sources are never mixed for the same instance, so buckets of time ranges
+// partially covered by raw values are missing instead of being estimated.
+func (stg *Storage) unsafeGetCounterSamples(
+	metric *CachedMetric, from, to time.Time, step, period int,
+	aggregator, instance string) ([][2]interface{}, error) {
+	buckets := make(map[int64]float64)
+
+	// Same criteria used by the sample processor when calculating rates at
+	// ingest (see 'SampleProcessor.isGap()').
+	gapCondition := "TRUE"
+	if period > 0 {
+		gapCondition = fmt.Sprintf(
+			"round(elapsed / %d) - 1 < %d", period, stg.app.Cfg().MetricsGapPeriods())
+	}
+
+	// Fallback to stored rates for instances without raw values in the
+	// requested time range. Instances are disjoint in both queries, so
+	// results of the same bucket are summed up.
+	//nolint:gosec
+	if err := stg.unsafeQueryCounterBuckets(fmt.Sprintf(`
+		WITH samples AS (
+			SELECT
+				instance,
+				timestamp,
+				value.float64 AS rate,
+				epoch(timestamp) - epoch(lag(timestamp) OVER w) AS elapsed
+			FROM metric_values
+			WHERE
+				metric_id = $1 AND
+				timestamp >= %s AND
+				timestamp < $3 AND
+				($4 = '' OR instance = $4) AND
+				instance NOT IN (
+					SELECT DISTINCT instance
+					FROM counter_values
+					WHERE
+						metric_id = $1 AND
+						timestamp >= $2 AND
+						timestamp < $3)
+			WINDOW w AS (PARTITION BY instance ORDER BY timestamp)
+		), buckets AS (
+			SELECT
+				instance,
+				time_bucket(INTERVAL '%ds', timestamp) AS bucket,
+				avg(rate) AS rate,
+				COALESCE(sum(rate * elapsed), 0) AS increase
+			FROM samples
+			WHERE timestamp >= $2
+			GROUP BY instance, bucket
+		)
+		SELECT bucket, sum(rate), sum(increase)
+		FROM buckets
+		GROUP BY bucket`, counterLookbackExpression("metric_values"), step),
+		metric.ID, from, to, aggregator, instance, buckets); err != nil {
+		return nil, err
+	}
+
+	//nolint:gosec
+	if err := stg.unsafeQueryCounterBuckets(fmt.Sprintf(`
+		WITH samples AS (
+			SELECT
+				instance,
+				timestamp,
+				CAST(value AS HUGEINT) AS value,
+				CAST(lag(value) OVER w AS HUGEINT) AS previous,
+				epoch(timestamp) - epoch(lag(timestamp) OVER w) AS elapsed
+			FROM counter_values
+			WHERE
+				metric_id = $1 AND
+				timestamp >= %s AND
+				timestamp < $3 AND
+				($4 = '' OR instance = $4)
+			WINDOW w AS (PARTITION BY instance ORDER BY timestamp)
+		), buckets AS (
+			SELECT
+				instance,
+				time_bucket(INTERVAL '%ds', timestamp) AS bucket,
+				sum(CASE WHEN value >= previous THEN value - previous ELSE value END) AS increase,
+				sum(elapsed) AS elapsed
+			FROM samples
+			WHERE timestamp >= $2 AND previous IS NOT NULL AND %s
+			GROUP BY instance, bucket
+		)
+		SELECT bucket, sum(increase / elapsed), CAST(sum(increase) AS DOUBLE)
+		FROM buckets
+		GROUP BY bucket`, counterLookbackExpression("counter_values"), step, gapCondition),
+		metric.ID, from, to, aggregator, instance, buckets); err != nil {
+		return nil, err
+	}
+
+	// Sort buckets.
+	result := make([][2]interface{}, 0, len(buckets))
+	for timestamp, value := range buckets {
+		result = append(result, [2]interface{}{timestamp, value})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i][0].(int64) < result[j][0].(int64)
+	})
+
+	return result, nil
+}
+
+func (stg *Storage) unsafeQueryCounterBuckets(
+	query string, id int, from, to time.Time,
+	aggregator, instance string, buckets map[int64]float64) error {
+	rows, err := stg.db.Query(query, id, from, to, instance)
+	if err != nil {
+		return fmt.Errorf("failed to query counter samples: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var timestamp time.Time
+		var rate, increase sql.NullFloat64
+		if err := rows.Scan(&timestamp, &rate, &increase); err != nil {
+			return fmt.Errorf("failed to scan counter samples: %w", err)
+		}
+		switch aggregator {
+		case AggregatorRate:
+			if rate.Valid {
+				buckets[timestamp.Unix()] += rate.Float64
+			}
+		case AggregatorIncrease:
+			if increase.Valid {
+				buckets[timestamp.Unix()] += increase.Float64
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to iterate over counter samples: %w", err)
+	}
+
+	return nil
+}
+
+// Returns an SQL expression evaluating to the timestamp of the last sample
+// before the requested time range (i.e., '$2') of every instance, or to the
+// start of the time range if there are no previous samples. Parameters are
+// the ones used by 'unsafeGetCounterSamples()' queries.
+func counterLookbackExpression(table string) string {
+	return fmt.Sprintf(`COALESCE((
+		SELECT min(latest)
+		FROM (
+			SELECT max(timestamp) AS latest
+			FROM %s
+			WHERE
+				metric_id = $1 AND
+				timestamp < $2 AND
+				($4 = '' OR instance = $4)
+			GROUP BY instance
+		)), $2)`, table)
+}
+
+// CounterValue is the latest raw value of a counter of an instance, as stored
+// in the 'counter_values' table.
+type CounterValue struct {
+	Instance    string
+	Name        string
+	Flag        string
+	Format      string
+	Description string
+	Timestamp   time.Time
+	Value       uint64
+}
+
+// Returns the latest raw value of every counter and instance, ignoring values
+// older than 'since'. Useful to resume the calculation of rates after a
+// restart. Checkpoints carried over from previous databases (see
+// 'unsafePushCounterCheckpoints') are considered too.
+func (stg *Storage) GetLatestCounters(since time.Time) ([]*CounterValue, error) {
+	// Lock 'db' instance.
+	stg.mutex.RLock()
+	defer stg.mutex.RUnlock()
+
+	return stg.unsafeGetLatestCounters(since)
+}
+
+func (stg *Storage) unsafeGetLatestCounters(since time.Time) ([]*CounterValue, error) {
+	rows, err := stg.db.Query(`
+		SELECT
+			instance,
+			name,
+			arg_max(flag, timestamp),
+			arg_max(format, timestamp),
+			arg_max(description, timestamp),
+			max(timestamp),
+			arg_max(value, timestamp)
+		FROM (
+			SELECT
+				latest.instance,
+				metrics.name,
+				metrics.flag,
+				metrics.format,
+				metrics.description,
+				latest.timestamp,
+				latest.value
+			FROM (
+				SELECT
+					metric_id,
+					instance,
+					max(timestamp) AS timestamp,
+					arg_max(value, timestamp) AS value
+				FROM counter_values
+				WHERE timestamp >= $1
+				GROUP BY metric_id, instance
+			) AS latest
+			JOIN metrics ON metrics.id = latest.metric_id
+			UNION ALL
+			SELECT instance, name, flag, format, description, timestamp, value
+			FROM counter_checkpoints
+			WHERE timestamp >= $1
+		)
+		GROUP BY instance, name`, since)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query 'counter_values' & 'counter_checkpoints' tables: %w", err)
+	}
+	defer rows.Close()
+
+	result := make([]*CounterValue, 0)
+	for rows.Next() {
+		var counter CounterValue
+		if err := rows.Scan(
+			&counter.Instance, &counter.Name, &counter.Flag, &counter.Format,
+			&counter.Description, &counter.Timestamp, &counter.Value); err != nil {
+			return nil, fmt.Errorf("failed to scan latest raw values of counters: %w", err)
+		}
+		result = append(result, &counter)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate over latest raw values of counters: %w", err)
+	}
+
+	return result, nil
+}
+
+// Stores the given raw values of counters as checkpoints, replacing older
+// ones. Used to carry over the latest raw values when the database is
+// reopened (e.g., after being rotated), so the new database is enough to
+// resume the calculation of rates after a restart. Checkpoints are kept apart
+// from the 'counter_values' table, so the same samples are never stored in
+// several database files (e.g., when browsing them as a single timeline).
+func (stg *Storage) unsafePushCounterCheckpoints(counters []*CounterValue) error {
+	tx, err := stg.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	for _, counter := range counters {
+		if _, err := tx.Exec(`
+			INSERT OR REPLACE INTO counter_checkpoints (instance, name, flag, format, description, timestamp, value)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+			counter.Instance, counter.Name, counter.Flag, counter.Format,
+			counter.Description, counter.Timestamp, counter.Value); err != nil {
+			return fmt.Errorf("failed to insert into 'counter_checkpoints' table: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,219 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Supported formats of exports.
+const (
+	// Comma-separated values, with a header row.
+	ExportFormatCSV = "csv"
+	// Apache Parquet.
+	ExportFormatParquet = "parquet"
+	// Newline-delimited JSON, one object per row.
+	ExportFormatNDJSON = "ndjson"
+)
+
+var (
+	ErrInvalidExportFormat = errors.New("invalid export format")
+	ErrRawSamplesExpired   = errors.New("raw samples removed by the retention policy")
+)
+
+// Export is a temporary file holding the result of 'Export'. The file is
+// removed when closed.
+type Export struct {
+	*os.File
+	Size int64
+}
+
+func (e *Export) Close() error {
+	err := e.File.Close()
+	os.Remove(e.Name())
+	return err
+}
+
+// Exports aggregated samples of all metrics in the requested time range, one
+// row per metric and bucket ('timestamp', 'metric' and 'value' columns),
+// using the DuckDB 'COPY' statement, so the result is never buffered in
+// memory. If 'filter' is not empty, only metrics whose name contains any of
+// its whitespace-separated terms are exported (i.e., same criteria used by the
+// web UI). Same as in 'GetMetric', the instance can only be omitted if there
+// is a single one, and the coarsest rollup tier evenly dividing 'step' is
+// used, if possible. Otherwise, samples are aggregated from raw values,
+// failing with 'ErrRawSamplesExpired' if some of them have already
+// been removed by the retention policy. Values are exported as 'DOUBLE'
+// (except for the 'count' aggregator). The file is written to
+// 'db.temp-directory', and the caller is responsible for closing it.
+func (stg *Storage) Export(
+	from, to time.Time, step int,
+	aggregator, filter, instance, format string) (*Export, error) {
+	// Validate 'from' and 'to' parameters.
+	if from.After(to) {
+		return nil, ErrInvalidFromTo
+	}
+
+	// Validate 'aggregator' parameter. Rates and increases of counters are not
+	// supported: they're calculated per metric from raw values of counters.
+	aggregator = strings.ToLower(aggregator)
+	switch aggregator {
+	case "avg", "min", "max", "first", "last", "count":
+	default:
+		return nil, ErrInvalidAggregator
+	}
+
+	// Validate 'format' parameter. See:
+	//   - https://duckdb.org/docs/sql/statements/copy.html.
+	var options string
+	switch format {
+	case ExportFormatCSV:
+		options = "FORMAT csv, HEADER"
+	case ExportFormatParquet:
+		options = "FORMAT parquet"
+	case ExportFormatNDJSON:
+		options = "FORMAT json"
+	default:
+		return nil, ErrInvalidExportFormat
+	}
+
+	// Validate 'instance' parameter.
+	if err := stg.checkInstance(instance); err != nil {
+		return nil, err
+	}
+
+	// Lock 'db' instance.
+	stg.mutex.RLock()
+	defer stg.mutex.RUnlock()
+
+	// Normalize 'from', 'to', and 'step' parameters.
+	from, to, step, err := stg.unsafeNormalizeFromToAndStep(from, to, step)
+	if err != nil {
+		return nil, fmt.Errorf("failed to normalize 'from', 'to', and 'step' parameters: %w", err)
+	}
+
+	// Use rolled up values, if possible. Otherwise, make sure raw samples in
+	// the requested range are still available.
+	var tier *rollupTier
+	if _, ok := rollupAggregates[aggregator]; ok {
+		tier = getRollupTier(step)
+	}
+	if tier == nil {
+		expired, err := stg.unsafeHasExpiredRawSamples(from, to)
+		if err != nil {
+			return nil, err
+		}
+		if expired {
+			return nil, ErrRawSamplesExpired
+		}
+	}
+
+	// Prepare the destination file. DuckDB overwrites it using its own file
+	// handle, so it's reopened once written.
+	if err := os.MkdirAll(stg.tempDirectory, 0750); err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	file, err := os.CreateTemp(stg.tempDirectory, "varnishmon-export-*."+format)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	path := file.Name()
+	file.Close()
+	ok := false
+	defer func() {
+		if !ok {
+			os.Remove(path)
+		}
+	}()
+
+	// Prepare query. 'COPY' doesn't support parameters, so all values are
+	// inlined.
+	table := "metric_values"
+	aggregate := fmt.Sprintf("%s(COALESCE(%s.value.float64, %s.value.uint64::DOUBLE))", aggregator, table, table)
+	if tier != nil {
+		table = tier.table
+		aggregate = rollupAggregates[aggregator]
+	}
+	quote := func(value string) string {
+		return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+	}
+	conditions := []string{
+		fmt.Sprintf("%s.timestamp >= %s", table, quote(from.UTC().Format(time.DateTime))),
+		fmt.Sprintf("%s.timestamp < %s", table, quote(to.UTC().Format(time.DateTime))),
+	}
+	if instance != "" {
+		conditions = append(conditions, fmt.Sprintf("%s.instance = %s", table, quote(instance)))
+	}
+	if terms := strings.Fields(filter); len(terms) > 0 {
+		matches := make([]string, 0, len(terms))
+		for _, term := range terms {
+			matches = append(matches, fmt.Sprintf("contains(metrics.name, %s)", quote(term)))
+		}
+		conditions = append(conditions, "("+strings.Join(matches, " OR ")+")")
+	}
+	//nolint:gosec
+	query := fmt.Sprintf(`
+		COPY (
+			SELECT
+				time_bucket(INTERVAL '%ds', %s.timestamp) AS timestamp,
+				metrics.name AS metric,
+				%s AS value
+			FROM %s
+				JOIN metrics ON metrics.id = %s.metric_id
+			WHERE %s
+			GROUP BY ALL
+			ORDER BY metric, timestamp
+		) TO %s (%s)`,
+		step, table, aggregate, table, table,
+		strings.Join(conditions, " AND "), quote(path), options)
+
+	// Export.
+	if _, err := stg.db.Exec(query); err != nil {
+		return nil, fmt.Errorf("failed to export '%s' table: %w", table, err)
+	}
+
+	// Done!
+	if file, err = os.Open(path); err != nil {
+		return nil, fmt.Errorf("failed to open exported file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to stat exported file: %w", err)
+	}
+	ok = true
+	return &Export{File: file, Size: info.Size()}, nil
+}
+
+// Checks if raw samples in the requested range have been removed by the
+// retention policy, i.e., if there are rolled up samples in the range older
+// than the bucket of the earliest raw sample. Raw samples are always removed
+// before the rollups summarizing them.
+func (stg *Storage) unsafeHasExpiredRawSamples(from, to time.Time) (bool, error) {
+	conditions := make([]string, 0, len(rollupTiers))
+	for _, tier := range rollupTiers {
+		conditions = append(conditions, fmt.Sprintf(`
+			EXISTS (
+				SELECT 1
+				FROM %s
+				WHERE
+					timestamp >= $1 AND
+					timestamp < $2 AND
+					(
+						(SELECT earliest FROM raw) IS NULL OR
+						timestamp < time_bucket(INTERVAL '%ds', (SELECT earliest FROM raw))
+					)
+			)`, tier.table, tier.step))
+	}
+
+	var expired bool
+	//nolint:gosec
+	if err := stg.db.QueryRow(`
+		WITH raw AS (SELECT min(timestamp) AS earliest FROM metric_values)
+		SELECT `+strings.Join(conditions, " OR "), from, to).Scan(&expired); err != nil {
+		return false, fmt.Errorf("failed to query 'metric_values' & rollup tables: %w", err)
+	}
+	return expired, nil
+}
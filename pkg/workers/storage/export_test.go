@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ExportTestSuite struct {
+	suite.Suite
+	stg *Storage
+}
+
+func (suite *ExportTestSuite) BeforeTest(suiteName, testName string) {
+	suite.stg = newTestStorage(
+		suite.T(),
+		"scraper.enabled", true,
+		"scraper.period", "60s",
+		"db.temp-directory", suite.T().TempDir())
+}
+
+func (suite *ExportTestSuite) push(instance string, timestamp time.Time, backends uint64, requests float64) {
+	suite.Require().NoError(suite.stg.PushMetricSamples(instance, timestamp, []*MetricSample{
+		{
+			Name:        "MAIN.n_backend",
+			Flag:        "g",
+			Format:      "i",
+			Description: "Number of backends",
+			Value:       backends,
+		},
+		{
+			Name:        "MAIN.client_req",
+			Flag:        "c",
+			Format:      "i",
+			Description: "Good client requests received",
+			Value:       requests,
+		},
+	}))
+}
+
+func (suite *ExportTestSuite) read(export *Export) string {
+	defer export.Close()
+	data, err := io.ReadAll(export)
+	suite.Require().NoError(err)
+	suite.Require().Equal(int64(len(data)), export.Size)
+	return string(data)
+}
+
+func (suite *ExportTestSuite) TestExport() {
+	assert := suite.Require()
+
+	base := time.Date(2025, time.January, 1, 13, 0, 0, 0, time.UTC)
+	suite.push("foo", base, 3, 1.5)
+	suite.push("bar", base, 5, 2.5)
+	suite.push("foo", base.Add(time.Minute), 4, 3.5)
+	suite.push("foo", base.Add(2*time.Minute), 6, 4.5)
+
+	// Samples of different instances are never aggregated together.
+	_, err := suite.stg.Export(base, base.Add(2*time.Minute), 120, "max", "", "", ExportFormatCSV)
+	assert.ErrorIs(err, ErrInstanceRequired)
+
+	export, err := suite.stg.Export(base, base.Add(2*time.Minute), 120, "max", "", "foo", ExportFormatCSV)
+	assert.NoError(err)
+	assert.Equal(
+		"timestamp,metric,value\n"+
+			"2025-01-01 13:00:00,MAIN.client_req,3.5\n"+
+			"2025-01-01 13:02:00,MAIN.client_req,4.5\n"+
+			"2025-01-01 13:00:00,MAIN.n_backend,4.0\n"+
+			"2025-01-01 13:02:00,MAIN.n_backend,6.0\n",
+		suite.read(export))
+
+	// Metrics and instances can be filtered.
+	export, err = suite.stg.Export(base, base.Add(time.Minute), 60, "count", "n_backend foo", "foo", ExportFormatNDJSON)
+	assert.NoError(err)
+	assert.Equal(
+		`{"timestamp":"2025-01-01 13:00:00","metric":"MAIN.n_backend","value":1}`+"\n"+
+			`{"timestamp":"2025-01-01 13:01:00","metric":"MAIN.n_backend","value":1}`+"\n",
+		suite.read(export))
+
+	// Same using raw samples (i.e., step not evenly divided by rollup tiers).
+	export, err = suite.stg.Export(base, base.Add(2*time.Minute), 90, "min", "n_backend", "foo", ExportFormatCSV)
+	assert.NoError(err)
+	assert.Equal(
+		"timestamp,metric,value\n"+
+			"2025-01-01 13:00:00,MAIN.n_backend,3.0\n"+
+			"2025-01-01 13:01:30,MAIN.n_backend,6.0\n",
+		suite.read(export))
+
+	// Parquet files start with a magic number.
+	export, err = suite.stg.Export(base, base.Add(time.Minute), 60, "avg", "", "bar", ExportFormatParquet)
+	assert.NoError(err)
+	path := export.Name()
+	assert.Equal("PAR1", suite.read(export)[:4])
+
+	// Temporary files are written to the temporary directory of the
+	// database, and removed once closed.
+	assert.Equal(suite.stg.tempDirectory, filepath.Dir(path))
+	_, err = os.Stat(path)
+	assert.True(os.IsNotExist(err))
+
+	assert.Len(suite.stg.app.Cfg().Log().Buffer().Events(), 0)
+}
+
+func (suite *ExportTestSuite) TestExportRawSamplesExpired() {
+	assert := suite.Require()
+
+	base := time.Date(2025, time.January, 1, 13, 0, 0, 0, time.UTC)
+	for i := range 4 {
+		suite.push("foo", base.Add(time.Duration(i)*time.Minute), uint64(i), float64(i))
+	}
+	_, err := suite.stg.db.Exec(`DELETE FROM metric_values WHERE timestamp < $1`, base.Add(2*time.Minute))
+	assert.NoError(err)
+
+	// Rolled up values are still available.
+	export, err := suite.stg.Export(base, base.Add(4*time.Minute), 60, "max", "n_backend", "", ExportFormatCSV)
+	assert.NoError(err)
+	assert.Equal(
+		"timestamp,metric,value\n"+
+			"2025-01-01 13:00:00,MAIN.n_backend,0.0\n"+
+			"2025-01-01 13:01:00,MAIN.n_backend,1.0\n"+
+			"2025-01-01 13:02:00,MAIN.n_backend,2.0\n"+
+			"2025-01-01 13:03:00,MAIN.n_backend,3.0\n",
+		suite.read(export))
+
+	// But raw samples are not.
+	_, err = suite.stg.Export(base, base.Add(4*time.Minute), 60, "first", "n_backend", "", ExportFormatCSV)
+	assert.ErrorIs(err, ErrRawSamplesExpired)
+	export, err = suite.stg.Export(base.Add(2*time.Minute), base.Add(4*time.Minute), 60, "first", "n_backend", "", ExportFormatCSV)
+	assert.NoError(err)
+	assert.Equal(
+		"timestamp,metric,value\n"+
+			"2025-01-01 13:02:00,MAIN.n_backend,2.0\n"+
+			"2025-01-01 13:03:00,MAIN.n_backend,3.0\n",
+		suite.read(export))
+
+	assert.Len(suite.stg.app.Cfg().Log().Buffer().Events(), 0)
+}
+
+func (suite *ExportTestSuite) TestExportInvalidParameters() {
+	assert := suite.Require()
+
+	base := time.Date(2025, time.January, 1, 13, 0, 0, 0, time.UTC)
+	_, err := suite.stg.Export(base, base.Add(-time.Minute), 60, "avg", "", "", ExportFormatCSV)
+	assert.ErrorIs(err, ErrInvalidFromTo)
+	_, err = suite.stg.Export(base, base.Add(time.Minute), 60, AggregatorRate, "", "", ExportFormatCSV)
+	assert.ErrorIs(err, ErrInvalidAggregator)
+	_, err = suite.stg.Export(base, base.Add(time.Minute), 60, "avg", "", "", "xlsx")
+	assert.ErrorIs(err, ErrInvalidExportFormat)
+
+	assert.Len(suite.stg.app.Cfg().Log().Buffer().Events(), 0)
+}
+
+func TestExportTestSuite(t *testing.T) {
+	suite.Run(t, &ExportTestSuite{})
+}
@@ -0,0 +1,251 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/allenta/varnishmon/pkg/helpers"
+)
+
+var (
+	ErrNoDBFiles = errors.New("no database files found")
+)
+
+// Extensions of the database files found when scanning directories listed in
+// 'db.files', including the ones compressed by 'Rotate'.
+var dbFileExtensions = []string{".db", ".duckdb", ".db.gz", ".duckdb.gz"} //nolint:gochecknoglobals
+
+// Tables exposed as views over all the attached database files, and the
+// columns identifying their rows, so rows found in several files (e.g., files
+// with overlapping time ranges) are only exposed once, taken from the most
+// recent file. Metric IDs in the ones with a 'metric_id' column are
+// translated, so they match the reconciled 'metrics' table.
+var (
+	dbFileMetricTables = []string{ //nolint:gochecknoglobals
+		"metric_values", "metric_rollups_1m", "metric_rollups_1h", "counter_values",
+	}
+	dbFileOtherTables = map[string]string{ //nolint:gochecknoglobals
+		"bursts":              "started",
+		"scrapes":             "instance, timestamp",
+		"top_requests":        "instance, timestamp, dimension, key",
+		"transactions":        "instance, timestamp, vxid",
+		"counter_checkpoints": "instance, name",
+	}
+)
+
+// Expands the given paths (files, directories or glob patterns) into a sorted
+// list of database files. Directories are not scanned recursively.
+func findDBFiles(paths []string) ([]string, error) {
+	seen := make(map[string]bool)
+	result := make([]string, 0)
+	add := func(file string) {
+		if !seen[file] {
+			seen[file] = true
+			result = append(result, file)
+		}
+	}
+
+	for _, path := range paths {
+		matches := []string{path}
+		if _, err := os.Stat(path); err != nil {
+			if matches, err = filepath.Glob(path); err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %w", path, err)
+			}
+		}
+
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil {
+				return nil, fmt.Errorf("failed to stat %q: %w", match, err)
+			}
+			if !info.IsDir() {
+				add(match)
+				continue
+			}
+
+			entries, err := os.ReadDir(match)
+			if err != nil {
+				return nil, fmt.Errorf("failed to scan %q: %w", match, err)
+			}
+			for _, entry := range entries {
+				if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+					continue
+				}
+				for _, extension := range dbFileExtensions {
+					if strings.HasSuffix(entry.Name(), extension) {
+						add(filepath.Join(match, entry.Name()))
+						break
+					}
+				}
+			}
+		}
+	}
+
+	if len(result) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNoDBFiles, strings.Join(paths, ", "))
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// Attaches the database files listed in 'db.files' to the (in-memory)
+// database, in read-only mode, and exposes them as a single one: metrics are
+// reconciled by name (IDs assigned by 'metrics_seq' differ per file) into the
+// 'metrics' table, and the rest of tables are replaced by views over all files.
+// Compressed files are decompressed into temporary copies first, which are
+// migrated if needed. Files that can't be attached (e.g., locked by a running
+// varnishmon, or with an outdated schema) are skipped.
+func (stg *Storage) unsafeAttachDBFiles() error {
+	files, err := findDBFiles(stg.filePatterns)
+	if err != nil {
+		return err
+	}
+
+	aliases := make([]string, 0, len(files))
+	for _, file := range files {
+		alias := fmt.Sprintf("f%d", len(aliases))
+		if err := stg.unsafeAttachDBFile(file, alias); err != nil {
+			stg.app.Cfg().Log().Error().
+				Err(err).
+				Str("file", file).
+				Msg("Failed to attach database file, skipping it!")
+			continue
+		}
+		aliases = append(aliases, alias)
+	}
+	if len(aliases) == 0 {
+		return fmt.Errorf("%w: none of the %d files could be attached", ErrNoDBFiles, len(files))
+	}
+
+	union := func(format string) string {
+		parts := make([]string, 0, len(aliases))
+		for i, alias := range aliases {
+			parts = append(parts, fmt.Sprintf(format, i, alias))
+		}
+		return strings.Join(parts, " UNION ALL ")
+	}
+
+	// The class of a metric may differ between files (e.g., a metric stored as
+	// 'uint64' by an older version of varnishmon). In that case 'float64' is
+	// used, and values in the other files are converted when reading them.
+	statements := []string{
+		fmt.Sprintf(`
+			CREATE TABLE metrics AS
+			SELECT
+				(row_number() OVER (ORDER BY name))::INTEGER AS id,
+				name,
+				arg_max(flag, source) AS flag,
+				arg_max(format, source) AS format,
+				arg_max(description, source) AS description,
+				CASE WHEN count(DISTINCT class) > 1 THEN 'float64' ELSE any_value(class) END AS class
+			FROM (%s)
+			GROUP BY name`,
+			union(`SELECT %d AS source, * FROM %s.metrics`)),
+		fmt.Sprintf(`
+			CREATE TABLE metric_ids AS
+			SELECT source, local_id, local_class, metrics.id, metrics.class
+			FROM (%s) JOIN metrics USING (name)`,
+			union(`SELECT %d AS source, id AS local_id, name, class AS local_class FROM %s.metrics`)),
+		// The most recent file (i.e., the last one, assuming files are named
+		// after their time range) describes the whole set.
+		fmt.Sprintf(`CREATE VIEW metadata AS SELECT * FROM %s.metadata`, aliases[len(aliases)-1]),
+	}
+	for _, table := range dbFileMetricTables {
+		replace := ""
+		if table == "metric_values" {
+			replace = `REPLACE (
+				CASE
+					WHEN metric_ids.class = metric_ids.local_class THEN t.value
+					ELSE union_value(float64 := COALESCE(t.value.float64, t.value.uint64::DOUBLE))::
+						UNION(float64 FLOAT8, uint64 UBIGINT)
+				END AS value)`
+		}
+		statements = append(statements, fmt.Sprintf(`
+			CREATE VIEW %s AS
+			SELECT DISTINCT ON (metric_id, instance, timestamp) * EXCLUDE (source)
+			FROM (
+				SELECT metric_ids.id AS metric_id, t.* EXCLUDE (metric_id) %s
+				FROM (%s) AS t
+				JOIN metric_ids ON metric_ids.source = t.source AND metric_ids.local_id = t.metric_id
+			)
+			ORDER BY source DESC`,
+			table, replace, union(`SELECT %d AS source, * FROM %s.`+table)))
+	}
+	for table, key := range dbFileOtherTables {
+		statements = append(statements, fmt.Sprintf(`
+			CREATE VIEW %s AS
+			SELECT DISTINCT ON (%s) * EXCLUDE (source)
+			FROM (%s)
+			ORDER BY source DESC`,
+			table, key, union(`SELECT %d AS source, * FROM %s.`+table)))
+	}
+	for _, statement := range statements {
+		if _, err := stg.db.Exec(statement); err != nil {
+			return fmt.Errorf("failed to create unified view of database files: %w", err)
+		}
+	}
+
+	stg.app.Cfg().Log().Info().
+		Int("attached", len(aliases)).
+		Int("skipped", len(files)-len(aliases)).
+		Msg("Database files have been attached")
+
+	return nil
+}
+
+func (stg *Storage) unsafeAttachDBFile(file, alias string) error {
+	if strings.HasSuffix(file, ".gz") {
+		if stg.copiesDirectory == "" {
+			var err error
+			if stg.copiesDirectory, err = os.MkdirTemp("", "varnishmon-"); err != nil {
+				return fmt.Errorf("failed to create temporary directory: %w", err)
+			}
+		}
+		tmp := filepath.Join(stg.copiesDirectory, alias+".db")
+		if _, err := helpers.DecompressFile(file, tmp); err != nil {
+			return fmt.Errorf("failed to decompress file: %w", err)
+		}
+		if _, err := Migrate(tmp, false); err != nil {
+			return err
+		}
+		file = tmp
+	}
+
+	//nolint:gosec
+	if _, err := stg.db.Exec(fmt.Sprintf(`ATTACH '%s' AS %s (READ_ONLY)`,
+		strings.ReplaceAll(file, "'", "''"), alias)); err != nil {
+		return fmt.Errorf("failed to attach database: %w", err)
+	}
+
+	var version int
+	//nolint:gosec
+	if err := stg.db.QueryRow(
+		`SELECT schema_version FROM ` + alias + `.metadata LIMIT 1`).Scan(&version); err != nil {
+		version = 0
+	}
+	if version != SchemaVersion {
+		if _, err := stg.db.Exec(`DETACH ` + alias); err != nil {
+			return fmt.Errorf("failed to detach database: %w", err)
+		}
+		if _, err := planMigrations(version); err != nil {
+			return err
+		}
+		return fmt.Errorf(
+			"%w: database schema version is %d, but the latest one is %d (hint: use 'varnishmon db migrate')",
+			ErrOutdatedSchemaVersion, version, SchemaVersion)
+	}
+
+	return nil
+}
+
+// Removes temporary copies of compressed database files, if any.
+func (stg *Storage) removeCopies() {
+	if stg.copiesDirectory != "" {
+		os.RemoveAll(stg.copiesDirectory)
+		stg.copiesDirectory = ""
+	}
+}
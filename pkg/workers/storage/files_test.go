@@ -0,0 +1,191 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/allenta/varnishmon/pkg/helpers"
+	"github.com/stretchr/testify/suite"
+)
+
+type FilesTestSuite struct {
+	suite.Suite
+	tmpDir string
+}
+
+func (suite *FilesTestSuite) BeforeTest(suiteName, testName string) {
+	suite.tmpDir = suite.T().TempDir()
+}
+
+// Creates a database file with samples of the given gauges, registered in
+// the given order, so metric IDs differ between files.
+func (suite *FilesTestSuite) createFile(
+	name, instance string, timestamps []time.Time, metrics ...string) {
+	stg := newTestStorage(suite.T(), "db.file", filepath.Join(suite.tmpDir, name))
+	for _, timestamp := range timestamps {
+		samples := make([]*MetricSample, 0, len(metrics))
+		for i, metric := range metrics {
+			samples = append(samples, &MetricSample{
+				Name:        metric,
+				Flag:        "g",
+				Format:      "i",
+				Description: "Foo",
+				Value:       uint64(timestamp.Day()*10 + i),
+			})
+		}
+		suite.Require().NoError(stg.PushMetricSamples(instance, timestamp, samples))
+	}
+	suite.Require().NoError(stg.Shutdown())
+}
+
+func (suite *FilesTestSuite) TestFindDBFiles() {
+	assert := suite.Require()
+
+	for _, name := range []string{"a.db", "b.db.gz", "c.duckdb", "notes.txt", ".d.db"} {
+		assert.NoError(os.WriteFile(filepath.Join(suite.tmpDir, name), []byte{}, 0640))
+	}
+
+	files, err := findDBFiles([]string{suite.tmpDir})
+	assert.NoError(err)
+	assert.Equal([]string{
+		filepath.Join(suite.tmpDir, "a.db"),
+		filepath.Join(suite.tmpDir, "b.db.gz"),
+		filepath.Join(suite.tmpDir, "c.duckdb"),
+	}, files)
+
+	files, err = findDBFiles([]string{
+		filepath.Join(suite.tmpDir, "c.duckdb"),
+		filepath.Join(suite.tmpDir, "a.*"),
+	})
+	assert.NoError(err)
+	assert.Equal([]string{
+		filepath.Join(suite.tmpDir, "a.db"),
+		filepath.Join(suite.tmpDir, "c.duckdb"),
+	}, files)
+
+	_, err = findDBFiles([]string{filepath.Join(suite.tmpDir, "*.foo")})
+	assert.ErrorIs(err, ErrNoDBFiles)
+}
+
+func (suite *FilesTestSuite) TestAttachDBFiles() {
+	assert := suite.Require()
+
+	// Two files with different metric IDs, plus a compressed one created by
+	// a previous version of varnishmon.
+	day := time.Date(2025, time.January, 1, 12, 0, 0, 0, time.UTC)
+	suite.createFile("varnishmon-1.db", "foo",
+		[]time.Time{day, day.Add(time.Minute)}, "MAIN.cache_hit", "MAIN.n_backend")
+	suite.createFile("varnishmon-2.db", "bar",
+		[]time.Time{day.Add(24 * time.Hour)}, "MAIN.n_backend")
+	data, err := os.ReadFile(filepath.Join("testdata", "schema-v2.duckdb.gz"))
+	assert.NoError(err)
+	assert.NoError(os.WriteFile(filepath.Join(suite.tmpDir, "varnishmon-3.db.gz"), data, 0640))
+
+	stg := newTestStorage(suite.T(), "db.files", []string{filepath.Join(suite.tmpDir, "varnishmon-*")})
+
+	// The cache covers all files.
+	assert.Len(stg.cache.metricsByName, 3)
+	assert.Equal([]string{"bar", "foo"}, stg.Instances())
+	assert.True(day.Equal(stg.Earliest()))
+	assert.True(stg.Latest().After(time.Date(2025, time.February, 1, 0, 0, 0, 0, time.UTC)))
+
+	// Metrics are reconciled by name.
+	metrics, err := stg.GetMetrics(day, day.Add(48*time.Hour), 60, "")
+	assert.NoError(err)
+	assert.Len(metrics["metrics"], 2)
+	id := stg.cache.metricsByName["MAIN.n_backend"].ID
+	_, err = stg.GetMetric(id, day, day.Add(48*time.Hour), 60, "max", FillNone, "")
+	assert.ErrorIs(err, ErrInstanceRequired)
+	metric, err := stg.GetMetric(id, day, day.Add(48*time.Hour), 60, "max", FillNone, "foo")
+	assert.NoError(err)
+	assert.Equal([][2]interface{}{
+		{day.Unix(), uint64(11)},
+		{day.Add(time.Minute).Unix(), uint64(11)},
+	}, metric["samples"])
+	metric, err = stg.GetMetric(id, day, day.Add(48*time.Hour), 3600, "max", FillNone, "bar")
+	assert.NoError(err)
+	assert.Equal([][2]interface{}{
+		{day.Add(24 * time.Hour).Unix(), uint64(20)},
+	}, metric["samples"])
+
+	// Temporary copies are removed on shutdown.
+	copies := stg.copiesDirectory
+	assert.NotEmpty(copies)
+	assert.NoError(stg.Shutdown())
+	_, err = os.Stat(copies)
+	assert.True(os.IsNotExist(err))
+
+	assert.Len(stg.app.Cfg().Log().Buffer().Events(), 0)
+}
+
+func (suite *FilesTestSuite) TestAttachOverlappingDBFiles() {
+	assert := suite.Require()
+
+	// Both files include the sample at 'day', and the metric is stored as
+	// 'uint64' in the first one and as 'float64' in the second one.
+	day := time.Date(2025, time.January, 1, 12, 0, 0, 0, time.UTC)
+	for i, value := range []any{uint64(10), float64(20.5)} {
+		stg := newTestStorage(suite.T(), "db.file", filepath.Join(suite.tmpDir, fmt.Sprintf("varnishmon-%d.db", i+1)))
+		for j := range 2 {
+			assert.NoError(stg.PushMetricSamples("foo", day.Add(time.Duration(i+j)*time.Minute), []*MetricSample{{
+				Name:        "MAIN.foo",
+				Flag:        "g",
+				Format:      "i",
+				Description: "Foo",
+				Value:       value,
+			}}))
+		}
+		assert.NoError(stg.PushScrape(&Scrape{Instance: "foo", Timestamp: day, Outcome: ScrapeOutcomeOK}))
+		assert.NoError(stg.Shutdown())
+	}
+
+	stg := newTestStorage(suite.T(), "db.files", []string{suite.tmpDir})
+	defer stg.Shutdown() //nolint:errcheck
+
+	// Duplicated rows are exposed once, taken from the most recent file, and
+	// values are converted to the reconciled class.
+	metric := stg.cache.metricsByName["MAIN.foo"]
+	assert.Equal("float64", metric.Class)
+	samples, err := stg.GetMetric(metric.ID, day, day.Add(time.Hour), 60, "max", FillNone, "")
+	assert.NoError(err)
+	assert.Equal([][2]interface{}{
+		{day.Unix(), float64(10)},
+		{day.Add(time.Minute).Unix(), float64(20.5)},
+		{day.Add(2 * time.Minute).Unix(), float64(20.5)},
+	}, samples["samples"])
+	var count int
+	assert.NoError(stg.db.QueryRow(`SELECT COUNT(*) FROM scrapes`).Scan(&count))
+	assert.Equal(1, count)
+
+	assert.Len(stg.app.Cfg().Log().Buffer().Events(), 0)
+}
+
+func (suite *FilesTestSuite) TestSkipOutdatedDBFiles() {
+	assert := suite.Require()
+
+	day := time.Date(2025, time.January, 1, 12, 0, 0, 0, time.UTC)
+	suite.createFile("varnishmon-1.db", "foo", []time.Time{day}, "MAIN.n_backend")
+	ok, err := helpers.DecompressFile(
+		filepath.Join("testdata", "schema-v2.duckdb.gz"),
+		filepath.Join(suite.tmpDir, "varnishmon-2.db"))
+	assert.NoError(err)
+	assert.True(ok)
+
+	// Uncompressed files are attached in read-only mode, so they're not
+	// migrated.
+	stg := newTestStorage(suite.T(), "db.files", []string{suite.tmpDir})
+	defer stg.Shutdown() //nolint:errcheck
+	assert.Equal([]string{"foo"}, stg.Instances())
+	assert.True(day.Equal(stg.Latest()))
+
+	events := stg.app.Cfg().Log().Buffer().Events()
+	assert.Len(events, 1)
+	assert.Equal("Failed to attach database file, skipping it!", events[0]["message"])
+}
+
+func TestFilesTestSuite(t *testing.T) {
+	suite.Run(t, &FilesTestSuite{})
+}
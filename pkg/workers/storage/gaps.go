@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Strategies to fill missing buckets inside gaps.
+const (
+	// Missing buckets are left out.
+	FillNone = ""
+	// Missing buckets are returned with a null value, so charts are broken
+	// instead of drawing a straight line across the gap.
+	FillNull = "null"
+	// Missing buckets are returned with the value of the previous bucket.
+	FillPrevious = "previous"
+	// Missing buckets are returned with a zero value.
+	FillZero = "zero"
+	// Missing buckets are returned with a value linearly interpolated
+	// between the surrounding buckets. Non-numeric values (i.e., bitmaps)
+	// are returned as null.
+	FillLinear = "linear"
+)
+
+// Returns the interval, in seconds, between consecutive samples of a metric
+// (i.e., the scraping period in effect) in the requested time range. It's
+// estimated as the most common interval, so bursts and occasional failures
+// don't distort it. The period is the same for all metrics of an instance, so
+// it's estimated using the scrape attempts recorded in the 'scrapes' table,
+// which is much smaller than the samples tables. Samples of the metric are
+// used only if there are no recorded attempts (e.g., metrics pushed to the
+// ingest endpoint, or databases created by older versions of varnishmon),
+// using its rolled up values instead of raw samples if a rollup tier is given.
+// If there are not enough samples, the shortest scraping period of the
+// configuration is used, if any. Zero if unknown.
+func (stg *Storage) unsafeGetMetricPeriod(
+	metric *CachedMetric, tier *rollupTier, from, to time.Time, instance string) int {
+	period, err := stg.unsafeGetScrapesPeriod(from, to, instance)
+	if err == nil && period == nil {
+		if tier != nil {
+			period, err = stg.unsafeGetRolledUpMetricPeriod(metric, tier, from, to, instance)
+		} else {
+			period, err = stg.unsafeGetRawMetricPeriod(metric, from, to, instance)
+		}
+	}
+	if err != nil {
+		stg.app.Cfg().Log().Warn().
+			Err(err).
+			Int("metric", metric.ID).
+			Msg("Failed to estimate scraping period!")
+	}
+	if period != nil && *period >= 1 {
+		return int(*period)
+	}
+
+	if stg.app.Cfg().ScraperEnabled() {
+		return int(stg.app.Cfg().ScraperMinPeriod().Seconds())
+	}
+	return 0
+}
+
+func (stg *Storage) unsafeGetScrapesPeriod(from, to time.Time, instance string) (*float64, error) {
+	var period *float64
+	if err := stg.db.QueryRow(`
+		SELECT mode(interval)
+		FROM (
+			SELECT round(epoch(timestamp) - epoch(lag(timestamp) OVER w)) AS interval
+			FROM scrapes
+			WHERE
+				timestamp >= $1 AND
+				timestamp < $2 AND
+				($3 = '' OR instance = $3)
+			WINDOW w AS (PARTITION BY instance ORDER BY timestamp)
+		)
+		WHERE interval > 0`, from, to, instance).Scan(&period); err != nil {
+		return nil, fmt.Errorf("failed to query 'scrapes' table: %w", err)
+	}
+	return period, nil
+}
+
+func (stg *Storage) unsafeGetRawMetricPeriod(
+	metric *CachedMetric, from, to time.Time, instance string) (*float64, error) {
+	var period *float64
+	if err := stg.db.QueryRow(`
+		SELECT mode(interval)
+		FROM (
+			SELECT round(epoch(timestamp) - epoch(lag(timestamp) OVER w)) AS interval
+			FROM (
+				SELECT instance, timestamp
+				FROM metric_values
+				WHERE
+					metric_id = $1 AND
+					timestamp >= $2 AND
+					timestamp < $3 AND
+					($4 = '' OR instance = $4)
+				UNION
+				SELECT instance, timestamp
+				FROM counter_values
+				WHERE
+					metric_id = $1 AND
+					timestamp >= $2 AND
+					timestamp < $3 AND
+					($4 = '' OR instance = $4)
+			)
+			WINDOW w AS (PARTITION BY instance ORDER BY timestamp)
+		)
+		WHERE interval > 0`, metric.ID, from, to, instance).Scan(&period); err != nil {
+		return nil, fmt.Errorf("failed to query 'metric_values' & 'counter_values' tables: %w", err)
+	}
+	return period, nil
+}
+
+// Looks for gaps between the given samples (sorted buckets, as returned by
+// 'GetMetric'), and fills them according to 'fill'. A gap is an interval
+// between non-consecutive buckets where at least 'gapPeriods' scrapes were
+// missed, according to the given scraping period (in seconds, or zero if
+// unknown). Buckets before the first sample and after the last one are never
+// considered gaps. Returns the filled samples and the gaps, as '[from, to]'
+// intervals (i.e., from the end of the bucket before the gap to the start of
+// the bucket after it).
+func fillGaps(
+	samples [][2]interface{}, step, period, gapPeriods int,
+	fill string) ([][2]interface{}, [][2]int64) {
+	if period < 1 {
+		period = step
+	}
+
+	result := make([][2]interface{}, 0, len(samples))
+	gaps := make([][2]int64, 0)
+	for i, sample := range samples {
+		if i > 0 {
+			previous := samples[i-1]
+			start := previous[0].(int64)
+			end := sample[0].(int64)
+			interval := end - start
+			missed := int(math.Round(float64(interval)/float64(period))) - 1
+			if interval > int64(step) && missed >= gapPeriods {
+				gaps = append(gaps, [2]int64{start + int64(step), end})
+				if fill != FillNone {
+					for timestamp := start + int64(step); timestamp < end; timestamp += int64(step) {
+						result = append(result, [2]interface{}{
+							timestamp,
+							fillValue(fill, previous, sample, timestamp),
+						})
+					}
+				}
+			}
+		}
+		result = append(result, sample)
+	}
+
+	return result, gaps
+}
+
+func fillValue(fill string, previous, next [2]interface{}, timestamp int64) interface{} {
+	switch fill {
+	case FillPrevious:
+		return previous[1]
+	case FillZero:
+		switch previous[1].(type) {
+		case string:
+			return "0"
+		case uint64:
+			return uint64(0)
+		case int64:
+			return int64(0)
+		default:
+			return float64(0)
+		}
+	case FillLinear:
+		start, ok1 := toFloat64(previous[1])
+		end, ok2 := toFloat64(next[1])
+		if !ok1 || !ok2 {
+			return nil
+		}
+		ratio := float64(timestamp-previous[0].(int64)) / float64(next[0].(int64)-previous[0].(int64))
+		return start + (end-start)*ratio
+	default:
+		return nil
+	}
+}
+
+func toFloat64(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,248 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type GapsTestSuite struct {
+	suite.Suite
+	stg *Storage
+}
+
+func (suite *GapsTestSuite) BeforeTest(suiteName, testName string) {
+	suite.stg = newTestStorage(suite.T())
+}
+
+func (suite *GapsTestSuite) TestFillGaps() {
+	assert := suite.Require()
+
+	samples := [][2]interface{}{
+		{int64(0), float64(1)},
+		{int64(60), float64(2)},
+		// Single missed scrape.
+		{int64(180), float64(3)},
+		// Gap.
+		{int64(420), float64(7)},
+	}
+
+	tests := []struct {
+		step     int
+		period   int
+		fill     string
+		expected [][2]interface{}
+		gaps     [][2]int64
+	}{
+		{
+			step:     60,
+			period:   60,
+			fill:     FillNone,
+			expected: samples,
+			gaps:     [][2]int64{{240, 420}},
+		},
+		{
+			step:   60,
+			period: 60,
+			fill:   FillNull,
+			expected: [][2]interface{}{
+				{int64(0), float64(1)},
+				{int64(60), float64(2)},
+				{int64(180), float64(3)},
+				{int64(240), nil},
+				{int64(300), nil},
+				{int64(360), nil},
+				{int64(420), float64(7)},
+			},
+			gaps: [][2]int64{{240, 420}},
+		},
+		{
+			step:   60,
+			period: 60,
+			fill:   FillPrevious,
+			expected: [][2]interface{}{
+				{int64(0), float64(1)},
+				{int64(60), float64(2)},
+				{int64(180), float64(3)},
+				{int64(240), float64(3)},
+				{int64(300), float64(3)},
+				{int64(360), float64(3)},
+				{int64(420), float64(7)},
+			},
+			gaps: [][2]int64{{240, 420}},
+		},
+		{
+			step:   60,
+			period: 60,
+			fill:   FillZero,
+			expected: [][2]interface{}{
+				{int64(0), float64(1)},
+				{int64(60), float64(2)},
+				{int64(180), float64(3)},
+				{int64(240), float64(0)},
+				{int64(300), float64(0)},
+				{int64(360), float64(0)},
+				{int64(420), float64(7)},
+			},
+			gaps: [][2]int64{{240, 420}},
+		},
+		{
+			step:   60,
+			period: 60,
+			fill:   FillLinear,
+			expected: [][2]interface{}{
+				{int64(0), float64(1)},
+				{int64(60), float64(2)},
+				{int64(180), float64(3)},
+				{int64(240), float64(4)},
+				{int64(300), float64(5)},
+				{int64(360), float64(6)},
+				{int64(420), float64(7)},
+			},
+			gaps: [][2]int64{{240, 420}},
+		},
+		{
+			// Large steps: any missing bucket is a gap.
+			step:   60,
+			period: 10,
+			fill:   FillNull,
+			expected: [][2]interface{}{
+				{int64(0), float64(1)},
+				{int64(60), float64(2)},
+				{int64(120), nil},
+				{int64(180), float64(3)},
+				{int64(240), nil},
+				{int64(300), nil},
+				{int64(360), nil},
+				{int64(420), float64(7)},
+			},
+			gaps: [][2]int64{{120, 180}, {240, 420}},
+		},
+		{
+			// Small steps: empty buckets between scrapes are not gaps.
+			step:     1,
+			period:   60,
+			fill:     FillNull,
+			expected: nil,
+			gaps:     [][2]int64{{181, 420}},
+		},
+	}
+
+	for _, test := range tests {
+		filled, gaps := fillGaps(samples, test.step, test.period, 2, test.fill)
+		if test.expected != nil {
+			assert.Equal(test.expected, filled, "fill=%q step=%d", test.fill, test.step)
+		} else {
+			assert.Len(filled, len(samples)+239)
+		}
+		assert.Equal(test.gaps, gaps, "fill=%q step=%d", test.fill, test.step)
+	}
+}
+
+func (suite *GapsTestSuite) TestGetMetricWithGaps() {
+	assert := suite.Require()
+
+	// A gauge scraped every 10 seconds, with a gap of one minute.
+	start := time.Date(2025, time.January, 1, 13, 0, 0, 0, time.UTC)
+	for _, offset := range []int{0, 10, 20, 30, 90, 100} {
+		err := suite.stg.PushMetricSamples("default", start.Add(time.Duration(offset)*time.Second), []*MetricSample{
+			{
+				Name:        "MAIN.n_backend",
+				Flag:        "g",
+				Format:      "i",
+				Description: "Number of backends",
+				Value:       uint64(offset),
+			},
+		})
+		assert.NoError(err)
+	}
+
+	id := suite.stg.cache.metricsByName["MAIN.n_backend"].ID
+	metric, err := suite.stg.GetMetric(id, start, start.Add(110*time.Second), 10, "max", FillNull, "")
+	assert.NoError(err)
+	assert.Equal([][2]int64{{start.Unix() + 40, start.Unix() + 90}}, metric["gaps"])
+	assert.Len(metric["samples"], 11)
+
+	_, err = suite.stg.GetMetric(id, start, start.Add(110*time.Second), 10, "max", "foo", "")
+	assert.ErrorIs(err, ErrInvalidFill)
+
+	assert.Len(suite.stg.app.Cfg().Log().Buffer().Events(), 0)
+}
+
+func (suite *GapsTestSuite) TestGetCounterWithGaps() {
+	assert := suite.Require()
+
+	// A counter scraped every 10 seconds, increasing by 1 per second, with a
+	// gap of one minute.
+	start := time.Date(2025, time.January, 1, 13, 0, 0, 0, time.UTC)
+	for _, offset := range []int{0, 10, 20, 30, 90, 100} {
+		rawValue := uint64(offset)
+		err := suite.stg.PushMetricSamples("default", start.Add(time.Duration(offset)*time.Second), []*MetricSample{
+			{
+				Name:        "MAIN.client_req",
+				Flag:        "c",
+				Format:      "i",
+				Description: "Good client requests received",
+				RawValue:    &rawValue,
+			},
+		})
+		assert.NoError(err)
+	}
+
+	// The increase during the gap is not accounted in the bucket after it.
+	id := suite.stg.cache.metricsByName["MAIN.client_req"].ID
+	metric, err := suite.stg.GetMetric(
+		id, start, start.Add(110*time.Second), 10, AggregatorIncrease, FillNone, "")
+	assert.NoError(err)
+	assert.Equal([][2]interface{}{
+		{start.Unix() + 10, float64(10)},
+		{start.Unix() + 20, float64(10)},
+		{start.Unix() + 30, float64(10)},
+		{start.Unix() + 100, float64(10)},
+	}, metric["samples"])
+	assert.Equal([][2]int64{{start.Unix() + 40, start.Unix() + 100}}, metric["gaps"])
+
+	assert.Len(suite.stg.app.Cfg().Log().Buffer().Events(), 0)
+}
+
+func (suite *GapsTestSuite) TestGetMetricPeriodFromScrapes() {
+	assert := suite.Require()
+
+	// A gauge only reported every other scrape, and then missing during
+	// three consecutive ones, while scrapes are recorded every 10 seconds.
+	start := time.Date(2025, time.January, 1, 13, 0, 0, 0, time.UTC)
+	for offset := 0; offset <= 100; offset += 10 {
+		timestamp := start.Add(time.Duration(offset) * time.Second)
+		assert.NoError(suite.stg.PushScrape(&Scrape{
+			Instance:  "default",
+			Timestamp: timestamp,
+			Outcome:   ScrapeOutcomeOK,
+		}))
+		if offset%20 == 0 && (offset < 40 || offset > 70) {
+			assert.NoError(suite.stg.PushMetricSamples("default", timestamp, []*MetricSample{
+				{
+					Name:        "MAIN.n_backend",
+					Flag:        "g",
+					Format:      "i",
+					Description: "Number of backends",
+					Value:       uint64(offset),
+				},
+			}))
+		}
+	}
+
+	// Estimated using the scrapes, not the samples of the metric.
+	id := suite.stg.cache.metricsByName["MAIN.n_backend"].ID
+	metric := suite.stg.cache.metricsByID[id]
+	assert.Equal(10, suite.stg.unsafeGetMetricPeriod(metric, nil, start, start.Add(110*time.Second), ""))
+	result, err := suite.stg.GetMetric(id, start, start.Add(110*time.Second), 10, "max", FillNone, "default")
+	assert.NoError(err)
+	assert.Equal([][2]int64{{start.Unix() + 30, start.Unix() + 80}}, result["gaps"])
+
+	assert.Len(suite.stg.app.Cfg().Log().Buffer().Events(), 0)
+}
+
+func TestGapsTestSuite(t *testing.T) {
+	suite.Run(t, &GapsTestSuite{})
+}
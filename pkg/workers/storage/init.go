@@ -3,15 +3,13 @@ package storage
 import (
 	"database/sql"
 	"fmt"
-	"os"
 	"time"
 
-	"github.com/allenta/varnishmon/pkg/config"
 	_ "github.com/marcboeker/go-duckdb" // Register the DuckDB driver.
 )
 
 const (
-	SchemaVersion = 1
+	SchemaVersion = 9
 )
 
 func (stg *Storage) init() {
@@ -21,21 +19,71 @@ func (stg *Storage) init() {
 	stg.cache.mutex.Lock()
 	defer stg.cache.mutex.Unlock()
 
+	// Initialize the database and cache. When reopening the database, the
+	// latest raw values of counters are carried over to the new one (e.g.,
+	// after being rotated), so the archiver can resume from it after a
+	// restart.
+	var counters []*CounterValue
+	if stg.db != nil {
+		counters = stg.unsafeClose()
+	}
+	if err := stg.unsafeOpen(counters); err != nil {
+		stg.app.Cfg().Log().Fatal().
+			Err(err).
+			Str("file", stg.file).
+			Msg("Failed to initialize database & cache!")
+	}
+}
+
+// Closes the database, returning the latest raw values of counters worth
+// carrying over to the next one opened (see 'unsafeOpen').
+func (stg *Storage) unsafeClose() []*CounterValue {
+	counters := stg.unsafeGetResumableCounters()
+	stg.db.Close()
+	stg.db = nil
+	stg.removeCopies()
+	return counters
+}
+
+// Opens the database file (creating or migrating its schema, as needed) and
+// initializes the cache. Read-only databases (i.e., archives) are opened only
+// if their schema is up to date.
+func (stg *Storage) unsafeOpen(counters []*CounterValue) error {
 	// Log start of database and cache initialization.
 	start := time.Now()
 	stg.app.Cfg().Log().Info().
-		Str("file", stg.app.Cfg().DBFile()).
+		Str("file", stg.file).
+		Strs("files", stg.filePatterns).
+		Bool("read_only", stg.readOnly).
 		Msg("Initializing database & cache. This may take a while")
 
 	// Initialize the database and cache.
-	if stg.db != nil {
-		stg.db.Close()
+	if err := stg.unsafeOpenDB(); err != nil {
+		return err
+	}
+	if err := stg.unsafeConfigureDB(); err != nil {
+		return err
+	}
+	if len(stg.filePatterns) > 0 {
+		if err := stg.unsafeAttachDBFiles(); err != nil {
+			return err
+		}
+	} else {
+		if err := stg.unsafeMigrateDBTables(); err != nil {
+			return err
+		}
+	}
+	if len(counters) > 0 {
+		if err := stg.unsafePushCounterCheckpoints(counters); err != nil {
+			stg.app.Cfg().Log().Error().
+				Err(err).
+				Int("count", len(counters)).
+				Msg("Failed to carry over latest raw values of counters!")
+		}
+	}
+	if err := stg.unsafeInitCache(); err != nil {
+		return err
 	}
-	stg.unsafeOpenDB()
-	stg.unsafeConfigureDB()
-	stg.unsafeMigrateDBTables()
-	stg.unsafeCreateDBTables()
-	stg.unsafeInitCache()
 
 	// Fetch some database information, just for logging purposes.
 	row := stg.db.QueryRow(`
@@ -44,9 +92,7 @@ func (stg *Storage) init() {
 		LIMIT 1`)
 	var databaseSize, walSize, memoryUsage, memoryLimit string
 	if err := row.Scan(&databaseSize, &walSize, &memoryUsage, &memoryLimit); err != nil {
-		stg.app.Cfg().Log().Fatal().
-			Err(err).
-			Msg("Failed to query 'database_size'!")
+		return fmt.Errorf("failed to query 'database_size': %w", err)
 	}
 	row = stg.db.QueryRow(`
 		SELECT
@@ -55,14 +101,12 @@ func (stg *Storage) init() {
 			current_setting('max_temp_directory_size') AS max_temp_directory_size`)
 	var threads, tempDirectory, maxTempDirectorySize string
 	if err := row.Scan(&threads, &tempDirectory, &maxTempDirectorySize); err != nil {
-		stg.app.Cfg().Log().Fatal().
-			Err(err).
-			Msg("Failed to query 'current_setting'!")
+		return fmt.Errorf("failed to query 'current_setting': %w", err)
 	}
 
 	// Done!
 	stg.app.Cfg().Log().Info().
-		Str("file", stg.app.Cfg().DBFile()).
+		Str("file", stg.file).
 		Str("duration", time.Since(start).String()).
 		Str("database_size", databaseSize).
 		Str("wal_size", walSize).
@@ -72,21 +116,42 @@ func (stg *Storage) init() {
 		Str("temp_directory", tempDirectory).
 		Str("max_temp_directory_size", maxTempDirectorySize).
 		Msg("Database & cache have been successfully initialized")
+
+	return nil
+}
+
+func (stg *Storage) unsafeGetResumableCounters() []*CounterValue {
+	// Nothing to carry over from / to read-only databases.
+	maxAge := stg.app.Cfg().MetricsResumeMaxAge()
+	if maxAge == 0 || stg.readOnly || len(stg.filePatterns) > 0 {
+		return nil
+	}
+
+	counters, err := stg.unsafeGetLatestCounters(time.Now().Add(-maxAge))
+	if err != nil {
+		stg.app.Cfg().Log().Error().
+			Err(err).
+			Msg("Failed to fetch latest raw values of counters!")
+		return nil
+	}
+	return counters
 }
 
-func (stg *Storage) unsafeOpenDB() {
+func (stg *Storage) unsafeOpenDB() error {
 	// Create a new database instance. A in-memory database is used when an
 	// empty string is provided as the database file.
+	dsn := stg.file
+	if stg.readOnly {
+		dsn += "?access_mode=READ_ONLY"
+	}
 	var err error
-	if stg.db, err = sql.Open("duckdb", stg.app.Cfg().DBFile()); err != nil {
-		stg.app.Cfg().Log().Fatal().
-			Err(err).
-			Str("file", stg.app.Cfg().DBFile()).
-			Msg("Failed to open database!")
+	if stg.db, err = sql.Open("duckdb", dsn); err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
 	}
+	return nil
 }
 
-func (stg *Storage) unsafeConfigureDB() {
+func (stg *Storage) unsafeConfigureDB() error {
 	// Adjust configuration of the database to limit resource usage. See:
 	//   - https://duckdb.org/docs/configuration/overview.html.
 	//   - https://duckdb.org/2024/07/09/memory-management.html.
@@ -98,93 +163,58 @@ func (stg *Storage) unsafeConfigureDB() {
 		SET preserve_insertion_order = false;`,
 		stg.app.Cfg().DBMemoryLimit(),
 		stg.app.Cfg().DBThreads(),
-		stg.app.Cfg().DBTempDirectory(),
+		stg.tempDirectory,
 		stg.app.Cfg().DBMaxTempDirectorySize())); err != nil {
-		stg.app.Cfg().Log().Fatal().
-			Err(err).
-			Msg("Failed to set database configuration!")
+		return fmt.Errorf("failed to set database configuration: %w", err)
 	}
+	return nil
 }
 
-func (stg *Storage) unsafeMigrateDBTables() {
-	// This is a placeholder for future database migrations. The idea is to
-	// use 'metadata.schema_version' to track the current schema version and
-	// apply migrations as needed.
-}
+func (stg *Storage) unsafeMigrateDBTables() error {
+	// Check the schema version of the database, refusing to open databases
+	// created by newer versions of varnishmon.
+	version, err := readSchemaVersion(stg.db)
+	if err != nil {
+		return fmt.Errorf("failed to read database schema version: %w", err)
+	}
+	plan, err := planMigrations(version)
+	if err != nil {
+		return err
+	}
 
-func (stg *Storage) unsafeCreateDBTables() {
-	// Create the database tables, if they do not exist.
-	if _, err := stg.db.Exec(`
-		CREATE TABLE IF NOT EXISTS metadata (
-			app_version VARCHAR NOT NULL,
-			app_revision VARCHAR NOT NULL,
-			schema_version INTEGER NOT NULL,
-			hostname VARCHAR NOT NULL
-		);
-
-		CREATE SEQUENCE IF NOT EXISTS metrics_seq;
-
-		CREATE TABLE IF NOT EXISTS metrics (
-			id INTEGER PRIMARY KEY,
-			name VARCHAR NOT NULL,
-			flag VARCHAR NOT NULL,
-			format VARCHAR NOT NULL,
-			description VARCHAR NOT NULL,
-			class VARCHAR NOT NULL,
-			UNIQUE(name)
-		);
-
-		CREATE TABLE IF NOT EXISTS metric_values (
-			metric_id INTEGER NOT NULL REFERENCES metrics(id),
-			timestamp TIMESTAMP NOT NULL,
-			value UNION(float64 FLOAT8, uint64 UBIGINT) NOT NULL,
-			PRIMARY KEY (metric_id, timestamp)
-		)`); err != nil {
-		stg.app.Cfg().Log().Fatal().
-			Err(err).
-			Msg("Failed to create database tables!")
+	// Read-only databases cannot be migrated here.
+	if stg.readOnly && len(plan.Migrations) > 0 {
+		return fmt.Errorf(
+			"%w: database schema version is %d, but the latest one is %d (hint: use 'varnishmon db migrate')",
+			ErrOutdatedSchemaVersion, version, SchemaVersion)
 	}
 
-	// Populate the metadata table, if it is empty.
-	{
-		hostname, err := os.Hostname()
-		if err != nil {
-			stg.app.Cfg().Log().Fatal().
-				Err(err).
-				Msg("Failed to get hostname!")
+	// Apply pending migrations, one by one. Empty databases are initialized
+	// by running all of them, which is not worth logging.
+	for _, migration := range plan.Migrations {
+		if version > 0 {
+			stg.app.Cfg().Log().Info().
+				Int("from", migration.Version-1).
+				Int("to", migration.Version).
+				Str("description", migration.Description).
+				Msg("Migrating database schema. This may take a while")
 		}
 
-		row := stg.db.QueryRow(`SELECT COUNT(*) FROM metadata`)
-		var count int
-		if err := row.Scan(&count); err != nil {
-			stg.app.Cfg().Log().Fatal().
-				Err(err).
-				Msg("Failed to query 'metadata' table!")
-		}
-		if count == 0 {
-			if _, err := stg.db.Exec(`
-				INSERT INTO metadata (app_version, app_revision, schema_version, hostname)
-				VALUES ($1, $2, $3, $4)`,
-				config.Version(), config.Revision(), SchemaVersion,
-				hostname); err != nil {
-				stg.app.Cfg().Log().Fatal().
-					Err(err).
-					Msg("Failed to insert into 'metadata' table!")
-			}
+		if err := applyMigration(stg.db, migration); err != nil {
+			return fmt.Errorf("failed to migrate database schema: %w", err)
 		}
 	}
+	return nil
 }
 
-func (stg *Storage) unsafeInitCache() {
+func (stg *Storage) unsafeInitCache() error {
 	// Initialize the cache of known metrics.
 	{
 		rows, err := stg.db.Query(`
 			SELECT id, name, flag, format, description, class
 			FROM metrics`)
 		if err != nil {
-			stg.app.Cfg().Log().Fatal().
-				Err(err).
-				Msg("Failed to query 'metrics' table!")
+			return fmt.Errorf("failed to query 'metrics' table: %w", err)
 		}
 		defer rows.Close()
 
@@ -195,34 +225,57 @@ func (stg *Storage) unsafeInitCache() {
 			if err := rows.Scan(
 				&metric.ID, &metric.Name, &metric.Flag, &metric.Format,
 				&metric.Description, &metric.Class); err != nil {
-				stg.app.Cfg().Log().Fatal().
-					Err(err).
-					Msg("Failed to scan 'metrics' rows!")
+				return fmt.Errorf("failed to scan 'metrics' rows: %w", err)
 			}
 			stg.cache.metricsByID[metric.ID] = &metric
 			stg.cache.metricsByName[metric.Name] = &metric
 		}
 		if err := rows.Err(); err != nil {
-			stg.app.Cfg().Log().Fatal().
-				Err(err).
-				Msg("Failed to iterate over 'metrics' rows!")
+			return fmt.Errorf("failed to iterate over 'metrics' rows: %w", err)
 		}
 	}
 
+	// Initialize the cache of known instances, including the ones with rolled
+	// up samples only.
+	{
+		rows, err := stg.db.Query(`
+			SELECT instance FROM metric_values
+			UNION
+			SELECT instance FROM metric_rollups_1m
+			UNION
+			SELECT instance FROM metric_rollups_1h`)
+		if err != nil {
+			return fmt.Errorf("failed to query instances in 'metric_values' & rollup tables: %w", err)
+		}
+		defer rows.Close()
+
+		stg.cache.instances = make(map[string]bool)
+		for rows.Next() {
+			var instance string
+			if err := rows.Scan(&instance); err != nil {
+				return fmt.Errorf("failed to scan instance rows: %w", err)
+			}
+			stg.cache.instances[instance] = true
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("failed to iterate over instance rows: %w", err)
+		}
+	}
+
+	// Initialize the cache of bursts.
+	if err := stg.unsafeLoadBursts(); err != nil {
+		return fmt.Errorf("failed to initialize the cache of bursts: %w", err)
+	}
+
 	// Initialize the cache of earliest and latest timestamps, if some data
 	// exists in the database.
 	{
-		row := stg.db.QueryRow(`
-			SELECT
-				min(timestamp) AS earliest,
-				max(timestamp) AS latest
-			FROM metric_values`)
-		var earliest, latest *time.Time
-		if err := row.Scan(&earliest, &latest); err != nil {
-			stg.app.Cfg().Log().Fatal().
-				Err(err).
-				Msg("Failed to query earliest and latest timestamps in 'metric_values' table!")
+		earliest, latest, err := stg.unsafeGetEarliestAndLatest()
+		if err != nil {
+			return fmt.Errorf("failed to query earliest and latest timestamps: %w", err)
 		}
+		stg.cache.earliest = time.Time{}
+		stg.cache.latest = time.Time{}
 		if earliest != nil && latest != nil {
 			stg.cache.earliest = *earliest
 			stg.cache.latest = *latest
@@ -233,9 +286,9 @@ func (stg *Storage) unsafeInitCache() {
 	{
 		row := stg.db.QueryRow(`SELECT hostname FROM metadata LIMIT 1`)
 		if err := row.Scan(&stg.cache.hostname); err != nil {
-			stg.app.Cfg().Log().Fatal().
-				Err(err).
-				Msg("Failed to query hostname in 'metadata' table!")
+			return fmt.Errorf("failed to query hostname in 'metadata' table: %w", err)
 		}
 	}
+
+	return nil
 }
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"sort"
 	"sync"
 	"syscall"
 	"time"
@@ -16,6 +17,22 @@ import (
 type Storage struct {
 	app Application
 
+	// Database file, or an empty string for an in-memory database. Archives
+	// (see 'AcquireArchive') are opened in read-only mode, unless they're
+	// disposable decompressed copies.
+	file          string
+	readOnly      bool
+	tempDirectory string
+
+	// Database files browsed as a single one, as listed in 'db.files' (see
+	// 'unsafeAttachDBFiles'), and the temporary directory holding decompressed
+	// copies of them. The database itself is an in-memory one in that case.
+	filePatterns    []string
+	copiesDirectory string
+
+	// Archives opened on demand. Nil for the archives themselves.
+	archives *archives
+
 	// Locking order: 'stg.mutex' -> 'stg.cache.mutex'.
 
 	// Operations on 'db' are thread-safe, but the mutex is required to safely
@@ -36,10 +53,18 @@ type Storage struct {
 		metricsByID   map[int]*CachedMetric
 		metricsByName map[string]*CachedMetric
 
+		// Known instances (i.e., scraper targets) with samples in the
+		// 'metric_values' table or in rollup tiers.
+		instances map[string]bool
+
+		// Bursts, as stored in the 'bursts' table, sorted by start time.
+		bursts []*Burst
+
 		// Hostname, as stored in the 'metadata' table.
 		hostname string
 
-		// Earliest and latest timestamps in the 'metric_values' table.
+		// Earliest and latest timestamps in the 'metric_values' table and
+		// rollup tiers.
 		earliest time.Time
 		latest   time.Time
 	}
@@ -62,13 +87,31 @@ type MetricSample struct {
 	Flag        string
 	Format      string
 	Description string
-	Value       interface{}
+	// Value stored in the 'metric_values' table: a 'float64' (e.g., the rate of
+	// a counter) or an 'uint64'. Nil if only the raw value of a counter is
+	// available (e.g., the first sample of a counter, when the rate cannot be
+	// calculated yet).
+	Value interface{}
+	// Raw cumulative value of a counter, stored in the 'counter_values' table.
+	// Nil for other metrics.
+	RawValue *uint64
+}
+
+// MetricSampleBatch groups the samples of a single scrape of an instance.
+type MetricSampleBatch struct {
+	Instance  string
+	Timestamp time.Time
+	Samples   []*MetricSample
 }
 
 func NewStorage(app Application) *Storage {
 	// Create instance.
 	stg := &Storage{
-		app: app,
+		app:           app,
+		file:          app.Cfg().DBFile(),
+		tempDirectory: app.Cfg().DBTempDirectory(),
+		filePatterns:  app.Cfg().DBFiles(),
+		archives:      newArchives(),
 	}
 
 	// Initialize database & cache.
@@ -144,6 +187,38 @@ func (stg *Storage) Latest() time.Time {
 	return stg.cache.latest
 }
 
+func (stg *Storage) Instances() []string {
+	stg.cache.mutex.RLock()
+	defer stg.cache.mutex.RUnlock()
+	return stg.unsafeInstances()
+}
+
+// Checks the instance requested when aggregating samples. Samples of
+// different instances (e.g., gauges or rates of different Varnish servers)
+// can't be meaningfully aggregated together, so an instance is required unless
+// there is a single one.
+func (stg *Storage) checkInstance(instance string) error {
+	if instance != "" {
+		return nil
+	}
+
+	stg.cache.mutex.RLock()
+	defer stg.cache.mutex.RUnlock()
+	if len(stg.cache.instances) > 1 {
+		return ErrInstanceRequired
+	}
+	return nil
+}
+
+func (stg *Storage) unsafeInstances() []string {
+	result := make([]string, 0, len(stg.cache.instances))
+	for instance := range stg.cache.instances {
+		result = append(result, instance)
+	}
+	sort.Strings(result)
+	return result
+}
+
 func (stg *Storage) Hostname() string {
 	stg.cache.mutex.RLock()
 	defer stg.cache.mutex.RUnlock()
@@ -151,6 +226,10 @@ func (stg *Storage) Hostname() string {
 }
 
 func (stg *Storage) Shutdown() error {
+	if stg.archives != nil {
+		stg.closeArchives()
+	}
+
 	stg.mutex.Lock()
 	defer stg.mutex.Unlock()
 	stg.cache.mutex.Lock()
@@ -160,9 +239,12 @@ func (stg *Storage) Shutdown() error {
 		return fmt.Errorf("failed to close database: %w", err)
 	}
 	stg.db = nil
+	stg.removeCopies()
 
 	stg.cache.metricsByID = nil
 	stg.cache.metricsByName = nil
+	stg.cache.instances = nil
+	stg.cache.bursts = nil
 	stg.cache.hostname = ""
 	stg.cache.earliest = time.Time{}
 	stg.cache.latest = time.Time{}
@@ -191,7 +273,7 @@ func (stg *Storage) getDuckDBFileSize() float64 {
 	// Using DuckDB's 'database_size' & 'wal_size' columns in 'pragma_database_size()'
 	// would be ideal, but the data there is human-readable and not suitable for
 	// programmatic use.
-	file := stg.app.Cfg().DBFile()
+	file := stg.file
 	var result float64
 	if file != "" {
 		if info, err := os.Stat(file); err == nil {
@@ -0,0 +1,26 @@
+package storage
+
+import (
+	"github.com/allenta/varnishmon/pkg/testutil"
+	"github.com/rs/zerolog"
+)
+
+// Creates a storage for tests: only errors are logged, the scraper and the
+// API are disabled, and an in-memory database is used. Any of these can be
+// overridden using 'settings' (i.e., key & value pairs).
+func newTestStorage(tl zerolog.TestingLog, settings ...interface{}) *Storage {
+	tl.Helper()
+
+	app := new(MockApplication)
+	app.
+		On("Cfg").
+		Return(testutil.NewConfig(
+			tl,
+			append([]interface{}{
+				"global.loglevel", "error",
+				"scraper.enabled", false,
+				"api.enabled", false,
+				"db.file", "",
+			}, settings...)...))
+	return NewStorage(app)
+}
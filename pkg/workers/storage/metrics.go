@@ -1,21 +1,64 @@
 package storage
 
 import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
 	"errors"
 	"fmt"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/marcboeker/go-duckdb"
 )
 
 var (
 	ErrInvalidFromTo     = errors.New("invalid 'from' & 'to'")
 	ErrInvalidAggregator = errors.New("invalid aggregator")
+	ErrInvalidFill       = errors.New("invalid fill")
 	ErrInvalidMetricType = errors.New("invalid metric type")
 	ErrUnknownMetricID   = errors.New("unknown metric ID")
+	ErrInstanceRequired  = errors.New("instance required")
+
+	ErrUnexpectedDriverConn = errors.New("unexpected driver connection")
 )
 
-func (stg *Storage) GetMetrics(from, to time.Time, step int) (map[string]interface{}, error) {
+// PartialPushError is returned when storing several scrapes at once when some
+// of them could be stored, but not all (e.g., because of duplicated samples).
+type PartialPushError struct {
+	// Error of every scrape, in the same order as they were pushed. Nil for
+	// the stored ones.
+	Errors []error
+}
+
+func (e *PartialPushError) Error() string {
+	failed := 0
+	var first error
+	for _, err := range e.Errors {
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			failed++
+		}
+	}
+	return fmt.Sprintf("failed to store %d of %d scrapes: %s", failed, len(e.Errors), first)
+}
+
+func (e *PartialPushError) Unwrap() []error {
+	result := make([]error, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		if err != nil {
+			result = append(result, err)
+		}
+	}
+	return result
+}
+
+// Returns the metrics with samples in the requested time range. If 'instance'
+// is empty, samples of all instances are considered.
+func (stg *Storage) GetMetrics(from, to time.Time, step int, instance string) (map[string]interface{}, error) {
 	// Validate 'from' and 'to' parameters.
 	if from.After(to) {
 		return nil, ErrInvalidFromTo
@@ -31,25 +74,35 @@ func (stg *Storage) GetMetrics(from, to time.Time, step int) (map[string]interfa
 		return nil, fmt.Errorf("failed to normalize 'from', 'to', and 'step' parameters: %w", err)
 	}
 
-	// Fetch metric IDs with samples in the requested time range.
+	// Fetch metric IDs with samples in the requested time range. 'from' and
+	// 'to' are aligned to 'step' boundaries, so the coarsest rollup tier
+	// evenly dividing 'step' gives the same results, much faster.
+	table := "metric_values"
+	if tier := getRollupTier(step); tier != nil {
+		table = tier.table
+	}
+	//nolint:gosec
 	rows, err := stg.db.Query(`
 		SELECT DISTINCT metric_id
-		FROM metric_values
-		WHERE timestamp >= $1 AND timestamp < $2`, from, to)
+		FROM `+table+`
+		WHERE
+			timestamp >= $1 AND
+			timestamp < $2 AND
+			($3 = '' OR instance = $3)`, from, to, instance)
 	if err != nil {
-		return nil, fmt.Errorf("failed to query 'metric_values' table: %w", err)
+		return nil, fmt.Errorf("failed to query '%s' table: %w", table, err)
 	}
 	defer rows.Close()
 	ids := make([]int, 0)
 	for rows.Next() {
 		var id int
 		if err := rows.Scan(&id); err != nil {
-			return nil, fmt.Errorf("failed to scan 'metric_values' rows: %w", err)
+			return nil, fmt.Errorf("failed to scan '%s' rows: %w", table, err)
 		}
 		ids = append(ids, id)
 	}
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("failed to iterate over 'metric_values' rows: %w", err)
+		return nil, fmt.Errorf("failed to iterate over '%s' rows: %w", table, err)
 	}
 
 	// Lock 'cache'.
@@ -77,16 +130,28 @@ func (stg *Storage) GetMetrics(from, to time.Time, step int) (map[string]interfa
 
 	// Done!
 	return map[string]interface{}{
-		"from":    from.Unix(),
-		"to":      to.Unix(),
-		"step":    step,
-		"metrics": metrics,
+		"from":      from.Unix(),
+		"to":        to.Unix(),
+		"step":      step,
+		"instance":  instance,
+		"instances": stg.unsafeInstances(),
+		"metrics":   metrics,
 	}, nil
 }
 
+// Returns aggregated samples of a metric in the requested time range. The
+// instance can only be omitted if there is a single one, so samples of
+// different instances are never aggregated together.
+// Gaps are returned as a list of '[from, to]' intervals, and missing buckets
+// inside them are filled according to 'fill' (empty to leave them out).
+//
+// The 'rate' and 'increase' aggregators of counters are calculated from raw
+// values. Instances without raw values in the requested time range (e.g.,
+// samples stored by previous versions) fall back to the stored rates instead,
+// but both sources are never mixed for the same instance.
 func (stg *Storage) GetMetric(
 	id int, from, to time.Time, step int,
-	aggregator string) (map[string]interface{}, error) {
+	aggregator, fill, instance string) (map[string]interface{}, error) {
 	// Validate 'from' and 'to' parameters.
 	if from.After(to) {
 		return nil, ErrInvalidFromTo
@@ -114,11 +179,27 @@ func (stg *Storage) GetMetric(
 	default:
 		switch aggregator {
 		case "avg", "min", "max", "first", "last", "count":
+		case AggregatorRate, AggregatorIncrease:
+			if !metric.IsRate() {
+				return nil, ErrInvalidAggregator
+			}
 		default:
 			return nil, ErrInvalidAggregator
 		}
 	}
 
+	// Validate 'fill' parameter.
+	switch fill {
+	case FillNone, FillNull, FillPrevious, FillZero, FillLinear:
+	default:
+		return nil, ErrInvalidFill
+	}
+
+	// Validate 'instance' parameter.
+	if err := stg.checkInstance(instance); err != nil {
+		return nil, err
+	}
+
 	// Lock 'db' instance.
 	stg.mutex.RLock()
 	defer stg.mutex.RUnlock()
@@ -129,27 +210,73 @@ func (stg *Storage) GetMetric(
 		return nil, fmt.Errorf("failed to normalize 'from', 'to', and 'step' parameters: %w", err)
 	}
 
-	// Prepare query to fetch aggregated samples of the requested metric. Note
-	// that some metrics (e.g., gauges) are stored as 'uint64' in the database,
-	// but when querying DuckDB, they might be returned as 'float64' (e.g., with
-	// the 'avg' aggregator) or 'int64' (e.g., with the 'count' aggregator).
+	// Fetch aggregated samples. Rates and increases of counters are
+	// calculated from raw values, ignoring the ones spanning gaps according
+	// to the scraping period. Otherwise, the coarsest rollup tier evenly
+	// dividing 'step' is used, if possible.
+	var samples [][2]interface{}
+	var tier *rollupTier
+	isCounter := aggregator == AggregatorRate || aggregator == AggregatorIncrease
+	if !isCounter && isRollupAggregator(metric, aggregator) {
+		tier = getRollupTier(step)
+	}
+	period := stg.unsafeGetMetricPeriod(metric, tier, from, to, instance)
+	if isCounter {
+		samples, err = stg.unsafeGetCounterSamples(metric, from, to, step, period, aggregator, instance)
+	} else {
+		samples, err = stg.unsafeGetAggregatedSamples(metric, tier, from, to, step, aggregator, instance)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Detect gaps (i.e., intervals without samples longer than expected
+	// according to the scraping period) and fill them as requested.
+	samples, gaps := fillGaps(samples, step, period, stg.app.Cfg().MetricsGapPeriods(), fill)
+
+	// Done!
+	return map[string]interface{}{
+		"from":     from.Unix(),
+		"to":       to.Unix(),
+		"step":     step,
+		"instance": instance,
+		"samples":  samples,
+		"gaps":     gaps,
+	}, nil
+}
+
+func (stg *Storage) unsafeGetAggregatedSamples(
+	metric *CachedMetric, tier *rollupTier, from, to time.Time, step int,
+	aggregator, instance string) ([][2]interface{}, error) {
+	// Prepare query to fetch aggregated samples of the requested metric, either
+	// from raw samples or from a rollup tier, if provided. Note that some
+	// metrics (e.g., gauges) are stored as 'uint64' in the database, but when
+	// querying DuckDB, they might be returned as 'float64' (e.g., with the
+	// 'avg' aggregator) or 'int64' (e.g., with the 'count' aggregator).
+	table := "metric_values"
+	aggregate := fmt.Sprintf("%s(value.%s)", aggregator, metric.Class)
+	if tier != nil {
+		table = tier.table
+		aggregate = getRollupAggregate(metric, aggregator)
+	}
 	//nolint:gosec
 	query := fmt.Sprintf(`
 		SELECT
 			time_bucket(INTERVAL '%ds', timestamp) AS timestamp,
-			%s(value.%s) AS value
-		FROM metric_values
+			%s AS value
+		FROM %s
 		WHERE
 			metric_id=$1 AND
 			timestamp >= $2 AND
-			timestamp < $3
+			timestamp < $3 AND
+			($4 = '' OR instance = $4)
 		GROUP BY time_bucket(INTERVAL '%ds', timestamp)
-		ORDER BY timestamp`, step, aggregator, metric.Class, step)
+		ORDER BY timestamp`, step, aggregate, table, step)
 
 	// Query database.
-	rows, err := stg.db.Query(query, id, from, to)
+	rows, err := stg.db.Query(query, metric.ID, from, to, instance)
 	if err != nil {
-		return nil, fmt.Errorf("failed to query 'metric_values' table: %w", err)
+		return nil, fmt.Errorf("failed to query '%s' table: %w", table, err)
 	}
 	defer rows.Close()
 
@@ -159,7 +286,7 @@ func (stg *Storage) GetMetric(
 		var timestamp time.Time
 		var value interface{}
 		if err := rows.Scan(&timestamp, &value); err != nil {
-			return nil, fmt.Errorf("failed to scan 'metric_values' rows: %w", err)
+			return nil, fmt.Errorf("failed to scan '%s' rows: %w", table, err)
 		}
 		samples = append(samples, [2]interface{}{
 			// In the client side, seconds gives more than enough granularity,
@@ -174,90 +301,254 @@ func (stg *Storage) GetMetric(
 		})
 	}
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("failed to iterate over 'metric_values' rows: %w", err)
+		return nil, fmt.Errorf("failed to iterate over '%s' rows: %w", table, err)
 	}
 
-	// Done!
-	return map[string]interface{}{
-		"from":    from.Unix(),
-		"to":      to.Unix(),
-		"step":    step,
-		"samples": samples,
-	}, nil
+	return samples, nil
+}
+
+// Stores the samples of a single scrape of an instance. See
+// 'PushMetricSampleBatches' for details.
+func (stg *Storage) PushMetricSamples(
+	instance string, timestamp time.Time, samples []*MetricSample) error {
+	return stg.PushMetricSampleBatches([]*MetricSampleBatch{{
+		Instance:  instance,
+		Timestamp: timestamp,
+		Samples:   samples,
+	}})
 }
 
-func (stg *Storage) PushMetricSamples(timestamp time.Time, samples []*MetricSample) error {
+// Stores the samples of several scrapes in a single transaction. If the
+// transaction fails because of the data being stored (e.g., a single scrape
+// includes duplicated samples; see 'isDataError()'), every scrape is stored in
+// its own transaction, so a bad scrape doesn't sink the rest. A
+// '*PartialPushError' is returned if only some of them are stored; if none is
+// stored, the error of the first transaction is returned. Any other error
+// (e.g., a closed database) is returned right away, so callers can retry the
+// whole set later on. Samples are loaded using the DuckDB appender API, which is much
+// faster than executing an 'INSERT' per sample. The appender doesn't support
+// 'UNION' columns, so samples for the 'metric_values' table are staged in a
+// temporary table first, and then moved with a bulk 'INSERT ... SELECT'.
+func (stg *Storage) PushMetricSampleBatches(batches []*MetricSampleBatch) error {
 	// This is a write operation on 'db' but a read lock is intentionally used.
 	// See the note on the 'Storage' type for more information.
 	stg.mutex.RLock()
 	defer stg.mutex.RUnlock()
 
-	// Using a transaction is crucial to batch the inserts and avoid performance
-	// penalties.
-	tx, err := stg.db.Begin()
+	err := stg.unsafePushMetricSampleBatches(batches)
+	if err == nil || len(batches) < 2 || !isDataError(err) {
+		return err
+	}
+
+	errs := make([]error, len(batches))
+	stored := 0
+	for i, batch := range batches {
+		errs[i] = stg.unsafePushMetricSampleBatches([]*MetricSampleBatch{batch})
+		if errs[i] == nil {
+			stored++
+		}
+	}
+	if stored == 0 {
+		return err
+	}
+	if stored < len(batches) {
+		return &PartialPushError{Errors: errs}
+	}
+	return nil
+}
+
+// Returns true if the error is caused by the data being stored (e.g.,
+// duplicated samples or values out of range), as opposed to the database
+// itself (e.g., a closed database, I/O errors, etc.).
+func isDataError(err error) bool {
+	if errors.Is(err, ErrInvalidMetricType) {
+		return true
+	}
+
+	var duckdbErr *duckdb.Error
+	if errors.As(err, &duckdbErr) {
+		switch duckdbErr.Type {
+		case duckdb.ErrorTypeConstraint, duckdb.ErrorTypeConversion, duckdb.ErrorTypeOutOfRange,
+			duckdb.ErrorTypeInvalidInput, duckdb.ErrorTypeMismatchType:
+			return true
+		default:
+			return false
+		}
+	}
+
+	// Errors of the appender are not typed, but those caused by rows
+	// rejected by DuckDB (e.g., duplicated keys) are flagged as such.
+	return strings.Contains(err.Error(), "appended data has been invalidated due to corrupt row")
+}
+
+// Stores the samples of several scrapes in a single transaction: either all
+// of them are stored or none.
+func (stg *Storage) unsafePushMetricSampleBatches(batches []*MetricSampleBatch) error {
+	// The appender API requires a dedicated connection, and so do temporary
+	// tables, which are private to the connection that created them.
+	ctx := context.Background()
+	conn, err := stg.db.Conn(ctx)
 	if err != nil {
+		return fmt.Errorf("failed to get connection: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `
+		CREATE TEMP TABLE IF NOT EXISTS staged_metric_values (
+			metric_id INTEGER NOT NULL,
+			instance VARCHAR NOT NULL,
+			timestamp TIMESTAMP NOT NULL,
+			float64 DOUBLE,
+			uint64 UBIGINT
+		)`); err != nil {
+		return fmt.Errorf("failed to create staging table: %w", err)
+	}
+
+	// Using a single transaction is crucial to avoid performance penalties.
+	// The appender is not aware of 'database/sql' transactions, so the
+	// transaction is explicitly managed on the connection.
+	if _, err := conn.ExecContext(ctx, `BEGIN TRANSACTION`); err != nil {
 		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
-	defer tx.Rollback() //nolint:errcheck
+	committed := false
+	defer func() {
+		if !committed {
+			conn.ExecContext(ctx, `ROLLBACK`) //nolint:errcheck
+		}
+	}()
 
-	// Build prepared statements for batch inserts, one for each metric class.
-	uint64Statement, err := tx.Prepare(`
-		INSERT INTO metric_values (metric_id, timestamp, value)
-		VALUES (?, ?, union_value(uint64 := ?))`)
+	// Insert or update in the 'metrics' table if necessary. This is done
+	// inside the transaction, so the cache is only updated after commit.
+	metrics, registered, err := stg.unsafeRegisterMetrics(ctx, conn, batches)
 	if err != nil {
-		return fmt.Errorf("failed to prepare statement: %w", err)
+		return err
 	}
-	defer uint64Statement.Close()
-	float64Statement, err := tx.Prepare(`
-		INSERT INTO metric_values (metric_id, timestamp, value)
-		VALUES (?, ?, union_value(float64 := ?))`)
-	if err != nil {
-		return fmt.Errorf("failed to prepare statement: %w", err)
-	}
-	defer float64Statement.Close()
-
-	// Prepare batched inserts into the 'metric_values' table. During this
-	// process, insert or update in the 'metrics' table if necessary.
-	for _, sample := range samples {
-		// Check if the metric is known and identical to the one in the database.
-		// Non identical metrics will preserve their internal ID, but the rest
-		// of the fields will be updated. Beware of locking order: 'stg.mutex'
-		// was locked before 'stg.cache.mutex'.
-		var metric *CachedMetric
-		stg.cache.mutex.RLock()
-		if m := stg.cache.metricsByName[sample.Name]; m != nil {
-			if m.Flag == sample.Flag && m.Format == sample.Format &&
-				m.Description == sample.Description {
-				metric = m
-			}
+
+	// Append samples to the 'counter_values' and staging tables.
+	if err := conn.Raw(func(driverConn any) error {
+		dc, ok := driverConn.(driver.Conn)
+		if !ok {
+			return ErrUnexpectedDriverConn
 		}
-		stg.cache.mutex.RUnlock()
+		return appendMetricSamples(dc, batches, metrics)
+	}); err != nil {
+		return err
+	}
 
-		// Insert / update in the 'metrics' table.
-		if metric == nil {
+	// Move staged samples to the 'metric_values' table, one metric class at a
+	// time.
+	if _, err := conn.ExecContext(ctx, `
+		INSERT INTO metric_values (metric_id, instance, timestamp, value)
+		SELECT metric_id, instance, timestamp, union_value(uint64 := uint64)
+		FROM staged_metric_values
+		WHERE uint64 IS NOT NULL;
+
+		INSERT INTO metric_values (metric_id, instance, timestamp, value)
+		SELECT metric_id, instance, timestamp, union_value(float64 := float64)
+		FROM staged_metric_values
+		WHERE float64 IS NOT NULL;`); err != nil {
+		return fmt.Errorf("failed to insert into 'metric_values' table: %w", err)
+	}
+
+	// Update rollups using the staged samples too.
+	if err := pushRollups(ctx, conn); err != nil {
+		return err
+	}
+	if _, err := conn.ExecContext(ctx, `DELETE FROM staged_metric_values`); err != nil {
+		return fmt.Errorf("failed to delete from 'staged_metric_values' table: %w", err)
+	}
+
+	// Commit transaction.
+	if _, err := conn.ExecContext(ctx, `COMMIT`); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	committed = true
+
+	// Update 'metrics', 'instances', 'earliest' and 'latest' cache values.
+	// Beware of locking order: 'stg.mutex' was locked before
+	// 'stg.cache.mutex'.
+	stg.cache.mutex.Lock()
+	for _, metric := range registered {
+		stg.cache.metricsByID[metric.ID] = metric
+		stg.cache.metricsByName[metric.Name] = metric
+	}
+	for _, batch := range batches {
+		stg.cache.instances[batch.Instance] = true
+		if stg.cache.earliest.IsZero() || batch.Timestamp.Before(stg.cache.earliest) {
+			stg.cache.earliest = batch.Timestamp
+		}
+		if stg.cache.latest.IsZero() || batch.Timestamp.After(stg.cache.latest) {
+			stg.cache.latest = batch.Timestamp
+		}
+	}
+	stg.cache.mutex.Unlock()
+
+	// Done!
+	return nil
+}
+
+// Resolves the metrics of all samples in the batches, inserting or updating
+// them in the 'metrics' table using the given connection (i.e., inside its
+// transaction) when unknown or not identical to the cached ones. Returns the
+// metrics indexed by name, and the ones to be cached once the transaction is
+// committed.
+func (stg *Storage) unsafeRegisterMetrics(
+	ctx context.Context, conn *sql.Conn,
+	batches []*MetricSampleBatch) (map[string]*CachedMetric, []*CachedMetric, error) {
+	metrics := make(map[string]*CachedMetric)
+	registered := make([]*CachedMetric, 0)
+
+	for _, batch := range batches {
+		for _, sample := range batch.Samples {
+			// Check if the metric was already resolved, or if it's known and
+			// identical to the one in the database. Non identical metrics
+			// will preserve their internal ID, but the rest of the fields will
+			// be updated. Beware of locking order: 'stg.mutex' was locked
+			// before 'stg.cache.mutex'.
+			metric := metrics[sample.Name]
+			if metric == nil {
+				stg.cache.mutex.RLock()
+				metric = stg.cache.metricsByName[sample.Name]
+				stg.cache.mutex.RUnlock()
+			}
+			if metric != nil && metric.Flag == sample.Flag &&
+				metric.Format == sample.Format &&
+				metric.Description == sample.Description {
+				metrics[sample.Name] = metric
+				continue
+			}
+
+			// Insert / update in the 'metrics' table.
 			var class string
 			switch sample.Value.(type) {
 			case uint64:
 				class = "uint64"
 			case float64:
 				class = "float64"
+			case nil:
+				// Counters are stored as rates, even if only the raw value is
+				// available so far.
+				if sample.RawValue == nil {
+					return nil, nil, ErrInvalidMetricType
+				}
+				class = "float64"
 			default:
-				return ErrInvalidMetricType
+				return nil, nil, ErrInvalidMetricType
 			}
 
 			var metricID int
-			if err := stg.db.QueryRow(`
-			INSERT INTO metrics (id, name, flag, format, description, class)
-			VALUES (
-				COALESCE((SELECT id FROM metrics WHERE name = $1), NEXTVAL('metrics_seq')),
-				$1, $2, $3, $4, $5)
-			ON CONFLICT(name) DO UPDATE SET
-				flag = excluded.flag,
-				format = excluded.format,
-				description = excluded.description
-			RETURNING id`,
+			if err := conn.QueryRowContext(ctx, `
+				INSERT INTO metrics (id, name, flag, format, description, class)
+				VALUES (
+					COALESCE((SELECT id FROM metrics WHERE name = $1), NEXTVAL('metrics_seq')),
+					$1, $2, $3, $4, $5)
+				ON CONFLICT(name) DO UPDATE SET
+					flag = excluded.flag,
+					format = excluded.format,
+					description = excluded.description
+				RETURNING id`,
 				sample.Name, sample.Flag, sample.Format, sample.Description, class).Scan(&metricID); err != nil {
-				return fmt.Errorf("failed to insert / update into 'metrics' table: %w", err)
+				return nil, nil, fmt.Errorf("failed to insert / update into 'metrics' table: %w", err)
 			}
 
 			metric = &CachedMetric{
@@ -268,55 +559,97 @@ func (stg *Storage) PushMetricSamples(timestamp time.Time, samples []*MetricSamp
 				Description: sample.Description,
 				Class:       class,
 			}
-
-			// Beware of locking order: 'stg.mutex' was locked before
-			// 'stg.cache.mutex'.
-			stg.cache.mutex.Lock()
-			stg.cache.metricsByID[metric.ID] = metric
-			stg.cache.metricsByName[metric.Name] = metric
-			stg.cache.mutex.Unlock()
+			metrics[sample.Name] = metric
+			registered = append(registered, metric)
 		}
+	}
+
+	return metrics, registered, nil
+}
 
-		// Insert sample in the 'metric_values' table.
-		switch metric.Class {
-		case "uint64":
-			if _, err := uint64Statement.Exec(metric.ID, timestamp, sample.Value); err != nil {
-				return fmt.Errorf("failed to insert into 'metric_values' table: %w", err)
+// Appends the samples in the batches to the 'counter_values' table (raw
+// values of counters) and to the 'staged_metric_values' temporary table (the
+// rest of values), using the DuckDB appender API.
+func appendMetricSamples(
+	conn driver.Conn, batches []*MetricSampleBatch,
+	metrics map[string]*CachedMetric) error {
+	stagedAppender, err := duckdb.NewAppenderFromConn(conn, "", "staged_metric_values")
+	if err != nil {
+		return fmt.Errorf("failed to create appender: %w", err)
+	}
+	defer stagedAppender.Close()
+	counterAppender, err := duckdb.NewAppenderFromConn(conn, "", "counter_values")
+	if err != nil {
+		return fmt.Errorf("failed to create appender: %w", err)
+	}
+	defer counterAppender.Close()
+
+	for _, batch := range batches {
+		for _, sample := range batch.Samples {
+			metric := metrics[sample.Name]
+
+			// Append value, in the column matching the class of the metric.
+			if sample.Value != nil {
+				var float64Value, uint64Value driver.Value
+				switch metric.Class {
+				case "uint64":
+					v, ok := sample.Value.(uint64)
+					if !ok {
+						return ErrInvalidMetricType
+					}
+					uint64Value = v
+				case "float64":
+					v, ok := toFloat64(sample.Value)
+					if !ok {
+						return ErrInvalidMetricType
+					}
+					float64Value = v
+				}
+				if err := stagedAppender.AppendRow(
+					metric.ID, batch.Instance, batch.Timestamp,
+					float64Value, uint64Value); err != nil {
+					return fmt.Errorf("failed to append to 'staged_metric_values' table: %w", err)
+				}
 			}
-		case "float64":
-			if _, err := float64Statement.Exec(metric.ID, timestamp, sample.Value); err != nil {
-				return fmt.Errorf("failed to insert into 'metric_values' table: %w", err)
+
+			// Append raw value of counters.
+			if sample.RawValue != nil {
+				if err := counterAppender.AppendRow(
+					metric.ID, batch.Instance, batch.Timestamp,
+					*sample.RawValue); err != nil {
+					return fmt.Errorf("failed to append to 'counter_values' table: %w", err)
+				}
 			}
 		}
 	}
 
-	// Commit transaction.
-	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("failed to commit transaction: %w", err)
-	}
-
-	// Update 'earliest' and 'latest' cache values. Beware of locking order:
-	// 'stg.mutex' was locked before 'stg.cache.mutex'.
-	stg.cache.mutex.Lock()
-	if stg.cache.earliest.IsZero() || timestamp.Before(stg.cache.earliest) {
-		stg.cache.earliest = timestamp
+	// Flush appended rows. Errors such as duplicated keys are reported here.
+	if err := stagedAppender.Close(); err != nil {
+		return fmt.Errorf("failed to append to 'staged_metric_values' table: %w", err)
 	}
-	if stg.cache.latest.IsZero() || timestamp.After(stg.cache.latest) {
-		stg.cache.latest = timestamp
+	if err := counterAppender.Close(); err != nil {
+		return fmt.Errorf("failed to append to 'counter_values' table: %w", err)
 	}
-	stg.cache.mutex.Unlock()
 
-	// Done!
 	return nil
 }
 
 func (stg *Storage) unsafeNormalizeFromToAndStep(
 	from, to time.Time, step int) (time.Time, time.Time, int, error) {
-	// Ensure 'step' is at least the scraper period, if enabled. If disabled,
-	// 1s is the minimum resolution.
+	// Ensure 'step' is at least the shortest scraper period, if enabled. If
+	// disabled, 1s is the minimum resolution. Bursts overlapping the requested
+	// range may lower that limit.
 	period := 1
 	if stg.app.Cfg().ScraperEnabled() {
-		period = int(stg.app.Cfg().ScraperPeriod().Seconds())
+		period = int(stg.app.Cfg().ScraperMinPeriod().Seconds())
+
+		// Beware of locking order: 'stg.mutex' is expected to be locked
+		// before 'stg.cache.mutex'.
+		stg.cache.mutex.RLock()
+		for _, burst := range stg.unsafeOverlappingBursts(from, to) {
+			period = min(period, int(burst.Period.Seconds()))
+		}
+		stg.cache.mutex.RUnlock()
 	}
 	if step < period {
 		step = period
@@ -1,10 +1,10 @@
 package storage
 
 import (
+	"fmt"
 	"testing"
 	"time"
 
-	"github.com/allenta/varnishmon/pkg/testutil"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -17,16 +17,7 @@ type MetricsTestSuite struct {
 func (suite *MetricsTestSuite) BeforeTest(suiteName, testName string) {
 	suite.testName = testName
 
-	app := new(MockApplication)
-	app.
-		On("Cfg").
-		Return(testutil.NewConfig(
-			suite.T(),
-			"global.loglevel", "error",
-			"scraper.enabled", false,
-			"api.enabled", false,
-			"db.file", ""))
-	suite.stg = NewStorage(app)
+	suite.stg = newTestStorage(suite.T())
 }
 
 func (suite *MetricsTestSuite) TestNormalizeFromTo() {
@@ -149,7 +140,7 @@ func (suite *MetricsTestSuite) TestPushSamplesBasics() {
 	}
 
 	for _, test := range tests {
-		err := suite.stg.PushMetricSamples(test.timestamp, test.samples)
+		err := suite.stg.PushMetricSamples("default", test.timestamp, test.samples)
 		assert.NoError(err)
 		assert.Len(suite.stg.cache.metricsByID, test.nMetrics)
 		assert.Len(suite.stg.cache.metricsByName, test.nMetrics)
@@ -217,12 +208,14 @@ func (suite *MetricsTestSuite) TestGetMetricsBasics() {
 	from := time.Date(2025, time.January, 1, 13, 0, 0, 0, time.UTC)
 	to := time.Date(2025, time.January, 1, 13, 0, 5, 0, time.UTC)
 	step := 10
-	metrics, err := suite.stg.GetMetrics(from, to, step)
+	metrics, err := suite.stg.GetMetrics(from, to, step, "")
 
 	assert.NoError(err)
 	assert.Equal(from.Unix(), metrics["from"])
 	assert.Equal(from.Unix()+int64(step), metrics["to"])
 	assert.Equal(step, metrics["step"])
+	assert.Equal("", metrics["instance"])
+	assert.Equal([]string{"default"}, metrics["instances"])
 	assert.ElementsMatch([]map[string]interface{}{
 		{
 			"id":          suite.stg.cache.metricsByName["foo"].ID,
@@ -253,7 +246,7 @@ func (suite *MetricsTestSuite) TestGetMetricBasics() {
 	to := time.Date(2025, time.January, 1, 13, 0, 5, 0, time.UTC)
 	step := 10
 	aggregator := "count"
-	metric, err := suite.stg.GetMetric(id, from, to, step, aggregator)
+	metric, err := suite.stg.GetMetric(id, from, to, step, aggregator, FillNone, "")
 
 	assert.NoError(err)
 	assert.Equal(from.Unix(), metric["from"])
@@ -264,6 +257,472 @@ func (suite *MetricsTestSuite) TestGetMetricBasics() {
 	}, metric["samples"])
 }
 
+func (suite *MetricsTestSuite) TestInstances() {
+	assert := suite.Require()
+
+	timestamp := time.Date(2025, time.January, 1, 13, 0, 0, 0, time.UTC)
+	for _, instance := range []string{"tls", "internal"} {
+		err := suite.stg.PushMetricSamples(instance, timestamp, []*MetricSample{
+			{
+				Name:        "MAIN.n_backend",
+				Flag:        "g",
+				Format:      "i",
+				Description: "Number of backends",
+				Value:       uint64(len(instance)),
+			},
+		})
+		assert.NoError(err)
+	}
+	err := suite.stg.PushMetricSamples("tls", timestamp, []*MetricSample{
+		{
+			Name:        "MAIN.sess_conn",
+			Flag:        "c",
+			Format:      "i",
+			Description: "Sessions accepted",
+			Value:       float64(1.5),
+		},
+	})
+	assert.NoError(err)
+
+	assert.Equal([]string{"internal", "tls"}, suite.stg.Instances())
+	assert.Len(suite.stg.cache.metricsByID, 2)
+
+	from := timestamp
+	to := timestamp.Add(5 * time.Second)
+	step := 10
+
+	metrics, err := suite.stg.GetMetrics(from, to, step, "internal")
+	assert.NoError(err)
+	assert.Equal("internal", metrics["instance"])
+	assert.Equal([]string{"internal", "tls"}, metrics["instances"])
+	assert.Len(metrics["metrics"], 1)
+
+	metrics, err = suite.stg.GetMetrics(from, to, step, "")
+	assert.NoError(err)
+	assert.Len(metrics["metrics"], 2)
+
+	id := suite.stg.cache.metricsByName["MAIN.n_backend"].ID
+	for instance, value := range map[string]interface{}{
+		"tls":      uint64(3),
+		"internal": uint64(8),
+	} {
+		metric, err := suite.stg.GetMetric(id, from, to, step, "max", FillNone, instance)
+		assert.NoError(err)
+		assert.Equal(instance, metric["instance"])
+		assert.Equal([][2]interface{}{{from.Unix(), value}}, metric["samples"])
+	}
+
+	// Samples of different instances are never aggregated together.
+	_, err = suite.stg.GetMetric(id, from, to, step, "max", FillNone, "")
+	assert.ErrorIs(err, ErrInstanceRequired)
+}
+
+func (suite *MetricsTestSuite) TestCounters() {
+	assert := suite.Require()
+
+	// Raw values, including a reset of the counter.
+	start := time.Date(2025, time.January, 1, 13, 0, 0, 0, time.UTC)
+	for i, sample := range []struct {
+		value    interface{}
+		rawValue uint64
+	}{
+		{nil, 100},
+		{float64(10), 200},
+		{float64(5), 250},
+		{nil, 30},
+		{float64(6), 90},
+	} {
+		err := suite.stg.PushMetricSamples("default", start.Add(time.Duration(i)*10*time.Second), []*MetricSample{
+			{
+				Name:        "MAIN.client_req",
+				Flag:        "c",
+				Format:      "i",
+				Description: "Good client requests received",
+				Value:       sample.value,
+				RawValue:    &sample.rawValue,
+			},
+		})
+		assert.NoError(err)
+	}
+
+	// Stored rates only (e.g., samples stored by previous versions).
+	for i, value := range []float64{1, 2, 4} {
+		err := suite.stg.PushMetricSamples("default", start.Add(time.Duration(i)*10*time.Second), []*MetricSample{
+			{
+				Name:        "MAIN.sess_conn",
+				Flag:        "c",
+				Format:      "i",
+				Description: "Sessions accepted",
+				Value:       value,
+			},
+		})
+		assert.NoError(err)
+	}
+
+	// Stored rates first, and raw values later on (e.g., after upgrading).
+	for i, rawValue := range []uint64{0, 0, 100, 130} {
+		sample := &MetricSample{
+			Name:        "MAIN.backend_conn",
+			Flag:        "c",
+			Format:      "i",
+			Description: "Backend conn. success",
+			Value:       float64(3),
+		}
+		if rawValue > 0 {
+			sample.RawValue = &rawValue
+		}
+		err := suite.stg.PushMetricSamples(
+			"default", start.Add(time.Duration(i)*10*time.Second), []*MetricSample{sample})
+		assert.NoError(err)
+	}
+
+	tests := []struct {
+		metric     string
+		from       time.Time
+		aggregator string
+		samples    [][2]interface{}
+	}{
+		{
+			metric:     "MAIN.client_req",
+			from:       start,
+			aggregator: AggregatorIncrease,
+			samples: [][2]interface{}{
+				{start.Unix(), float64(100)},
+				{start.Unix() + 20, float64(80)},
+				{start.Unix() + 40, float64(60)},
+			},
+		},
+		{
+			metric:     "MAIN.client_req",
+			from:       start,
+			aggregator: AggregatorRate,
+			samples: [][2]interface{}{
+				{start.Unix(), float64(10)},
+				{start.Unix() + 20, float64(4)},
+				{start.Unix() + 40, float64(6)},
+			},
+		},
+		{
+			// The last sample before the time range is taken into account.
+			metric:     "MAIN.client_req",
+			from:       start.Add(20 * time.Second),
+			aggregator: AggregatorIncrease,
+			samples: [][2]interface{}{
+				{start.Unix() + 20, float64(80)},
+				{start.Unix() + 40, float64(60)},
+			},
+		},
+		{
+			metric:     "MAIN.sess_conn",
+			from:       start,
+			aggregator: AggregatorRate,
+			samples: [][2]interface{}{
+				{start.Unix(), float64(1.5)},
+				{start.Unix() + 20, float64(4)},
+			},
+		},
+		{
+			metric:     "MAIN.sess_conn",
+			from:       start,
+			aggregator: AggregatorIncrease,
+			samples: [][2]interface{}{
+				{start.Unix(), float64(20)},
+				{start.Unix() + 20, float64(40)},
+			},
+		},
+		{
+			// Stored rates are ignored once raw values are available.
+			metric:     "MAIN.backend_conn",
+			from:       start,
+			aggregator: AggregatorRate,
+			samples: [][2]interface{}{
+				{start.Unix() + 20, float64(3)},
+			},
+		},
+		{
+			metric:     "MAIN.backend_conn",
+			from:       start,
+			aggregator: AggregatorIncrease,
+			samples: [][2]interface{}{
+				{start.Unix() + 20, float64(30)},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		id := suite.stg.cache.metricsByName[test.metric].ID
+		metric, err := suite.stg.GetMetric(id, test.from, start.Add(40*time.Second), 20, test.aggregator, FillNone, "")
+		assert.NoError(err)
+		assert.Equal(test.samples, metric["samples"], "%s (%s)", test.metric, test.aggregator)
+	}
+
+	// Rates and increases are only available for counters.
+	err := suite.stg.PushMetricSamples("default", start, []*MetricSample{
+		{
+			Name:        "MAIN.n_backend",
+			Flag:        "g",
+			Format:      "i",
+			Description: "Number of backends",
+			Value:       uint64(3),
+		},
+	})
+	assert.NoError(err)
+	_, err = suite.stg.GetMetric(
+		suite.stg.cache.metricsByName["MAIN.n_backend"].ID,
+		start, start.Add(40*time.Second), 20, AggregatorRate, FillNone, "")
+	assert.ErrorIs(err, ErrInvalidAggregator)
+
+	assert.Len(suite.stg.app.Cfg().Log().Buffer().Events(), 0)
+}
+
+func (suite *MetricsTestSuite) TestLatestCounters() {
+	assert := suite.Require()
+
+	now := time.Now().Truncate(time.Second).UTC()
+	for i, instance := range []string{"tls", "internal"} {
+		for j := range 3 {
+			rawValue := uint64(100*i + j)
+			err := suite.stg.PushMetricSamples(instance, now.Add(time.Duration(j-2)*time.Minute), []*MetricSample{
+				{
+					Name:        "MAIN.client_req",
+					Flag:        "c",
+					Format:      "i",
+					Description: "Good client requests received",
+					RawValue:    &rawValue,
+				},
+			})
+			assert.NoError(err)
+		}
+	}
+
+	expected := []*CounterValue{
+		{
+			Instance:    "tls",
+			Name:        "MAIN.client_req",
+			Flag:        "c",
+			Format:      "i",
+			Description: "Good client requests received",
+			Timestamp:   now,
+			Value:       2,
+		},
+		{
+			Instance:    "internal",
+			Name:        "MAIN.client_req",
+			Flag:        "c",
+			Format:      "i",
+			Description: "Good client requests received",
+			Timestamp:   now,
+			Value:       102,
+		},
+	}
+
+	counters, err := suite.stg.GetLatestCounters(now.Add(-time.Hour))
+	assert.NoError(err)
+	assert.ElementsMatch(expected, counters)
+
+	counters, err = suite.stg.GetLatestCounters(now.Add(time.Minute))
+	assert.NoError(err)
+	assert.Empty(counters)
+
+	// Latest raw values are carried over when the database is reopened (i.e.,
+	// a new in-memory database in this case), but they're not stored as
+	// samples of the new database.
+	suite.stg.init()
+	counters, err = suite.stg.GetLatestCounters(now.Add(-time.Hour))
+	assert.NoError(err)
+	assert.ElementsMatch(expected, counters)
+	var nRows int
+	assert.NoError(suite.stg.db.QueryRow("SELECT COUNT(*) FROM counter_values").Scan(&nRows))
+	assert.Zero(nRows)
+	assert.Empty(suite.stg.cache.metricsByName)
+
+	// Newer raw values take precedence over carried over ones.
+	rawValue := uint64(200)
+	assert.NoError(suite.stg.PushMetricSamples("tls", now.Add(time.Second), []*MetricSample{{
+		Name:        "MAIN.client_req",
+		Flag:        "c",
+		Format:      "i",
+		Description: "Good client requests received",
+		Value:       float64(1),
+		RawValue:    &rawValue,
+	}}))
+	counters, err = suite.stg.GetLatestCounters(now.Add(-time.Hour))
+	assert.NoError(err)
+	assert.Len(counters, len(expected))
+	for _, counter := range counters {
+		if counter.Instance == "tls" {
+			assert.Equal(rawValue, counter.Value)
+			assert.Equal(now.Add(time.Second), counter.Timestamp)
+		}
+	}
+
+	assert.Len(suite.stg.app.Cfg().Log().Buffer().Events(), 0)
+}
+
+func (suite *MetricsTestSuite) TestPushSampleBatches() {
+	assert := suite.Require()
+
+	start := time.Date(2025, time.January, 1, 13, 0, 0, 0, time.UTC)
+	rawValue := uint64(42)
+	newBatch := func(instance string, offset int) *MetricSampleBatch {
+		return &MetricSampleBatch{
+			Instance:  instance,
+			Timestamp: start.Add(time.Duration(offset) * time.Second),
+			Samples: []*MetricSample{
+				{
+					Name:        "MAIN.client_req",
+					Flag:        "c",
+					Format:      "i",
+					Description: "Good client requests received",
+					Value:       float64(1),
+					RawValue:    &rawValue,
+				},
+				{
+					Name:        "MAIN.n_backend",
+					Flag:        "g",
+					Format:      "i",
+					Description: "Number of backends",
+					Value:       uint64(3),
+				},
+			},
+		}
+	}
+
+	// Several scrapes are stored in a single transaction.
+	err := suite.stg.PushMetricSampleBatches([]*MetricSampleBatch{
+		newBatch("foo", 0),
+		newBatch("foo", 10),
+		newBatch("bar", 20),
+	})
+	assert.NoError(err)
+
+	var nRows int
+	err = suite.stg.db.QueryRow("SELECT COUNT(*) FROM metric_values").Scan(&nRows)
+	assert.NoError(err)
+	assert.Equal(6, nRows)
+	err = suite.stg.db.QueryRow("SELECT COUNT(*) FROM counter_values").Scan(&nRows)
+	assert.NoError(err)
+	assert.Equal(3, nRows)
+	assert.Len(suite.stg.cache.metricsByName, 2)
+	assert.Equal(map[string]bool{"foo": true, "bar": true}, suite.stg.cache.instances)
+	assert.Equal(start, suite.stg.cache.earliest)
+	assert.Equal(start.Add(20*time.Second), suite.stg.cache.latest)
+
+	// If any scrape fails (e.g., a duplicated sample), the rest are stored
+	// one by one, including new metrics.
+	batch := newBatch("foo", 30)
+	batch.Samples = append(batch.Samples, &MetricSample{
+		Name:        "MAIN.n_vcl",
+		Flag:        "g",
+		Format:      "i",
+		Description: "Number of loaded VCLs in total",
+		Value:       uint64(1),
+	})
+	err = suite.stg.PushMetricSampleBatches([]*MetricSampleBatch{
+		batch,
+		newBatch("foo", 10),
+		newBatch("bar", 40),
+	})
+	var partial *PartialPushError
+	assert.ErrorAs(err, &partial)
+	assert.Len(partial.Errors, 3)
+	assert.NoError(partial.Errors[0])
+	assert.Error(partial.Errors[1])
+	assert.True(isDataError(partial.Errors[1]))
+	assert.NoError(partial.Errors[2])
+
+	err = suite.stg.db.QueryRow("SELECT COUNT(*) FROM metric_values").Scan(&nRows)
+	assert.NoError(err)
+	assert.Equal(11, nRows)
+	err = suite.stg.db.QueryRow("SELECT COUNT(*) FROM metrics").Scan(&nRows)
+	assert.NoError(err)
+	assert.Equal(3, nRows)
+	assert.Contains(suite.stg.cache.metricsByName, "MAIN.n_vcl")
+	assert.Equal(start.Add(40*time.Second), suite.stg.cache.latest)
+
+	// Nothing is stored if all scrapes fail.
+	err = suite.stg.PushMetricSampleBatches([]*MetricSampleBatch{
+		newBatch("foo", 0),
+		newBatch("bar", 20),
+	})
+	assert.Error(err)
+	assert.NotErrorAs(err, &partial)
+
+	err = suite.stg.db.QueryRow("SELECT COUNT(*) FROM metric_values").Scan(&nRows)
+	assert.NoError(err)
+	assert.Equal(11, nRows)
+
+	// Errors not caused by the data (e.g., a closed database) are returned
+	// right away, without storing scrapes one by one.
+	assert.NoError(suite.stg.db.Close())
+	err = suite.stg.PushMetricSampleBatches([]*MetricSampleBatch{
+		newBatch("foo", 50),
+		newBatch("bar", 50),
+	})
+	assert.Error(err)
+	assert.False(isDataError(err))
+	assert.NotErrorAs(err, &partial)
+
+	assert.Len(suite.stg.app.Cfg().Log().Buffer().Events(), 0)
+}
+
 func TestMetricsTestSuite(t *testing.T) {
 	suite.Run(t, &MetricsTestSuite{})
 }
+
+// Pushes scrapes of a few thousand metrics, similar to a Varnish instance with
+// a bunch of backends, one scrape per transaction. Run with:
+//
+//	go test -run '^$' -bench PushMetricSample ./pkg/workers/storage/
+func BenchmarkPushMetricSamples(b *testing.B) {
+	benchmarkPushMetricSamples(b, 1)
+}
+
+// Same as 'BenchmarkPushMetricSamples', but storing several scrapes per
+// transaction.
+func BenchmarkPushMetricSampleBatches(b *testing.B) {
+	benchmarkPushMetricSamples(b, 10)
+}
+
+func benchmarkPushMetricSamples(b *testing.B, scrapesPerBatch int) {
+	stg := newTestStorage(b)
+
+	samples := make([]*MetricSample, 0, 3000)
+	for i := range 1500 {
+		rawValue := uint64(i)
+		samples = append(samples, &MetricSample{
+			Name:        fmt.Sprintf("VBE.boot.backend_%d.req", i),
+			Flag:        "c",
+			Format:      "i",
+			Description: "Backend requests sent",
+			Value:       float64(i),
+			RawValue:    &rawValue,
+		})
+	}
+	for i := range 1500 {
+		samples = append(samples, &MetricSample{
+			Name:        fmt.Sprintf("VBE.boot.backend_%d.conn", i),
+			Flag:        "g",
+			Format:      "i",
+			Description: "Concurrent connections used",
+			Value:       uint64(i),
+		})
+	}
+
+	start := time.Date(2025, time.January, 1, 13, 0, 0, 0, time.UTC)
+	b.ResetTimer()
+	for i := range b.N {
+		batches := make([]*MetricSampleBatch, 0, scrapesPerBatch)
+		for j := range scrapesPerBatch {
+			batches = append(batches, &MetricSampleBatch{
+				Instance:  "default",
+				Timestamp: start.Add(time.Duration(i*scrapesPerBatch+j) * time.Second),
+				Samples:   samples,
+			})
+		}
+		if err := stg.PushMetricSampleBatches(batches); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(b.N*scrapesPerBatch*len(samples))/b.Elapsed().Seconds(), "samples/s")
+}
@@ -0,0 +1,411 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/allenta/varnishmon/pkg/config"
+)
+
+var (
+	ErrUnsupportedSchemaVersion = errors.New("unsupported schema version")
+	ErrOutdatedSchemaVersion    = errors.New("outdated schema version")
+)
+
+// Migration upgrades the schema of the database from 'Version - 1' to
+// 'Version'. Migrations are executed in a transaction, together with the
+// update of 'metadata.schema_version', so they're either fully applied or not
+// at all.
+type Migration struct {
+	Version     int
+	Description string
+	Apply       func(tx *sql.Tx) error
+}
+
+// MigrationPlan describes the migrations required to bring a database up to
+// date.
+type MigrationPlan struct {
+	// Current schema version of the database. Zero if the database is empty.
+	From       int
+	To         int
+	Migrations []*Migration
+}
+
+// Registry of migrations, sorted by version. When changing the schema, bump
+// 'SchemaVersion', register a migration here and add a test opening a fixture
+// database from the previous version (see 'testdata/schema-v*.duckdb.gz').
+// Empty databases are initialized by running the whole chain, so there's no
+// other place where the schema is defined.
+var migrations = []*Migration{ //nolint:gochecknoglobals
+	{
+		Version:     1,
+		Description: "Create the 'metadata', 'metrics' & 'metric_values' tables",
+		Apply:       migrateToV1,
+	},
+	{
+		Version:     2,
+		Description: "Add the 'instance' dimension to the 'metric_values' table",
+		Apply:       migrateToV2,
+	},
+	{
+		Version:     3,
+		Description: "Add the 'metric_rollups_1m' & 'metric_rollups_1h' tables",
+		Apply:       migrateToV3,
+	},
+	{
+		Version:     4,
+		Description: "Add the 'counter_checkpoints' table",
+		Apply:       migrateToV4,
+	},
+	{
+		Version:     5,
+		Description: "Add the 'bursts' table",
+		Apply:       migrateToV5,
+	},
+	{
+		Version:     6,
+		Description: "Add the 'scrapes' table",
+		Apply:       migrateToV6,
+	},
+	{
+		Version:     7,
+		Description: "Add the 'top_requests' table",
+		Apply:       migrateToV7,
+	},
+	{
+		Version:     8,
+		Description: "Add the 'transactions' table",
+		Apply:       migrateToV8,
+	},
+	{
+		Version:     9,
+		Description: "Add the 'counter_values' table",
+		Apply:       migrateToV9,
+	},
+}
+
+// Returns the migrations required to bring a database at the given schema
+// version up to date. Fails if the database is newer than this version of
+// varnishmon understands.
+func planMigrations(version int) (*MigrationPlan, error) {
+	if version > SchemaVersion {
+		return nil, fmt.Errorf(
+			"%w: database schema version is %d, but the latest supported one is %d",
+			ErrUnsupportedSchemaVersion, version, SchemaVersion)
+	}
+
+	plan := &MigrationPlan{
+		From:       version,
+		To:         SchemaVersion,
+		Migrations: make([]*Migration, 0),
+	}
+
+	for _, migration := range migrations {
+		if migration.Version > version {
+			plan.Migrations = append(plan.Migrations, migration)
+		}
+	}
+	return plan, nil
+}
+
+// Returns the schema version of the database, or zero if the database is
+// empty (i.e., the 'metadata' table does not exist yet or it's empty).
+func readSchemaVersion(db *sql.DB) (int, error) {
+	var count int
+	if err := db.QueryRow(`
+		SELECT COUNT(*)
+		FROM duckdb_tables()
+		WHERE table_name = 'metadata'`).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to query 'duckdb_tables': %w", err)
+	}
+	if count == 0 {
+		return 0, nil
+	}
+
+	var version int
+	if err := db.QueryRow(`SELECT schema_version FROM metadata LIMIT 1`).Scan(&version); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to query schema version in 'metadata' table: %w", err)
+	}
+	return version, nil
+}
+
+// Applies a migration in a transaction, updating the schema version too.
+func applyMigration(db *sql.DB, migration *Migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	if err := migration.Apply(tx); err != nil {
+		return fmt.Errorf("failed to migrate to schema version %d: %w", migration.Version, err)
+	}
+	if _, err := tx.Exec(`UPDATE metadata SET schema_version = $1`, migration.Version); err != nil {
+		return fmt.Errorf("failed to update schema version in 'metadata' table: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// Migrate brings the given database file up to date, without initializing
+// the rest of the storage (e.g., as done by 'varnishmon db migrate'). Empty
+// databases are initialized from scratch. If 'dryRun' is true, the database
+// is opened in read-only mode and the plan is returned without applying it.
+func Migrate(file string, dryRun bool) (*MigrationPlan, error) {
+	dsn := file
+	if dryRun {
+		dsn += "?access_mode=READ_ONLY"
+	}
+	db, err := sql.Open("duckdb", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	defer db.Close()
+
+	version, err := readSchemaVersion(db)
+	if err != nil {
+		return nil, err
+	}
+	plan, err := planMigrations(version)
+	if err != nil {
+		return nil, err
+	}
+
+	if !dryRun {
+		for _, migration := range plan.Migrations {
+			if err := applyMigration(db, migration); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return plan, nil
+}
+
+// Version 0 -> 1: create the initial schema, as created by the first versions
+// of varnishmon, and populate the 'metadata' table.
+func migrateToV1(tx *sql.Tx) error {
+	if _, err := tx.Exec(`
+		CREATE TABLE metadata (
+			app_version VARCHAR NOT NULL,
+			app_revision VARCHAR NOT NULL,
+			schema_version INTEGER NOT NULL,
+			hostname VARCHAR NOT NULL
+		);
+
+		CREATE SEQUENCE metrics_seq;
+
+		CREATE TABLE metrics (
+			id INTEGER PRIMARY KEY,
+			name VARCHAR NOT NULL,
+			flag VARCHAR NOT NULL,
+			format VARCHAR NOT NULL,
+			description VARCHAR NOT NULL,
+			class VARCHAR NOT NULL,
+			UNIQUE(name)
+		);
+
+		CREATE TABLE metric_values (
+			metric_id INTEGER NOT NULL REFERENCES metrics(id),
+			timestamp TIMESTAMP NOT NULL,
+			value UNION(float64 FLOAT8, uint64 UBIGINT) NOT NULL,
+			PRIMARY KEY (metric_id, timestamp)
+		)`); err != nil {
+		return fmt.Errorf("failed to create database tables: %w", err)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("failed to get hostname: %w", err)
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO metadata (app_version, app_revision, schema_version, hostname)
+		VALUES ($1, $2, $3, $4)`,
+		config.Version(), config.Revision(), 1, hostname); err != nil {
+		return fmt.Errorf("failed to insert into 'metadata' table: %w", err)
+	}
+	return nil
+}
+
+// Version 1 -> 2: add the 'instance' dimension to the 'metric_values' table.
+// Existing samples are assigned to the default scraper target. DuckDB does not
+// support altering primary keys, so the table needs to be rebuilt. Samples are
+// moved through a temporary table: renaming tables referencing others leaves
+// stale foreign keys behind in the catalog.
+func migrateToV2(tx *sql.Tx) error {
+	for _, statement := range []struct {
+		query string
+		args  []any
+	}{
+		{query: `CREATE TEMP TABLE metric_values_v1 AS SELECT * FROM metric_values`},
+		{query: `DROP TABLE metric_values`},
+		{query: `
+			CREATE TABLE metric_values (
+				metric_id INTEGER NOT NULL REFERENCES metrics(id),
+				instance VARCHAR NOT NULL,
+				timestamp TIMESTAMP NOT NULL,
+				value UNION(float64 FLOAT8, uint64 UBIGINT) NOT NULL,
+				PRIMARY KEY (metric_id, instance, timestamp)
+			)`},
+		{query: `
+			INSERT INTO metric_values (metric_id, instance, timestamp, value)
+			SELECT metric_id, $1, timestamp, value
+			FROM metric_values_v1`, args: []any{config.DefaultScraperTarget}},
+		{query: `DROP TABLE metric_values_v1`},
+	} {
+		if _, err := tx.Exec(statement.query, statement.args...); err != nil {
+			return fmt.Errorf("failed to rebuild 'metric_values' table: %w", err)
+		}
+	}
+	return nil
+}
+
+// Version 2 -> 3: add the rollup tables, populated using the existing samples.
+func migrateToV3(tx *sql.Tx) error {
+	for _, tier := range []struct {
+		table string
+		step  int
+	}{
+		{"metric_rollups_1m", 60},
+		{"metric_rollups_1h", 3600},
+	} {
+		//nolint:gosec
+		if _, err := tx.Exec(fmt.Sprintf(`
+			CREATE TABLE %s (
+				metric_id INTEGER NOT NULL REFERENCES metrics(id),
+				instance VARCHAR NOT NULL,
+				timestamp TIMESTAMP NOT NULL,
+				min DOUBLE NOT NULL,
+				max DOUBLE NOT NULL,
+				sum DOUBLE NOT NULL,
+				count UBIGINT NOT NULL,
+				last DOUBLE NOT NULL,
+				last_timestamp TIMESTAMP NOT NULL,
+				PRIMARY KEY (metric_id, instance, timestamp)
+			);
+
+			INSERT INTO %s (metric_id, instance, timestamp, min, max, sum, count, last, last_timestamp)
+			SELECT
+				metric_id,
+				instance,
+				time_bucket(INTERVAL '%ds', timestamp),
+				min(value),
+				max(value),
+				sum(value),
+				count(*),
+				arg_max(value, timestamp),
+				max(timestamp)
+			FROM (
+				SELECT metric_id, instance, timestamp, coalesce(value.float64, value.uint64::DOUBLE) AS value
+				FROM metric_values
+			)
+			GROUP BY metric_id, instance, time_bucket(INTERVAL '%ds', timestamp)`,
+			tier.table, tier.table, tier.step, tier.step)); err != nil {
+			return fmt.Errorf("failed to create '%s' table: %w", tier.table, err)
+		}
+	}
+	return nil
+}
+
+// Version 3 -> 4: add the 'counter_checkpoints' table. Raw values of counters
+// carried over from previous databases used to be copied into the
+// 'counter_values' table; they're left there.
+func migrateToV4(tx *sql.Tx) error {
+	if _, err := tx.Exec(`
+		CREATE TABLE counter_checkpoints (
+			instance VARCHAR NOT NULL,
+			name VARCHAR NOT NULL,
+			flag VARCHAR NOT NULL,
+			format VARCHAR NOT NULL,
+			description VARCHAR NOT NULL,
+			timestamp TIMESTAMP NOT NULL,
+			value UBIGINT NOT NULL,
+			PRIMARY KEY (instance, name)
+		)`); err != nil {
+		return fmt.Errorf("failed to create 'counter_checkpoints' table: %w", err)
+	}
+	return nil
+}
+
+// Version 4 -> 5: add the 'bursts' table. It used to be created on startup,
+// if missing, so it may already exist.
+func migrateToV5(tx *sql.Tx) error {
+	return createTableIfNotExists(tx, "bursts", `
+		started TIMESTAMP NOT NULL,
+		ended TIMESTAMP NOT NULL,
+		period INTEGER NOT NULL,
+		PRIMARY KEY (started)`)
+}
+
+// Version 5 -> 6: add the 'scrapes' table. It used to be created on startup,
+// if missing, so it may already exist.
+func migrateToV6(tx *sql.Tx) error {
+	return createTableIfNotExists(tx, "scrapes", `
+		instance VARCHAR NOT NULL,
+		timestamp TIMESTAMP NOT NULL,
+		duration DOUBLE NOT NULL,
+		outcome VARCHAR NOT NULL,
+		error VARCHAR NOT NULL,
+		stderr VARCHAR NOT NULL,
+		metrics INTEGER NOT NULL`)
+}
+
+// Version 6 -> 7: add the 'top_requests' table. It used to be created on
+// startup, if missing, so it may already exist.
+func migrateToV7(tx *sql.Tx) error {
+	return createTableIfNotExists(tx, "top_requests", `
+		instance VARCHAR NOT NULL,
+		timestamp TIMESTAMP NOT NULL,
+		dimension VARCHAR NOT NULL,
+		key VARCHAR NOT NULL,
+		requests UBIGINT NOT NULL,
+		bytes UBIGINT NOT NULL,
+		PRIMARY KEY (instance, timestamp, dimension, key)`)
+}
+
+// Version 7 -> 8: add the 'transactions' table. It used to be created on
+// startup, if missing, so it may already exist.
+func migrateToV8(tx *sql.Tx) error {
+	return createTableIfNotExists(tx, "transactions", `
+		instance VARCHAR NOT NULL,
+		timestamp TIMESTAMP NOT NULL,
+		vxid UBIGINT NOT NULL,
+		method VARCHAR NOT NULL,
+		url VARCHAR NOT NULL,
+		host VARCHAR NOT NULL,
+		status INTEGER NOT NULL,
+		backend VARCHAR NOT NULL,
+		duration DOUBLE NOT NULL,
+		timings VARCHAR NOT NULL`)
+}
+
+// Version 8 -> 9: add the 'counter_values' table, where raw values of counters
+// are stored. It used to be created on startup, if missing, so it may already
+// exist.
+func migrateToV9(tx *sql.Tx) error {
+	return createTableIfNotExists(tx, "counter_values", `
+		metric_id INTEGER NOT NULL REFERENCES metrics(id),
+		instance VARCHAR NOT NULL,
+		timestamp TIMESTAMP NOT NULL,
+		value UBIGINT NOT NULL,
+		PRIMARY KEY (metric_id, instance, timestamp)`)
+}
+
+// Creates a table, unless it already exists. Useful for tables that used to be
+// created on startup, before being registered as migrations.
+func createTableIfNotExists(tx *sql.Tx, name, definition string) error {
+	//nolint:gosec
+	if _, err := tx.Exec(fmt.Sprintf(
+		`CREATE TABLE IF NOT EXISTS %s (%s)`, name, definition)); err != nil {
+		return fmt.Errorf("failed to create '%s' table: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,444 @@
+package storage
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/allenta/varnishmon/pkg/config"
+	"github.com/allenta/varnishmon/pkg/helpers"
+	"github.com/stretchr/testify/suite"
+)
+
+type MigrationsTestSuite struct {
+	suite.Suite
+}
+
+// Decompresses a fixture database into a temporary directory.
+func (suite *MigrationsTestSuite) openFixture(version string) string {
+	assert := suite.Require()
+
+	file := filepath.Join(suite.T().TempDir(), "varnishmon.db")
+	ok, err := helpers.DecompressFile(
+		filepath.Join("testdata", "schema-v"+version+".duckdb.gz"), file)
+	assert.NoError(err)
+	assert.True(ok)
+	return file
+}
+
+func (suite *MigrationsTestSuite) newStorage(file string) *Storage {
+	return newTestStorage(suite.T(), "db.file", file)
+}
+
+func (suite *MigrationsTestSuite) TestRegistry() {
+	assert := suite.Require()
+
+	for i, migration := range migrations {
+		assert.Equal(i+1, migration.Version)
+		assert.NotEmpty(migration.Description)
+	}
+	assert.Equal(SchemaVersion, migrations[len(migrations)-1].Version)
+
+	// Empty databases are initialized by running all migrations.
+	plan, err := planMigrations(0)
+	assert.NoError(err)
+	assert.Equal(migrations, plan.Migrations)
+
+	plan, err = planMigrations(SchemaVersion)
+	assert.NoError(err)
+	assert.Empty(plan.Migrations)
+
+	_, err = planMigrations(SchemaVersion + 1)
+	assert.ErrorIs(err, ErrUnsupportedSchemaVersion)
+}
+
+func (suite *MigrationsTestSuite) TestCreate() {
+	assert := suite.Require()
+
+	file := filepath.Join(suite.T().TempDir(), "varnishmon.db")
+	stg := suite.newStorage(file)
+	version, err := readSchemaVersion(stg.db)
+	assert.NoError(err)
+	assert.Equal(SchemaVersion, version)
+	var count int
+	assert.NoError(stg.db.QueryRow(`SELECT COUNT(*) FROM metadata`).Scan(&count))
+	assert.Equal(1, count)
+	assert.NoError(stg.Shutdown())
+
+	// Same schema as a database migrated from the initial version.
+	migrated := suite.openFixture("1")
+	plan, err := Migrate(migrated, false)
+	assert.NoError(err)
+	assert.Len(plan.Migrations, SchemaVersion-1)
+	assert.Equal(suite.schema(migrated), suite.schema(file))
+
+	assert.Len(stg.app.Cfg().Log().Buffer().Events(), 0)
+}
+
+// Returns the tables and columns of a database file.
+func (suite *MigrationsTestSuite) schema(file string) []string {
+	assert := suite.Require()
+
+	db, err := sql.Open("duckdb", file+"?access_mode=READ_ONLY")
+	assert.NoError(err)
+	defer db.Close()
+
+	rows, err := db.Query(`
+		SELECT table_name || '.' || column_name || ' ' || data_type
+		FROM duckdb_columns()
+		WHERE database_name = current_database() AND schema_name = 'main'
+		ORDER BY table_name, column_index`)
+	assert.NoError(err)
+	defer rows.Close()
+	result := make([]string, 0)
+	for rows.Next() {
+		var column string
+		assert.NoError(rows.Scan(&column))
+		result = append(result, column)
+	}
+	assert.NoError(rows.Err())
+	return result
+}
+
+func (suite *MigrationsTestSuite) TestMigrateToV2() {
+	assert := suite.Require()
+
+	file := suite.openFixture("1")
+
+	// Dry runs don't modify the database.
+	for range 2 {
+		plan, err := Migrate(file, true)
+		assert.NoError(err)
+		assert.Equal(1, plan.From)
+		assert.Equal(SchemaVersion, plan.To)
+		assert.Equal(2, plan.Migrations[0].Version)
+	}
+
+	// Migrations are applied when opening the database.
+	stg := suite.newStorage(file)
+	version, err := readSchemaVersion(stg.db)
+	assert.NoError(err)
+	assert.Equal(SchemaVersion, version)
+	assert.Equal(map[string]bool{config.DefaultScraperTarget: true}, stg.cache.instances)
+
+	rows, err := stg.db.Query(`
+		SELECT metric_id, instance, timestamp
+		FROM metric_values
+		ORDER BY metric_id, timestamp`)
+	assert.NoError(err)
+	defer rows.Close()
+	nRows := 0
+	for rows.Next() {
+		var metricID int
+		var instance string
+		var timestamp time.Time
+		assert.NoError(rows.Scan(&metricID, &instance, &timestamp))
+		assert.Equal(config.DefaultScraperTarget, instance)
+		nRows++
+	}
+	assert.NoError(rows.Err())
+	assert.Equal(4, nRows)
+
+	id := stg.cache.metricsByName["MAIN.n_backend"].ID
+	start := time.Date(2025, time.January, 1, 13, 0, 0, 0, time.UTC)
+	metric, err := stg.GetMetric(id, start, start.Add(2*time.Minute), 60, "max", FillNone, "")
+	assert.NoError(err)
+	assert.Len(metric["samples"], 2)
+
+	// Foreign keys of the rebuilt table are still enforced (e.g., when
+	// pruning unused metrics).
+	_, err = stg.db.Exec(`DELETE FROM metrics WHERE id NOT IN (SELECT metric_id FROM metric_values)`)
+	assert.NoError(err)
+	_, err = stg.db.Exec(`DELETE FROM metrics`)
+	assert.Error(err)
+
+	assert.Len(stg.app.Cfg().Log().Buffer().Events(), 0)
+	assert.NoError(stg.Shutdown())
+
+	// Nothing else to do.
+	plan, err := Migrate(file, false)
+	assert.NoError(err)
+	assert.Equal(SchemaVersion, plan.From)
+	assert.Empty(plan.Migrations)
+}
+
+func (suite *MigrationsTestSuite) TestMigrateToV3() {
+	assert := suite.Require()
+
+	file := suite.openFixture("2")
+
+	plan, err := Migrate(file, true)
+	assert.NoError(err)
+	assert.Equal(2, plan.From)
+	assert.Equal(3, plan.Migrations[0].Version)
+
+	// Rollups are populated using the existing samples.
+	stg := suite.newStorage(file)
+	version, err := readSchemaVersion(stg.db)
+	assert.NoError(err)
+	assert.Equal(SchemaVersion, version)
+	assert.Equal(map[string]bool{"bar": true, "foo": true}, stg.cache.instances)
+
+	for table, expected := range map[string]int{
+		"metric_rollups_1m": 14,
+		"metric_rollups_1h": 8,
+	} {
+		var count int
+		assert.NoError(stg.db.QueryRow(`SELECT COUNT(*) FROM ` + table).Scan(&count))
+		assert.Equal(expected, count, table)
+	}
+
+	start := time.Date(2025, time.February, 1, 12, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		metric     string
+		aggregator string
+		instance   string
+		expected   [][2]interface{}
+	}{
+		{
+			metric:     "MAIN.n_backend",
+			aggregator: "max",
+			instance:   "bar",
+			expected: [][2]interface{}{
+				{start.Unix(), uint64(111)},
+				{start.Unix() + 3600, uint64(113)},
+			},
+		},
+		{
+			metric:     "MAIN.n_backend",
+			aggregator: "avg",
+			instance:   "foo",
+			expected: [][2]interface{}{
+				{start.Unix(), float64(10.5)},
+				{start.Unix() + 3600, float64(12.5)},
+			},
+		},
+		{
+			metric:     "MAIN.client_req",
+			aggregator: "last",
+			instance:   "foo",
+			expected: [][2]interface{}{
+				{start.Unix(), float64(1)},
+				{start.Unix() + 3600, float64(3)},
+			},
+		},
+	} {
+		id := stg.cache.metricsByName[test.metric].ID
+		metric, err := stg.GetMetric(
+			id, start, start.Add(2*time.Hour-time.Second), 3600, test.aggregator, FillNone, test.instance)
+		assert.NoError(err)
+		assert.Equal(test.expected, metric["samples"], test.metric)
+	}
+
+	assert.Len(stg.app.Cfg().Log().Buffer().Events(), 0)
+	assert.NoError(stg.Shutdown())
+}
+
+func (suite *MigrationsTestSuite) TestMigrateToV4() {
+	assert := suite.Require()
+
+	file := suite.openFixture("3")
+
+	plan, err := Migrate(file, true)
+	assert.NoError(err)
+	assert.Equal(3, plan.From)
+	assert.Equal(4, plan.Migrations[0].Version)
+
+	// Checkpoints are stored apart from raw values of counters.
+	stg := suite.newStorage(file)
+	version, err := readSchemaVersion(stg.db)
+	assert.NoError(err)
+	assert.Equal(SchemaVersion, version)
+
+	start := time.Date(2025, time.March, 1, 12, 0, 0, 0, time.UTC)
+	assert.NoError(stg.unsafePushCounterCheckpoints([]*CounterValue{{
+		Instance:    "baz",
+		Name:        "MAIN.client_req",
+		Flag:        "c",
+		Format:      "i",
+		Description: "Good client requests received",
+		Timestamp:   start,
+		Value:       42,
+	}}))
+	var count int
+	assert.NoError(stg.db.QueryRow(`SELECT COUNT(*) FROM counter_values`).Scan(&count))
+	assert.Equal(8, count)
+
+	counters, err := stg.GetLatestCounters(start)
+	assert.NoError(err)
+	values := make(map[string]uint64)
+	for _, counter := range counters {
+		values[counter.Instance] = counter.Value
+	}
+	assert.Equal(map[string]uint64{"foo": 280, "bar": 380, "baz": 42}, values)
+
+	assert.Len(stg.app.Cfg().Log().Buffer().Events(), 0)
+	assert.NoError(stg.Shutdown())
+}
+
+func (suite *MigrationsTestSuite) TestMigrateToV5() {
+	assert := suite.Require()
+
+	// The fixture already includes the 'bursts' table, as it used to be
+	// created on startup.
+	file := suite.openFixture("4")
+
+	plan, err := Migrate(file, true)
+	assert.NoError(err)
+	assert.Equal(4, plan.From)
+	assert.Equal(5, plan.Migrations[0].Version)
+
+	stg := suite.newStorage(file)
+	version, err := readSchemaVersion(stg.db)
+	assert.NoError(err)
+	assert.Equal(SchemaVersion, version)
+
+	// Existing bursts are kept, and new ones can be stored.
+	start := time.Date(2025, time.April, 1, 12, 0, 0, 0, time.UTC)
+	assert.NoError(stg.PushBurst(&Burst{
+		From:   start.Add(time.Hour),
+		To:     start.Add(2 * time.Hour),
+		Period: time.Second,
+	}))
+	bursts, err := stg.GetBursts(start, start.Add(3*time.Hour))
+	assert.NoError(err)
+	assert.Len(bursts["bursts"], 2)
+
+	assert.Len(stg.app.Cfg().Log().Buffer().Events(), 0)
+	assert.NoError(stg.Shutdown())
+}
+
+func (suite *MigrationsTestSuite) TestMigrateToV6() {
+	assert := suite.Require()
+
+	file := suite.openFixture("5")
+
+	plan, err := Migrate(file, true)
+	assert.NoError(err)
+	assert.Equal(5, plan.From)
+	assert.Equal(6, plan.Migrations[0].Version)
+
+	stg := suite.newStorage(file)
+	version, err := readSchemaVersion(stg.db)
+	assert.NoError(err)
+	assert.Equal(SchemaVersion, version)
+
+	// Scrapes can be stored.
+	start := time.Date(2025, time.April, 1, 12, 0, 0, 0, time.UTC)
+	assert.NoError(stg.PushScrape(&Scrape{
+		Instance:  "foo",
+		Timestamp: start.Add(3 * time.Minute),
+		Outcome:   ScrapeOutcomeOK,
+	}))
+	var count int
+	assert.NoError(stg.db.QueryRow(`SELECT COUNT(*) FROM scrapes`).Scan(&count))
+	assert.Equal(1, count)
+
+	assert.Len(stg.app.Cfg().Log().Buffer().Events(), 0)
+	assert.NoError(stg.Shutdown())
+}
+
+func (suite *MigrationsTestSuite) TestMigrateToV7() {
+	assert := suite.Require()
+
+	file := suite.openFixture("6")
+
+	plan, err := Migrate(file, true)
+	assert.NoError(err)
+	assert.Equal(6, plan.From)
+	assert.Equal(7, plan.Migrations[0].Version)
+
+	stg := suite.newStorage(file)
+	version, err := readSchemaVersion(stg.db)
+	assert.NoError(err)
+	assert.Equal(SchemaVersion, version)
+
+	// Top requests can be stored.
+	start := time.Date(2025, time.April, 1, 12, 0, 0, 0, time.UTC)
+	assert.NoError(stg.PushTopRequests("foo", start.Add(3*time.Minute), []*helpers.TopEntry{
+		{Dimension: "url", Key: "/", Requests: 1, Bytes: 42},
+	}))
+	var count int
+	assert.NoError(stg.db.QueryRow(`SELECT COUNT(*) FROM top_requests`).Scan(&count))
+	assert.Equal(1, count)
+
+	assert.Len(stg.app.Cfg().Log().Buffer().Events(), 0)
+	assert.NoError(stg.Shutdown())
+}
+
+func (suite *MigrationsTestSuite) TestMigrateToV8() {
+	assert := suite.Require()
+
+	file := suite.openFixture("7")
+
+	plan, err := Migrate(file, true)
+	assert.NoError(err)
+	assert.Equal(7, plan.From)
+	assert.Equal(8, plan.Migrations[0].Version)
+
+	stg := suite.newStorage(file)
+	version, err := readSchemaVersion(stg.db)
+	assert.NoError(err)
+	assert.Equal(SchemaVersion, version)
+
+	// Transactions can be stored.
+	start := time.Date(2025, time.April, 1, 12, 0, 0, 0, time.UTC)
+	assert.NoError(stg.PushTransactions("foo", []*helpers.VarnishTransaction{
+		{Timestamp: start.Add(3 * time.Minute), VXID: 1, URL: "/", Duration: time.Second},
+	}))
+	var count int
+	assert.NoError(stg.db.QueryRow(`SELECT COUNT(*) FROM transactions`).Scan(&count))
+	assert.Equal(1, count)
+
+	assert.Len(stg.app.Cfg().Log().Buffer().Events(), 0)
+	assert.NoError(stg.Shutdown())
+}
+
+func (suite *MigrationsTestSuite) TestMigrateToV9() {
+	assert := suite.Require()
+
+	// The fixture already includes the 'counter_values' table.
+	file := suite.openFixture("8")
+
+	plan, err := Migrate(file, true)
+	assert.NoError(err)
+	assert.Equal(8, plan.From)
+	assert.Equal(9, plan.Migrations[0].Version)
+
+	stg := suite.newStorage(file)
+	version, err := readSchemaVersion(stg.db)
+	assert.NoError(err)
+	assert.Equal(SchemaVersion, version)
+
+	// Existing rows are kept.
+	var count int
+	assert.NoError(stg.db.QueryRow(`SELECT COUNT(*) FROM counter_values`).Scan(&count))
+	assert.Equal(3, count)
+
+	assert.Len(stg.app.Cfg().Log().Buffer().Events(), 0)
+	assert.NoError(stg.Shutdown())
+}
+
+func (suite *MigrationsTestSuite) TestNewerSchemaVersion() {
+	assert := suite.Require()
+
+	file := filepath.Join(suite.T().TempDir(), "varnishmon.db")
+	stg := suite.newStorage(file)
+	assert.NoError(stg.Shutdown())
+
+	db, err := sql.Open("duckdb", file)
+	assert.NoError(err)
+	_, err = db.Exec(`UPDATE metadata SET schema_version = $1`, SchemaVersion+1)
+	assert.NoError(err)
+	assert.NoError(db.Close())
+
+	_, err = Migrate(file, true)
+	assert.ErrorIs(err, ErrUnsupportedSchemaVersion)
+	_, err = Migrate(file, false)
+	assert.ErrorIs(err, ErrUnsupportedSchemaVersion)
+}
+
+func TestMigrationsTestSuite(t *testing.T) {
+	suite.Run(t, &MigrationsTestSuite{})
+}
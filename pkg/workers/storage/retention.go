@@ -0,0 +1,510 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Attempts to checkpoint the database. Checkpoints fail if other write
+	// transactions are running (e.g., ingest), so they're retried after a
+	// short pause.
+	retentionCheckpointAttempts = 10
+	retentionCheckpointPause    = 500 * time.Millisecond
+
+	// Maximum number of consecutive passes deleting the oldest data without
+	// reducing the space used by the database, when enforcing the maximum
+	// size.
+	retentionMaxStalledPasses = 10
+)
+
+// Tables subject to retention, and their timestamp columns. The first one
+// drives the deletion of the oldest rows when enforcing the maximum size.
+var retentionTables = []struct { //nolint:gochecknoglobals
+	name   string
+	column string
+}{
+	{"metric_values", "timestamp"},
+	{"counter_values", "timestamp"},
+	{"scrapes", "timestamp"},
+	{"top_requests", "timestamp"},
+	{"transactions", "timestamp"},
+	{"bursts", "ended"},
+}
+
+// RetentionStats summarizes the work done while enforcing retention.
+type RetentionStats struct {
+	// Deleted rows, indexed by table.
+	DeletedRows   map[string]int64
+	PrunedMetrics int
+	Checkpoints   int
+}
+
+// Deletes rows older than 'db.retention.max-age' (and rolled up samples older
+// than the maximum age of each rollup tier), and then the oldest data,
+// regardless of the tier, while the space used by the database exceeds
+// 'db.retention.max-size'. Rows are deleted in batches of about
+// 'db.retention.batch-size' samples, each one in its own transaction and
+// without blocking other operations. Metrics without samples are then pruned,
+// and the database is checkpointed to reclaim space. Beware the database file
+// may not shrink, but free blocks are reused.
+func (stg *Storage) EnforceRetention(ctx context.Context) (*RetentionStats, error) {
+	stats := &RetentionStats{
+		DeletedRows: make(map[string]int64),
+	}
+	deleted := false
+
+	// Delete rows older than the maximum age.
+	if maxAge := stg.app.Cfg().DBRetentionMaxAge(); maxAge > 0 {
+		cutoff := time.Now().Add(-maxAge)
+		for {
+			if err := ctx.Err(); err != nil {
+				return stats, err
+			}
+			n, err := stg.deleteOldestRows(cutoff, stats)
+			if err != nil {
+				return stats, err
+			}
+			if n == 0 {
+				break
+			}
+			deleted = true
+		}
+	}
+
+	// Delete rolled up samples older than the maximum age of each tier. Only
+	// buckets fully older than the cutoff are deleted.
+	for _, tier := range rollupTiers {
+		maxAge := tier.maxAge(stg.app.Cfg())
+		if maxAge <= 0 {
+			continue
+		}
+		cutoff := time.Now().Add(-maxAge - time.Duration(tier.step)*time.Second)
+		for {
+			if err := ctx.Err(); err != nil {
+				return stats, err
+			}
+			n, err := stg.deleteOldestRollups(tier, cutoff, stats)
+			if err != nil {
+				return stats, err
+			}
+			if n == 0 {
+				break
+			}
+			deleted = true
+		}
+	}
+
+	// Delete the oldest data while the database is too large. The space used
+	// is only updated after a checkpoint, and it doesn't decrease steadily
+	// (i.e., freed blocks may not be released until reused), so deletions stop
+	// after a number of passes without reducing it. Otherwise, everything but
+	// the newest rows could be deleted.
+	if maxSize := int64(stg.app.Cfg().DBRetentionMaxSize()) * 1024 * 1024; maxSize > 0 {
+		smallest, stalled := int64(-1), 0
+		for {
+			if err := ctx.Err(); err != nil {
+				return stats, err
+			}
+			if err := stg.checkpoint(ctx, stats); err != nil {
+				return stats, err
+			}
+			size, err := stg.getUsedSize()
+			if err != nil {
+				return stats, err
+			}
+			if size <= maxSize {
+				break
+			}
+			if smallest < 0 || size < smallest {
+				smallest, stalled = size, 0
+			} else if stalled++; stalled >= retentionMaxStalledPasses {
+				stg.app.Cfg().Log().Warn().
+					Int64("size", size).
+					Int64("max_size", maxSize).
+					Msg("Deletion of the oldest data is not reducing the size of the database, giving up for now")
+				break
+			}
+			n, err := stg.deleteOldestData(stats)
+			if err != nil {
+				return stats, err
+			}
+			if n == 0 {
+				break
+			}
+			deleted = true
+		}
+	}
+
+	if !deleted {
+		return stats, nil
+	}
+
+	// Prune metrics without samples, refresh the cache and reclaim space.
+	if err := stg.pruneMetrics(stats); err != nil {
+		return stats, err
+	}
+	if err := stg.refreshCache(); err != nil {
+		return stats, err
+	}
+	if err := stg.checkpoint(ctx, stats); err != nil {
+		return stats, err
+	}
+
+	return stats, nil
+}
+
+// Deletes a batch of the oldest rows of all tables subject to retention: up
+// to 'db.retention.batch-size' rows of each table older than 'cutoff'. If
+// 'cutoff' is zero (i.e., when enforcing the maximum size), samples in
+// 'metric_values' drive the deletion: the batch of its oldest samples is
+// deleted, and rows of the rest of tables not newer than them. The newest rows
+// of every table are never deleted, so the web interface is never left empty
+// (e.g., after the service has been stopped for longer than the maximum age).
+// That also avoids a DuckDB bug corrupting indexes when checkpointing tables
+// emptied by a sequence of deletions. Returns the number of deleted rows.
+func (stg *Storage) deleteOldestRows(cutoff time.Time, stats *RetentionStats) (int64, error) {
+	// This is a write operation on 'db' but a read lock is intentionally used.
+	// See the note on the 'Storage' type for more information.
+	stg.mutex.RLock()
+	defer stg.mutex.RUnlock()
+
+	var result int64
+	for _, table := range retentionTables {
+		// Find the newest row of the batch of the oldest rows of the table.
+		var bound *time.Time
+		//nolint:gosec
+		if err := stg.db.QueryRow(`
+			SELECT max(`+table.column+`)
+			FROM (
+				SELECT `+table.column+`
+				FROM `+table.name+`
+				WHERE
+					($1 OR `+table.column+` < $2) AND
+					`+table.column+` < (SELECT max(`+table.column+`) FROM `+table.name+`)
+				ORDER BY `+table.column+`
+				LIMIT $3
+			)`, cutoff.IsZero(), cutoff, stg.app.Cfg().DBRetentionBatchSize()).Scan(&bound); err != nil {
+			return 0, fmt.Errorf("failed to query oldest rows in '%s' table: %w", table.name, err)
+		}
+		if bound == nil {
+			if cutoff.IsZero() && table.name == "metric_values" {
+				return 0, nil
+			}
+			continue
+		}
+
+		// Delete the batch. When enforcing the maximum size, the first table
+		// (i.e., 'metric_values') bounds the rest.
+		//nolint:gosec
+		res, err := stg.db.Exec(`
+			DELETE FROM `+table.name+`
+			WHERE `+table.column+` <= $1`, *bound)
+		if err != nil {
+			return 0, fmt.Errorf("failed to delete from '%s' table: %w", table.name, err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return 0, fmt.Errorf("failed to delete from '%s' table: %w", table.name, err)
+		}
+		stats.DeletedRows[table.name] += n
+		result += n
+		if cutoff.IsZero() && table.name == "metric_values" {
+			cutoff = bound.Add(time.Microsecond)
+		}
+	}
+
+	return result, nil
+}
+
+// Deletes a batch of about 'db.retention.batch-size' of the oldest rolled up
+// samples of the tier, older than 'cutoff' (if not zero). As in
+// 'deleteOldestRows', the newest ones are never deleted. Returns the number of
+// deleted rows.
+func (stg *Storage) deleteOldestRollups(
+	tier *rollupTier, cutoff time.Time, stats *RetentionStats) (int64, error) {
+	// This is a write operation on 'db' but a read lock is intentionally used.
+	// See the note on the 'Storage' type for more information.
+	stg.mutex.RLock()
+	defer stg.mutex.RUnlock()
+
+	var bound *time.Time
+	//nolint:gosec
+	if err := stg.db.QueryRow(`
+		SELECT max(timestamp)
+		FROM (
+			SELECT timestamp
+			FROM `+tier.table+`
+			WHERE
+				($1 OR timestamp < $2) AND
+				timestamp < (SELECT max(timestamp) FROM `+tier.table+`)
+			ORDER BY timestamp
+			LIMIT $3
+		)`, cutoff.IsZero(), cutoff, stg.app.Cfg().DBRetentionBatchSize()).Scan(&bound); err != nil {
+		return 0, fmt.Errorf("failed to query oldest rows in '%s' table: %w", tier.table, err)
+	}
+	if bound == nil {
+		return 0, nil
+	}
+
+	//nolint:gosec
+	res, err := stg.db.Exec(`
+		DELETE FROM `+tier.table+`
+		WHERE timestamp <= $1`, *bound)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete from '%s' table: %w", tier.table, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete from '%s' table: %w", tier.table, err)
+	}
+	stats.DeletedRows[tier.table] += n
+
+	return n, nil
+}
+
+// Deletes a batch of the oldest data: raw samples (and the rest of timestamped
+// data) or rolled up samples of some tier, whatever ends earlier (i.e., the
+// end of buckets is considered for rollups, so raw samples are deleted before
+// the rollups summarizing them). Returns the number of deleted samples.
+func (stg *Storage) deleteOldestData(stats *RetentionStats) (int64, error) {
+	type candidate struct {
+		tier *rollupTier // Nil for raw samples.
+		end  time.Time
+	}
+	candidates := make([]candidate, 0, len(rollupTiers)+1)
+
+	stg.mutex.RLock()
+	for _, tier := range append([]*rollupTier{nil}, rollupTiers...) {
+		table, step := "metric_values", 0
+		if tier != nil {
+			table, step = tier.table, tier.step
+		}
+		var oldest *time.Time
+		//nolint:gosec
+		if err := stg.db.QueryRow(`SELECT min(timestamp) FROM ` + table).Scan(&oldest); err != nil {
+			stg.mutex.RUnlock()
+			return 0, fmt.Errorf("failed to query oldest row in '%s' table: %w", table, err)
+		}
+		if oldest != nil {
+			candidates = append(candidates, candidate{
+				tier: tier,
+				end:  oldest.Add(time.Duration(step) * time.Second),
+			})
+		}
+	}
+	stg.mutex.RUnlock()
+
+	// Try candidates from the oldest to the newest, until some rows are
+	// deleted (i.e., all but the newest ones may have been deleted already).
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].end.Before(candidates[j].end)
+	})
+	for _, candidate := range candidates {
+		var n int64
+		var err error
+		if candidate.tier == nil {
+			n, err = stg.deleteOldestRows(time.Time{}, stats)
+		} else {
+			n, err = stg.deleteOldestRollups(candidate.tier, time.Time{}, stats)
+		}
+		if err != nil || n > 0 {
+			return n, err
+		}
+	}
+	return 0, nil
+}
+
+// Deletes metrics without samples (raw or rolled up), both from the database
+// and the cache.
+func (stg *Storage) pruneMetrics(stats *RetentionStats) error {
+	// Look for candidates first, using a read lock. That's the expensive
+	// part.
+	stg.mutex.RLock()
+	ids, err := stg.unsafeGetUnusedMetrics("")
+	stg.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	// Samples of the candidates could be concurrently inserted using the
+	// cached IDs, so the write lock is required to actually delete them. Only
+	// the candidates are checked again, which is cheap. Beware of locking
+	// order.
+	stg.mutex.Lock()
+	defer stg.mutex.Unlock()
+	stg.cache.mutex.Lock()
+	defer stg.cache.mutex.Unlock()
+
+	ids, err = stg.unsafeGetUnusedMetrics(joinIDs(ids))
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	//nolint:gosec
+	if _, err := stg.db.Exec(`DELETE FROM metrics WHERE id IN (` + joinIDs(ids) + `)`); err != nil {
+		return fmt.Errorf("failed to delete from 'metrics' table: %w", err)
+	}
+	for _, id := range ids {
+		if metric := stg.cache.metricsByID[id]; metric != nil {
+			delete(stg.cache.metricsByName, metric.Name)
+			delete(stg.cache.metricsByID, id)
+		}
+		stats.PrunedMetrics++
+	}
+
+	return nil
+}
+
+// Returns the IDs of metrics without samples (raw or rolled up). If 'ids' is
+// not empty (i.e., a comma-separated list of IDs, see 'joinIDs'), only those
+// metrics are checked.
+func (stg *Storage) unsafeGetUnusedMetrics(ids string) ([]int, error) {
+	metricsFilter, samplesFilter := "TRUE", "TRUE"
+	if ids != "" {
+		metricsFilter = "id IN (" + ids + ")"
+		samplesFilter = "metric_id IN (" + ids + ")"
+	}
+	conditions := []string{metricsFilter}
+	for _, table := range []string{"metric_values", "counter_values", "metric_rollups_1m", "metric_rollups_1h"} {
+		conditions = append(conditions, fmt.Sprintf(
+			"id NOT IN (SELECT DISTINCT metric_id FROM %s WHERE %s)", table, samplesFilter))
+	}
+
+	//nolint:gosec
+	rows, err := stg.db.Query(`
+		SELECT id
+		FROM metrics
+		WHERE ` + strings.Join(conditions, " AND "))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query unused metrics in 'metrics' table: %w", err)
+	}
+	defer rows.Close()
+
+	result := make([]int, 0)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan 'metrics' row: %w", err)
+		}
+		result = append(result, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate over 'metrics' rows: %w", err)
+	}
+
+	return result, nil
+}
+
+// Updates the cached instances and earliest & latest timestamps after
+// deleting samples.
+func (stg *Storage) refreshCache() error {
+	stg.mutex.RLock()
+	defer stg.mutex.RUnlock()
+
+	earliest, _, err := stg.unsafeGetEarliestAndLatest()
+	if err != nil {
+		return err
+	}
+
+	rows, err := stg.db.Query(`
+		SELECT instance FROM metric_values
+		UNION
+		SELECT instance FROM metric_rollups_1m
+		UNION
+		SELECT instance FROM metric_rollups_1h`)
+	if err != nil {
+		return fmt.Errorf("failed to query instances in 'metric_values' & rollup tables: %w", err)
+	}
+	defer rows.Close()
+	instances := make(map[string]bool)
+	for rows.Next() {
+		var instance string
+		if err := rows.Scan(&instance); err != nil {
+			return fmt.Errorf("failed to scan instance row: %w", err)
+		}
+		instances[instance] = true
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to iterate over instance rows: %w", err)
+	}
+
+	// Samples may have been inserted in the meantime, so the cache is only
+	// updated to remove stale values. Beware of locking order: 'stg.mutex' was
+	// locked before 'stg.cache.mutex'.
+	stg.cache.mutex.Lock()
+	defer stg.cache.mutex.Unlock()
+	if earliest == nil {
+		for instance := range stg.cache.instances {
+			delete(stg.cache.instances, instance)
+		}
+		stg.cache.earliest = time.Time{}
+		stg.cache.latest = time.Time{}
+		return nil
+	}
+	for instance := range stg.cache.instances {
+		if !instances[instance] {
+			delete(stg.cache.instances, instance)
+		}
+	}
+	if stg.cache.earliest.Before(*earliest) {
+		stg.cache.earliest = *earliest
+	}
+
+	return nil
+}
+
+// Returns the space, in bytes, used by the data in the database (i.e.,
+// excluding free blocks, which are reused).
+func (stg *Storage) getUsedSize() (int64, error) {
+	stg.mutex.RLock()
+	defer stg.mutex.RUnlock()
+
+	var blockSize, usedBlocks int64
+	if err := stg.db.QueryRow(`
+		SELECT block_size, used_blocks
+		FROM pragma_database_size()
+		LIMIT 1`).Scan(&blockSize, &usedBlocks); err != nil {
+		return 0, fmt.Errorf("failed to query 'database_size': %w", err)
+	}
+	return blockSize * usedBlocks, nil
+}
+
+func (stg *Storage) checkpoint(ctx context.Context, stats *RetentionStats) error {
+	var err error
+	for range retentionCheckpointAttempts {
+		stg.mutex.RLock()
+		_, err = stg.db.Exec(`CHECKPOINT`)
+		stg.mutex.RUnlock()
+		if err == nil {
+			stats.Checkpoints++
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(retentionCheckpointPause):
+		}
+	}
+	return fmt.Errorf("failed to checkpoint database: %w", err)
+}
+
+// Returns a comma-separated list of the given metric IDs, to be inlined in
+// queries.
+func joinIDs(ids []int) string {
+	items := make([]string, 0, len(ids))
+	for _, id := range ids {
+		items = append(items, strconv.Itoa(id))
+	}
+	return strings.Join(items, ",")
+}
@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type RetentionTestSuite struct {
+	suite.Suite
+}
+
+func (suite *RetentionTestSuite) newStorage(settings ...interface{}) *Storage {
+	return newTestStorage(
+		suite.T(),
+		append([]interface{}{"db.retention.batch-size", 1000}, settings...)...)
+}
+
+// Pushes a scrape of 'n' gauges named after the given prefix.
+func (suite *RetentionTestSuite) push(
+	stg *Storage, instance string, timestamp time.Time, prefix string, n int) {
+	samples := make([]*MetricSample, 0, n)
+	for i := range n {
+		samples = append(samples, &MetricSample{
+			Name:        fmt.Sprintf("%s.%d", prefix, i),
+			Flag:        "g",
+			Format:      "i",
+			Description: "Foo",
+			Value:       uint64(i),
+		})
+	}
+	suite.Require().NoError(stg.PushMetricSamples(instance, timestamp, samples))
+	suite.Require().NoError(stg.PushScrape(&Scrape{
+		Instance:  instance,
+		Timestamp: timestamp,
+		Outcome:   ScrapeOutcomeOK,
+		Metrics:   n,
+	}))
+}
+
+func (suite *RetentionTestSuite) count(stg *Storage, table string) int {
+	var result int
+	suite.Require().NoError(stg.db.QueryRow(`SELECT COUNT(*) FROM ` + table).Scan(&result))
+	return result
+}
+
+func (suite *RetentionTestSuite) TestMaxAge() {
+	assert := suite.Require()
+
+	// Hourly rollups are kept for a shorter time, so the ones of old samples
+	// are deleted regardless of the alignment of buckets.
+	stg := suite.newStorage(
+		"db.file", "",
+		"db.retention.max-age", "1h",
+		"db.retention.max-age-1h", "30m")
+
+	// Old samples of an instance and of metrics that are not scraped anymore,
+	// spanning several batches, and recent samples.
+	now := time.Now().Truncate(time.Second)
+	for i := range 3 {
+		suite.push(stg, "foo", now.Add(-3*time.Hour+time.Duration(i)*time.Minute), "old", 1500)
+	}
+	suite.push(stg, "bar", now.Add(-2*time.Hour), "new", 10)
+	suite.push(stg, "bar", now.Add(-time.Minute), "new", 10)
+	suite.push(stg, "bar", now, "new", 10)
+	assert.Len(stg.cache.metricsByName, 1510)
+
+	stats, err := stg.EnforceRetention(context.Background())
+	assert.NoError(err)
+	assert.Equal(int64(4510), stats.DeletedRows["metric_values"])
+	assert.Equal(int64(4), stats.DeletedRows["scrapes"])
+	assert.Equal(1500, stats.PrunedMetrics)
+	assert.Positive(stats.Checkpoints)
+
+	assert.Equal(20, suite.count(stg, "metric_values"))
+	assert.Equal(2, suite.count(stg, "scrapes"))
+	assert.Equal(10, suite.count(stg, "metrics"))
+	assert.Len(stg.cache.metricsByName, 10)
+	assert.Len(stg.cache.metricsByID, 10)
+	assert.Equal([]string{"bar"}, stg.Instances())
+	assert.True(now.Add(-time.Minute).Truncate(time.Hour).Equal(stg.Earliest()))
+	assert.True(now.Equal(stg.Latest()))
+
+	// Pruned metrics are registered again if scraped.
+	suite.push(stg, "foo", now.Add(time.Second), "old", 1)
+	assert.Len(stg.cache.metricsByName, 11)
+	assert.Equal(11, suite.count(stg, "metrics"))
+
+	// Nothing else to do.
+	stats, err = stg.EnforceRetention(context.Background())
+	assert.NoError(err)
+	assert.Equal(int64(0), stats.DeletedRows["metric_values"])
+	assert.Equal(0, stats.PrunedMetrics)
+
+	assert.Len(stg.app.Cfg().Log().Buffer().Events(), 0)
+}
+
+func (suite *RetentionTestSuite) TestMaxSize() {
+	assert := suite.Require()
+
+	stg := suite.newStorage(
+		"db.file", filepath.Join(suite.T().TempDir(), "varnishmon.db"),
+		"db.retention.max-size", 9)
+	defer stg.Shutdown() //nolint:errcheck
+
+	start := time.Now().Truncate(time.Hour).Add(-2 * time.Hour)
+	for i := range 20 {
+		suite.push(stg, "foo", start.Add(time.Duration(i)*5*time.Minute), "foo", 3000)
+	}
+	_, err := stg.db.Exec(`CHECKPOINT`)
+	assert.NoError(err)
+	size, err := stg.getUsedSize()
+	assert.NoError(err)
+	assert.Greater(size, int64(9*1024*1024))
+
+	// The oldest data is deleted first: raw samples and 1m rollups of the
+	// first scrapes, but not the 1h rollups summarizing them.
+	stats, err := stg.EnforceRetention(context.Background())
+	assert.NoError(err)
+	assert.Positive(stats.DeletedRows["metric_values"])
+	assert.Equal(stats.DeletedRows["metric_values"], stats.DeletedRows["metric_rollups_1m"])
+	assert.Equal(int64(0), stats.DeletedRows["metric_rollups_1h"])
+	assert.Equal(0, stats.PrunedMetrics)
+
+	size, err = stg.getUsedSize()
+	assert.NoError(err)
+	assert.LessOrEqual(size, int64(9*1024*1024))
+	assert.Equal(6000, suite.count(stg, "metric_rollups_1h"))
+	assert.True(start.Equal(stg.Earliest()))
+	assert.True(start.Add(95 * time.Minute).Equal(stg.Latest()))
+
+	assert.Len(stg.app.Cfg().Log().Buffer().Events(), 0)
+}
+
+func (suite *RetentionTestSuite) TestRollupsMaxAge() {
+	assert := suite.Require()
+
+	// Hourly rollups are kept forever.
+	stg := suite.newStorage(
+		"db.file", "",
+		"db.retention.max-age", "1h",
+		"db.retention.max-age-1h", "0")
+
+	now := time.Now().Truncate(time.Second)
+	suite.push(stg, "foo", now.Add(-48*time.Hour), "old", 10)
+	suite.push(stg, "foo", now, "new", 10)
+
+	stats, err := stg.EnforceRetention(context.Background())
+	assert.NoError(err)
+	assert.Equal(int64(10), stats.DeletedRows["metric_values"])
+	assert.Equal(int64(10), stats.DeletedRows["metric_rollups_1m"])
+	assert.Equal(int64(0), stats.DeletedRows["metric_rollups_1h"])
+	assert.Equal(0, stats.PrunedMetrics)
+	assert.True(stg.Earliest().Before(now.Add(-47 * time.Hour)))
+
+	// Old samples are still available using hourly steps.
+	id := stg.cache.metricsByName["old.5"].ID
+	metric, err := stg.GetMetric(
+		id, now.Add(-49*time.Hour), now, 3600, "max", FillNone, "")
+	assert.NoError(err)
+	assert.Equal([][2]interface{}{
+		{now.Add(-48 * time.Hour).Truncate(time.Hour).Unix(), uint64(5)},
+	}, metric["samples"])
+	metric, err = stg.GetMetric(
+		id, now.Add(-49*time.Hour), now, 60, "max", FillNone, "")
+	assert.NoError(err)
+	assert.Empty(metric["samples"])
+
+	assert.Len(stg.app.Cfg().Log().Buffer().Events(), 0)
+}
+
+func TestRetentionTestSuite(t *testing.T) {
+	suite.Run(t, &RetentionTestSuite{})
+}
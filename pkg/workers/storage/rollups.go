@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/allenta/varnishmon/pkg/config"
+)
+
+// Rollups summarize samples in the 'metric_values' table per metric, instance
+// and fixed time bucket (min, max, sum, count and last value), so metrics can
+// be navigated over long time periods without aggregating raw samples. They're
+// populated as samples are stored, and they're subject to their own retention
+// (see 'db.retention.max-age-*'). Values are stored as 'DOUBLE', so 'uint64'
+// values beyond 2^53 lose some precision once rolled up.
+type rollupTier struct {
+	table string
+	// Width of the buckets, in seconds.
+	step int
+	// Maximum age of rolled up samples. Zero if unlimited.
+	maxAge func(cfg *config.Config) time.Duration
+}
+
+// Rollup tiers, sorted by bucket width.
+var rollupTiers = []*rollupTier{ //nolint:gochecknoglobals
+	{table: "metric_rollups_1m", step: 60, maxAge: (*config.Config).DBRetentionMaxAge1m},
+	{table: "metric_rollups_1h", step: 3600, maxAge: (*config.Config).DBRetentionMaxAge1h},
+}
+
+// Returns the coarsest rollup tier whose buckets evenly divide the given
+// 'step', or nil if raw samples are required.
+func getRollupTier(step int) *rollupTier {
+	var result *rollupTier
+	for _, tier := range rollupTiers {
+		if step%tier.step == 0 {
+			result = tier
+		}
+	}
+	return result
+}
+
+// Checks if samples of the metric can be aggregated from rolled up values
+// using the given aggregator. That excludes 'first' (not stored), bitwise
+// aggregators and bitmaps in general (not representable as 'DOUBLE').
+func isRollupAggregator(metric *CachedMetric, aggregator string) bool {
+	if metric.Flag == "b" || metric.Format == "b" {
+		return false
+	}
+	_, ok := rollupAggregates[aggregator]
+	return ok
+}
+
+// Aggregators computable from rolled up values, and the corresponding
+// expressions.
+var rollupAggregates = map[string]string{ //nolint:gochecknoglobals
+	"min":   "min(min)",
+	"max":   "max(max)",
+	"avg":   "sum(sum) / sum(count)",
+	"last":  "arg_max(last, last_timestamp)",
+	"count": "sum(count)::BIGINT",
+}
+
+// Returns the expression aggregating rolled up values using the given
+// aggregator. Values are cast back to the class of the metric, so results
+// match the ones aggregating raw samples.
+func getRollupAggregate(metric *CachedMetric, aggregator string) string {
+	result := rollupAggregates[aggregator]
+	if metric.Class == "uint64" {
+		switch aggregator {
+		case "min", "max", "last":
+			result += "::UBIGINT"
+		}
+	}
+	return result
+}
+
+// Adds the samples in the 'staged_metric_values' temporary table to all
+// rollup tiers, using the given connection (i.e., inside its transaction).
+// Samples may arrive out of order (e.g., when replaying spooled batches), so
+// the last value of each bucket is decided using its timestamp.
+func pushRollups(ctx context.Context, conn *sql.Conn) error {
+	for _, tier := range rollupTiers {
+		//nolint:gosec
+		if _, err := conn.ExecContext(ctx, fmt.Sprintf(`
+			INSERT INTO %s (metric_id, instance, timestamp, min, max, sum, count, last, last_timestamp)
+			SELECT
+				metric_id,
+				instance,
+				time_bucket(INTERVAL '%ds', timestamp),
+				min(value),
+				max(value),
+				sum(value),
+				count(*),
+				arg_max(value, timestamp),
+				max(timestamp)
+			FROM (
+				SELECT metric_id, instance, timestamp, coalesce(float64, uint64::DOUBLE) AS value
+				FROM staged_metric_values
+			)
+			GROUP BY metric_id, instance, time_bucket(INTERVAL '%ds', timestamp)
+			ON CONFLICT (metric_id, instance, timestamp) DO UPDATE SET
+				min = least(min, excluded.min),
+				max = greatest(max, excluded.max),
+				sum = sum + excluded.sum,
+				count = count + excluded.count,
+				last = CASE WHEN excluded.last_timestamp >= last_timestamp THEN excluded.last ELSE last END,
+				last_timestamp = greatest(last_timestamp, excluded.last_timestamp)`,
+			tier.table, tier.step, tier.step)); err != nil {
+			return fmt.Errorf("failed to insert / update into '%s' table: %w", tier.table, err)
+		}
+	}
+	return nil
+}
+
+// Returns the scraping period of a metric, as in 'unsafeGetRawMetricPeriod', but
+// estimated using rolled up values: the interval between consecutive buckets
+// of an instance divided by the number of samples in the first one.
+func (stg *Storage) unsafeGetRolledUpMetricPeriod(
+	metric *CachedMetric, tier *rollupTier, from, to time.Time, instance string) (*float64, error) {
+	var period *float64
+	//nolint:gosec
+	if err := stg.db.QueryRow(`
+		SELECT mode(interval)
+		FROM (
+			SELECT round((epoch(timestamp) - epoch(lag(timestamp) OVER w)) / lag(count) OVER w) AS interval
+			FROM `+tier.table+`
+			WHERE
+				metric_id = $1 AND
+				timestamp >= $2 AND
+				timestamp < $3 AND
+				($4 = '' OR instance = $4)
+			WINDOW w AS (PARTITION BY instance ORDER BY timestamp)
+		)
+		WHERE interval > 0`, metric.ID, from, to, instance).Scan(&period); err != nil {
+		return nil, fmt.Errorf("failed to query '%s' table: %w", tier.table, err)
+	}
+	return period, nil
+}
+
+// Returns the earliest and latest timestamps in the 'metric_values' table and
+// rollup tiers (i.e., including periods with rolled up samples only), or nil
+// if there are no samples at all.
+func (stg *Storage) unsafeGetEarliestAndLatest() (*time.Time, *time.Time, error) {
+	var earliest, latest *time.Time
+	if err := stg.db.QueryRow(`
+		SELECT min(earliest), max(latest)
+		FROM (
+			SELECT min(timestamp) AS earliest, max(timestamp) AS latest
+			FROM metric_values
+			UNION ALL
+			SELECT min(timestamp), max(last_timestamp)
+			FROM metric_rollups_1m
+			UNION ALL
+			SELECT min(timestamp), max(last_timestamp)
+			FROM metric_rollups_1h
+		)`).Scan(&earliest, &latest); err != nil {
+		return nil, nil, fmt.Errorf("failed to query 'metric_values' & rollup tables: %w", err)
+	}
+	return earliest, latest, nil
+}
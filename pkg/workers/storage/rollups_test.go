@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type RollupsTestSuite struct {
+	suite.Suite
+	stg *Storage
+}
+
+func (suite *RollupsTestSuite) BeforeTest(suiteName, testName string) {
+	suite.stg = newTestStorage(suite.T())
+}
+
+func (suite *RollupsTestSuite) push(instance string, timestamp time.Time, gauge uint64, rate float64) {
+	suite.Require().NoError(suite.stg.PushMetricSamples(instance, timestamp, []*MetricSample{
+		{
+			Name:        "MAIN.n_backend",
+			Flag:        "g",
+			Format:      "i",
+			Description: "Number of backends",
+			Value:       gauge,
+		},
+		{
+			Name:        "MAIN.client_req",
+			Flag:        "c",
+			Format:      "i",
+			Description: "Good client requests received",
+			Value:       rate,
+		},
+	}))
+}
+
+func (suite *RollupsTestSuite) TestGetRollupTier() {
+	assert := suite.Require()
+
+	assert.Nil(getRollupTier(1))
+	assert.Nil(getRollupTier(90))
+	assert.Equal("metric_rollups_1m", getRollupTier(60).table)
+	assert.Equal("metric_rollups_1m", getRollupTier(1800).table)
+	assert.Equal("metric_rollups_1h", getRollupTier(3600).table)
+	assert.Equal("metric_rollups_1h", getRollupTier(86400).table)
+
+	gauge := &CachedMetric{Flag: "g", Format: "i", Class: "uint64"}
+	bitmap := &CachedMetric{Flag: "b", Format: "b", Class: "uint64"}
+	assert.True(isRollupAggregator(gauge, "avg"))
+	assert.False(isRollupAggregator(gauge, "first"))
+	assert.False(isRollupAggregator(bitmap, "last"))
+}
+
+func (suite *RollupsTestSuite) TestPushRollups() {
+	assert := suite.Require()
+
+	// Samples of two instances, some of them out of order.
+	start := time.Date(2025, time.January, 1, 13, 0, 0, 0, time.UTC)
+	suite.push("foo", start.Add(10*time.Second), 5, 0.5)
+	suite.push("foo", start.Add(50*time.Second), 3, 1.5)
+	suite.push("foo", start.Add(30*time.Second), 9, 1)
+	suite.push("foo", start.Add(70*time.Second), 1, 2)
+	suite.push("bar", start.Add(10*time.Second), 100, 10)
+
+	type rollup struct {
+		instance string
+		min      float64
+		max      float64
+		sum      float64
+		count    uint64
+		last     float64
+	}
+	query := func(table string) []rollup {
+		rows, err := suite.stg.db.Query(`
+			SELECT instance, min, max, sum, count, last
+			FROM `+table+`
+			WHERE metric_id = $1
+			ORDER BY instance DESC, timestamp`,
+			suite.stg.cache.metricsByName["MAIN.n_backend"].ID)
+		assert.NoError(err)
+		defer rows.Close()
+		result := make([]rollup, 0)
+		for rows.Next() {
+			var r rollup
+			assert.NoError(rows.Scan(&r.instance, &r.min, &r.max, &r.sum, &r.count, &r.last))
+			result = append(result, r)
+		}
+		assert.NoError(rows.Err())
+		return result
+	}
+
+	assert.Equal([]rollup{
+		{"foo", 3, 9, 17, 3, 3},
+		{"foo", 1, 1, 1, 1, 1},
+		{"bar", 100, 100, 100, 1, 100},
+	}, query("metric_rollups_1m"))
+	assert.Equal([]rollup{
+		{"foo", 1, 9, 18, 4, 1},
+		{"bar", 100, 100, 100, 1, 100},
+	}, query("metric_rollups_1h"))
+
+	assert.Len(suite.stg.app.Cfg().Log().Buffer().Events(), 0)
+}
+
+func (suite *RollupsTestSuite) TestGetMetricUsingRollups() {
+	assert := suite.Require()
+
+	// Two instances scraped every 15 seconds for three hours, with a gap.
+	start := time.Date(2025, time.January, 1, 13, 0, 0, 0, time.UTC)
+	for i := range 3 * 60 * 4 {
+		if i >= 200 && i < 300 {
+			continue
+		}
+		timestamp := start.Add(time.Duration(i) * 15 * time.Second)
+		suite.push("foo", timestamp, uint64(i%17), float64(i%7)/2)
+		suite.push("bar", timestamp, uint64(i%5), float64(i%3))
+	}
+
+	// Rolled up values give the same results as raw samples.
+	for _, metric := range []string{"MAIN.n_backend", "MAIN.client_req"} {
+		cachedMetric := suite.stg.cache.metricsByName[metric]
+		for _, step := range []int{60, 300, 3600} {
+			for _, aggregator := range []string{"min", "max", "avg", "last", "count"} {
+				for _, instance := range []string{"", "foo"} {
+					// The last value of several instances scraped at the same
+					// time is undefined.
+					if aggregator == "last" && instance == "" {
+						continue
+					}
+
+					tier := getRollupTier(step)
+					assert.NotNil(tier)
+
+					suite.stg.mutex.RLock()
+					expected, err := suite.stg.unsafeGetAggregatedSamples(
+						cachedMetric, nil, start, start.Add(3*time.Hour), step, aggregator, instance)
+					assert.NoError(err)
+					samples, err := suite.stg.unsafeGetAggregatedSamples(
+						cachedMetric, tier, start, start.Add(3*time.Hour), step, aggregator, instance)
+					assert.NoError(err)
+					period := suite.stg.unsafeGetMetricPeriod(
+						cachedMetric, tier, start, start.Add(3*time.Hour), instance)
+					suite.stg.mutex.RUnlock()
+
+					assert.Len(samples, len(expected))
+					for i := range expected {
+						assert.Equal(expected[i][0], samples[i][0])
+						assert.InDelta(expected[i][1], samples[i][1], 1e-9,
+							"metric=%s step=%d aggregator=%s instance=%q", metric, step, aggregator, instance)
+						assert.IsType(expected[i][1], samples[i][1])
+					}
+					// Too few hourly buckets, one of them with a gap, to
+					// reliably estimate the period.
+					if tier.step < 3600 {
+						assert.Equal(15, period)
+					}
+				}
+			}
+		}
+	}
+
+	// Gaps are detected using the estimated period.
+	id := suite.stg.cache.metricsByName["MAIN.n_backend"].ID
+	metric, err := suite.stg.GetMetric(id, start, start.Add(3*time.Hour), 300, "max", FillNone, "foo")
+	assert.NoError(err)
+	assert.Equal([][2]int64{{start.Unix() + 3000, start.Unix() + 4500}}, metric["gaps"])
+
+	assert.Len(suite.stg.app.Cfg().Log().Buffer().Events(), 0)
+}
+
+func TestRollupsTestSuite(t *testing.T) {
+	suite.Run(t, &RollupsTestSuite{})
+}
@@ -0,0 +1,434 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/allenta/varnishmon/pkg/helpers"
+)
+
+const (
+	// Layout of the timestamps in the names of archived database files.
+	archiveTimeLayout = "20060102T150405Z"
+
+	// Maximum number of archives kept open at once (see 'AcquireArchive').
+	maxOpenArchives = 4
+)
+
+var (
+	ErrUnknownArchive = errors.New("unknown archive")
+)
+
+// Archive describes a database file archived by 'Rotate', as listed in the
+// catalog.
+type Archive struct {
+	// Name of the file, relative to the directory of 'db.file'. Compressed
+	// files have a '.gz' suffix.
+	File     string    `json:"file"`
+	Hostname string    `json:"hostname"`
+	Earliest time.Time `json:"earliest"`
+	Latest   time.Time `json:"latest"`
+	Metrics  int       `json:"metrics"`
+	// Size of the file, in bytes.
+	Size int64 `json:"size"`
+}
+
+type RotationStats struct {
+	// Nil if the database was empty, so nothing was archived.
+	Archive *Archive
+	// Archives deleted to honor 'db.rotation.keep'.
+	DeletedArchives int
+}
+
+type archives struct {
+	// Serializes updates of the catalog.
+	catalogMutex sync.Mutex
+
+	mutex sync.Mutex
+	// Archives opened on demand, indexed by file name.
+	open map[string]*openArchive
+}
+
+type openArchive struct {
+	storage  *Storage
+	refs     int
+	lastUsed time.Time
+	// Decompressed copy of the archive, removed once closed. Empty if the
+	// archive is not compressed.
+	copy string
+	// Deleted from the catalog while in use. The archived database file is
+	// removed once closed.
+	deleted bool
+}
+
+func newArchives() *archives {
+	return &archives{
+		open: make(map[string]*openArchive),
+	}
+}
+
+// Checks if the database file should be rotated, according to the
+// 'db.rotation.*' settings: when it holds data older than the latest multiple
+// of 'db.rotation.interval' (i.e., aligned to UTC), or when it's larger than
+// 'db.rotation.size' MiB.
+func (stg *Storage) RotationDue(now time.Time) bool {
+	earliest := stg.Earliest()
+	if stg.file == "" || earliest.IsZero() {
+		return false
+	}
+
+	if interval := stg.app.Cfg().DBRotationInterval(); interval > 0 {
+		if now.Truncate(interval).After(earliest) {
+			return true
+		}
+	}
+
+	if size := stg.app.Cfg().DBRotationSize(); size > 0 {
+		if info, err := os.Stat(stg.file); err == nil && info.Size() > int64(size)*1024*1024 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Rotate archives the database file, naming it after the time range of its
+// data (e.g., 'varnishmon-20250101T000000Z-20250102T000000Z.db'), and
+// continues with an empty one, as when reopening the database on SIGHUP. The
+// archive is then compressed (if 'db.rotation.compress' is enabled) and added
+// to the catalog, and the oldest archives beyond 'db.rotation.keep' are
+// deleted. Nothing is archived if the database is empty.
+func (stg *Storage) Rotate() (*RotationStats, error) {
+	stats := &RotationStats{}
+	if stg.file == "" {
+		return stats, nil
+	}
+
+	archive, err := stg.rotateDB()
+	if err != nil || archive == nil {
+		return stats, err
+	}
+	stats.Archive = archive
+
+	// Compress the archive. The database is not blocked meanwhile, and the
+	// archive is not listed in the catalog until it's done.
+	file := filepath.Join(filepath.Dir(stg.file), archive.File)
+	if stg.app.Cfg().DBRotationCompress() {
+		if err := helpers.CompressFile(file, file+".gz"); err != nil {
+			os.Remove(file + ".gz")
+			stg.app.Cfg().Log().Error().
+				Err(err).
+				Str("file", file).
+				Msg("Failed to compress archived database!")
+		} else {
+			os.Remove(file)
+			archive.File += ".gz"
+			file += ".gz"
+		}
+	}
+	if info, err := os.Stat(file); err == nil {
+		archive.Size = info.Size()
+	}
+
+	// Update the catalog.
+	stg.archives.catalogMutex.Lock()
+	defer stg.archives.catalogMutex.Unlock()
+
+	catalog, err := stg.readCatalog()
+	if err != nil {
+		return stats, err
+	}
+	catalog = append(catalog, archive)
+	sort.SliceStable(catalog, func(i, j int) bool {
+		return catalog[i].Earliest.Before(catalog[j].Earliest)
+	})
+	if keep := stg.app.Cfg().DBRotationKeep(); keep > 0 {
+		for len(catalog) > keep {
+			stg.deleteArchive(catalog[0].File)
+			catalog = catalog[1:]
+			stats.DeletedArchives++
+		}
+	}
+	if err := stg.writeCatalog(catalog); err != nil {
+		return stats, err
+	}
+
+	return stats, nil
+}
+
+// Moves the database file away and opens an empty one, returning the
+// description of the archive, or nil if the database is empty.
+func (stg *Storage) rotateDB() (*Archive, error) {
+	// Write lock the db and cache mutexes. Beware of locking order.
+	stg.mutex.Lock()
+	defer stg.mutex.Unlock()
+	stg.cache.mutex.Lock()
+	defer stg.cache.mutex.Unlock()
+
+	if stg.cache.earliest.IsZero() {
+		return nil, nil
+	}
+
+	extension := filepath.Ext(stg.file)
+	archive := &Archive{
+		File: fmt.Sprintf("%s-%s-%s%s",
+			strings.TrimSuffix(filepath.Base(stg.file), extension),
+			stg.cache.earliest.UTC().Format(archiveTimeLayout),
+			stg.cache.latest.UTC().Format(archiveTimeLayout),
+			extension),
+		Hostname: stg.cache.hostname,
+		Earliest: stg.cache.earliest,
+		Latest:   stg.cache.latest,
+		Metrics:  len(stg.cache.metricsByID),
+	}
+	destination := filepath.Join(filepath.Dir(stg.file), archive.File)
+	if _, err := os.Stat(destination); err == nil {
+		return nil, fmt.Errorf("failed to archive database: '%s' already exists", destination)
+	}
+
+	// Make sure the WAL is merged into the database file before moving it.
+	if _, err := stg.db.Exec(`CHECKPOINT`); err != nil {
+		return nil, fmt.Errorf("failed to checkpoint database: %w", err)
+	}
+
+	// As when reopening the database on SIGHUP, failing to open the new one
+	// is fatal.
+	counters := stg.unsafeClose()
+	renameErr := os.Rename(stg.file, destination)
+	if err := stg.unsafeOpen(counters); err != nil {
+		stg.app.Cfg().Log().Fatal().
+			Err(err).
+			Str("file", stg.file).
+			Msg("Failed to initialize database & cache!")
+	}
+	if renameErr != nil {
+		return nil, fmt.Errorf("failed to archive database: %w", renameErr)
+	}
+
+	return archive, nil
+}
+
+// Archives returns the catalog of archived database files, sorted by their
+// earliest timestamp.
+func (stg *Storage) Archives() ([]*Archive, error) {
+	if stg.archives == nil || stg.file == "" {
+		return []*Archive{}, nil
+	}
+
+	stg.archives.catalogMutex.Lock()
+	defer stg.archives.catalogMutex.Unlock()
+	return stg.readCatalog()
+}
+
+// AcquireArchive returns the storage of an archived database file listed in
+// the catalog, opening it if needed. Compressed archives are decompressed
+// into a temporary copy first. The returned function must be called once the
+// storage is not needed anymore. Up to 'maxOpenArchives' unused archives are
+// kept open, closing the least recently used ones.
+func (stg *Storage) AcquireArchive(name string) (*Storage, func(), error) {
+	catalog, err := stg.Archives()
+	if err != nil {
+		return nil, nil, err
+	}
+	found := false
+	for _, archive := range catalog {
+		if archive.File == name {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, nil, fmt.Errorf("%w: %s", ErrUnknownArchive, name)
+	}
+
+	// Archives are opened while holding the mutex. That may take a while, but
+	// it's simpler and it avoids opening the same archive twice.
+	stg.archives.mutex.Lock()
+	defer stg.archives.mutex.Unlock()
+
+	entry := stg.archives.open[name]
+	if entry == nil {
+		if entry, err = stg.openArchive(name); err != nil {
+			return nil, nil, err
+		}
+		stg.archives.open[name] = entry
+	}
+	entry.refs++
+	entry.lastUsed = time.Now()
+	stg.unsafeEvictArchives()
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			stg.archives.mutex.Lock()
+			defer stg.archives.mutex.Unlock()
+			entry.refs--
+			if entry.deleted && entry.refs == 0 {
+				stg.unsafeCloseArchive(name)
+			}
+			stg.unsafeEvictArchives()
+		})
+	}
+	return entry.storage, release, nil
+}
+
+func (stg *Storage) openArchive(name string) (*openArchive, error) {
+	archive := &Storage{
+		app:           stg.app,
+		file:          filepath.Join(filepath.Dir(stg.file), name),
+		readOnly:      true,
+		tempDirectory: filepath.Join(stg.archivesDirectory(), name+".tmp"),
+	}
+	entry := &openArchive{
+		storage: archive,
+	}
+
+	// Decompressed copies are disposable, so they're opened in read-write mode,
+	// migrating their schema if needed.
+	if strings.HasSuffix(name, ".gz") {
+		if err := os.MkdirAll(stg.archivesDirectory(), 0750); err != nil {
+			return nil, fmt.Errorf("failed to create directory: %w", err)
+		}
+		entry.copy = filepath.Join(stg.archivesDirectory(), strings.TrimSuffix(name, ".gz"))
+		if _, err := helpers.DecompressFile(archive.file, entry.copy); err != nil {
+			os.Remove(entry.copy)
+			return nil, fmt.Errorf("failed to decompress archive: %w", err)
+		}
+		archive.file = entry.copy
+		archive.readOnly = false
+	}
+
+	archive.mutex.Lock()
+	defer archive.mutex.Unlock()
+	archive.cache.mutex.Lock()
+	defer archive.cache.mutex.Unlock()
+
+	if err := archive.unsafeOpen(nil); err != nil {
+		if archive.db != nil {
+			archive.db.Close()
+		}
+		if entry.copy != "" {
+			os.Remove(entry.copy)
+		}
+		return nil, fmt.Errorf("failed to open archive: %w", err)
+	}
+
+	return entry, nil
+}
+
+func (stg *Storage) unsafeEvictArchives() {
+	for len(stg.archives.open) > maxOpenArchives {
+		var oldest string
+		for name, entry := range stg.archives.open {
+			if entry.refs == 0 &&
+				(oldest == "" || entry.lastUsed.Before(stg.archives.open[oldest].lastUsed)) {
+				oldest = name
+			}
+		}
+		if oldest == "" {
+			return
+		}
+		stg.unsafeCloseArchive(oldest)
+	}
+}
+
+// Deletes an archived database file, closing it first if open. Archives still
+// in use are deleted once released.
+func (stg *Storage) deleteArchive(name string) {
+	stg.archives.mutex.Lock()
+	defer stg.archives.mutex.Unlock()
+	if entry := stg.archives.open[name]; entry != nil {
+		entry.deleted = true
+		if entry.refs == 0 {
+			stg.unsafeCloseArchive(name)
+		}
+		return
+	}
+	stg.unsafeRemoveArchive(name)
+}
+
+func (stg *Storage) closeArchives() {
+	stg.archives.mutex.Lock()
+	defer stg.archives.mutex.Unlock()
+	for name := range stg.archives.open {
+		stg.unsafeCloseArchive(name)
+	}
+	if stg.file != "" {
+		os.RemoveAll(stg.archivesDirectory())
+	}
+}
+
+func (stg *Storage) unsafeCloseArchive(name string) {
+	entry := stg.archives.open[name]
+	delete(stg.archives.open, name)
+	if err := entry.storage.Shutdown(); err != nil {
+		stg.app.Cfg().Log().Error().
+			Err(err).
+			Str("file", name).
+			Msg("Failed to close archive!")
+	}
+	if entry.copy != "" {
+		os.Remove(entry.copy)
+	}
+	if entry.deleted {
+		stg.unsafeRemoveArchive(name)
+	}
+}
+
+func (stg *Storage) unsafeRemoveArchive(name string) {
+	if err := os.Remove(filepath.Join(filepath.Dir(stg.file), name)); err != nil && !os.IsNotExist(err) {
+		stg.app.Cfg().Log().Error().
+			Err(err).
+			Str("file", name).
+			Msg("Failed to delete archived database!")
+	}
+}
+
+// Directory of temporary files used by archives (e.g., decompressed copies).
+func (stg *Storage) archivesDirectory() string {
+	return stg.file + ".archives.tmp"
+}
+
+// Name of the catalog file, stored next to the database file.
+func (stg *Storage) catalogFile() string {
+	return stg.file + ".catalog.json"
+}
+
+func (stg *Storage) readCatalog() ([]*Archive, error) {
+	catalog := make([]*Archive, 0)
+	data, err := os.ReadFile(stg.catalogFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return catalog, nil
+		}
+		return nil, fmt.Errorf("failed to read catalog: %w", err)
+	}
+	if err := json.Unmarshal(data, &catalog); err != nil {
+		return nil, fmt.Errorf("failed to parse catalog: %w", err)
+	}
+	return catalog, nil
+}
+
+func (stg *Storage) writeCatalog(catalog []*Archive) error {
+	data, err := json.MarshalIndent(catalog, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode catalog: %w", err)
+	}
+
+	// Write a temporary file first, so the catalog is replaced atomically.
+	tmp := stg.catalogFile() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0640); err != nil {
+		return fmt.Errorf("failed to write catalog: %w", err)
+	}
+	if err := os.Rename(tmp, stg.catalogFile()); err != nil {
+		return fmt.Errorf("failed to write catalog: %w", err)
+	}
+	return nil
+}
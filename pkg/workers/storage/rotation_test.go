@@ -0,0 +1,226 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/allenta/varnishmon/pkg/helpers"
+	"github.com/stretchr/testify/suite"
+)
+
+type RotationTestSuite struct {
+	suite.Suite
+	tmpDir string
+}
+
+func (suite *RotationTestSuite) BeforeTest(suiteName, testName string) {
+	suite.tmpDir = suite.T().TempDir()
+}
+
+func (suite *RotationTestSuite) newStorage(settings ...interface{}) *Storage {
+	return newTestStorage(
+		suite.T(),
+		append([]interface{}{
+			"db.file", filepath.Join(suite.tmpDir, "varnishmon.db"),
+			"db.rotation.interval", "24h",
+		}, settings...)...)
+}
+
+func (suite *RotationTestSuite) push(stg *Storage, instance string, timestamp time.Time) {
+	suite.Require().NoError(stg.PushMetricSamples(instance, timestamp, []*MetricSample{
+		{
+			Name:        "MAIN.n_backend",
+			Flag:        "g",
+			Format:      "i",
+			Description: "Number of backends",
+			Value:       uint64(3),
+		},
+		{
+			Name:        "MAIN.client_req",
+			Flag:        "c",
+			Format:      "i",
+			Description: "Good client requests received",
+			Value:       float64(1.5),
+		},
+	}))
+}
+
+func (suite *RotationTestSuite) TestRotationDue() {
+	assert := suite.Require()
+
+	stg := suite.newStorage("db.rotation.size", 1)
+	defer stg.Shutdown() //nolint:errcheck
+
+	day := time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)
+	assert.False(stg.RotationDue(day.Add(48 * time.Hour)))
+
+	// Rotated once the data spans beyond midnight.
+	suite.push(stg, "foo", day.Add(23*time.Hour))
+	assert.False(stg.RotationDue(day.Add(23*time.Hour + 59*time.Minute)))
+	assert.True(stg.RotationDue(day.Add(24*time.Hour + time.Minute)))
+
+	assert.Len(stg.app.Cfg().Log().Buffer().Events(), 0)
+}
+
+func (suite *RotationTestSuite) TestRotate() {
+	assert := suite.Require()
+
+	stg := suite.newStorage("db.rotation.keep", 2)
+	defer stg.Shutdown() //nolint:errcheck
+
+	// Nothing to rotate.
+	stats, err := stg.Rotate()
+	assert.NoError(err)
+	assert.Nil(stats.Archive)
+
+	// Archives are named after the time range of their data, and only the
+	// most recent ones are kept.
+	day := time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)
+	for i := range 3 {
+		start := day.Add(time.Duration(i) * 24 * time.Hour)
+		suite.push(stg, "foo", start)
+		suite.push(stg, "bar", start.Add(90*time.Second))
+
+		stats, err = stg.Rotate()
+		assert.NoError(err)
+		assert.NotNil(stats.Archive)
+		assert.Equal(i/2, stats.DeletedArchives)
+		assert.True(stg.Earliest().IsZero())
+		assert.Empty(stg.Instances())
+	}
+	assert.Equal("varnishmon-20250103T000000Z-20250103T000130Z.db", stats.Archive.File)
+
+	archives, err := stg.Archives()
+	assert.NoError(err)
+	assert.Len(archives, 2)
+	for i, archive := range archives {
+		start := day.Add(time.Duration(i+1) * 24 * time.Hour)
+		assert.True(start.Equal(archive.Earliest))
+		assert.True(start.Add(90 * time.Second).Equal(archive.Latest))
+		assert.Equal(2, archive.Metrics)
+		assert.Equal(stg.Hostname(), archive.Hostname)
+		info, err := os.Stat(filepath.Join(suite.tmpDir, archive.File))
+		assert.NoError(err)
+		assert.Equal(info.Size(), archive.Size)
+	}
+	_, err = os.Stat(filepath.Join(suite.tmpDir, "varnishmon-20250101T000000Z-20250101T000130Z.db"))
+	assert.True(os.IsNotExist(err))
+
+	// The current database is still usable.
+	suite.push(stg, "foo", day.Add(72*time.Hour))
+	assert.Equal([]string{"foo"}, stg.Instances())
+
+	assert.Len(stg.app.Cfg().Log().Buffer().Events(), 0)
+}
+
+func (suite *RotationTestSuite) TestAcquireArchive() {
+	assert := suite.Require()
+
+	stg := suite.newStorage("db.rotation.compress", true)
+
+	start := time.Date(2025, time.January, 1, 12, 0, 0, 0, time.UTC)
+	suite.push(stg, "foo", start)
+	suite.push(stg, "foo", start.Add(time.Minute))
+	stats, err := stg.Rotate()
+	assert.NoError(err)
+	assert.Equal("varnishmon-20250101T120000Z-20250101T120100Z.db.gz", stats.Archive.File)
+	_, err = os.Stat(filepath.Join(suite.tmpDir, "varnishmon-20250101T120000Z-20250101T120100Z.db"))
+	assert.True(os.IsNotExist(err))
+
+	// Compressed archives are opened using a decompressed copy, which is
+	// shared until released.
+	archive, release, err := stg.AcquireArchive(stats.Archive.File)
+	assert.NoError(err)
+	assert.Equal([]string{"foo"}, archive.Instances())
+	assert.True(start.Equal(archive.Earliest()))
+	metrics, err := archive.GetMetrics(start, start.Add(time.Hour), 60, "")
+	assert.NoError(err)
+	assert.Len(metrics["metrics"], 2)
+	other, otherRelease, err := stg.AcquireArchive(stats.Archive.File)
+	assert.NoError(err)
+	assert.Same(archive, other)
+	otherRelease()
+	release()
+
+	// Unknown archives.
+	_, _, err = stg.AcquireArchive("foo.db")
+	assert.ErrorIs(err, ErrUnknownArchive)
+
+	// Temporary files are removed on shutdown.
+	assert.NoError(stg.Shutdown())
+	_, err = os.Stat(stg.archivesDirectory())
+	assert.True(os.IsNotExist(err))
+
+	assert.Len(stg.app.Cfg().Log().Buffer().Events(), 0)
+}
+
+func (suite *RotationTestSuite) TestDeleteAcquiredArchive() {
+	assert := suite.Require()
+
+	stg := suite.newStorage("db.rotation.keep", 1)
+	defer stg.Shutdown() //nolint:errcheck
+
+	day := time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)
+	suite.push(stg, "foo", day)
+	stats, err := stg.Rotate()
+	assert.NoError(err)
+	file := filepath.Join(suite.tmpDir, stats.Archive.File)
+	archive, release, err := stg.AcquireArchive(stats.Archive.File)
+	assert.NoError(err)
+
+	// Archives beyond 'db.rotation.keep' are not deleted while in use.
+	suite.push(stg, "foo", day.Add(24*time.Hour))
+	stats, err = stg.Rotate()
+	assert.NoError(err)
+	assert.Equal(1, stats.DeletedArchives)
+	_, err = os.Stat(file)
+	assert.NoError(err)
+	assert.Equal([]string{"foo"}, archive.Instances())
+	assert.True(day.Equal(archive.Earliest()))
+
+	// Deleted once released.
+	release()
+	_, err = os.Stat(file)
+	assert.True(os.IsNotExist(err))
+	_, _, err = stg.AcquireArchive(filepath.Base(file))
+	assert.ErrorIs(err, ErrUnknownArchive)
+
+	assert.Len(stg.app.Cfg().Log().Buffer().Events(), 0)
+}
+
+func (suite *RotationTestSuite) TestAcquireOutdatedArchive() {
+	assert := suite.Require()
+
+	stg := suite.newStorage()
+	defer stg.Shutdown() //nolint:errcheck
+
+	// Archives created by a previous version of varnishmon, both compressed
+	// and uncompressed.
+	fixture := filepath.Join("testdata", "schema-v2.duckdb.gz")
+	data, err := os.ReadFile(fixture)
+	assert.NoError(err)
+	assert.NoError(os.WriteFile(filepath.Join(suite.tmpDir, "old.db.gz"), data, 0640))
+	ok, err := helpers.DecompressFile(fixture, filepath.Join(suite.tmpDir, "old.db"))
+	assert.NoError(err)
+	assert.True(ok)
+	assert.NoError(stg.writeCatalog([]*Archive{{File: "old.db.gz"}, {File: "old.db"}}))
+
+	// Uncompressed archives are opened in read-only mode, so they're not
+	// migrated.
+	_, _, err = stg.AcquireArchive("old.db")
+	assert.ErrorIs(err, ErrOutdatedSchemaVersion)
+
+	// Decompressed copies are migrated.
+	archive, release, err := stg.AcquireArchive("old.db.gz")
+	assert.NoError(err)
+	defer release()
+	assert.Equal([]string{"bar", "foo"}, archive.Instances())
+
+	assert.Len(stg.app.Cfg().Log().Buffer().Events(), 0)
+}
+
+func TestRotationTestSuite(t *testing.T) {
+	suite.Run(t, &RotationTestSuite{})
+}
@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Possible outcomes of a scrape attempt, as recorded in the 'scrapes' table.
+const (
+	// Metrics were successfully stored.
+	ScrapeOutcomeOK = "ok"
+	// The 'varnishstat' command failed (or, in streaming mode, terminated).
+	ScrapeOutcomeFailed = "failed"
+	// The 'varnishstat' command was killed after 'scraper.timeout'.
+	ScrapeOutcomeTimeout = "timeout"
+	// The 'varnishstat' output could not be parsed.
+	ScrapeOutcomeInvalidOutput = "invalid_output"
+	// Metrics were dropped because the metrics queue was full.
+	ScrapeOutcomeQueueFull = "queue_full"
+	// Metrics could not be stored in the database.
+	ScrapeOutcomeStoreFailed = "store_failed"
+)
+
+const (
+	// Maximum length of the 'stderr' excerpt stored for every scrape attempt.
+	maxScrapeStderrLength = 1024
+)
+
+// Scrape is the outcome of a single scrape attempt (or of a single push of
+// metrics through the ingest endpoint).
+type Scrape struct {
+	Instance  string
+	Timestamp time.Time
+	Duration  time.Duration
+	Outcome   string
+	Error     string
+	Stderr    string
+	Metrics   int
+}
+
+func (stg *Storage) PushScrape(scrape *Scrape) error {
+	// This is a write operation on 'db' but a read lock is intentionally used.
+	// See the note on the 'Storage' type for more information.
+	stg.mutex.RLock()
+	defer stg.mutex.RUnlock()
+
+	// Truncate the excerpt on a rune boundary. DuckDB rejects invalid UTF-8
+	// strings, so any other invalid sequence is replaced too.
+	stderr := scrape.Stderr
+	if len(stderr) > maxScrapeStderrLength {
+		end := maxScrapeStderrLength
+		for end > 0 && !utf8.RuneStart(stderr[end]) {
+			end--
+		}
+		stderr = stderr[:end]
+	}
+	stderr = strings.ToValidUTF8(stderr, "\uFFFD")
+
+	if _, err := stg.db.Exec(`
+		INSERT INTO scrapes (instance, timestamp, duration, outcome, error, stderr, metrics)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		scrape.Instance, scrape.Timestamp, scrape.Duration.Seconds(), scrape.Outcome,
+		scrape.Error, stderr, scrape.Metrics); err != nil {
+		return fmt.Errorf("failed to insert into 'scrapes' table: %w", err)
+	}
+
+	return nil
+}
+
+// Returns the scrape attempts in the requested time range, aggregated by
+// 'step' and outcome. Every bucket includes the number of attempts per outcome
+// and the error message of the latest failed attempt, if any. If 'instance' is
+// empty, attempts of all instances are considered.
+func (stg *Storage) GetScrapes(
+	from, to time.Time, step int, instance string) (map[string]interface{}, error) {
+	// Validate 'from' and 'to' parameters.
+	if from.After(to) {
+		return nil, ErrInvalidFromTo
+	}
+
+	// Lock 'db' instance.
+	stg.mutex.RLock()
+	defer stg.mutex.RUnlock()
+
+	// Normalize 'from', 'to', and 'step' parameters.
+	from, to, step, err := stg.unsafeNormalizeFromToAndStep(from, to, step)
+	if err != nil {
+		return nil, fmt.Errorf("failed to normalize 'from', 'to', and 'step' parameters: %w", err)
+	}
+
+	// Query database.
+	//nolint:gosec
+	rows, err := stg.db.Query(fmt.Sprintf(`
+		SELECT
+			time_bucket(INTERVAL '%ds', timestamp) AS bucket,
+			outcome,
+			COUNT(*),
+			arg_max(error, timestamp)
+		FROM scrapes
+		WHERE
+			timestamp >= $1 AND
+			timestamp < $2 AND
+			($3 = '' OR instance = $3)
+		GROUP BY bucket, outcome
+		ORDER BY bucket, outcome`, step), from, to, instance)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query 'scrapes' table: %w", err)
+	}
+	defer rows.Close()
+
+	// Fetch rows, merging the outcomes of the same bucket.
+	buckets := make([]map[string]interface{}, 0)
+	var last time.Time
+	for rows.Next() {
+		var bucket time.Time
+		var outcome, lastError string
+		var count int
+		if err := rows.Scan(&bucket, &outcome, &count, &lastError); err != nil {
+			return nil, fmt.Errorf("failed to scan 'scrapes' rows: %w", err)
+		}
+		if len(buckets) == 0 || !bucket.Equal(last) {
+			buckets = append(buckets, map[string]interface{}{
+				"timestamp": bucket.Unix(),
+				"outcomes":  map[string]int{},
+				"error":     "",
+			})
+			last = bucket
+		}
+		current := buckets[len(buckets)-1]
+		current["outcomes"].(map[string]int)[outcome] = count
+		if outcome != ScrapeOutcomeOK && lastError != "" {
+			current["error"] = lastError
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate over 'scrapes' rows: %w", err)
+	}
+
+	// Done!
+	return map[string]interface{}{
+		"from":     from.Unix(),
+		"to":       to.Unix(),
+		"step":     step,
+		"instance": instance,
+		"scrapes":  buckets,
+	}, nil
+}
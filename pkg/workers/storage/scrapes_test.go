@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ScrapesTestSuite struct {
+	suite.Suite
+	stg *Storage
+}
+
+func (suite *ScrapesTestSuite) BeforeTest(suiteName, testName string) {
+	suite.stg = newTestStorage(suite.T(), "scraper.enabled", true, "scraper.period", "60s")
+}
+
+func (suite *ScrapesTestSuite) TestPushAndGetScrapes() {
+	assert := suite.Require()
+
+	base := time.Date(2025, time.January, 1, 13, 0, 0, 0, time.UTC)
+	for _, scrape := range []*Scrape{
+		{Instance: "foo", Timestamp: base, Outcome: ScrapeOutcomeOK, Metrics: 10},
+		{Instance: "foo", Timestamp: base.Add(1 * time.Minute), Outcome: ScrapeOutcomeTimeout, Error: "timed out"},
+		{Instance: "bar", Timestamp: base.Add(1 * time.Minute), Outcome: ScrapeOutcomeOK, Metrics: 10},
+		{Instance: "foo", Timestamp: base.Add(2 * time.Minute), Outcome: ScrapeOutcomeFailed, Error: "exit status 1"},
+		{Instance: "foo", Timestamp: base.Add(2*time.Minute + 30*time.Second), Outcome: ScrapeOutcomeFailed, Error: "exit status 2"},
+	} {
+		assert.NoError(suite.stg.PushScrape(scrape))
+	}
+
+	// Attempts are aggregated by step & outcome.
+	result, err := suite.stg.GetScrapes(base, base.Add(5*time.Minute), 60, "foo")
+	assert.NoError(err)
+	assert.Equal([]map[string]interface{}{
+		{
+			"timestamp": base.Unix(),
+			"outcomes":  map[string]int{ScrapeOutcomeOK: 1},
+			"error":     "",
+		},
+		{
+			"timestamp": base.Add(1 * time.Minute).Unix(),
+			"outcomes":  map[string]int{ScrapeOutcomeTimeout: 1},
+			"error":     "timed out",
+		},
+		{
+			"timestamp": base.Add(2 * time.Minute).Unix(),
+			"outcomes":  map[string]int{ScrapeOutcomeFailed: 2},
+			"error":     "exit status 2",
+		},
+	}, result["scrapes"])
+
+	// Attempts of all instances are considered if no instance is provided.
+	result, err = suite.stg.GetScrapes(base, base.Add(5*time.Minute), 120, "")
+	assert.NoError(err)
+	assert.Equal(120, result["step"])
+	assert.Equal([]map[string]interface{}{
+		{
+			"timestamp": base.Unix(),
+			"outcomes":  map[string]int{ScrapeOutcomeOK: 2, ScrapeOutcomeTimeout: 1},
+			"error":     "timed out",
+		},
+		{
+			"timestamp": base.Add(2 * time.Minute).Unix(),
+			"outcomes":  map[string]int{ScrapeOutcomeFailed: 2},
+			"error":     "exit status 2",
+		},
+	}, result["scrapes"])
+
+	// Invalid ranges are rejected.
+	_, err = suite.stg.GetScrapes(base, base.Add(-1*time.Hour), 60, "")
+	assert.ErrorIs(err, ErrInvalidFromTo)
+}
+
+func (suite *ScrapesTestSuite) TestPushScrapeTruncatesStderr() {
+	assert := suite.Require()
+
+	base := time.Date(2025, time.January, 1, 13, 0, 0, 0, time.UTC)
+	for i, stderr := range []string{
+		// A multi-byte rune straddling the limit.
+		strings.Repeat("a", maxScrapeStderrLength-1) + "é" + "b",
+		// Invalid UTF-8 sequences.
+		"foo \xff bar",
+	} {
+		assert.NoError(suite.stg.PushScrape(&Scrape{
+			Instance:  "foo",
+			Timestamp: base.Add(time.Duration(i) * time.Minute),
+			Outcome:   ScrapeOutcomeFailed,
+			Stderr:    stderr,
+		}))
+	}
+
+	rows, err := suite.stg.db.Query(`SELECT stderr FROM scrapes ORDER BY timestamp`)
+	assert.NoError(err)
+	defer rows.Close()
+	stored := make([]string, 0, 2)
+	for rows.Next() {
+		var stderr string
+		assert.NoError(rows.Scan(&stderr))
+		stored = append(stored, stderr)
+	}
+	assert.NoError(rows.Err())
+	assert.Equal([]string{
+		strings.Repeat("a", maxScrapeStderrLength-1),
+		"foo \uFFFD bar",
+	}, stored)
+
+	assert.Len(suite.stg.app.Cfg().Log().Buffer().Events(), 0)
+}
+
+func TestScrapesTestSuite(t *testing.T) {
+	suite.Run(t, &ScrapesTestSuite{})
+}
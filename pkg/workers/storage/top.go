@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/allenta/varnishmon/pkg/helpers"
+)
+
+const (
+	TopOrderRequests = "requests"
+	TopOrderBytes    = "bytes"
+)
+
+var (
+	ErrInvalidTopDimension = errors.New("invalid top dimension")
+	ErrInvalidTopOrder     = errors.New("invalid top order")
+)
+
+// Stores the top-N rollups of requests aggregated during the period starting
+// at 'timestamp'. Rollups pushed more than once for the same period (e.g.,
+// after a restart) are added up.
+func (stg *Storage) PushTopRequests(instance string, timestamp time.Time, entries []*helpers.TopEntry) error {
+	// This is a write operation on 'db' but a read lock is intentionally used.
+	// See the note on the 'Storage' type for more information.
+	stg.mutex.RLock()
+	defer stg.mutex.RUnlock()
+
+	// Begin transaction.
+	tx, err := stg.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	// Insert rollups.
+	stmt, err := tx.Prepare(`
+		INSERT INTO top_requests (instance, timestamp, dimension, key, requests, bytes)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (instance, timestamp, dimension, key) DO UPDATE SET
+			requests = requests + excluded.requests,
+			bytes = bytes + excluded.bytes`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+	for _, entry := range entries {
+		if _, err := stmt.Exec(
+			instance, timestamp, entry.Dimension, entry.Key, entry.Requests, entry.Bytes); err != nil {
+			return fmt.Errorf("failed to insert into 'top_requests' table: %w", err)
+		}
+	}
+
+	// Commit transaction.
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// Returns the top 'limit' keys of a dimension in the requested time range,
+// sorted by number of requests or bytes. Beware only the top keys of every
+// aggregation period are stored, so totals are a lower bound when the
+// requested time range spans several periods. If 'instance' is empty, rollups
+// of all instances are considered.
+func (stg *Storage) GetTopRequests(
+	from, to time.Time, dimension, order string, limit int,
+	instance string) (map[string]interface{}, error) {
+	// Validate 'from' and 'to' parameters.
+	if from.After(to) {
+		return nil, ErrInvalidFromTo
+	}
+
+	// Validate 'dimension' and 'order' parameters.
+	switch dimension {
+	case helpers.TopDimensionURL, helpers.TopDimensionHost,
+		helpers.TopDimensionStatus, helpers.TopDimensionBackend:
+	default:
+		return nil, ErrInvalidTopDimension
+	}
+	if order != TopOrderRequests && order != TopOrderBytes {
+		return nil, ErrInvalidTopOrder
+	}
+
+	// Lock 'db' instance.
+	stg.mutex.RLock()
+	defer stg.mutex.RUnlock()
+
+	// Query database.
+	//nolint:gosec
+	rows, err := stg.db.Query(fmt.Sprintf(`
+		SELECT key, SUM(requests) AS requests, SUM(bytes) AS bytes
+		FROM top_requests
+		WHERE
+			dimension = $1 AND
+			timestamp >= $2 AND
+			timestamp < $3 AND
+			($4 = '' OR instance = $4)
+		GROUP BY key
+		ORDER BY %s DESC, key
+		LIMIT $5`, order), dimension, from, to, instance, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query 'top_requests' table: %w", err)
+	}
+	defer rows.Close()
+
+	// Fetch rows.
+	items := make([]map[string]interface{}, 0)
+	for rows.Next() {
+		var key string
+		var requests, bytes uint64
+		if err := rows.Scan(&key, &requests, &bytes); err != nil {
+			return nil, fmt.Errorf("failed to scan 'top_requests' rows: %w", err)
+		}
+		items = append(items, map[string]interface{}{
+			"key":      key,
+			"requests": requests,
+			"bytes":    bytes,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate over 'top_requests' rows: %w", err)
+	}
+
+	// Done!
+	return map[string]interface{}{
+		"from":      from.Unix(),
+		"to":        to.Unix(),
+		"dimension": dimension,
+		"order":     order,
+		"instance":  instance,
+		"items":     items,
+	}, nil
+}
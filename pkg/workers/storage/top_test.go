@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/allenta/varnishmon/pkg/helpers"
+	"github.com/stretchr/testify/suite"
+)
+
+type TopTestSuite struct {
+	suite.Suite
+	stg *Storage
+}
+
+func (suite *TopTestSuite) BeforeTest(suiteName, testName string) {
+	suite.stg = newTestStorage(suite.T(), "scraper.enabled", true, "scraper.period", "60s")
+}
+
+func (suite *TopTestSuite) TestPushAndGetTopRequests() {
+	assert := suite.Require()
+
+	base := time.Date(2025, time.January, 1, 13, 0, 0, 0, time.UTC)
+	assert.NoError(suite.stg.PushTopRequests("foo", base, []*helpers.TopEntry{
+		{Dimension: helpers.TopDimensionURL, Key: "/a", Requests: 10, Bytes: 100},
+		{Dimension: helpers.TopDimensionURL, Key: "/b", Requests: 5, Bytes: 5000},
+		{Dimension: helpers.TopDimensionHost, Key: "www.example.com", Requests: 15, Bytes: 5100},
+	}))
+	assert.NoError(suite.stg.PushTopRequests("foo", base.Add(1*time.Minute), []*helpers.TopEntry{
+		{Dimension: helpers.TopDimensionURL, Key: "/b", Requests: 7, Bytes: 700},
+		{Dimension: helpers.TopDimensionURL, Key: "/c", Requests: 1, Bytes: 10},
+	}))
+	assert.NoError(suite.stg.PushTopRequests("bar", base, []*helpers.TopEntry{
+		{Dimension: helpers.TopDimensionURL, Key: "/c", Requests: 100, Bytes: 100},
+	}))
+
+	// Rollups pushed twice for the same period are added up.
+	assert.NoError(suite.stg.PushTopRequests("foo", base, []*helpers.TopEntry{
+		{Dimension: helpers.TopDimensionURL, Key: "/a", Requests: 1, Bytes: 1},
+	}))
+
+	// Sorted by requests.
+	result, err := suite.stg.GetTopRequests(
+		base, base.Add(5*time.Minute), helpers.TopDimensionURL, TopOrderRequests, 2, "foo")
+	assert.NoError(err)
+	assert.Equal([]map[string]interface{}{
+		{"key": "/b", "requests": uint64(12), "bytes": uint64(5700)},
+		{"key": "/a", "requests": uint64(11), "bytes": uint64(101)},
+	}, result["items"])
+
+	// Sorted by bytes, limited to the time range.
+	result, err = suite.stg.GetTopRequests(
+		base, base.Add(1*time.Minute), helpers.TopDimensionURL, TopOrderBytes, 10, "foo")
+	assert.NoError(err)
+	assert.Equal([]map[string]interface{}{
+		{"key": "/b", "requests": uint64(5), "bytes": uint64(5000)},
+		{"key": "/a", "requests": uint64(11), "bytes": uint64(101)},
+	}, result["items"])
+
+	// Rollups of all instances are considered if no instance is provided.
+	result, err = suite.stg.GetTopRequests(
+		base, base.Add(5*time.Minute), helpers.TopDimensionURL, TopOrderRequests, 1, "")
+	assert.NoError(err)
+	assert.Equal([]map[string]interface{}{
+		{"key": "/c", "requests": uint64(101), "bytes": uint64(110)},
+	}, result["items"])
+}
+
+func (suite *TopTestSuite) TestGetTopRequestsInvalidParams() {
+	assert := suite.Require()
+
+	now := time.Now()
+	_, err := suite.stg.GetTopRequests(now, now.Add(-time.Minute), helpers.TopDimensionURL, TopOrderRequests, 10, "")
+	assert.ErrorIs(err, ErrInvalidFromTo)
+	_, err = suite.stg.GetTopRequests(now, now, "whatever", TopOrderRequests, 10, "")
+	assert.ErrorIs(err, ErrInvalidTopDimension)
+	_, err = suite.stg.GetTopRequests(now, now, helpers.TopDimensionURL, "whatever", 10, "")
+	assert.ErrorIs(err, ErrInvalidTopOrder)
+}
+
+func TestTopTestSuite(t *testing.T) {
+	suite.Run(t, new(TopTestSuite))
+}
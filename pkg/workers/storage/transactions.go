@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/allenta/varnishmon/pkg/helpers"
+)
+
+// Stores slow transactions captured from 'varnishlog'.
+func (stg *Storage) PushTransactions(instance string, txs []*helpers.VarnishTransaction) error {
+	// This is a write operation on 'db' but a read lock is intentionally used.
+	// See the note on the 'Storage' type for more information.
+	stg.mutex.RLock()
+	defer stg.mutex.RUnlock()
+
+	// Begin transaction.
+	tx, err := stg.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	// Insert transactions.
+	stmt, err := tx.Prepare(`
+		INSERT INTO transactions (
+			instance, timestamp, vxid, method, url, host, status, backend,
+			duration, timings)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+	for _, item := range txs {
+		timings, err := json.Marshal(item.Timings)
+		if err != nil {
+			return fmt.Errorf("failed to encode timings: %w", err)
+		}
+		if _, err := stmt.Exec(
+			instance, item.Timestamp, item.VXID, item.Method, item.URL, item.Host,
+			item.Status, item.Backend, item.Duration.Seconds(), string(timings)); err != nil {
+			return fmt.Errorf("failed to insert into 'transactions' table: %w", err)
+		}
+	}
+
+	// Commit transaction.
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// Returns up to 'limit' transactions started in the requested time range,
+// sorted by start time. If 'instance' is empty, transactions of all instances
+// are considered.
+func (stg *Storage) GetTransactions(
+	from, to time.Time, limit int, instance string) (map[string]interface{}, error) {
+	// Validate 'from' and 'to' parameters.
+	if from.After(to) {
+		return nil, ErrInvalidFromTo
+	}
+
+	// Lock 'db' instance.
+	stg.mutex.RLock()
+	defer stg.mutex.RUnlock()
+
+	// Query database.
+	rows, err := stg.db.Query(`
+		SELECT
+			instance, timestamp, vxid, method, url, host, status, backend,
+			duration, timings
+		FROM transactions
+		WHERE
+			timestamp >= $1 AND
+			timestamp < $2 AND
+			($3 = '' OR instance = $3)
+		ORDER BY timestamp, vxid
+		LIMIT $4`, from, to, instance, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query 'transactions' table: %w", err)
+	}
+	defer rows.Close()
+
+	// Fetch rows.
+	items := make([]map[string]interface{}, 0)
+	for rows.Next() {
+		var txInstance, method, url, host, backend, rawTimings string
+		var timestamp time.Time
+		var vxid uint64
+		var status int
+		var duration float64
+		if err := rows.Scan(
+			&txInstance, &timestamp, &vxid, &method, &url, &host, &status, &backend,
+			&duration, &rawTimings); err != nil {
+			return nil, fmt.Errorf("failed to scan 'transactions' rows: %w", err)
+		}
+		var timings map[string]float64
+		if err := json.Unmarshal([]byte(rawTimings), &timings); err != nil {
+			return nil, fmt.Errorf("failed to decode timings: %w", err)
+		}
+		items = append(items, map[string]interface{}{
+			"instance":  txInstance,
+			"timestamp": float64(timestamp.UnixMicro()) / 1e6,
+			"vxid":      vxid,
+			"method":    method,
+			"url":       url,
+			"host":      host,
+			"status":    status,
+			"backend":   backend,
+			"duration":  duration,
+			"timings":   timings,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate over 'transactions' rows: %w", err)
+	}
+
+	// Done!
+	return map[string]interface{}{
+		"from":         from.Unix(),
+		"to":           to.Unix(),
+		"instance":     instance,
+		"transactions": items,
+	}, nil
+}
+
+// Removes transactions started before 'before', and returns the number of
+// transactions removed.
+func (stg *Storage) DeleteTransactions(before time.Time) (int64, error) {
+	// This is a write operation on 'db' but a read lock is intentionally used.
+	// See the note on the 'Storage' type for more information.
+	stg.mutex.RLock()
+	defer stg.mutex.RUnlock()
+
+	result, err := stg.db.Exec(`
+		DELETE FROM transactions
+		WHERE timestamp < $1`, before)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete from 'transactions' table: %w", err)
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get number of deleted transactions: %w", err)
+	}
+
+	return deleted, nil
+}
@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/allenta/varnishmon/pkg/helpers"
+	"github.com/stretchr/testify/suite"
+)
+
+type TransactionsTestSuite struct {
+	suite.Suite
+	stg *Storage
+}
+
+func (suite *TransactionsTestSuite) BeforeTest(suiteName, testName string) {
+	suite.stg = newTestStorage(suite.T(), "scraper.enabled", true, "scraper.period", "60s")
+}
+
+func (suite *TransactionsTestSuite) TestPushGetAndDeleteTransactions() {
+	assert := suite.Require()
+
+	base := time.Date(2025, time.January, 1, 13, 0, 0, 0, time.UTC)
+	assert.NoError(suite.stg.PushTransactions("foo", []*helpers.VarnishTransaction{
+		{
+			VXID:      32770,
+			Timestamp: base.Add(500 * time.Millisecond),
+			Method:    "GET",
+			URL:       "/slow",
+			Host:      "www.example.com",
+			Status:    200,
+			Backend:   "default",
+			Duration:  1500 * time.Millisecond,
+			Timings:   map[string]float64{"Fetch": 1.25, "Resp": 1.5},
+		},
+		{
+			VXID:      5,
+			Timestamp: base.Add(2 * time.Minute),
+			Method:    "POST",
+			URL:       "/api",
+			Status:    503,
+			Duration:  2 * time.Second,
+			Timings:   map[string]float64{"Resp": 2},
+		},
+	}))
+	assert.NoError(suite.stg.PushTransactions("bar", []*helpers.VarnishTransaction{
+		{VXID: 7, Timestamp: base.Add(1 * time.Minute), Timings: map[string]float64{}},
+	}))
+
+	// Filtered by instance & time range.
+	result, err := suite.stg.GetTransactions(base, base.Add(1*time.Minute), 10, "foo")
+	assert.NoError(err)
+	assert.Equal([]map[string]interface{}{
+		{
+			"instance":  "foo",
+			"timestamp": float64(base.Unix()) + 0.5,
+			"vxid":      uint64(32770),
+			"method":    "GET",
+			"url":       "/slow",
+			"host":      "www.example.com",
+			"status":    200,
+			"backend":   "default",
+			"duration":  1.5,
+			"timings":   map[string]float64{"Fetch": 1.25, "Resp": 1.5},
+		},
+	}, result["transactions"])
+
+	// Transactions of all instances are considered if no instance is provided.
+	result, err = suite.stg.GetTransactions(base, base.Add(5*time.Minute), 10, "")
+	assert.NoError(err)
+	assert.Len(result["transactions"], 3)
+	result, err = suite.stg.GetTransactions(base, base.Add(5*time.Minute), 2, "")
+	assert.NoError(err)
+	assert.Len(result["transactions"], 2)
+
+	// Old transactions are deleted.
+	deleted, err := suite.stg.DeleteTransactions(base.Add(90 * time.Second))
+	assert.NoError(err)
+	assert.Equal(int64(2), deleted)
+	result, err = suite.stg.GetTransactions(base, base.Add(5*time.Minute), 10, "")
+	assert.NoError(err)
+	assert.Len(result["transactions"], 1)
+
+	// Invalid time range.
+	_, err = suite.stg.GetTransactions(base, base.Add(-time.Minute), 10, "")
+	assert.ErrorIs(err, ErrInvalidFromTo)
+}
+
+func TestTransactionsTestSuite(t *testing.T) {
+	suite.Run(t, new(TransactionsTestSuite))
+}
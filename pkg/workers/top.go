@@ -0,0 +1,155 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/allenta/varnishmon/pkg/helpers"
+	"github.com/allenta/varnishmon/pkg/workers/storage"
+)
+
+const (
+	// Beware of the hardcoded limit here: keys of a dimension beyond this
+	// limit during an aggregation period are accounted under a single key.
+	topMaxKeys = 100000
+)
+
+// TopWorker runs a long-lived 'varnishncsa' command and periodically stores
+// the top-N URLs, hosts, status codes and backends by number of requests and
+// bytes.
+type TopWorker struct {
+	*worker
+	storage *storage.Storage
+
+	mutex      sync.Mutex
+	aggregator *helpers.TopAggregator
+
+	invalidLines prometheus.Counter
+	restarts     prometheus.Counter
+	pushFailed   prometheus.Counter
+}
+
+func NewTopWorker(
+	ctx context.Context, wg *sync.WaitGroup, app Application,
+	storage *storage.Storage) *TopWorker {
+	tw := &TopWorker{
+		storage:    storage,
+		aggregator: helpers.NewTopAggregator(topMaxKeys),
+
+		invalidLines: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "top_invalid_lines_total",
+				Help: "Invalid 'varnishncsa' lines discarded by the top worker",
+			}),
+		restarts: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "top_restarts_total",
+				Help: "Restarts of the 'varnishncsa' command run by the top worker",
+			}),
+		pushFailed: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "top_push_failed_total",
+				Help: "Failed pushes of rollups by the top worker",
+			}),
+	}
+
+	tw.worker = &worker{
+		ctx:  ctx,
+		wg:   wg,
+		app:  app,
+		id:   "Top",
+		init: tw.init,
+		run:  tw.run,
+		stop: tw.stop,
+	}
+
+	tw.app.Cfg().Metrics().Registry.MustRegister(tw.invalidLines)
+	tw.app.Cfg().Metrics().Registry.MustRegister(tw.restarts)
+	tw.app.Cfg().Metrics().Registry.MustRegister(tw.pushFailed)
+
+	return tw
+}
+
+func (tw *TopWorker) init() {
+}
+
+func (tw *TopWorker) run() {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		tw.stream()
+	}()
+
+	// Flush the aggregated requests on ticks aligned to multiples of the
+	// aggregation period on the wall clock, so rollups match the boundaries
+	// of the buckets used when aggregating timeseries. Rollups are keyed by
+	// the start of the period. Requests aggregated during the last (partial)
+	// period are flushed on termination, once the command has been stopped.
+	period := tw.worker.app.Cfg().TopPeriod()
+	for {
+		next := nextAlignedTick(time.Now(), period)
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-tw.worker.ctx.Done():
+			timer.Stop()
+			wg.Wait()
+			tw.flush(next.Add(-period))
+			return
+		case <-timer.C:
+			tw.flush(next.Add(-period))
+		}
+	}
+}
+
+func (tw *TopWorker) stop() {
+}
+
+func (tw *TopWorker) stream() {
+	sc := &supervisedCommand{
+		app:     tw.worker.app,
+		id:      tw.worker.id,
+		command: tw.worker.app.Cfg().TopVarnishncsa(),
+		onLine: func(line []byte) {
+			tw.mutex.Lock()
+			err := tw.aggregator.Add(line)
+			tw.mutex.Unlock()
+
+			if err != nil {
+				tw.invalidLines.Inc()
+				tw.worker.app.Cfg().Log().Debug().
+					Err(err).
+					Str("line", string(line)).
+					Msg("Failed to parse 'varnishncsa' line!")
+			}
+		},
+		onExit: func(error) {
+			tw.restarts.Inc()
+		},
+	}
+	sc.run(tw.worker.ctx)
+}
+
+func (tw *TopWorker) flush(timestamp time.Time) {
+	tw.mutex.Lock()
+	entries := tw.aggregator.Flush(tw.worker.app.Cfg().TopLimit())
+	tw.mutex.Unlock()
+
+	if len(entries) == 0 {
+		return
+	}
+
+	if err := tw.storage.PushTopRequests(
+		tw.worker.app.Cfg().TopInstance(), timestamp, entries); err != nil {
+		tw.pushFailed.Inc()
+		if !errors.Is(tw.worker.ctx.Err(), context.Canceled) {
+			tw.worker.app.Cfg().Log().Error().
+				Err(err).
+				Msg("Failed to push top requests!")
+		}
+	}
+}
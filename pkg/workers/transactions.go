@@ -0,0 +1,256 @@
+package workers
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/allenta/varnishmon/pkg/helpers"
+	"github.com/allenta/varnishmon/pkg/workers/storage"
+)
+
+const (
+	// Minimum time between executions of the retention policy.
+	transactionsCleanupInterval = 1 * time.Hour
+)
+
+// TransactionsWorker runs a long-lived 'varnishlog' command filtering slow
+// transactions and periodically stores the slowest ones captured during the
+// period, up to a limit, removing old ones according to the retention policy.
+type TransactionsWorker struct {
+	*worker
+	storage *storage.Storage
+	reader  *helpers.VarnishlogReader
+
+	// Slowest transactions captured since the previous flush, up to
+	// 'transactions.limit'.
+	mutex   sync.Mutex
+	pending slowestTransactions
+
+	lastCleanup time.Time
+
+	invalidGroups    prometheus.Counter
+	restarts         prometheus.Counter
+	droppedTxs       prometheus.Counter
+	storedTxs        prometheus.Counter
+	pushFailed       prometheus.Counter
+	expiredTxs       prometheus.Counter
+	expirationFailed prometheus.Counter
+}
+
+func NewTransactionsWorker(
+	ctx context.Context, wg *sync.WaitGroup, app Application,
+	storage *storage.Storage) *TransactionsWorker {
+	tw := &TransactionsWorker{
+		storage: storage,
+		reader:  helpers.NewVarnishlogReader(),
+		pending: make(slowestTransactions, 0),
+
+		invalidGroups: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "transactions_invalid_groups_total",
+				Help: "Invalid 'varnishlog' groups discarded by the transactions worker",
+			}),
+		restarts: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "transactions_restarts_total",
+				Help: "Restarts of the 'varnishlog' command run by the transactions worker",
+			}),
+		droppedTxs: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "transactions_dropped_total",
+				Help: "Transactions dropped by the transactions worker due to 'transactions.limit'",
+			}),
+		storedTxs: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "transactions_stored_total",
+				Help: "Transactions stored by the transactions worker",
+			}),
+		pushFailed: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "transactions_push_failed_total",
+				Help: "Failed pushes of transactions by the transactions worker",
+			}),
+		expiredTxs: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "transactions_expired_total",
+				Help: "Transactions removed by the transactions worker due to 'transactions.retention'",
+			}),
+		expirationFailed: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "transactions_expiration_failed_total",
+				Help: "Failed removals of expired transactions by the transactions worker",
+			}),
+	}
+
+	tw.worker = &worker{
+		ctx:  ctx,
+		wg:   wg,
+		app:  app,
+		id:   "Transactions",
+		init: tw.init,
+		run:  tw.run,
+		stop: tw.stop,
+	}
+
+	tw.app.Cfg().Metrics().Registry.MustRegister(tw.invalidGroups)
+	tw.app.Cfg().Metrics().Registry.MustRegister(tw.restarts)
+	tw.app.Cfg().Metrics().Registry.MustRegister(tw.droppedTxs)
+	tw.app.Cfg().Metrics().Registry.MustRegister(tw.storedTxs)
+	tw.app.Cfg().Metrics().Registry.MustRegister(tw.pushFailed)
+	tw.app.Cfg().Metrics().Registry.MustRegister(tw.expiredTxs)
+	tw.app.Cfg().Metrics().Registry.MustRegister(tw.expirationFailed)
+
+	return tw
+}
+
+func (tw *TransactionsWorker) init() {
+}
+
+func (tw *TransactionsWorker) run() {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		tw.stream()
+	}()
+
+	// Flush the captured transactions on ticks aligned to multiples of the
+	// period on the wall clock. See 'TopWorker.run()'.
+	period := tw.worker.app.Cfg().TransactionsPeriod()
+	for {
+		next := nextAlignedTick(time.Now(), period)
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-tw.worker.ctx.Done():
+			timer.Stop()
+			wg.Wait()
+			return
+		case <-timer.C:
+			tw.flush()
+			tw.cleanup()
+		}
+	}
+}
+
+func (tw *TransactionsWorker) stop() {
+}
+
+func (tw *TransactionsWorker) stream() {
+	sc := &supervisedCommand{
+		app:        tw.worker.app,
+		id:         tw.worker.id,
+		command:    tw.worker.app.Cfg().TransactionsVarnishlog(),
+		emptyLines: true,
+		onLine: func(line []byte) {
+			tx, err := tw.reader.Add(line)
+			if err != nil {
+				tw.invalidGroups.Inc()
+				tw.worker.app.Cfg().Log().Debug().
+					Err(err).
+					Msg("Failed to parse 'varnishlog' group!")
+				return
+			}
+			if tx != nil {
+				tw.mutex.Lock()
+				if tw.pending.push(tx, tw.worker.app.Cfg().TransactionsLimit()) {
+					tw.droppedTxs.Inc()
+				}
+				tw.mutex.Unlock()
+			}
+		},
+		onExit: func(error) {
+			tw.restarts.Inc()
+			// Discard whatever was left of the last group.
+			tw.reader = helpers.NewVarnishlogReader()
+		},
+	}
+	sc.run(tw.worker.ctx)
+}
+
+// Stores the slowest transactions captured since the previous flush, slowest
+// first.
+func (tw *TransactionsWorker) flush() {
+	tw.mutex.Lock()
+	txs := []*helpers.VarnishTransaction(tw.pending)
+	tw.pending = make(slowestTransactions, 0)
+	tw.mutex.Unlock()
+
+	if len(txs) == 0 {
+		return
+	}
+
+	sort.SliceStable(txs, func(i, j int) bool {
+		return txs[i].Duration > txs[j].Duration
+	})
+
+	if err := tw.storage.PushTransactions(
+		tw.worker.app.Cfg().TransactionsInstance(), txs); err != nil {
+		tw.pushFailed.Inc()
+		if !errors.Is(tw.worker.ctx.Err(), context.Canceled) {
+			tw.worker.app.Cfg().Log().Error().
+				Err(err).
+				Msg("Failed to push transactions!")
+		}
+		return
+	}
+	tw.storedTxs.Add(float64(len(txs)))
+}
+
+func (tw *TransactionsWorker) cleanup() {
+	if time.Since(tw.lastCleanup) < transactionsCleanupInterval {
+		return
+	}
+	tw.lastCleanup = time.Now()
+
+	deleted, err := tw.storage.DeleteTransactions(
+		time.Now().Add(-tw.worker.app.Cfg().TransactionsRetention()))
+	if err != nil {
+		tw.expirationFailed.Inc()
+		tw.worker.app.Cfg().Log().Error().
+			Err(err).
+			Msg("Failed to remove expired transactions!")
+		return
+	}
+	tw.expiredTxs.Add(float64(deleted))
+}
+
+// Min-heap of transactions by duration, so the fastest one is dropped first
+// once the limit is reached. See 'container/heap'.
+type slowestTransactions []*helpers.VarnishTransaction
+
+func (st slowestTransactions) Len() int           { return len(st) }
+func (st slowestTransactions) Less(i, j int) bool { return st[i].Duration < st[j].Duration }
+func (st slowestTransactions) Swap(i, j int)      { st[i], st[j] = st[j], st[i] }
+
+func (st *slowestTransactions) Push(x any) {
+	*st = append(*st, x.(*helpers.VarnishTransaction)) //nolint:forcetypeassert
+}
+
+func (st *slowestTransactions) Pop() any {
+	old := *st
+	n := len(old)
+	tx := old[n-1]
+	old[n-1] = nil
+	*st = old[:n-1]
+	return tx
+}
+
+// Adds a transaction, keeping up to 'limit' of the slowest ones. Returns true
+// if a transaction (i.e., the new one or the fastest one) was dropped.
+func (st *slowestTransactions) push(tx *helpers.VarnishTransaction, limit int) bool {
+	if len(*st) < limit {
+		heap.Push(st, tx)
+		return false
+	}
+	if tx.Duration > (*st)[0].Duration {
+		(*st)[0] = tx
+		heap.Fix(st, 0)
+	}
+	return true
+}
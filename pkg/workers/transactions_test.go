@@ -0,0 +1,47 @@
+package workers
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/allenta/varnishmon/pkg/helpers"
+	"github.com/stretchr/testify/suite"
+)
+
+type TransactionsTestSuite struct {
+	suite.Suite
+}
+
+func (suite *TransactionsTestSuite) TestSlowestTransactions() {
+	assert := suite.Require()
+
+	pending := make(slowestTransactions, 0)
+	dropped := 0
+	for i, ms := range []int{30, 10, 50, 20, 40, 60, 5} {
+		tx := &helpers.VarnishTransaction{
+			VXID:     uint64(i),
+			Duration: time.Duration(ms) * time.Millisecond,
+		}
+		if pending.push(tx, 3) {
+			dropped++
+		}
+	}
+
+	// Only the slowest transactions are kept.
+	assert.Equal(4, dropped)
+	durations := make([]time.Duration, 0, len(pending))
+	for _, tx := range pending {
+		durations = append(durations, tx.Duration)
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] > durations[j] })
+	assert.Equal([]time.Duration{
+		60 * time.Millisecond,
+		50 * time.Millisecond,
+		40 * time.Millisecond,
+	}, durations)
+}
+
+func TestTransactionsTestSuite(t *testing.T) {
+	suite.Run(t, &TransactionsTestSuite{})
+}